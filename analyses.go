@@ -5,12 +5,15 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
-	"strings"
+	"regexp"
+	"sync"
 	"time"
 
 	"github.com/cyverse-de/messaging/v9"
@@ -18,12 +21,43 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
 )
 
 // TimestampFromDBFormat is the format of the timestamps retrieved from the
 // database through the GraphQL server. Shouldn't have timezone info.
 const TimestampFromDBFormat = "2006-01-02T15:04:05"
 
+// TimestampToDBFormat is the format of the timestamps written to the database.
+const TimestampToDBFormat = "2006-01-02 15:04:05.000000-07"
+
+// TimestampLocation is the timezone that timestamps without timezone info are
+// interpreted in. Defaults to UTC so that results don't depend on the TZ of
+// the host that timelord is running on.
+var TimestampLocation = time.UTC
+
+// TimezoneInit sets the timezone used when parsing and writing timestamps.
+func TimezoneInit(name string) error {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load timezone %s", name)
+	}
+	TimestampLocation = loc
+	return nil
+}
+
+// parseDBTimestamp parses a timestamp in TimestampFromDBFormat, interpreting
+// it in the configured timezone.
+func parseDBTimestamp(ts string) (time.Time, error) {
+	return time.ParseInLocation(TimestampFromDBFormat, ts, TimestampLocation)
+}
+
+// formatDBTimestamp formats the time in the configured timezone for writing
+// to the database.
+func formatDBTimestamp(t time.Time) string {
+	return t.In(TimestampLocation).Format(TimestampToDBFormat)
+}
+
 // VICEURI is the base URI for VICE access
 var VICEURI string
 
@@ -48,11 +82,23 @@ type Job struct {
 	User           string `json:"user"`
 	ExternalID     string `json:"external_id"`
 	NotifyPeriodic bool   `json:"notify_periodic"`
-	PeriodicPeriod int    `json:"periodic_period"`
+	PeriodicPeriod int64  `json:"periodic_period"`
+	Interactive    bool   `json:"interactive"`
+
+	// interactiveKnown is set when Interactive was filled in by the query
+	// that loaded the job, rather than left at its zero value.
+	interactiveKnown bool
 }
 
+// interactiveSystemID is the system ID of the job type used by VICE analyses.
+const interactiveSystemID = "interactive"
+
+// accessURL returns the URL that the job's VICE session can be reached at,
+// which is the VICE base URI with the job's subdomain prepended to the host.
+// Returns an empty string if the VICE base URI isn't configured or the job
+// isn't an interactive job with a subdomain.
 func (j *Job) accessURL() (string, error) {
-	if VICEURI == "" {
+	if VICEURI == "" || j.Subdomain == "" || j.Type != interactiveSystemID {
 		return "", nil
 	}
 	vice_uri, err := url.Parse(VICEURI)
@@ -63,30 +109,43 @@ func (j *Job) accessURL() (string, error) {
 	return vice_uri.String(), nil
 }
 
-// getJobDuration takes a job and returns a duration string since the start of the job
+// getJobDuration takes a job and returns a duration string since the start of
+// the job. A start date in the future, which can happen if the clocks are
+// skewed, is treated as the job having just started.
 func getJobDuration(j *Job) (string, error) {
-	starttime, err := time.ParseInLocation(TimestampFromDBFormat, j.StartDate, time.Local)
+	starttime, err := parseDBTimestamp(j.StartDate)
 	if err != nil {
 		return "", errors.Wrapf(err, "failed to parse start date %s", j.StartDate)
 	}
 
-	// just print H(HH):MM format
-	dur := time.Since(starttime).Round(time.Minute)
-	h := dur / time.Hour
-	dur -= h * time.Hour
-	m := dur / time.Minute
-	return fmt.Sprintf("%d:%02d", h, m), nil
+	dur := CurrentClock.Now().Sub(starttime)
+	if dur < 0 {
+		dur = 0
+	}
+	return formatHoursMinutes(dur), nil
 }
 
-// getRemainingDuration takes a job and returns a duration string until the planned end date
+// formatHoursMinutes formats a non-negative duration in H:MM format, rounded
+// to the nearest minute. The hours aren't limited to two digits.
+func formatHoursMinutes(dur time.Duration) string {
+	minutes := int64(dur.Round(time.Minute) / time.Minute)
+	return fmt.Sprintf("%d:%02d", minutes/60, minutes%60)
+}
+
+// getRemainingDuration takes a job and returns a duration string until the planned end date.
+// Jobs that are exempt from being killed have no remaining duration, so the string is empty.
 func getRemainingDuration(j *Job) (string, error) {
-	endtime, err := time.ParseInLocation(TimestampFromDBFormat, j.PlannedEndDate, time.Local)
+	if isExempt(j) {
+		return "", nil
+	}
+
+	endtime, err := parseDBTimestamp(j.PlannedEndDate)
 	if err != nil {
 		return "", errors.Wrapf(err, "failed to parse planned end date %s", j.PlannedEndDate)
 	}
 
 	// just print H(HH):MM format
-	dur := time.Until(endtime).Round(time.Minute)
+	dur := endtime.Sub(CurrentClock.Now()).Round(time.Minute)
 	h := dur / time.Hour
 	dur -= h * time.Hour
 	m := dur / time.Minute
@@ -167,7 +226,25 @@ func getExternalID(ctx context.Context, dedb *sql.DB, jobID string) (string, err
 	return externalID, err
 }
 
-const jobsToKillQuery = `
+// interactiveStepQuery finds the interactive steps of the job in the outer
+// query. It's used to keep the interactive and batch kill selections apart.
+const interactiveStepQuery = `
+select 1
+  from job_steps s
+  join job_types t on s.job_type_id = t.id
+ where s.job_id = jobs.id
+   and t.name = 'Interactive'`
+
+// jobPageSize is the number of jobs that the paginated job listings fetch with
+// each query.
+var jobPageSize = 500
+
+// firstJobID sorts before every job ID, so it's where pagination starts.
+const firstJobID = "00000000-0000-0000-0000-000000000000"
+
+// jobListColumns selects the columns that jobFromRow scans for the job
+// listings, which add their own predicates after it.
+const jobListColumns = `
 select jobs.id,
        jobs.app_id,
        jobs.user_id,
@@ -184,28 +261,10 @@ select jobs.id,
        COALESCE((jobs.submission->>'periodic_period')::int, 0) AS periodic_period
   from jobs
   join job_types on jobs.job_type_id = job_types.id
-  join users on jobs.user_id = users.id
- where jobs.status = $1
-   and jobs.planned_end_date <= $2`
-
-// JobsToKill returns a list of running jobs that are past their expiration date
-// and can be killed off. 'api' should be the base URL for the analyses service.
-func JobsToKill(ctx context.Context, dedb *sql.DB) ([]Job, error) {
-	var (
-		err  error
-		rows *sql.Rows
-	)
-
-	if rows, err = dedb.QueryContext(
-		ctx,
-		jobsToKillQuery,
-		"Running",
-		time.Now().Format("2006-01-02 15:04:05.000000-07"),
-	); err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+  join users on jobs.user_id = users.id`
 
+// jobsFromRows scans every row of a job listing query with jobFromRow.
+func jobsFromRows(ctx context.Context, dedb *sql.DB, rows *sql.Rows) ([]Job, error) {
 	jobs := []Job{}
 
 	for rows.Next() {
@@ -217,73 +276,301 @@ func JobsToKill(ctx context.Context, dedb *sql.DB) ([]Job, error) {
 		jobs = append(jobs, job)
 	}
 
-	if err = rows.Err(); err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
 	return jobs, nil
 }
 
-const periodicWarningsQuery = `
-SELECT jobs.id,
-       jobs.app_id,
-       jobs.user_id,
-       jobs.status,
-       jobs.job_description,
-       jobs.job_name,
-       jobs.result_folder_path,
-       jobs.planned_end_date,
-       jobs.subdomain,
-       jobs.start_date,
-       job_types.system_id,
-       users.username,
-       COALESCE((jobs.submission->>'notify_periodic')::bool, TRUE) AS notify_periodic,
-       COALESCE((jobs.submission->>'periodic_period')::int, 0) AS periodic_period
-  FROM jobs
-  JOIN job_types on jobs.job_type_id = job_types.id
-  JOIN users on jobs.user_id = users.id
+// listJobPage runs one page of a paginated job listing query.
+func listJobPage(ctx context.Context, dedb *sql.DB, query string, args ...interface{}) ([]Job, error) {
+	rows, err := dedb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return jobsFromRows(ctx, dedb, rows)
+}
+
+// listJobPages runs a job listing query one page of jobPageSize jobs at a time
+// until it runs out of jobs, so that the listings that run every iteration of
+// the main loop don't have to read every matching job at once. The pages are
+// keyed on jobs.id, so the query has to take the ID to start after and the page
+// size as the two parameters following args, and has to order its results by
+// jobs.id. The listings rely on the jobs primary key for that and on the
+// indexes on jobs.status and jobs.planned_end_date to find the running jobs.
+// Jobs that keep returns false for are left out; a nil keep keeps every job.
+func listJobPages(ctx context.Context, dedb *sql.DB, query string, keep func(*Job) bool, args ...interface{}) ([]Job, error) {
+	jobs := []Job{}
+	after := firstJobID
+
+	for {
+		pageArgs := append(append([]interface{}{}, args...), after, jobPageSize)
+		page, err := listJobPage(ctx, dedb, query, pageArgs...)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range page {
+			if keep == nil || keep(&page[i]) {
+				jobs = append(jobs, page[i])
+			}
+		}
+
+		if len(page) < jobPageSize {
+			return jobs, nil
+		}
+		after = page[len(page)-1].ID
+	}
+}
+
+// jobsToKillBase selects the running jobs whose planned end dates are at or
+// before $2. The pages are keyed on $3 and $4, and the predicates added between
+// jobsToKillBase and jobsToKillPage narrow the selection.
+const jobsToKillBase = jobListColumns + `
+ where jobs.status = $1
+   and jobs.planned_end_date <= $2`
+
+const jobsToKillPage = `
+   and jobs.id > $3
+ order by jobs.id
+ limit $4`
+
+// jobsToKillQuery selects every running job that has passed its planned end
+// date, which is what's killed when BatchLimitsEnabled isn't set.
+const jobsToKillQuery = jobsToKillBase + jobsToKillPage
+
+// interactiveJobsToKillQuery only selects the interactive jobs that have passed
+// their planned end dates. It's used when BatchLimitsEnabled is set, since the
+// batch jobs are killed by BatchJobsToKill then.
+const interactiveJobsToKillQuery = jobsToKillBase + `
+   and exists (` + interactiveStepQuery + `)` + jobsToKillPage
+
+// JobFilter limits the jobs that timelord acts on by job type (the system ID)
+// and app ID. An empty allow list allows everything, and the deny lists take
+// precedence over the allow lists.
+type JobFilter struct {
+	AllowSystemIDs map[string]bool
+	DenySystemIDs  map[string]bool
+	AllowAppIDs    map[string]bool
+	DenyAppIDs     map[string]bool
+}
+
+// NewJobFilter returns a *JobFilter for the lists of system IDs and app IDs.
+func NewJobFilter(allowSystemIDs, denySystemIDs, allowAppIDs, denyAppIDs []string) *JobFilter {
+	set := func(list []string) map[string]bool {
+		m := make(map[string]bool, len(list))
+		for _, v := range list {
+			m[v] = true
+		}
+		return m
+	}
+	return &JobFilter{
+		AllowSystemIDs: set(allowSystemIDs),
+		DenySystemIDs:  set(denySystemIDs),
+		AllowAppIDs:    set(allowAppIDs),
+		DenyAppIDs:     set(denyAppIDs),
+	}
+}
+
+// Allows returns whether timelord may act on the job.
+func (f *JobFilter) Allows(j *Job) bool {
+	if f.DenySystemIDs[j.Type] || f.DenyAppIDs[j.AppID] {
+		return false
+	}
+	if len(f.AllowSystemIDs) > 0 && !f.AllowSystemIDs[j.Type] {
+		return false
+	}
+	if len(f.AllowAppIDs) > 0 && !f.AllowAppIDs[j.AppID] {
+		return false
+	}
+	return true
+}
+
+// KillFilter limits the jobs that are warned about and killed. It allows
+// every job by default.
+var KillFilter = NewJobFilter(nil, nil, nil, nil)
+
+// KillFilterInit sets the filter that limits the jobs that are warned about
+// and killed.
+func KillFilterInit(f *JobFilter) {
+	KillFilter = f
+}
+
+// killCutoff returns the time that a job's planned end date must be at or
+// before for the job to be killed, given the grace period.
+func killCutoff(now time.Time, grace time.Duration) time.Time {
+	return now.Add(-grace)
+}
+
+// JobsToKill returns a list of running jobs that are past their expiration date
+// by more than the grace period and can be killed off. Jobs that KillFilter
+// doesn't allow are left out, as are batch jobs if BatchLimitsEnabled is set.
+func JobsToKill(ctx context.Context, dedb *sql.DB, grace time.Duration) ([]Job, error) {
+	query := jobsToKillQuery
+	if BatchLimitsEnabled {
+		query = interactiveJobsToKillQuery
+	}
+
+	return listJobPages(
+		ctx,
+		dedb,
+		query,
+		KillFilter.Allows,
+		"Running",
+		formatDBTimestamp(killCutoff(CurrentClock.Now(), grace)),
+	)
+}
+
+const periodicWarningsQuery = jobListColumns + `
   LEFT join notif_statuses ON jobs.id = notif_statuses.analysis_id
  WHERE jobs.status = $1
    AND jobs.planned_end_date > now()
    AND (notif_statuses.last_periodic_warning is null
-    OR notif_statuses.last_periodic_warning < now() - coalesce(notif_statuses.periodic_warning_period, '4 hours'::interval))
+    OR notif_statuses.last_periodic_warning < now() - coalesce(notif_statuses.periodic_warning_period, cast($2 as interval)))
+   AND jobs.id > $3
+ ORDER BY jobs.id
+ LIMIT $4
 `
 
 // JobPeriodicWarnings returns a list of running jobs that may need periodic notifications to be sent
 func JobPeriodicWarnings(ctx context.Context, dedb *sql.DB) ([]Job, error) {
+	return listJobPages(
+		ctx,
+		dedb,
+		periodicWarningsQuery,
+		nil,
+		"Running",
+		fmt.Sprintf("%d seconds", int64(PeriodicWarningDefault.Seconds())),
+	)
+}
+
+const jobWarningsQuery = jobListColumns + `
+ where jobs.status = $1
+   and jobs.planned_end_date > $2
+   and jobs.planned_end_date <= $3
+   and jobs.id > $4
+ order by jobs.id
+ limit $5
+`
+
+// JobKillWarnings returns a list of running jobs that are set to be killed
+// within the number of minutes specified. 'api' should be the base URL for the
+// analyses service. Jobs that KillFilter doesn't allow are left out, since
+// they won't be killed.
+func JobKillWarnings(ctx context.Context, dedb *sql.DB, minutes int64) ([]Job, error) {
+	now := CurrentClock.Now()
+
+	return listJobPages(
+		ctx,
+		dedb,
+		jobWarningsQuery,
+		KillFilter.Allows,
+		"Running",
+		formatDBTimestamp(now),
+		formatDBTimestamp(now.Add(time.Duration(minutes)*time.Minute)),
+	)
+}
+
+// missingEndDateQuery selects the running interactive jobs that don't have a
+// planned end date, which happens when their Running status update is lost.
+const missingEndDateQuery = jobListColumns + `
+ where jobs.status = $1
+   and jobs.planned_end_date is null
+   and exists (` + interactiveStepQuery + `)`
+
+// JobsMissingEndDate returns a list of running interactive jobs that don't
+// have a planned end date.
+func JobsMissingEndDate(ctx context.Context, dedb *sql.DB) ([]Job, error) {
 	var (
 		err  error
 		rows *sql.Rows
 	)
 
-	if rows, err = dedb.QueryContext(
-		ctx,
-		periodicWarningsQuery,
-		"Running",
-	); err != nil {
+	if rows, err = dedb.QueryContext(ctx, missingEndDateQuery, "Running"); err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	jobs := []Job{}
+	return jobsFromRows(ctx, dedb, rows)
+}
 
-	for rows.Next() {
-		job, err := jobFromRow(ctx, dedb, rows)
-		if err != nil {
-			return nil, err
+// EndDateSweepSummary counts what SweepMissingEndDates did with the running
+// interactive jobs that were missing planned end dates.
+type EndDateSweepSummary struct {
+	Missing int // The number of jobs without a planned end date.
+	Ensured int // Jobs that EnsurePlannedEndDate succeeded for.
+	Failed  int // Jobs that EnsurePlannedEndDate failed for.
+}
+
+// SweepMissingEndDates sets the planned end dates of the running interactive
+// jobs that don't have one. It's a safety net for lost status updates, since
+// jobs without a planned end date are never killed, and it's also what the
+// --backfill-end-dates flag runs once when planned end dates are first
+// deployed.
+func SweepMissingEndDates(ctx context.Context, dedb *sql.DB) (EndDateSweepSummary, error) {
+	var summary EndDateSweepSummary
+
+	jobs, err := JobsMissingEndDate(ctx, dedb)
+	if err != nil {
+		return summary, errors.Wrap(err, "error listing jobs without a planned end date")
+	}
+	summary.Missing = len(jobs)
+
+	for i := range jobs {
+		j := &jobs[i]
+		if err = EnsurePlannedEndDate(ctx, dedb, j); err != nil {
+			log.Error(errors.Wrapf(err, "error setting the missing planned end date for analysis %s", j.ID))
+			summary.Failed++
+			continue
 		}
+		summary.Ensured++
+	}
 
-		jobs = append(jobs, job)
+	if len(jobs) > 0 {
+		log.Infof("set planned end dates for %d of %d running jobs that were missing them", summary.Ensured, len(jobs))
 	}
 
-	if err = rows.Err(); err != nil {
+	return summary, nil
+}
+
+// runningInteractiveJobsQuery selects all of the running interactive jobs.
+const runningInteractiveJobsQuery = jobListColumns + `
+ where jobs.status = $1
+   and exists (` + interactiveStepQuery + `)`
+
+// RunningInteractiveJobs returns all of the running interactive jobs.
+func RunningInteractiveJobs(ctx context.Context, dedb *sql.DB) ([]Job, error) {
+	rows, err := dedb.QueryContext(ctx, runningInteractiveJobsQuery, "Running")
+	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return jobs, nil
+	return jobsFromRows(ctx, dedb, rows)
 }
 
-const jobWarningsQuery = `
+// BatchLimitsEnabled is whether time limits are enforced on non-interactive
+// jobs. They're left alone by default.
+var BatchLimitsEnabled = false
+
+// BatchTimeLimitSeconds is how long non-interactive jobs may run before
+// they're killed. Defaults to 7 days (7 * 24 * 60 * 60 = 604800).
+var BatchTimeLimitSeconds int64 = 604800
+
+// BatchLimitsInit sets whether time limits are enforced on non-interactive
+// jobs and what the time limit is.
+func BatchLimitsInit(enabled bool, seconds int64) {
+	BatchLimitsEnabled = enabled
+	BatchTimeLimitSeconds = seconds
+}
+
+// batchJobsToKillQuery selects the running non-interactive jobs that have run
+// longer than the time limit in $3. Non-interactive jobs don't get a planned
+// end date, so it's computed from the start date and the limit instead.
+const batchJobsToKillQuery = `
 select jobs.id,
        jobs.app_id,
        jobs.user_id,
@@ -291,7 +578,7 @@ select jobs.id,
        jobs.job_description,
        jobs.job_name,
        jobs.result_folder_path,
-       jobs.planned_end_date,
+       jobs.start_date + cast($3 as interval) AS planned_end_date,
        jobs.subdomain,
        jobs.start_date,
        job_types.system_id,
@@ -302,51 +589,136 @@ select jobs.id,
   join job_types on jobs.job_type_id = job_types.id
   join users on jobs.user_id = users.id
  where jobs.status = $1
-   and jobs.planned_end_date > $2
-   and jobs.planned_end_date <= $3
-`
+   and jobs.start_date + cast($3 as interval) <= $2
+   and not exists (` + interactiveStepQuery + `)`
 
-// JobKillWarnings returns a list of running jobs that are set to be killed
-// within the number of minutes specified. 'api' should be the base URL for the
-// analyses service.
-func JobKillWarnings(ctx context.Context, dedb *sql.DB, minutes int64) ([]Job, error) {
+// BatchJobsToKill returns a list of running non-interactive jobs that have
+// been running longer than BatchTimeLimitSeconds plus the grace period. Jobs
+// that KillFilter doesn't allow are left out.
+func BatchJobsToKill(ctx context.Context, dedb *sql.DB, grace time.Duration) ([]Job, error) {
 	var (
 		err  error
 		rows *sql.Rows
 	)
 
-	now := time.Now()
-	// fmtstring := "2006-01-02 15:04:05.000000-07"
-	// nowtimestamp := now.Format(fmtstring)
-	// futuretimestamp := now.Add(time.Duration(minutes) * time.Minute).Format(fmtstring)
-
 	if rows, err = dedb.QueryContext(
 		ctx,
-		jobWarningsQuery,
+		batchJobsToKillQuery,
 		"Running",
-		now,
-		now.Add(time.Duration(minutes)*time.Minute),
+		formatDBTimestamp(killCutoff(CurrentClock.Now(), grace)),
+		fmt.Sprintf("%d seconds", BatchTimeLimitSeconds),
 	); err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	listed, err := jobsFromRows(ctx, dedb, rows)
+	if err != nil {
+		return nil, err
+	}
+
 	jobs := []Job{}
+	for i := range listed {
+		if KillFilter.Allows(&listed[i]) {
+			jobs = append(jobs, listed[i])
+		}
+	}
+
+	return jobs, nil
+}
+
+const runningJobsByUserQuery = `
+select users.username,
+       count(*)
+  from jobs
+  join users on jobs.user_id = users.id
+ where jobs.status = $1
+   and exists (` + interactiveStepQuery + `)
+ group by users.username`
+
+// CountRunningJobsByUser returns the number of running interactive jobs for
+// each user that has at least one, keyed by username.
+func CountRunningJobsByUser(ctx context.Context, dedb *sql.DB) (map[string]int64, error) {
+	rows, err := dedb.QueryContext(ctx, runningJobsByUserQuery, "Running")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
 
 	for rows.Next() {
-		job, err := jobFromRow(ctx, dedb, rows)
-		if err != nil {
+		var (
+			username string
+			count    int64
+		)
+		if err = rows.Scan(&username, &count); err != nil {
 			return nil, err
 		}
-
-		jobs = append(jobs, job)
+		counts[username] = count
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return jobs, nil
+	return counts, nil
+}
+
+// The kinds of errors that KillJob can return. Use errors.Is to check for them.
+var (
+	ErrKillNotFound  = errors.New("analysis not found by the kill endpoint")
+	ErrKillUpstream  = errors.New("kill request rejected by the kill endpoint")
+	ErrKillTransient = errors.New("kill endpoint temporarily unavailable")
+)
+
+// KillError is returned by KillJob when the kill request fails. Kind is one of
+// ErrKillNotFound, ErrKillUpstream, or ErrKillTransient.
+type KillError struct {
+	Kind error
+	Err  error
+}
+
+func (e *KillError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *KillError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of the error.
+func (e *KillError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// killStatusError returns a *KillError for a kill request that got a non-2xx
+// response with the given status code.
+func killStatusError(statusCode int, err error) error {
+	kind := ErrKillUpstream
+	switch {
+	case statusCode == http.StatusNotFound:
+		kind = ErrKillNotFound
+	case statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		kind = ErrKillTransient
+	}
+	return &KillError{Kind: kind, Err: err}
+}
+
+// KillFailureReason returns a short description of why a kill failed, suitable
+// for storing in the database.
+func KillFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrKillNotFound):
+		return "not_found"
+	case errors.Is(err, ErrKillUpstream):
+		return "upstream"
+	case errors.Is(err, ErrKillTransient):
+		return "transient"
+	default:
+		return "unknown"
+	}
 }
 
 // JobKiller is responsible for killing jobs either in HTCondor or in K8s.
@@ -356,7 +728,8 @@ type JobKiller struct {
 	AppExposerBase string // base URL for the app-exposer serivce
 }
 
-// KillJob uses either the apps or app-exposer APIs to kill a VICE job.
+// KillJob uses either the apps or app-exposer APIs to kill a VICE job. Failed
+// kill requests return a *KillError describing why they failed.
 func (j *JobKiller) KillJob(ctx context.Context, dedb *sql.DB, job *Job) error {
 	if j.K8sEnabled {
 		return j.killK8sJob(ctx, dedb, job)
@@ -365,42 +738,48 @@ func (j *JobKiller) KillJob(ctx context.Context, dedb *sql.DB, job *Job) error {
 
 }
 
-// killCondorJob uses the provided API at the base URL to kill a running job. This
-// will probably be to the apps service. jobID should be the UUID for the Job,
-// typically returned in the ID field by the analyses service. The username
-// should be the short username for the user that launched the job.
-func (j *JobKiller) killCondorJob(ctx context.Context, jobID, username string) error {
-	apiURL, err := url.Parse(j.AppsBase)
+// KillBatchJob uses the apps API to kill a non-interactive job.
+func (j *JobKiller) KillBatchJob(ctx context.Context, dedb *sql.DB, job *Job) error {
+	return j.killCondorJob(ctx, job.ID, job.User)
+}
+
+// appsStopURL returns the apps service URL that stops the job with the given
+// UUID on behalf of the user, who is passed by their short username. The path
+// comes from the AppsStopPath template.
+func appsStopURL(appsBase, jobID, username string) (*url.URL, error) {
+	apiURL, err := url.Parse(appsBase)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	apiURL.Path = filepath.Join(apiURL.Path, "analyses", jobID, "stop")
+	apiURL.Path = path.Join(apiURL.Path, renderKillPath(AppsStopPath, jobID, "", username))
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL.String(), nil)
+	q := apiURL.Query()
+	q.Set("user", ParseID(username))
+	apiURL.RawQuery = q.Encode()
+
+	return apiURL, nil
+}
+
+// killCondorJob uses the apps service at AppsBase to kill a running job.
+// jobID should be the UUID for the Job, typically returned in the ID field by
+// the analyses service. The username is shortened before it's sent.
+func (j *JobKiller) killCondorJob(ctx context.Context, jobID, username string) error {
+	apiURL, err := appsStopURL(j.AppsBase, jobID, username)
 	if err != nil {
 		return err
 	}
 
-	var shortusername string
-	userparts := strings.Split(username, "@")
-	if len(userparts) > 1 {
-		shortusername = userparts[0]
-	} else {
-		shortusername = username
-	}
-	q := req.URL.Query()
-	q.Add("user", shortusername)
-	req.URL.RawQuery = q.Encode()
-
-	resp, err := httpClient.Do(req)
+	resp, err := doWithRetry(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, apiURL.String(), nil)
+	})
 	if err != nil {
-		return err
+		return &KillError{Kind: ErrKillTransient, Err: err}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("response status code for POST %s was %d as %s", apiURL.String(), resp.StatusCode, username)
+		return killStatusError(resp.StatusCode, fmt.Errorf("response status code for POST %s was %d as %s", apiURL.String(), resp.StatusCode, username))
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -408,13 +787,27 @@ func (j *JobKiller) killCondorJob(ctx context.Context, jobID, username string) e
 		return err
 	}
 
-	log.Infof("response from %s was: %s", req.URL, string(body))
+	log.Infof("response from %s was: %s", apiURL, string(body))
 	return nil
 }
 
 // killK8sJob uses the app-exposer API to make a job save its outputs and exit.
 // JobID should be the external_id (AKA invocationID) for the job.
 func (j *JobKiller) killK8sJob(ctx context.Context, dedb *sql.DB, job *Job) error {
+	return j.viceAction(ctx, job, "save-and-exit", VICESaveAndExitPath)
+}
+
+// HardStopJob uses the app-exposer API to make a VICE job exit without saving
+// its outputs. It's for jobs that are still running well after they were asked
+// to save and exit.
+func (j *JobKiller) HardStopJob(ctx context.Context, dedb *sql.DB, job *Job) error {
+	return j.viceAction(ctx, job, "exit", VICEExitPath)
+}
+
+// viceAction POSTs to the app-exposer endpoint for the action on the job's
+// VICE analysis, such as save-and-exit. The endpoint's path is rendered from
+// the tmpl path template.
+func (j *JobKiller) viceAction(ctx context.Context, job *Job, action, tmpl string) error {
 	var err error
 
 	origAPIURL, err := url.Parse(j.AppExposerBase)
@@ -430,29 +823,30 @@ func (j *JobKiller) killK8sJob(ctx context.Context, dedb *sql.DB, job *Job) erro
 		return errors.Wrapf(err, "error parsing URL %s while processing external-id %s", origAPIURL.String(), externalID)
 	}
 
-	apiURL.Path = filepath.Join(apiURL.Path, "vice", externalID, "save-and-exit")
+	apiURL.Path = filepath.Join(apiURL.Path, renderKillPath(tmpl, job.ID, externalID, job.User))
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL.String(), nil)
-	if err != nil {
-		return errors.Wrapf(err, "error creating save-and-exit request for external-id %s", externalID)
-	}
-
-	resp, err := httpClient.Do(req)
+	resp, err := doWithRetry(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL.String(), nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error creating %s request for external-id %s", action, externalID)
+		}
+		return req, nil
+	})
 	if err != nil {
-		return errors.Wrapf(err, "error calling save-and-exit for external-id %s", externalID)
+		return &KillError{Kind: ErrKillTransient, Err: errors.Wrapf(err, "error calling %s for external-id %s", action, externalID)}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("response status code for POST %s was %d", apiURL.String(), resp.StatusCode)
+		return killStatusError(resp.StatusCode, fmt.Errorf("response status code for POST %s was %d", apiURL.String(), resp.StatusCode))
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return errors.Wrapf(err, "error reading response body of save-and-exit call for external-id %s", externalID)
+		return errors.Wrapf(err, "error reading response body of %s call for external-id %s", action, externalID)
 	}
 
-	log.Infof("response from %s was: %s", req.URL, string(body))
+	log.Infof("response from %s was: %s", apiURL, string(body))
 
 	resp.Body.Close()
 
@@ -474,7 +868,8 @@ select jobs.id,
        users.username,
        COALESCE((jobs.submission->>'notify_periodic')::bool, TRUE) AS notify_periodic,
        COALESCE((jobs.submission->>'periodic_period')::int, 0) AS periodic_period,
-       job_steps.external_id
+       job_steps.external_id,
+       exists (` + interactiveStepQuery + `) AS interactive
   from jobs
   join job_types on jobs.job_type_id = job_types.id
   join users on jobs.user_id = users.id
@@ -482,6 +877,39 @@ select jobs.id,
  where job_steps.external_id = $1`
 
 func lookupByExternalID(ctx context.Context, dedb *sql.DB, externalID string) (*Job, error) {
+	return scanJob(dedb.QueryRowContext(ctx, jobByExternalIDQuery, externalID))
+}
+
+const jobByIDQuery = `
+select jobs.id,
+       jobs.app_id,
+       jobs.user_id,
+       jobs.status,
+       jobs.job_description,
+       jobs.job_name,
+       jobs.result_folder_path,
+       jobs.planned_end_date,
+       jobs.subdomain,
+       jobs.start_date,
+       job_types.system_id,
+       users.username,
+       COALESCE((jobs.submission->>'notify_periodic')::bool, TRUE) AS notify_periodic,
+       COALESCE((jobs.submission->>'periodic_period')::int, 0) AS periodic_period,
+       job_steps.external_id,
+       exists (` + interactiveStepQuery + `) AS interactive
+  from jobs
+  join job_types on jobs.job_type_id = job_types.id
+  join users on jobs.user_id = users.id
+  join job_steps on jobs.id = job_steps.job_id
+ where jobs.id = $1
+ limit 1`
+
+func lookupByID(ctx context.Context, dedb *sql.DB, id string) (*Job, error) {
+	return scanJob(dedb.QueryRowContext(ctx, jobByIDQuery, id))
+}
+
+// scanJob reads a job from a row returned by jobByExternalIDQuery or jobByIDQuery.
+func scanJob(row *sql.Row) (*Job, error) {
 	var (
 		err            error
 		job            *Job
@@ -492,7 +920,7 @@ func lookupByExternalID(ctx context.Context, dedb *sql.DB, externalID string) (*
 
 	job = &Job{}
 
-	if err = dedb.QueryRowContext(ctx, jobByExternalIDQuery, externalID).Scan(
+	if err = row.Scan(
 		&job.ID,
 		&job.AppID,
 		&job.UserID,
@@ -508,9 +936,11 @@ func lookupByExternalID(ctx context.Context, dedb *sql.DB, externalID string) (*
 		&job.NotifyPeriodic,
 		&job.PeriodicPeriod,
 		&job.ExternalID,
+		&job.Interactive,
 	); err != nil {
 		return nil, err
 	}
+	job.interactiveKnown = true
 	if plannedEndDate.Valid {
 		job.PlannedEndDate = plannedEndDate.Time.Format(TimestampFromDBFormat)
 	}
@@ -524,8 +954,95 @@ func lookupByExternalID(ctx context.Context, dedb *sql.DB, externalID string) (*
 	return job, nil
 }
 
+// SubdomainPrefix starts the subdomains generated for VICE analyses.
+var SubdomainPrefix = "a"
+
+// SubdomainLength is the length of the subdomains generated for VICE analyses,
+// including the prefix. The rest of the subdomain is hex characters from a
+// SHA-256 hash, so the default of "a" plus 8 hex characters keeps 32 bits of
+// the hash, and collisions become likely after tens of thousands of analyses.
+// Each extra character adds 4 bits.
+var SubdomainLength = 9
+
+// subdomainPattern matches valid DNS labels that start with a letter.
+var subdomainPattern = regexp.MustCompile(`^[a-z]([a-z0-9-]*[a-z0-9])?$`)
+
+// maxSubdomainLength is the maximum length of a DNS label.
+const maxSubdomainLength = 63
+
+// SubdomainInit sets the prefix and length of the subdomains generated for
+// VICE analyses. Returns an error if the subdomains wouldn't be valid DNS
+// labels.
+func SubdomainInit(prefix string, length int) error {
+	hashChars := length - len(prefix)
+	if hashChars < 1 || hashChars > sha256.Size*2 {
+		return fmt.Errorf("subdomain length must leave between 1 and %d characters after the prefix, not %d", sha256.Size*2, hashChars)
+	}
+	if length > maxSubdomainLength {
+		return fmt.Errorf("subdomain length must be at most %d, not %d", maxSubdomainLength, length)
+	}
+	// The hash characters are hex digits, so check the prefix with one added.
+	if !subdomainPattern.MatchString(prefix + "0") {
+		return fmt.Errorf("subdomain prefix %q must start with a lowercase letter and contain only lowercase letters, digits, and hyphens", prefix)
+	}
+
+	SubdomainPrefix = prefix
+	SubdomainLength = length
+	return nil
+}
+
 func generateSubdomain(userID, externalID string) string {
-	return fmt.Sprintf("a%x", sha256.Sum256([]byte(fmt.Sprintf("%s%s", userID, externalID))))[0:9]
+	return fmt.Sprintf("%s%x", SubdomainPrefix, sha256.Sum256([]byte(fmt.Sprintf("%s%s", userID, externalID))))[0:SubdomainLength]
+}
+
+// maxSubdomainAttempts is the number of subdomains tried for an analysis
+// before giving up on finding one that isn't in use.
+const maxSubdomainAttempts = 10
+
+// saltedSubdomain returns the subdomain to try for an analysis on the given
+// attempt. The first attempt uses the unsalted subdomain so that subdomains
+// don't change for analyses without collisions.
+func saltedSubdomain(userID, externalID string, attempt int) string {
+	if attempt == 0 {
+		return generateSubdomain(userID, externalID)
+	}
+	return generateSubdomain(userID, fmt.Sprintf("%s-%d", externalID, attempt))
+}
+
+const subdomainInUseQuery = `
+select count(*) from jobs where subdomain = $1 and id != $2
+`
+
+// subdomainInUse returns whether a job other than the analysis is using the subdomain.
+func subdomainInUse(ctx context.Context, dedb *sql.DB, analysisID, subdomain string) (bool, error) {
+	var count int64
+	if err := dedb.QueryRowContext(ctx, subdomainInUseQuery, subdomain, analysisID).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// uniqueSubdomain returns a subdomain for the analysis that no other job is
+// using, salting the hash until it finds one.
+func uniqueSubdomain(ctx context.Context, dedb *sql.DB, analysisID, userID, externalID string) (string, error) {
+	for attempt := 0; attempt < maxSubdomainAttempts; attempt++ {
+		subdomain := saltedSubdomain(userID, externalID, attempt)
+
+		inUse, err := subdomainInUse(ctx, dedb, analysisID, subdomain)
+		if err != nil {
+			return "", errors.Wrapf(err, "error checking whether subdomain %s is in use", subdomain)
+		}
+		if !inUse {
+			if attempt > 0 {
+				log.Warnf("resolved subdomain collision for analysis %s after %d attempts, using %s", analysisID, attempt+1, subdomain)
+			}
+			return subdomain, nil
+		}
+
+		log.Warnf("subdomain %s for analysis %s is already in use", subdomain, analysisID)
+	}
+
+	return "", fmt.Errorf("no unused subdomain found for analysis %s after %d attempts", analysisID, maxSubdomainAttempts)
 }
 
 const setSubdomainMutation = `update only jobs set subdomain = $1 where id = $2`
@@ -547,8 +1064,7 @@ const setPlannedEndDateMutation = `update only jobs set planned_end_date = $1 wh
 func setPlannedEndDate(ctx context.Context, dedb *sql.DB, id string, millisSinceEpoch int64) error {
 	var err error
 
-	plannedEndDate := time.UnixMilli(millisSinceEpoch).
-		Format("2006-01-02 15:04:05.000000-07")
+	plannedEndDate := formatDBTimestamp(time.UnixMilli(millisSinceEpoch))
 
 	if _, err = dedb.ExecContext(ctx, setPlannedEndDateMutation, plannedEndDate, id); err != nil {
 		return errors.Wrapf(err, "error setting planned_end_date to %s for job %s", plannedEndDate, id)
@@ -557,6 +1073,77 @@ func setPlannedEndDate(ctx context.Context, dedb *sql.DB, id string, millisSince
 	return err
 }
 
+// MaxExtensions is the number of times a job's planned end date may be
+// extended. Zero or less means jobs can't be extended at all.
+var MaxExtensions = 3
+
+// ExtensionsInit sets the number of times a job's planned end date may be extended.
+func ExtensionsInit(max int) {
+	MaxExtensions = max
+}
+
+// ErrExtensionLimitReached is returned by ExtendPlannedEndDate when the job
+// has already been extended the maximum number of times.
+var ErrExtensionLimitReached = errors.New("the analysis has already been extended the maximum number of times")
+
+// ExtendPlannedEndDate pushes the planned end date of the job back by d and
+// returns the new planned end date. The job's warnings are reset and its queued
+// warnings dropped when the date moves later. Returns ErrExtensionLimitReached
+// if the job has been extended MaxExtensions times already. The extension is
+// counted before the date is moved, so that concurrent extensions can't go over
+// the limit, and given back if the date can't be moved.
+func ExtendPlannedEndDate(ctx context.Context, dedb *sql.DB, vicedb *VICEDatabaser, job *Job, d time.Duration) (time.Time, error) {
+	var (
+		err     error
+		endDate time.Time
+		claimed bool
+	)
+
+	if job.PlannedEndDate == "" {
+		return endDate, fmt.Errorf("analysis %s does not have a planned end date", job.ID)
+	}
+
+	if endDate, err = parseDBTimestamp(job.PlannedEndDate); err != nil {
+		return endDate, errors.Wrapf(err, "failed to parse planned end date %s", job.PlannedEndDate)
+	}
+
+	if err = vicedb.EnsureNotifRecord(ctx, job); err != nil {
+		return endDate, errors.Wrapf(err, "error adding notification statuses for analysis %s", job.ID)
+	}
+
+	if claimed, err = vicedb.ClaimExtension(ctx, job, MaxExtensions); err != nil {
+		return endDate, errors.Wrapf(err, "error counting the extension of analysis %s", job.ID)
+	}
+
+	if !claimed {
+		return endDate, ErrExtensionLimitReached
+	}
+
+	endDate = endDate.Add(d)
+
+	if err = setPlannedEndDate(ctx, dedb, job.ID, endDate.UnixMilli()); err != nil {
+		if releaseErr := vicedb.ReleaseExtension(ctx, job); releaseErr != nil {
+			log.Error(errors.Wrapf(releaseErr, "error giving back the extension of analysis %s", job.ID))
+		}
+		return endDate, err
+	}
+
+	// Only a later deadline warrants fresh warnings. Queued warnings would give
+	// the user the time left before the old deadline, so they're dropped too.
+	if d > 0 {
+		if err = vicedb.ResetWarnings(ctx, job); err != nil {
+			return endDate, errors.Wrapf(err, "error resetting warnings for analysis %s", job.ID)
+		}
+		if err = vicedb.DeletePendingWarnings(ctx, job); err != nil {
+			return endDate, errors.Wrapf(err, "error deleting queued warnings for analysis %s", job.ID)
+		}
+	}
+
+	job.PlannedEndDate = endDate.In(TimestampLocation).Format(TimestampFromDBFormat)
+
+	return endDate, nil
+}
+
 const stepTypeQuery = `
 SELECT t.name
   FROM jobs j
@@ -614,10 +1201,57 @@ func getUserIDForJob(ctx context.Context, dedb *sql.DB, analysisID string) (stri
 	return userID, nil
 }
 
-// getTimeLimitQuery is the query for calculating a number-of-seconds time limit for a job
-// if a time_limit_seconds is not set for a tool, use 72 hours (72 * 60 * 60 = 259200)
+// DefaultTimeLimitSeconds is the time limit used for tools that don't have
+// their own time limit set. Defaults to 72 hours (72 * 60 * 60 = 259200).
+var DefaultTimeLimitSeconds int64 = 259200
+
+// MaxTimeLimitSeconds caps the summed time limit of a job's tools. Zero means
+// there's no cap. Jobs using a tool with NoTimeLimit aren't capped.
+var MaxTimeLimitSeconds int64
+
+// MinTimeLimitSeconds is the shortest time limit a job is given, so that a
+// tool with a tiny time limit doesn't get its sessions reclaimed almost right
+// away. Zero means there's no floor. Jobs using a tool with NoTimeLimit are
+// still never given a planned end date.
+var MinTimeLimitSeconds int64
+
+// TimeLimitsInit sets the time limit used for tools without one of their own
+// and the floor and cap on the total time limit of a job.
+func TimeLimitsInit(defaultSeconds, minSeconds, maxSeconds int64) {
+	DefaultTimeLimitSeconds = defaultSeconds
+	MinTimeLimitSeconds = minSeconds
+	MaxTimeLimitSeconds = maxSeconds
+}
+
+// capTimeLimit returns the time limit clamped to maxSeconds, along with whether
+// it had to be clamped. A maxSeconds of zero or less means there's no cap.
+func capTimeLimit(seconds, maxSeconds int64) (int64, bool) {
+	if maxSeconds > 0 && seconds > maxSeconds {
+		return maxSeconds, true
+	}
+	return seconds, false
+}
+
+// floorTimeLimit returns the time limit raised to minSeconds, along with
+// whether it had to be raised. A minSeconds of zero or less means there's no
+// floor.
+func floorTimeLimit(seconds, minSeconds int64) (int64, bool) {
+	if minSeconds > 0 && seconds < minSeconds {
+		return minSeconds, true
+	}
+	return seconds, false
+}
+
+// NoTimeLimit is the tool time limit that marks a tool as never being subject
+// to a time limit. Jobs that use such a tool are never given a planned end
+// date, so they're never killed.
+const NoTimeLimit int64 = -1
+
+// getTimeLimitQuery is the query for fetching the time limits, in seconds, of
+// each of the tools used by a job. A limit of 0 means the tool doesn't have
+// one set.
 const getTimeLimitQuery = `
-SELECT sum(CASE WHEN tools.time_limit_seconds > 0 THEN tools.time_limit_seconds ELSE 259200 END)
+SELECT COALESCE(tools.time_limit_seconds, 0)
   FROM tools
   JOIN tasks ON tools.id = tasks.tool_id
   JOIN app_steps ON tasks.id = app_steps.task_id
@@ -625,15 +1259,144 @@ SELECT sum(CASE WHEN tools.time_limit_seconds > 0 THEN tools.time_limit_seconds
  WHERE jobs.id = $1
 `
 
+// sumTimeLimits adds up the tool time limits, using defaultSeconds in place
+// of any limit that isn't set. Returns NoTimeLimit if any of the tools is
+// unlimited.
+func sumTimeLimits(limits []int64, defaultSeconds int64) int64 {
+	var total int64
+	for _, limit := range limits {
+		if limit == NoTimeLimit {
+			return NoTimeLimit
+		}
+		if limit > 0 {
+			total += limit
+		} else {
+			total += defaultSeconds
+		}
+	}
+	return total
+}
+
 func getTimeLimit(ctx context.Context, dedb *sql.DB, analysisID string) (int64, error) {
 	var (
-		err              error
-		timeLimitSeconds int64
+		err    error
+		rows   *sql.Rows
+		limits []int64
 	)
-	if err = dedb.QueryRowContext(ctx, getTimeLimitQuery, analysisID).Scan(&timeLimitSeconds); err != nil {
+
+	if rows, err = dedb.QueryContext(ctx, getTimeLimitQuery, analysisID); err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var limit int64
+		if err = rows.Scan(&limit); err != nil {
+			return 0, err
+		}
+		limits = append(limits, limit)
+	}
+
+	if err = rows.Err(); err != nil {
 		return 0, err
 	}
-	return timeLimitSeconds, nil
+
+	if len(limits) == 0 {
+		return 0, fmt.Errorf("no tools found for analysis %s", analysisID)
+	}
+
+	return sumTimeLimits(limits, DefaultTimeLimitSeconds), nil
+}
+
+// firstRunningQuery finds when a job first reported that it was running. The
+// sent_on column is stored as milliseconds since the epoch, so it doesn't carry
+// the timezone ambiguity that the jobs table timestamps do.
+const firstRunningQuery = `
+SELECT min(job_status_updates.sent_on)
+  FROM job_status_updates
+  JOIN job_steps ON job_status_updates.external_id = job_steps.external_id
+ WHERE job_steps.job_id = $1
+   AND job_status_updates.status = 'Running'
+`
+
+// getFirstRunningTime returns the time of the earliest 'Running' status update
+// for the job. The returned bool is false if the job hasn't reported that it's
+// running yet.
+func getFirstRunningTime(ctx context.Context, dedb *sql.DB, analysisID string) (time.Time, bool, error) {
+	var (
+		err    error
+		sentOn sql.NullInt64
+	)
+	if err = dedb.QueryRowContext(ctx, firstRunningQuery, analysisID).Scan(&sentOn); err != nil {
+		return time.Time{}, false, err
+	}
+	if !sentOn.Valid {
+		return time.Time{}, false, nil
+	}
+	return time.UnixMilli(sentOn.Int64), true, nil
+}
+
+// StatusUpdate is a status that a job reported and when it reported it.
+type StatusUpdate struct {
+	Status string    `json:"status"`
+	SentOn time.Time `json:"sent_on"`
+}
+
+// statusHistoryQuery returns the status updates for all of a job's steps in
+// the order they were sent.
+const statusHistoryQuery = `
+SELECT job_status_updates.status,
+       job_status_updates.sent_on
+  FROM job_status_updates
+  JOIN job_steps ON job_status_updates.external_id = job_steps.external_id
+ WHERE job_steps.job_id = $1
+ ORDER BY job_status_updates.sent_on ASC
+`
+
+// getStatusHistory returns every status update that the job has sent, oldest
+// first.
+func getStatusHistory(ctx context.Context, dedb *sql.DB, analysisID string) ([]StatusUpdate, error) {
+	rows, err := dedb.QueryContext(ctx, statusHistoryQuery, analysisID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying status history for analysis %s", analysisID)
+	}
+	defer rows.Close()
+
+	updates := []StatusUpdate{}
+	for rows.Next() {
+		var (
+			status string
+			sentOn int64
+		)
+		if err = rows.Scan(&status, &sentOn); err != nil {
+			return nil, errors.Wrapf(err, "error scanning status history for analysis %s", analysisID)
+		}
+		updates = append(updates, StatusUpdate{Status: status, SentOn: time.UnixMilli(sentOn).UTC()})
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "error reading status history for analysis %s", analysisID)
+	}
+
+	return updates, nil
+}
+
+// recentTransitions returns up to the last n updates that changed the job's
+// status. Updates that repeat the status before them are left out, since jobs
+// send plenty of those while they're running.
+func recentTransitions(updates []StatusUpdate, n int) []StatusUpdate {
+	transitions := []StatusUpdate{}
+	for _, u := range updates {
+		if len(transitions) > 0 && transitions[len(transitions)-1].Status == u.Status {
+			continue
+		}
+		transitions = append(transitions, u)
+	}
+
+	if len(transitions) > n {
+		transitions = transitions[len(transitions)-n:]
+	}
+	return transitions
 }
 
 // EnsureSubdomain makes sure the provided job has a subdomain set in the DB, returning it
@@ -647,7 +1410,10 @@ func EnsureSubdomain(ctx context.Context, dedb *sql.DB, analysis *Job) (string,
 			log.Infof("user id is %s and invocation id is %s", userID, analysis.ExternalID)
 
 			// make sure to use externalID, not analysis.ID here
-			subdomain := generateSubdomain(userID, analysis.ExternalID)
+			subdomain, err := uniqueSubdomain(ctx, dedb, analysis.ID, userID, analysis.ExternalID)
+			if err != nil {
+				return "", err
+			}
 
 			log.Infof("generated subdomain for analysis %s is %s, based on user ID %s and invocation ID %s", analysis.ID, subdomain, userID, analysis.ExternalID)
 
@@ -668,88 +1434,329 @@ func EnsurePlannedEndDate(ctx context.Context, dedb *sql.DB, analysis *Job) erro
 		return nil // it's already set, so move along.
 	}
 
-	startDate, err := time.ParseInLocation(TimestampFromDBFormat, analysis.StartDate, time.Local)
+	timeLimitSeconds, err := getTimeLimit(ctx, dedb, analysis.ID)
 	if err != nil {
-		return errors.Wrapf(err, "error parsing start date field %s", analysis.StartDate)
+		return errors.Wrapf(err, "error fetching time limit for analysis %s", analysis.ID)
 	}
-	sdnano := startDate.UnixNano()
 
-	timeLimitSeconds, err := getTimeLimit(ctx, dedb, analysis.ID)
+	// Leaving the planned end date unset keeps the job out of jobsToKillQuery.
+	if timeLimitSeconds == NoTimeLimit {
+		log.Infof("analysis %s has no time limit, not setting a planned end date", analysis.ID)
+		return nil
+	}
+
+	if capped, clamped := capTimeLimit(timeLimitSeconds, MaxTimeLimitSeconds); clamped {
+		log.Infof("time limit of %d seconds for analysis %s is over the maximum, using %d seconds", timeLimitSeconds, analysis.ID, capped)
+		timeLimitSeconds = capped
+	}
+
+	if floored, raised := floorTimeLimit(timeLimitSeconds, MinTimeLimitSeconds); raised {
+		log.Infof("time limit of %d seconds for analysis %s is under the minimum, using %d seconds", timeLimitSeconds, analysis.ID, floored)
+		timeLimitSeconds = floored
+	}
+
+	// jobs.start_date is the submission time, so prefer the time the job
+	// actually started running if it's available.
+	startDate, found, err := getFirstRunningTime(ctx, dedb, analysis.ID)
 	if err != nil {
-		return errors.Wrapf(err, "error fetching time limit for analysis %s", analysis.ID)
+		return errors.Wrapf(err, "error looking up first running status for analysis %s", analysis.ID)
 	}
+	if !found {
+		startDate, err = parseDBTimestamp(analysis.StartDate)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing start date field %s", analysis.StartDate)
+		}
+	}
+	sdnano := startDate.UnixNano()
 
 	// StartDate is in milliseconds, so convert it to nanoseconds, add correct number of seconds,
 	// then convert back to milliseconds.
-	endDate := time.Unix(0, sdnano).Add(time.Duration(timeLimitSeconds)*time.Second).UnixNano() / 1000000
+	end := time.Unix(0, sdnano).Add(time.Duration(timeLimitSeconds) * time.Second)
+
+	// A time limit that overflowed or a bad start date would give the job an
+	// end date that has already passed, getting it killed right away.
+	if !end.After(startDate) {
+		log.WithFields(log.Fields{
+			"context":            "planned end date",
+			"ID":                 analysis.ID,
+			"start_date":         startDate,
+			"planned_end_date":   end,
+			"time_limit_seconds": timeLimitSeconds,
+		}).Error("computed planned end date isn't after the start date, not setting it; the job's data needs to be checked")
+		return fmt.Errorf("computed planned end date %s for analysis %s isn't after its start date %s", end, analysis.ID, startDate)
+	}
+
+	endDate := end.UnixNano() / 1000000
 	if err = setPlannedEndDate(ctx, dedb, analysis.ID, endDate); err != nil {
 		return errors.Wrapf(err, "error setting planned end date for analysis '%s' to '%d'", analysis.ID, endDate)
 	}
 	return nil
 }
 
+// terminalStates contains the job states that a job can't leave once it's in them.
+var terminalStates = map[string]bool{
+	"Completed": true,
+	"Failed":    true,
+	"Canceled":  true,
+}
+
+// maxRedeliveries is the number of times a status update message can be
+// redelivered before it's dropped instead of being requeued.
+const maxRedeliveries = 5
+
+// deliveryCount returns the number of times a message has been delivered
+// according to the x-delivery-count header set by RabbitMQ. Returns 0 if the
+// header isn't present, which it never is for classic queues like the one
+// the status updates are read from. failedDeliveries covers those.
+func deliveryCount(delivery amqp.Delivery) int64 {
+	switch count := delivery.Headers["x-delivery-count"].(type) {
+	case int:
+		return int64(count)
+	case int16:
+		return int64(count)
+	case int32:
+		return int64(count)
+	case int64:
+		return count
+	default:
+		return 0
+	}
+}
+
+// maxTrackedDeliveries is the most messages that failedDeliveries keeps
+// counts for. The counts start over once it's reached, which only lets the
+// messages that were being counted be redelivered a few more times.
+const maxTrackedDeliveries = 10000
+
+// failedDeliveries counts the failed deliveries of the messages that were
+// requeued, keyed by a hash of the message body, since a redelivered message
+// has the same body. RabbitMQ only sets x-delivery-count for quorum queues, so
+// without this a message that keeps failing would be redelivered forever.
+type failedDeliveries struct {
+	mu     sync.Mutex
+	counts map[[sha256.Size]byte]int64
+}
+
+func newFailedDeliveries() *failedDeliveries {
+	return &failedDeliveries{counts: make(map[[sha256.Size]byte]int64)}
+}
+
+// fail records a failed delivery of the message and returns the number of
+// times it failed before.
+func (f *failedDeliveries) fail(delivery amqp.Delivery) int64 {
+	key := sha256.Sum256(delivery.Body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.counts[key]; !ok && len(f.counts) >= maxTrackedDeliveries {
+		f.counts = make(map[[sha256.Size]byte]int64)
+	}
+
+	previous := f.counts[key]
+	f.counts[key] = previous + 1
+	return previous
+}
+
+// forget stops counting the message's failed deliveries, once it has either
+// been processed or dropped.
+func (f *failedDeliveries) forget(delivery amqp.Delivery) {
+	key := sha256.Sum256(delivery.Body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.counts, key)
+}
+
+// amqpHeaderCarrier adapts the headers of an AMQP message so that trace
+// context can be extracted from them.
+type amqpHeaderCarrier amqp.Table
+
+// Get returns the value of the header as a string, or "" if it isn't set or
+// isn't a string.
+func (c amqpHeaderCarrier) Get(key string) string {
+	switch v := c[key].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return ""
+	}
+}
+
+// Set sets the header to the value.
+func (c amqpHeaderCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+// Keys returns the names of the headers.
+func (c amqpHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// deliveryContext returns ctx with any trace context that the publisher
+// injected into the delivery's headers. Returns ctx unchanged if there isn't
+// any, so spans started from it become new root spans.
+func deliveryContext(ctx context.Context, delivery amqp.Delivery) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, amqpHeaderCarrier(delivery.Headers))
+}
+
+// messageOutcomes counts what happened to the status update messages, such as
+// whether they were processed or skipped and whether they were acked. It's
+// published through expvar.
+var messageOutcomes = expvar.NewMap("message_handler_outcomes")
+
+// The keys of the message handler outcomes. A message is counted once for
+// what handleUpdate did with it and once for whether it was acked or nacked.
+const (
+	outcomeAcked                 = "acked"
+	outcomeNacked                = "nacked"
+	outcomeMalformed             = "malformed"
+	outcomeLookupFailed          = "lookup_failed"
+	outcomeTerminal              = "terminal"
+	outcomeSkippedNonInteractive = "skipped_non_interactive"
+	outcomeSkippedNonRunning     = "skipped_non_running"
+	outcomeSetupFailed           = "setup_failed"
+	outcomeProcessed             = "processed"
+)
+
 // CreateMessageHandler returns a function that can be used by the messaging
 // package to handle job status messages. The handler will set the planned
-// end date for an analysis if it's not already set.
-func CreateMessageHandler(dedb *sql.DB) func(context.Context, amqp.Delivery) {
+// end date for an analysis if it's not already set, and will clean up the
+// notification statuses for an analysis once it's finished.
+//
+// Messages are acked once they've been processed. Messages that fail for
+// reasons that might go away, such as database errors, are requeued until
+// they've been redelivered maxRedeliveries times. Messages that can never be
+// processed are dropped. The handler is shared by all of the update consumers,
+// which each handle their deliveries concurrently, so it's called concurrently.
+func CreateMessageHandler(dedb *sql.DB, vicedb *VICEDatabaser) func(context.Context, amqp.Delivery) {
+	failures := newFailedDeliveries()
+
 	return func(ctx context.Context, delivery amqp.Delivery) {
-		var err error
+		ctx, span := otel.Tracer(otelName).Start(deliveryContext(ctx, delivery), "handle status update")
+		defer span.End()
+
 		msgLog := log.WithFields(log.Fields{"context": "message handler"})
 
-		if err = delivery.Ack(false); err != nil {
-			msgLog.Error(err)
+		requeue, err := handleUpdate(ctx, dedb, vicedb, delivery, msgLog)
+		if err == nil {
+			failures.forget(delivery)
+			messageOutcomes.Add(outcomeAcked, 1)
+			if err = delivery.Ack(false); err != nil {
+				msgLog.Error(err)
+			}
+			return
 		}
 
-		update := &messaging.UpdateMessage{}
+		msgLog.Error(err)
 
-		if err = json.Unmarshal(delivery.Body, update); err != nil {
-			msgLog.Error(errors.Wrap(err, "error unmarshaling body of update message"))
-			return
+		if requeue {
+			count := deliveryCount(delivery)
+			if previous := failures.fail(delivery); previous > count {
+				count = previous
+			}
+			if count >= maxRedeliveries {
+				msgLog.Errorf("message has been delivered %d times, dropping it", count)
+				requeue = false
+			}
 		}
-
-		var externalID string
-		if update.Job.InvocationID == "" {
-			msgLog.Error("external ID was not provided as the invocation ID in the status update, ignoring update")
-			return
+		if !requeue {
+			failures.forget(delivery)
 		}
-		externalID = update.Job.InvocationID
-		msgLog = msgLog.WithFields(log.Fields{"externalID": externalID})
 
-		analysis, err := lookupByExternalID(ctx, dedb, externalID)
-		if err != nil {
-			msgLog.Error(errors.Wrapf(err, "error looking up analysis by external ID '%s'", externalID))
-			return
+		messageOutcomes.Add(outcomeNacked, 1)
+		if err = delivery.Nack(false, requeue); err != nil {
+			msgLog.Error(err)
 		}
-		msgLog = msgLog.WithFields(log.Fields{"ID": analysis.ID})
+	}
+}
 
-		analysisIsInteractive, err := isInteractive(ctx, dedb, analysis.ID)
-		if err != nil {
-			msgLog.Error(errors.Wrapf(err, "error looking up interactive status for analysis %s", analysis.ID))
-			return
-		}
+// handleUpdate does the work for a single status update message. If an error
+// is returned, the bool indicates whether the message should be requeued.
+func handleUpdate(ctx context.Context, dedb *sql.DB, vicedb *VICEDatabaser, delivery amqp.Delivery, msgLog *log.Entry) (bool, error) {
+	var err error
 
-		if !analysisIsInteractive {
-			msgLog.Infof("analysis %s is not interactive, so move along", analysis.ID)
-			return
-		}
+	update := &messaging.UpdateMessage{}
 
-		if update.State != "Running" {
-			msgLog.Infof("job status update for %s was %s, moving along", analysis.ID, update.State)
-			return
-		}
+	if err = json.Unmarshal(delivery.Body, update); err != nil {
+		messageOutcomes.Add(outcomeMalformed, 1)
+		return false, errors.Wrap(err, "error unmarshaling body of update message")
+	}
 
-		msgLog.Infof("job status update for %s was %s", analysis.ID, update.State)
+	var externalID string
+	if update.Job.InvocationID == "" {
+		messageOutcomes.Add(outcomeMalformed, 1)
+		return false, errors.New("external ID was not provided as the invocation ID in the status update, ignoring update")
+	}
+	externalID = update.Job.InvocationID
+	msgLog = msgLog.WithFields(log.Fields{"externalID": externalID})
 
-		// Set the subdomain
-		subdomain, err := EnsureSubdomain(ctx, dedb, analysis)
-		if err != nil {
-			msgLog.Error(errors.Wrap(err, "error ensuring subdomain for analysis"))
+	analysis, err := lookupByExternalID(ctx, dedb, externalID)
+	if err == sql.ErrNoRows {
+		messageOutcomes.Add(outcomeLookupFailed, 1)
+		return false, errors.Wrapf(err, "no analysis found for external ID '%s'", externalID)
+	}
+	if err != nil {
+		messageOutcomes.Add(outcomeLookupFailed, 1)
+		return true, errors.Wrapf(err, "error looking up analysis by external ID '%s'", externalID)
+	}
+	msgLog = msgLog.WithFields(log.Fields{"ID": analysis.ID})
+
+	if terminalStates[string(update.State)] {
+		messageOutcomes.Add(outcomeTerminal, 1)
+		msgLog.Infof("job status update for %s was %s, removing notification statuses", analysis.ID, update.State)
+		if err = vicedb.DeleteNotifRecord(ctx, analysis); err != nil {
+			return true, errors.Wrapf(err, "error deleting notification statuses for analysis %s", analysis.ID)
 		}
-		msgLog = msgLog.WithFields(log.Fields{"subdomain": subdomain})
+		return false, nil
+	}
 
-		err = EnsurePlannedEndDate(ctx, dedb, analysis)
-		if err != nil {
-			msgLog.Error(errors.Wrap(err, "error ensuring planned end date for analysis"))
+	// The lookup query already says whether the analysis is interactive, so
+	// the separate query is only needed if it didn't.
+	analysisIsInteractive := analysis.Interactive
+	if !analysis.interactiveKnown {
+		if analysisIsInteractive, err = isInteractive(ctx, dedb, analysis.ID); err != nil {
+			messageOutcomes.Add(outcomeLookupFailed, 1)
+			return true, errors.Wrapf(err, "error looking up interactive status for analysis %s", analysis.ID)
 		}
 	}
+
+	if !analysisIsInteractive {
+		messageOutcomes.Add(outcomeSkippedNonInteractive, 1)
+		msgLog.Infof("analysis %s is not interactive, so move along", analysis.ID)
+		return false, nil
+	}
+
+	if update.State != "Running" {
+		messageOutcomes.Add(outcomeSkippedNonRunning, 1)
+		msgLog.Infof("job status update for %s was %s, moving along", analysis.ID, update.State)
+		return false, nil
+	}
+
+	msgLog.Infof("job status update for %s was %s", analysis.ID, update.State)
+
+	// Both of these leave alone anything that's already set, so the message
+	// is requeued if either fails to let a redelivery finish setting up the
+	// analysis.
+	subdomain, err := EnsureSubdomain(ctx, dedb, analysis)
+	if err != nil {
+		messageOutcomes.Add(outcomeSetupFailed, 1)
+		return true, errors.Wrapf(err, "error ensuring subdomain for analysis %s", analysis.ID)
+	}
+	msgLog = msgLog.WithFields(log.Fields{"subdomain": subdomain})
+
+	if err = EnsurePlannedEndDate(ctx, dedb, analysis); err != nil {
+		messageOutcomes.Add(outcomeSetupFailed, 1)
+		return true, errors.Wrapf(err, "error ensuring planned end date for analysis %s", analysis.ID)
+	}
+
+	messageOutcomes.Add(outcomeProcessed, 1)
+	return false, nil
 }
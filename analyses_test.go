@@ -0,0 +1,1263 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestParseDBTimestamp(t *testing.T) {
+	if err := TimezoneInit("America/Phoenix"); err != nil {
+		t.Fatal(err)
+	}
+	defer TimezoneInit("UTC")
+
+	actual, err := parseDBTimestamp("2024-01-01T10:00:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := time.Date(2024, 1, 1, 17, 0, 0, 0, time.UTC)
+	if !actual.Equal(expected) {
+		t.Errorf("parsed time was %s, not %s", actual, expected)
+	}
+}
+
+func TestPlannedEndDateIgnoresHostTZ(t *testing.T) {
+	if err := TimezoneInit("America/Phoenix"); err != nil {
+		t.Fatal(err)
+	}
+	defer TimezoneInit("UTC")
+
+	origLocal := time.Local
+	defer func() { time.Local = origLocal }()
+
+	expected := "2024-01-04 10:00:00.000000-07"
+
+	for _, hostTZ := range []string{"UTC", "America/New_York", "Asia/Tokyo", "Australia/Adelaide"} {
+		loc, err := time.LoadLocation(hostTZ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Local = loc
+
+		startDate, err := parseDBTimestamp("2024-01-01T10:00:00")
+		if err != nil {
+			t.Fatal(err)
+		}
+		endMillis := startDate.Add(259200 * time.Second).UnixMilli()
+
+		actual := formatDBTimestamp(time.UnixMilli(endMillis))
+		if actual != expected {
+			t.Errorf("planned end date with host TZ %s was %s, not %s", hostTZ, actual, expected)
+		}
+	}
+}
+
+func TestGetJobDuration(t *testing.T) {
+	defer ClockInit(realClock{})
+
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	ClockInit(newFakeClock(now))
+
+	tests := []struct {
+		name     string
+		start    time.Time
+		expected string
+	}{
+		{"zero", now, "0:00"},
+		{"rounded", now.Add(-(90*time.Minute + 29*time.Second)), "1:30"},
+		{"future", now.Add(5 * time.Minute), "0:00"},
+		{"very large", now.Add(-(250*time.Hour + 7*time.Minute)), "250:07"},
+	}
+
+	for _, test := range tests {
+		j := &Job{StartDate: test.start.Format(TimestampFromDBFormat)}
+		actual, err := getJobDuration(j)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("%s: duration was %s, not %s", test.name, actual, test.expected)
+		}
+	}
+
+	if _, err := getJobDuration(&Job{StartDate: "not a date"}); err == nil {
+		t.Error("error was nil for an unparseable start date")
+	}
+}
+
+func TestTimezoneInitInvalid(t *testing.T) {
+	if err := TimezoneInit("Not/AZone"); err == nil {
+		t.Error("error was nil")
+	}
+	if TimestampLocation != time.UTC {
+		t.Errorf("timezone was %s, not UTC", TimestampLocation)
+	}
+}
+
+func TestSumTimeLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   []int64
+		expected int64
+	}{
+		{"explicit limits", []int64{3600, 7200}, 10800},
+		{"zero limits", []int64{0, 0}, 518400},
+		{"mixed limits", []int64{3600, 0}, 262800},
+		{"unlimited tool", []int64{3600, NoTimeLimit, 0}, NoTimeLimit},
+	}
+	for _, test := range tests {
+		actual := sumTimeLimits(test.limits, 259200)
+		if actual != test.expected {
+			t.Errorf("%s: time limit was %d, not %d", test.name, actual, test.expected)
+		}
+	}
+}
+
+var jobByExternalIDColumns = []string{
+	"id", "app_id", "user_id", "status", "job_description", "job_name", "result_folder_path",
+	"planned_end_date", "subdomain", "start_date", "system_id", "username",
+	"notify_periodic", "periodic_period", "external_id", "interactive",
+}
+
+func jobByExternalIDRow(status string) []driver.Value {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	return []driver.Value{
+		"job-id", "app-id", "user-id", status, "", "job-name", "/iplant/home/user/analyses",
+		start.Add(time.Hour), "a1234abcd", start, "interactive", "user@example.com",
+		true, int64(0), "external-id", true,
+	}
+}
+
+func TestMessageHandlerNotifRecords(t *testing.T) {
+	tests := []struct {
+		state   string
+		deleted bool
+	}{
+		{"Running", false},
+		{"Completed", true},
+		{"Failed", true},
+		{"Canceled", true},
+	}
+
+	for _, test := range tests {
+		db, f := newFakeDB(t)
+		f.on("where job_steps.external_id = $1", jobByExternalIDColumns, jobByExternalIDRow(test.state))
+		f.on("SELECT t.name", []string{"name"}, []driver.Value{"Interactive"})
+
+		handler := CreateMessageHandler(db, &VICEDatabaser{db: db})
+		handler(context.Background(), amqp.Delivery{
+			Body: []byte(fmt.Sprintf(`{"Job": {"uuid": "external-id"}, "State": "%s"}`, test.state)),
+		})
+
+		deleted := f.ran("delete from notif_statuses") > 0
+		if deleted != test.deleted {
+			t.Errorf("%s: notif_statuses record deleted was %t, not %t", test.state, deleted, test.deleted)
+		}
+	}
+}
+
+func TestMessageHandlerInteractiveFlag(t *testing.T) {
+	skipped := func() int64 {
+		if v, ok := messageOutcomes.Get(outcomeSkippedNonInteractive).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+
+	for _, interactive := range []bool{true, false} {
+		db, f := newFakeDB(t)
+		row := jobByExternalIDRow("Running")
+		row[len(row)-1] = interactive
+		f.on("where job_steps.external_id = $1", jobByExternalIDColumns, row)
+
+		// The step type query disagrees with the flag, so the outcome shows
+		// which of them the handler went with.
+		stepType := "Interactive"
+		if interactive {
+			stepType = "Executable"
+		}
+		f.on("SELECT t.name", []string{"name"}, []driver.Value{stepType})
+
+		before := skipped()
+		handler := CreateMessageHandler(db, &VICEDatabaser{db: db})
+		handler(context.Background(), amqp.Delivery{
+			Body: []byte(`{"Job": {"uuid": "external-id"}, "State": "Running"}`),
+		})
+
+		if n := f.ran("SELECT t.name"); n != 0 {
+			t.Errorf("interactive %t: step type query ran %d times", interactive, n)
+		}
+		if wasSkipped := skipped() > before; wasSkipped == interactive {
+			t.Errorf("interactive %t: skipped as non-interactive was %t", interactive, wasSkipped)
+		}
+	}
+}
+
+// fakeAcknowledger records how a delivery was acknowledged.
+type fakeAcknowledger struct {
+	acked    bool
+	nacked   bool
+	requeued bool
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacked = true
+	a.requeued = requeue
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestMessageHandlerAcks(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		headers  amqp.Table
+		dbErr    error
+		acked    bool
+		requeued bool
+	}{
+		{"processed", `{"Job": {"uuid": "external-id"}, "State": "Running"}`, nil, nil, true, false},
+		{"malformed body", `{"Job": `, nil, nil, false, false},
+		{"missing invocation ID", `{"Job": {"uuid": ""}, "State": "Running"}`, nil, nil, false, false},
+		{"transient DB error", `{"Job": {"uuid": "external-id"}, "State": "Running"}`, nil, errors.New("connection refused"), false, true},
+		{"redelivered too often", `{"Job": {"uuid": "external-id"}, "State": "Running"}`, amqp.Table{"x-delivery-count": int64(maxRedeliveries)}, errors.New("connection refused"), false, false},
+	}
+
+	for _, test := range tests {
+		db, f := newFakeDB(t)
+		if test.dbErr != nil {
+			f.onError("where job_steps.external_id = $1", test.dbErr)
+		}
+		f.on("where job_steps.external_id = $1", jobByExternalIDColumns, jobByExternalIDRow("Running"))
+		f.on("SELECT t.name", []string{"name"}, []driver.Value{"Interactive"})
+
+		ack := &fakeAcknowledger{}
+		handler := CreateMessageHandler(db, &VICEDatabaser{db: db})
+		handler(context.Background(), amqp.Delivery{
+			Acknowledger: ack,
+			Headers:      test.headers,
+			Body:         []byte(test.body),
+		})
+
+		if ack.acked != test.acked {
+			t.Errorf("%s: acked was %t, not %t", test.name, ack.acked, test.acked)
+		}
+		if ack.nacked == test.acked {
+			t.Errorf("%s: nacked was %t, not %t", test.name, ack.nacked, !test.acked)
+		}
+		if ack.requeued != test.requeued {
+			t.Errorf("%s: requeued was %t, not %t", test.name, ack.requeued, test.requeued)
+		}
+	}
+}
+
+func TestMessageHandlerRedeliveriesWithoutHeader(t *testing.T) {
+	db, f := newFakeDB(t)
+	f.onError("where job_steps.external_id = $1", errors.New("connection refused"))
+
+	// Classic queues don't set x-delivery-count, so the handler has to count
+	// the deliveries itself.
+	handler := CreateMessageHandler(db, &VICEDatabaser{db: db})
+	for i := 0; i <= maxRedeliveries; i++ {
+		ack := &fakeAcknowledger{}
+		handler(context.Background(), amqp.Delivery{
+			Acknowledger: ack,
+			Redelivered:  i > 0,
+			Body:         []byte(`{"Job": {"uuid": "external-id"}, "State": "Running"}`),
+		})
+
+		if expected := i < maxRedeliveries; ack.requeued != expected {
+			t.Errorf("delivery %d: requeued was %t, not %t", i+1, ack.requeued, expected)
+		}
+	}
+
+	// A different message is counted separately.
+	ack := &fakeAcknowledger{}
+	handler(context.Background(), amqp.Delivery{
+		Acknowledger: ack,
+		Body:         []byte(`{"Job": {"uuid": "other-external-id"}, "State": "Running"}`),
+	})
+	if !ack.requeued {
+		t.Error("a different message wasn't requeued")
+	}
+}
+
+func TestMessageHandlerSetupFailures(t *testing.T) {
+	dbErr := errors.New("connection refused")
+
+	tests := []struct {
+		name      string
+		column    int
+		failing   string
+		redeliver int64
+		requeued  bool
+	}{
+		{"subdomain", 8, "SELECT user_id", 0, true},
+		{"planned end date", 7, "FROM tools", 0, true},
+		{"subdomain redelivered too often", 8, "SELECT user_id", int64(maxRedeliveries), false},
+		{"planned end date redelivered too often", 7, "FROM tools", int64(maxRedeliveries), false},
+	}
+
+	for _, test := range tests {
+		// Clearing the column makes the handler try to set it.
+		row := jobByExternalIDRow("Running")
+		row[test.column] = ""
+
+		db, f := newFakeDB(t)
+		f.on("where job_steps.external_id = $1", jobByExternalIDColumns, row)
+		f.on("SELECT t.name", []string{"name"}, []driver.Value{"Interactive"})
+		f.onError(test.failing, dbErr)
+
+		before := messageOutcome(outcomeSetupFailed)
+
+		ack := &fakeAcknowledger{}
+		handler := CreateMessageHandler(db, &VICEDatabaser{db: db})
+		handler(context.Background(), amqp.Delivery{
+			Acknowledger: ack,
+			Headers:      amqp.Table{"x-delivery-count": test.redeliver},
+			Body:         []byte(`{"Job": {"uuid": "external-id"}, "State": "Running"}`),
+		})
+
+		if ack.acked || !ack.nacked {
+			t.Errorf("%s: acked was %t and nacked was %t", test.name, ack.acked, ack.nacked)
+		}
+		if ack.requeued != test.requeued {
+			t.Errorf("%s: requeued was %t, not %t", test.name, ack.requeued, test.requeued)
+		}
+		if actual := messageOutcome(outcomeSetupFailed); actual != before+1 {
+			t.Errorf("%s: %s count was %d, not %d", test.name, outcomeSetupFailed, actual, before+1)
+		}
+	}
+}
+
+// messageOutcome returns the current count for the message handler outcome.
+func messageOutcome(key string) int64 {
+	if v, ok := messageOutcomes.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestMessageHandlerOutcomes(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		outcome string
+		acked   bool
+	}{
+		{"malformed body", `{"Job": `, outcomeMalformed, false},
+		{"missing invocation ID", `{"Job": {"uuid": ""}, "State": "Running"}`, outcomeMalformed, false},
+		{"not running", `{"Job": {"uuid": "external-id"}, "State": "Submitted"}`, outcomeSkippedNonRunning, true},
+		{"processed", `{"Job": {"uuid": "external-id"}, "State": "Running"}`, outcomeProcessed, true},
+	}
+
+	for _, test := range tests {
+		db, f := newFakeDB(t)
+		f.on("where job_steps.external_id = $1", jobByExternalIDColumns, jobByExternalIDRow("Running"))
+		f.on("SELECT t.name", []string{"name"}, []driver.Value{"Interactive"})
+
+		ackKey := outcomeNacked
+		if test.acked {
+			ackKey = outcomeAcked
+		}
+		before, ackBefore := messageOutcome(test.outcome), messageOutcome(ackKey)
+
+		handler := CreateMessageHandler(db, &VICEDatabaser{db: db})
+		handler(context.Background(), amqp.Delivery{
+			Acknowledger: &fakeAcknowledger{},
+			Body:         []byte(test.body),
+		})
+
+		if actual := messageOutcome(test.outcome); actual != before+1 {
+			t.Errorf("%s: %s count was %d, not %d", test.name, test.outcome, actual, before+1)
+		}
+		if actual := messageOutcome(ackKey); actual != ackBefore+1 {
+			t.Errorf("%s: %s count was %d, not %d", test.name, ackKey, actual, ackBefore+1)
+		}
+	}
+}
+
+func TestKillCutoff(t *testing.T) {
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	grace := 5 * time.Minute
+	cutoff := killCutoff(now, grace)
+
+	// The kill query selects jobs with planned_end_date <= cutoff.
+	insideGrace := now.Add(-grace).Add(time.Second)
+	if !insideGrace.After(cutoff) {
+		t.Errorf("job ending at %s would be killed within the grace period", insideGrace)
+	}
+
+	outsideGrace := now.Add(-grace).Add(-time.Second)
+	if outsideGrace.After(cutoff) {
+		t.Errorf("job ending at %s would not be killed after the grace period", outsideGrace)
+	}
+
+	if !killCutoff(now, 0).Equal(now) {
+		t.Errorf("cutoff with no grace period was %s, not %s", killCutoff(now, 0), now)
+	}
+}
+
+func TestJobsToKillGracePeriod(t *testing.T) {
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, TimestampLocation)
+	ClockInit(newFakeClock(now))
+	defer ClockInit(realClock{})
+
+	db, f := newFakeDB(t)
+
+	if _, err := JobsToKill(context.Background(), db, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	args := f.argsFor("jobs.planned_end_date <= $2")
+	if len(args) != 4 {
+		t.Fatalf("number of query args was %d, not 4", len(args))
+	}
+	cutoff, err := time.Parse(TimestampToDBFormat, args[1].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := now.Add(-time.Hour); !cutoff.Equal(expected) {
+		t.Errorf("cutoff was %s, not %s", cutoff, expected)
+	}
+}
+
+// onClaimExtension has the fake database count the extensions of a job that
+// has already been extended count times, up to the limit it's given.
+func onClaimExtension(f *fakeDB, count int64) {
+	var mu sync.Mutex
+	f.onFunc("set extension_count = extension_count + 1", []string{"extension_count"}, func(args []driver.Value) [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		if count >= args[1].(int64) {
+			return nil
+		}
+		count++
+		return [][]driver.Value{{count}}
+	})
+}
+
+func TestExtendPlannedEndDate(t *testing.T) {
+	tests := []struct {
+		name     string
+		count    int64
+		extended bool
+	}{
+		{"cap not reached", 2, true},
+		{"cap reached", 3, false},
+	}
+
+	for _, test := range tests {
+		db, f := newFakeDB(t)
+		onClaimExtension(f, test.count)
+
+		job := &Job{ID: "job-id", PlannedEndDate: "2024-01-01T12:00:00"}
+		endDate, err := ExtendPlannedEndDate(context.Background(), db, &VICEDatabaser{db: db}, job, 2*time.Hour)
+
+		if !test.extended {
+			if err != ErrExtensionLimitReached {
+				t.Errorf("%s: err was %v, not ErrExtensionLimitReached", test.name, err)
+			}
+			if f.ran("update only jobs set planned_end_date") != 0 {
+				t.Errorf("%s: planned end date was updated", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !endDate.Equal(time.Date(2024, 1, 1, 14, 0, 0, 0, time.UTC)) {
+			t.Errorf("%s: new end date was %s", test.name, endDate)
+		}
+		if job.PlannedEndDate != "2024-01-01T14:00:00" {
+			t.Errorf("%s: job planned end date was %s", test.name, job.PlannedEndDate)
+		}
+		if args := f.argsFor("set extension_count = extension_count + 1"); len(args) != 2 || args[1] != int64(MaxExtensions) {
+			t.Errorf("%s: extension count args were %v", test.name, args)
+		}
+	}
+}
+
+func TestExtendPlannedEndDateReleasesExtension(t *testing.T) {
+	db, f := newFakeDB(t)
+	onClaimExtension(f, 0)
+	f.onError("update only jobs set planned_end_date", errors.New("connection refused"))
+
+	job := &Job{ID: "job-id", PlannedEndDate: "2024-01-01T12:00:00"}
+	if _, err := ExtendPlannedEndDate(context.Background(), db, &VICEDatabaser{db: db}, job, 2*time.Hour); err == nil {
+		t.Fatal("error was nil")
+	}
+
+	if f.ran("set extension_count = extension_count - 1") != 1 {
+		t.Error("the extension wasn't given back")
+	}
+	if job.PlannedEndDate != "2024-01-01T12:00:00" {
+		t.Errorf("job planned end date was %s", job.PlannedEndDate)
+	}
+}
+
+func TestExtendPlannedEndDateResetsWarnings(t *testing.T) {
+	tests := []struct {
+		name   string
+		d      time.Duration
+		resets int
+	}{
+		{"later", 2 * time.Hour, 1},
+		{"earlier", -2 * time.Hour, 0},
+	}
+
+	for _, test := range tests {
+		db, f := newFakeDB(t)
+		onClaimExtension(f, 0)
+
+		job := &Job{ID: "job-id", PlannedEndDate: "2024-01-01T12:00:00"}
+		if _, err := ExtendPlannedEndDate(context.Background(), db, &VICEDatabaser{db: db}, job, test.d); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if actual := f.ran("set hour_warning_sent = false"); actual != test.resets {
+			t.Errorf("%s: warnings were reset %d times, not %d", test.name, actual, test.resets)
+		}
+		if actual := f.ran("delete from pending_notifications"); actual != test.resets {
+			t.Errorf("%s: queued warnings were deleted %d times, not %d", test.name, actual, test.resets)
+		}
+	}
+}
+
+func TestKillJobErrors(t *testing.T) {
+	defer fastRetries()()
+
+	tests := []struct {
+		status int
+		kind   error
+		reason string
+	}{
+		{http.StatusOK, nil, ""},
+		{http.StatusNotFound, ErrKillNotFound, "not_found"},
+		{http.StatusBadRequest, ErrKillUpstream, "upstream"},
+		{http.StatusForbidden, ErrKillUpstream, "upstream"},
+		{http.StatusTooManyRequests, ErrKillTransient, "transient"},
+		{http.StatusInternalServerError, ErrKillTransient, "transient"},
+		{http.StatusServiceUnavailable, ErrKillTransient, "transient"},
+	}
+
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+		}))
+
+		job := &Job{ID: "job-id", ExternalID: "external-id", User: "user@example.org"}
+		for _, k8s := range []bool{true, false} {
+			killer := &JobKiller{K8sEnabled: k8s, AppsBase: srv.URL, AppExposerBase: srv.URL}
+			err := killer.KillJob(context.Background(), nil, job)
+
+			if test.kind == nil {
+				if err != nil {
+					t.Errorf("status %d, k8s %t: unexpected error %s", test.status, k8s, err)
+				}
+				continue
+			}
+			if !errors.Is(err, test.kind) {
+				t.Errorf("status %d, k8s %t: error %v is not %v", test.status, k8s, err, test.kind)
+			}
+			if reason := KillFailureReason(err); reason != test.reason {
+				t.Errorf("status %d, k8s %t: reason was %s, not %s", test.status, k8s, reason, test.reason)
+			}
+		}
+
+		srv.Close()
+	}
+
+	// Network errors are transient.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	killer := &JobKiller{K8sEnabled: true, AppExposerBase: srv.URL}
+	if err := killer.KillJob(context.Background(), nil, &Job{ExternalID: "external-id"}); !errors.Is(err, ErrKillTransient) {
+		t.Errorf("error %v for an unreachable endpoint is not transient", err)
+	}
+}
+
+func TestBatchJobsToKill(t *testing.T) {
+	db, f := newFakeDB(t)
+	f.on("not exists (", jobColumns, jobRow(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)))
+	f.on("select job_steps.external_id", []string{"external_id"}, []driver.Value{"external-id"})
+
+	defer BatchLimitsInit(BatchLimitsEnabled, BatchTimeLimitSeconds)
+	BatchLimitsInit(true, 3600)
+
+	before := time.Now()
+	jobs, err := BatchJobsToKill(context.Background(), db, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].ExternalID != "external-id" {
+		t.Errorf("unexpected jobs %+v", jobs)
+	}
+
+	args := f.argsFor("not exists (")
+	if len(args) != 3 {
+		t.Fatalf("number of query args was %d, not 3", len(args))
+	}
+	if args[0] != "Running" {
+		t.Errorf("status was %v, not Running", args[0])
+	}
+	cutoff, err := time.Parse(TimestampToDBFormat, args[1].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delta := before.Add(-time.Hour).Sub(cutoff); delta > time.Second || delta < -time.Second {
+		t.Errorf("cutoff was %s, not about an hour before %s", cutoff, before)
+	}
+	if args[2] != "3600 seconds" {
+		t.Errorf("time limit was %v, not 3600 seconds", args[2])
+	}
+}
+
+func TestKillSelectionsDontOverlap(t *testing.T) {
+	// Interactive jobs have an interactive step and batch jobs don't, so a job
+	// can only be selected by one of the queries.
+	if !strings.Contains(interactiveJobsToKillQuery, "and exists ("+interactiveStepQuery+")") {
+		t.Error("interactiveJobsToKillQuery doesn't require an interactive step")
+	}
+	if !strings.Contains(batchJobsToKillQuery, "and not exists ("+interactiveStepQuery+")") {
+		t.Error("batchJobsToKillQuery doesn't exclude jobs with an interactive step")
+	}
+}
+
+func TestJobsToKillBatchLimits(t *testing.T) {
+	defer BatchLimitsInit(BatchLimitsEnabled, BatchTimeLimitSeconds)
+
+	tests := []struct {
+		name        string
+		enabled     bool
+		interactive bool
+	}{
+		{"batch limits disabled", false, false},
+		{"batch limits enabled", true, true},
+	}
+
+	for _, test := range tests {
+		BatchLimitsInit(test.enabled, 3600)
+
+		// Without batch limits, batch jobs that pass their planned end dates
+		// are killed along with the interactive ones.
+		db, f := newFakeDB(t)
+		f.on("jobs.planned_end_date <= $2", jobColumns, jobRow(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)))
+		f.on("select job_steps.external_id", []string{"external_id"}, []driver.Value{"external-id"})
+
+		jobs, err := JobsToKill(context.Background(), db, 0)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(jobs) != 1 {
+			t.Errorf("%s: %d jobs were listed, not 1", test.name, len(jobs))
+		}
+
+		if interactive := f.ran(interactiveStepQuery) > 0; interactive != test.interactive {
+			t.Errorf("%s: interactive steps were required: %t", test.name, interactive)
+		}
+	}
+}
+
+func TestEnsurePlannedEndDateNoTimeLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits []int64
+		set    bool
+	}{
+		{"limited", []int64{3600}, true},
+		{"unlimited", []int64{3600, NoTimeLimit}, false},
+	}
+
+	for _, test := range tests {
+		db, f := newFakeDB(t)
+		var rows [][]driver.Value
+		for _, limit := range test.limits {
+			rows = append(rows, []driver.Value{limit})
+		}
+		f.on("FROM tools", []string{"time_limit_seconds"}, rows...)
+		f.on("min(job_status_updates.sent_on)", []string{"min"}, []driver.Value{nil})
+
+		job := &Job{ID: "job-id", StartDate: "2024-01-01T10:00:00"}
+		if err := EnsurePlannedEndDate(context.Background(), db, job); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		set := f.ran("update only jobs set planned_end_date") > 0
+		if set != test.set {
+			t.Errorf("%s: planned end date set was %t, not %t", test.name, set, test.set)
+		}
+	}
+}
+
+func TestGetStatusHistory(t *testing.T) {
+	defer StatusHistoryInit(0)
+
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) int64 { return start.Add(d).UnixMilli() }
+
+	db, f := newFakeDB(t)
+	f.on("ORDER BY job_status_updates.sent_on", []string{"status", "sent_on"},
+		[]driver.Value{"Submitted", at(0)},
+		[]driver.Value{"Running", at(time.Minute)},
+		[]driver.Value{"Running", at(2 * time.Minute)},
+		[]driver.Value{"Submitted", at(time.Hour)},
+		[]driver.Value{"Running", at(time.Hour + time.Minute)},
+		[]driver.Value{"Running", at(2 * time.Hour)},
+	)
+
+	updates, err := getStatusHistory(context.Background(), db, "job-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 6 {
+		t.Fatalf("%d updates were returned, not 6", len(updates))
+	}
+	if updates[1].Status != "Running" || !updates[1].SentOn.Equal(start.Add(time.Minute)) {
+		t.Errorf("second update was %+v", updates[1])
+	}
+	if args := f.argsFor("ORDER BY job_status_updates.sent_on"); len(args) != 1 || args[0] != "job-id" {
+		t.Errorf("query args were %v", args)
+	}
+
+	// The restart shows up as the job going back to Submitted.
+	recent := recentTransitions(updates, 3)
+	expected := []StatusUpdate{
+		{"Running", start.Add(time.Minute)},
+		{"Submitted", start.Add(time.Hour)},
+		{"Running", start.Add(time.Hour + time.Minute)},
+	}
+	if len(recent) != len(expected) {
+		t.Fatalf("recent transitions were %+v", recent)
+	}
+	for i, e := range expected {
+		if recent[i].Status != e.Status || !recent[i].SentOn.Equal(e.SentOn) {
+			t.Errorf("transition %d was %+v, not %+v", i, recent[i], e)
+		}
+	}
+
+	if opts := statusHistoryOpts(context.Background(), db, &Job{ID: "job-id"}); opts != nil {
+		t.Error("status history was included while it's disabled")
+	}
+
+	StatusHistoryInit(2)
+	opts := statusHistoryOpts(context.Background(), db, &Job{ID: "job-id"})
+	p := NewPayload()
+	for _, opt := range opts {
+		opt(p)
+	}
+	if len(p.StatusHistory) != 2 || p.StatusHistory[0].Status != "Submitted" {
+		t.Errorf("payload status history was %+v", p.StatusHistory)
+	}
+}
+
+type traceparentKey struct{}
+
+// recordingPropagator stores the traceparent header it extracts in the context.
+type recordingPropagator struct{}
+
+func (recordingPropagator) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {}
+
+func (recordingPropagator) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	if tp := carrier.Get("traceparent"); tp != "" {
+		return context.WithValue(ctx, traceparentKey{}, tp)
+	}
+	return ctx
+}
+
+func (recordingPropagator) Fields() []string { return []string{"traceparent"} }
+
+func TestDeliveryContext(t *testing.T) {
+	orig := otel.GetTextMapPropagator()
+	defer otel.SetTextMapPropagator(orig)
+	otel.SetTextMapPropagator(recordingPropagator{})
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	tests := []struct {
+		name     string
+		headers  amqp.Table
+		expected interface{}
+	}{
+		{"string header", amqp.Table{"traceparent": traceparent}, traceparent},
+		{"byte header", amqp.Table{"traceparent": []byte(traceparent)}, traceparent},
+		{"no headers", nil, nil},
+	}
+
+	for _, test := range tests {
+		ctx := deliveryContext(context.Background(), amqp.Delivery{Headers: test.headers})
+		if actual := ctx.Value(traceparentKey{}); actual != test.expected {
+			t.Errorf("%s: extracted traceparent was %v, not %v", test.name, actual, test.expected)
+		}
+	}
+}
+
+func TestCapTimeLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		seconds  int64
+		max      int64
+		expected int64
+		clamped  bool
+	}{
+		{"below cap", 3600, 7200, 3600, false},
+		{"at cap", 7200, 7200, 7200, false},
+		{"above cap", 10800, 7200, 7200, true},
+		{"no cap", 10800, 0, 10800, false},
+	}
+
+	for _, test := range tests {
+		actual, clamped := capTimeLimit(test.seconds, test.max)
+		if actual != test.expected || clamped != test.clamped {
+			t.Errorf("%s: got %d (clamped %t), not %d (clamped %t)", test.name, actual, clamped, test.expected, test.clamped)
+		}
+	}
+}
+
+func TestEnsurePlannedEndDateInverted(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits []int64
+	}{
+		{"overflowed sum", []int64{math.MaxInt64, math.MaxInt64}},
+		{"overflowed duration", []int64{1 << 62}},
+	}
+
+	for _, test := range tests {
+		db, f := newFakeDB(t)
+		var rows [][]driver.Value
+		for _, limit := range test.limits {
+			rows = append(rows, []driver.Value{limit})
+		}
+		f.on("FROM tools", []string{"time_limit_seconds"}, rows...)
+		f.on("min(job_status_updates.sent_on)", []string{"min"}, []driver.Value{nil})
+
+		job := &Job{ID: "job-id", StartDate: "2024-01-01T10:00:00"}
+		if err := EnsurePlannedEndDate(context.Background(), db, job); err == nil {
+			t.Errorf("%s: no error was returned", test.name)
+		}
+		if f.ran("update only jobs set planned_end_date") > 0 {
+			t.Errorf("%s: planned end date was set", test.name)
+		}
+	}
+}
+
+func TestEnsurePlannedEndDateCapped(t *testing.T) {
+	defer TimeLimitsInit(DefaultTimeLimitSeconds, MinTimeLimitSeconds, MaxTimeLimitSeconds)
+	TimeLimitsInit(259200, 0, 7200)
+
+	db, f := newFakeDB(t)
+	f.on("FROM tools", []string{"time_limit_seconds"}, []driver.Value{int64(7200)}, []driver.Value{int64(3600)})
+	f.on("min(job_status_updates.sent_on)", []string{"min"}, []driver.Value{nil})
+
+	job := &Job{ID: "job-id", StartDate: "2024-01-01T10:00:00"}
+	if err := EnsurePlannedEndDate(context.Background(), db, job); err != nil {
+		t.Fatal(err)
+	}
+
+	args := f.argsFor("update only jobs set planned_end_date")
+	if len(args) != 2 {
+		t.Fatalf("planned end date args were %v", args)
+	}
+	if expected := "2024-01-01 12:00:00.000000+00"; args[0] != expected {
+		t.Errorf("planned end date was %v, not %s", args[0], expected)
+	}
+}
+
+func TestEnsurePlannedEndDateFloor(t *testing.T) {
+	defer TimeLimitsInit(DefaultTimeLimitSeconds, MinTimeLimitSeconds, MaxTimeLimitSeconds)
+	TimeLimitsInit(259200, 3600, 0)
+
+	tests := []struct {
+		name     string
+		limit    int64
+		expected string
+	}{
+		{"below floor", 60, "2024-01-01 11:00:00.000000+00"},
+		{"above floor", 7200, "2024-01-01 12:00:00.000000+00"},
+	}
+
+	for _, test := range tests {
+		db, f := newFakeDB(t)
+		f.on("FROM tools", []string{"time_limit_seconds"}, []driver.Value{test.limit})
+		f.on("min(job_status_updates.sent_on)", []string{"min"}, []driver.Value{nil})
+
+		job := &Job{ID: "job-id", StartDate: "2024-01-01T10:00:00"}
+		if err := EnsurePlannedEndDate(context.Background(), db, job); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		args := f.argsFor("update only jobs set planned_end_date")
+		if len(args) != 2 {
+			t.Errorf("%s: planned end date args were %v", test.name, args)
+			continue
+		}
+		if args[0] != test.expected {
+			t.Errorf("%s: planned end date was %v, not %s", test.name, args[0], test.expected)
+		}
+	}
+}
+
+func TestGenerateSubdomain(t *testing.T) {
+	defer SubdomainInit(SubdomainPrefix, SubdomainLength)
+
+	// The default has to match what was always generated, or running
+	// analyses would end up with different subdomains.
+	expected := fmt.Sprintf("a%x", sha256.Sum256([]byte("user-idexternal-id")))[0:9]
+	if actual := generateSubdomain("user-id", "external-id"); actual != expected {
+		t.Errorf("default subdomain was %s, not %s", actual, expected)
+	}
+
+	tests := []struct {
+		prefix string
+		length int
+	}{
+		{"a", 9},
+		{"vice-", 20},
+		{"x", 63},
+	}
+
+	for _, test := range tests {
+		if err := SubdomainInit(test.prefix, test.length); err != nil {
+			t.Fatalf("%s/%d: %s", test.prefix, test.length, err)
+		}
+		for i := 0; i < 20; i++ {
+			actual := generateSubdomain("user-id", fmt.Sprintf("external-id-%d", i))
+			if !strings.HasPrefix(actual, test.prefix) {
+				t.Errorf("subdomain %s doesn't start with %s", actual, test.prefix)
+			}
+			if len(actual) != test.length {
+				t.Errorf("subdomain %s is %d characters long, not %d", actual, len(actual), test.length)
+			}
+			if !subdomainPattern.MatchString(actual) {
+				t.Errorf("subdomain %s isn't a valid DNS label", actual)
+			}
+		}
+	}
+}
+
+func TestSubdomainInitInvalid(t *testing.T) {
+	defer SubdomainInit(SubdomainPrefix, SubdomainLength)
+
+	tests := []struct {
+		name   string
+		prefix string
+		length int
+	}{
+		{"no room for the hash", "abc", 3},
+		{"longer than a DNS label", "a", 64},
+		{"longer than the hash", "a", 70},
+		{"uppercase prefix", "A", 9},
+		{"prefix starts with a digit", "1", 9},
+		{"prefix with a dot", "a.b", 9},
+	}
+
+	for _, test := range tests {
+		if err := SubdomainInit(test.prefix, test.length); err == nil {
+			t.Errorf("%s: error was nil", test.name)
+		}
+	}
+	if SubdomainPrefix != "a" || SubdomainLength != 9 {
+		t.Errorf("invalid settings were applied: %s, %d", SubdomainPrefix, SubdomainLength)
+	}
+}
+
+func TestEnsureSubdomainCollision(t *testing.T) {
+	taken := generateSubdomain("user-id", "external-id")
+
+	db, f := newFakeDB(t)
+	f.on("SELECT user_id", []string{"user_id"}, []driver.Value{"user-id"})
+	f.onFunc("select count(*) from jobs where subdomain", []string{"count"}, func(args []driver.Value) [][]driver.Value {
+		if args[0] == taken {
+			return [][]driver.Value{{int64(1)}}
+		}
+		return [][]driver.Value{{int64(0)}}
+	})
+
+	job := &Job{ID: "job-id", ExternalID: "external-id"}
+	subdomain, err := EnsureSubdomain(context.Background(), db, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subdomain == taken {
+		t.Errorf("subdomain %s is already in use", subdomain)
+	}
+	if expected := saltedSubdomain("user-id", "external-id", 1); subdomain != expected {
+		t.Errorf("subdomain was %s, not %s", subdomain, expected)
+	}
+	if args := f.argsFor("update only jobs set subdomain"); len(args) != 2 || args[0] != subdomain {
+		t.Errorf("subdomain update args were %v", args)
+	}
+}
+
+func TestEnsureSubdomainNoCollision(t *testing.T) {
+	db, f := newFakeDB(t)
+	f.on("SELECT user_id", []string{"user_id"}, []driver.Value{"user-id"})
+	f.on("select count(*) from jobs where subdomain", []string{"count"}, []driver.Value{int64(0)})
+
+	subdomain, err := EnsureSubdomain(context.Background(), db, &Job{ID: "job-id", ExternalID: "external-id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := generateSubdomain("user-id", "external-id"); subdomain != expected {
+		t.Errorf("subdomain was %s, not %s", subdomain, expected)
+	}
+}
+
+func TestJobsMissingEndDate(t *testing.T) {
+	db, f := newFakeDB(t)
+	f.on("jobs.planned_end_date is null", jobColumns, jobRow(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)))
+	f.on("select job_steps.external_id", []string{"external_id"}, []driver.Value{"external-id"})
+
+	jobs, err := JobsMissingEndDate(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != "job-id" {
+		t.Errorf("unexpected jobs %+v", jobs)
+	}
+	if args := f.argsFor("jobs.planned_end_date is null"); len(args) != 1 || args[0] != "Running" {
+		t.Errorf("query args were %v", args)
+	}
+	if !strings.Contains(missingEndDateQuery, "and exists ("+interactiveStepQuery+")") {
+		t.Error("missingEndDateQuery doesn't require an interactive step")
+	}
+}
+
+func TestSweepMissingEndDates(t *testing.T) {
+	db, f := newFakeDB(t)
+	row := jobRow(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC))
+	row[7] = nil // no planned end date
+	f.on("jobs.planned_end_date is null", jobColumns, row)
+	f.on("select job_steps.external_id", []string{"external_id"}, []driver.Value{"external-id"})
+	f.on("FROM tools", []string{"time_limit_seconds"}, []driver.Value{int64(3600)})
+	f.on("min(job_status_updates.sent_on)", []string{"min"}, []driver.Value{nil})
+
+	summary, err := SweepMissingEndDates(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (EndDateSweepSummary{Missing: 1, Ensured: 1}); summary != expected {
+		t.Errorf("summary was %+v, not %+v", summary, expected)
+	}
+	if args := f.argsFor("update only jobs set planned_end_date"); len(args) != 2 || args[1] != "job-id" {
+		t.Errorf("planned end date args were %v", args)
+	}
+}
+
+func TestCountRunningJobsByUser(t *testing.T) {
+	db, f := newFakeDB(t)
+	f.on("group by users.username", []string{"username", "count"},
+		[]driver.Value{"alice@example.com", int64(2)},
+		[]driver.Value{"bob@example.com", int64(1)},
+	)
+
+	counts, err := CountRunningJobsByUser(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int64{"alice@example.com": 2, "bob@example.com": 1}
+	if fmt.Sprint(counts) != fmt.Sprint(expected) {
+		t.Errorf("counts were %v, not %v", counts, expected)
+	}
+	if args := f.argsFor("group by users.username"); len(args) != 1 || args[0] != "Running" {
+		t.Errorf("query args were %v", args)
+	}
+	if !strings.Contains(runningJobsByUserQuery, "and exists ("+interactiveStepQuery+")") {
+		t.Error("runningJobsByUserQuery doesn't require an interactive step")
+	}
+}
+
+func TestAccessURL(t *testing.T) {
+	defer AnalysesInit("")
+
+	tests := []struct {
+		name      string
+		base      string
+		subdomain string
+		jobType   string
+		expected  string
+	}{
+		{"interactive with subdomain", "https://cyverse.run", "a1234abcd", "interactive", "https://a1234abcd.cyverse.run"},
+		{"interactive with port", "https://cyverse.run:4343/", "a1234abcd", "interactive", "https://a1234abcd.cyverse.run:4343/"},
+		{"no subdomain", "https://cyverse.run", "", "interactive", ""},
+		{"not interactive", "https://cyverse.run", "a1234abcd", "de", ""},
+		{"no base", "", "a1234abcd", "interactive", ""},
+	}
+
+	for _, test := range tests {
+		AnalysesInit(test.base)
+		j := &Job{Subdomain: test.subdomain, Type: test.jobType}
+
+		actual, err := j.accessURL()
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("%s: access URL was %q, not %q", test.name, actual, test.expected)
+		}
+	}
+}
+
+func TestJobFilterAllows(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   *JobFilter
+		expected bool
+	}{
+		{"empty", NewJobFilter(nil, nil, nil, nil), true},
+		{"allowed system ID", NewJobFilter([]string{"interactive"}, nil, nil, nil), true},
+		{"unlisted system ID", NewJobFilter([]string{"de"}, nil, nil, nil), false},
+		{"denied system ID", NewJobFilter(nil, []string{"interactive"}, nil, nil), false},
+		{"allowed app ID", NewJobFilter(nil, nil, []string{"app-id"}, nil), true},
+		{"unlisted app ID", NewJobFilter(nil, nil, []string{"other-app-id"}, nil), false},
+		{"denied app ID", NewJobFilter(nil, nil, nil, []string{"app-id"}), false},
+		{"allowed and denied app ID", NewJobFilter(nil, nil, []string{"app-id"}, []string{"app-id"}), false},
+		{"allowed system ID and denied app ID", NewJobFilter([]string{"interactive"}, nil, nil, []string{"app-id"}), false},
+	}
+
+	j := &Job{AppID: "app-id", Type: "interactive"}
+	for _, test := range tests {
+		if actual := test.filter.Allows(j); actual != test.expected {
+			t.Errorf("%s: allows was %t, not %t", test.name, actual, test.expected)
+		}
+	}
+}
+
+func TestJobsToKillDeniedAppID(t *testing.T) {
+	defer KillFilterInit(NewJobFilter(nil, nil, nil, nil))
+
+	for _, denied := range []bool{false, true} {
+		if denied {
+			KillFilterInit(NewJobFilter(nil, nil, nil, []string{"app-id"}))
+		} else {
+			KillFilterInit(NewJobFilter(nil, nil, nil, []string{"other-app-id"}))
+		}
+
+		db, f := newFakeDB(t)
+		f.on("and jobs.planned_end_date <= $2", jobColumns, jobRow(time.Now().Add(-48*time.Hour)))
+		f.on("select job_steps.external_id", []string{"external_id"}, []driver.Value{"external-id"})
+
+		jobs, err := JobsToKill(context.Background(), db, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if denied && len(jobs) != 0 {
+			t.Errorf("jobs with a denied app ID were selected: %+v", jobs)
+		}
+		if !denied && len(jobs) != 1 {
+			t.Errorf("number of jobs was %d, not 1", len(jobs))
+		}
+	}
+}
+
+func TestJobsToKillPagination(t *testing.T) {
+	defer func(size int) { jobPageSize = size }(jobPageSize)
+	jobPageSize = 2
+
+	ids := []string{"job-1", "job-2", "job-3", "job-4", "job-5"}
+
+	db, f := newFakeDB(t)
+	f.onFunc("jobs.planned_end_date <= $2", jobColumns, func(args []driver.Value) [][]driver.Value {
+		after, limit := args[2].(string), args[3].(int64)
+
+		var rows [][]driver.Value
+		for _, id := range ids {
+			if id > after && int64(len(rows)) < limit {
+				row := jobRow(time.Now().Add(-48 * time.Hour))
+				row[0] = id
+				rows = append(rows, row)
+			}
+		}
+		return rows
+	})
+	f.on("select job_steps.external_id", []string{"external_id"}, []driver.Value{"external-id"})
+
+	jobs, err := JobsToKill(context.Background(), db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actual []string
+	for _, j := range jobs {
+		actual = append(actual, j.ID)
+	}
+	if fmt.Sprint(actual) != fmt.Sprint(ids) {
+		t.Errorf("jobs were %v, not %v", actual, ids)
+	}
+	if pages := f.ran("jobs.planned_end_date <= $2"); pages != 3 {
+		t.Errorf("%d pages were queried, not 3", pages)
+	}
+}
+
+func TestAppsStopURL(t *testing.T) {
+	tests := []struct {
+		base     string
+		username string
+		expected string
+	}{
+		{"http://apps", "test-user@example.com", "http://apps/analyses/job-id/stop?user=test-user"},
+		{"http://apps/", "test-user", "http://apps/analyses/job-id/stop?user=test-user"},
+		{"http://apps/prefix", "test@user@example.com", "http://apps/prefix/analyses/job-id/stop?user=test%40user"},
+	}
+
+	for _, test := range tests {
+		actual, err := appsStopURL(test.base, "job-id", test.username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual.String() != test.expected {
+			t.Errorf("URL was %s, not %s", actual, test.expected)
+		}
+	}
+}
+
+func TestKillBatchJobAppsService(t *testing.T) {
+	var requested string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method was %s, not POST", r.Method)
+		}
+		requested = r.URL.String()
+	}))
+	defer srv.Close()
+
+	killer := &JobKiller{K8sEnabled: true, AppsBase: srv.URL, AppExposerBase: "http://app-exposer"}
+	if err := killer.KillBatchJob(context.Background(), nil, &Job{ID: "job-id", User: "test-user@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "/analyses/job-id/stop?user=test-user"; requested != expected {
+		t.Errorf("request was for %s, not %s", requested, expected)
+	}
+}
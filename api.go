@@ -0,0 +1,911 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// minPeriodicWarningPeriod is the shortest period users can set between
+// periodic notifications.
+const minPeriodicWarningPeriod = 30 * time.Minute
+
+// API contains the handlers for the HTTP endpoints that timelord serves
+// alongside expvar.
+type API struct {
+	db              *sql.DB
+	vicedb          *VICEDatabaser
+	warningInterval int64 // The default number of minutes to look ahead for upcoming kills.
+	jobKiller       *JobKiller
+	config          map[string]interface{} // The effective configuration, with secrets redacted.
+	elector         *LeaderElector         // Nil unless leader election is enabled.
+	staleAfter      time.Duration          // How long the job killer loop can go without finishing an iteration. Zero disables the check.
+	consumer        *UpdateConsumer        // The status update consumer. Nil in tests that don't need it.
+}
+
+// RegisterHandlers adds the API's handlers to the provided mux.
+func (a *API) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/analyses/", a.analysesHandler)
+	mux.HandleFunc("/admin/", a.adminHandler)
+	mux.HandleFunc("/debug/jobs", a.debugJobsHandler)
+	mux.HandleFunc("/debug/config", a.debugConfigHandler)
+	mux.HandleFunc("/debug/analyses/by-external-id/", a.debugJobByExternalIDHandler)
+	mux.HandleFunc("/healthz", a.healthzHandler)
+	mux.HandleFunc("/readyz", a.readyzHandler)
+}
+
+// pathSegments splits a URL path into its non-empty segments.
+func pathSegments(path string) []string {
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+// writeJSON writes v to the response as JSON with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(errors.Wrap(err, "error encoding response body"))
+	}
+}
+
+// writeError writes an error message to the response as JSON with the given
+// status code.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// requireMethod writes a 405 response and returns false if the request doesn't
+// use the given method.
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	return true
+}
+
+// loadJob looks up the analysis with the given ID, writing an error response
+// and returning nil if it can't be found.
+func (a *API) loadJob(ctx context.Context, w http.ResponseWriter, id string) *Job {
+	job, err := lookupByID(ctx, a.db, id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "analysis not found")
+		return nil
+	}
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error looking up analysis %s", id))
+		writeError(w, http.StatusInternalServerError, "error looking up analysis")
+		return nil
+	}
+	return job
+}
+
+// analysesHandler routes requests under /analyses/.
+func (a *API) analysesHandler(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(strings.TrimPrefix(r.URL.Path, "/analyses/"))
+
+	switch {
+	case len(segments) == 3 && segments[1] == "notifications" && segments[2] == "periodic":
+		a.setPeriodicEnabledHandler(w, r, segments[0])
+	case len(segments) == 4 && segments[1] == "notifications" && segments[2] == "periodic" && segments[3] == "period":
+		a.setPeriodicPeriodHandler(w, r, segments[0])
+	case len(segments) == 2 && segments[1] == "notif-status":
+		a.notifStatusHandler(w, r, segments[0])
+	case len(segments) == 3 && segments[1] == "subdomain" && segments[2] == "ensure":
+		a.ensureSubdomainHandler(w, r, segments[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// setPeriodicEnabledHandler turns the periodic notifications for an analysis
+// on or off. Handles POST /analyses/{id}/notifications/periodic with a body
+// like {"enabled": false}.
+func (a *API) setPeriodicEnabledHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "request body must be JSON")
+		return
+	}
+	if body.Enabled == nil {
+		writeError(w, http.StatusBadRequest, "enabled must be set")
+		return
+	}
+
+	ctx := r.Context()
+
+	job := a.loadJob(ctx, w, id)
+	if job == nil {
+		return
+	}
+
+	if err := a.vicedb.EnsureNotifRecord(ctx, job); err != nil {
+		log.Error(errors.Wrapf(err, "error ensuring notification statuses for analysis %s", id))
+		writeError(w, http.StatusInternalServerError, "error updating notification statuses")
+		return
+	}
+
+	if err := a.vicedb.SetPeriodicEnabled(ctx, job, *body.Enabled); err != nil {
+		log.Error(errors.Wrapf(err, "error setting periodic notifications for analysis %s", id))
+		writeError(w, http.StatusInternalServerError, "error updating notification statuses")
+		return
+	}
+
+	log.Infof("periodic notifications for analysis %s set to %t", id, *body.Enabled)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":      job.ID,
+		"enabled": *body.Enabled,
+	})
+}
+
+// setPeriodicPeriodHandler sets how often periodic notifications are sent for
+// an analysis. Handles POST /analyses/{id}/notifications/periodic/period with a
+// body like {"period": 3600}, where the period is in seconds.
+func (a *API) setPeriodicPeriodHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var body struct {
+		Period int64 `json:"period"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "request body must be JSON")
+		return
+	}
+
+	period := time.Duration(body.Period) * time.Second
+	if period < minPeriodicWarningPeriod {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("period must be at least %d seconds", int64(minPeriodicWarningPeriod.Seconds())))
+		return
+	}
+
+	ctx := r.Context()
+
+	job := a.loadJob(ctx, w, id)
+	if job == nil {
+		return
+	}
+
+	if err := a.vicedb.EnsureNotifRecord(ctx, job); err != nil {
+		log.Error(errors.Wrapf(err, "error ensuring notification statuses for analysis %s", id))
+		writeError(w, http.StatusInternalServerError, "error updating notification statuses")
+		return
+	}
+
+	if err := a.vicedb.SetPeriodicWarningPeriod(ctx, job, period); err != nil {
+		log.Error(errors.Wrapf(err, "error setting periodic notification period for analysis %s", id))
+		writeError(w, http.StatusInternalServerError, "error updating notification statuses")
+		return
+	}
+
+	log.Infof("periodic notification period for analysis %s set to %s", id, period)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":     job.ID,
+		"period": body.Period,
+	})
+}
+
+// ensureSubdomainHandler makes sure that an analysis has a subdomain and
+// returns it. An analysis that already has one keeps it unless the force
+// query parameter is true, in which case it's regenerated. Handles
+// POST /analyses/{id}/subdomain/ensure.
+func (a *API) ensureSubdomainHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	force := false
+	if v := r.URL.Query().Get("force"); v != "" {
+		var err error
+		if force, err = strconv.ParseBool(v); err != nil {
+			writeError(w, http.StatusBadRequest, "force must be true or false")
+			return
+		}
+	}
+
+	ctx := r.Context()
+
+	job := a.loadJob(ctx, w, id)
+	if job == nil {
+		return
+	}
+
+	previous := job.Subdomain
+	if force {
+		job.Subdomain = ""
+	}
+
+	subdomain, err := EnsureSubdomain(ctx, a.db, job)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error ensuring subdomain for analysis %s", id))
+		writeError(w, http.StatusInternalServerError, "error ensuring subdomain")
+		return
+	}
+
+	if subdomain != previous {
+		log.Infof("subdomain for analysis %s changed from %q to %q", id, previous, subdomain)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":        job.ID,
+		"subdomain": subdomain,
+		"changed":   subdomain != previous,
+	})
+}
+
+// warningStatusResponse is the JSON form of the status of the warning for one
+// of the WarningThresholds.
+type warningStatusResponse struct {
+	ThresholdMinutes int64 `json:"threshold_minutes"`
+	Sent             bool  `json:"sent"`
+	FailureCount     int   `json:"failure_count"`
+}
+
+// notifStatusResponse is the JSON form of an analysis's notification statuses.
+type notifStatusResponse struct {
+	AnalysisID              string                  `json:"analysis_id"`
+	ExternalID              string                  `json:"external_id"`
+	Warnings                []warningStatusResponse `json:"warnings"` // One for each of the WarningThresholds.
+	KillWarningSent         bool                    `json:"kill_warning_sent"`
+	KillWarningFailureCount int                     `json:"kill_warning_failure_count"`
+	LastPeriodicWarning     *time.Time              `json:"last_periodic_warning"`   // Null if none have been sent.
+	PeriodicWarningPeriod   int64                   `json:"periodic_warning_period"` // In seconds. Zero means the default is used.
+	PeriodicEnabled         *bool                   `json:"periodic_enabled"`        // Null if the user hasn't set it.
+}
+
+// newNotifStatusResponse returns the JSON form of the notification statuses
+// and the statuses of the warnings.
+func newNotifStatusResponse(ns *NotifStatuses, warnings []warningStatusResponse) *notifStatusResponse {
+	resp := &notifStatusResponse{
+		AnalysisID:              ns.AnalysisID,
+		ExternalID:              ns.ExternalID,
+		Warnings:                warnings,
+		KillWarningSent:         ns.KillWarningSent,
+		KillWarningFailureCount: ns.KillWarningFailureCount,
+		PeriodicWarningPeriod:   int64(ns.PeriodicWarningPeriod.Seconds()),
+	}
+
+	// The query turns a missing last periodic warning into the epoch.
+	if ns.LastPeriodicWarning.Unix() > 0 {
+		last := ns.LastPeriodicWarning
+		resp.LastPeriodicWarning = &last
+	}
+	if ns.PeriodicEnabled.Valid {
+		enabled := ns.PeriodicEnabled.Bool
+		resp.PeriodicEnabled = &enabled
+	}
+
+	return resp
+}
+
+// notifStatusHandler returns the notification statuses recorded for an
+// analysis. Handles GET /analyses/{id}/notif-status.
+func (a *API) notifStatusHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	ns, err := a.vicedb.NotifStatuses(r.Context(), &Job{ID: id})
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no notification statuses found for analysis %s", id))
+		return
+	}
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error looking up notification statuses for analysis %s", id))
+		writeError(w, http.StatusInternalServerError, "error looking up notification statuses")
+		return
+	}
+
+	// The warnings are kept apart from the rest of the notification statuses,
+	// one record for each threshold.
+	warnings := make([]warningStatusResponse, 0, len(WarningThresholds))
+	for _, threshold := range WarningThresholds {
+		sent, failureCount, err := a.vicedb.WarningStatus(r.Context(), &Job{ID: id}, threshold)
+		if err != nil {
+			log.Error(errors.Wrapf(err, "error looking up the %d minute warning status for analysis %s", threshold, id))
+			writeError(w, http.StatusInternalServerError, "error looking up notification statuses")
+			return
+		}
+		warnings = append(warnings, warningStatusResponse{
+			ThresholdMinutes: threshold,
+			Sent:             sent,
+			FailureCount:     failureCount,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, newNotifStatusResponse(ns, warnings))
+}
+
+// adminHandler routes requests under /admin/.
+func (a *API) adminHandler(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(strings.TrimPrefix(r.URL.Path, "/admin/"))
+
+	switch {
+	case len(segments) == 1 && segments[0] == "upcoming-kills":
+		a.upcomingKillsHandler(w, r)
+	case len(segments) == 1 && segments[0] == "user-running-counts":
+		a.userRunningCountsHandler(w, r)
+	case len(segments) == 1 && segments[0] == "audit":
+		a.auditHandler(w, r)
+	case len(segments) == 1 && segments[0] == "pause":
+		a.pauseHandler(w, r, true)
+	case len(segments) == 1 && segments[0] == "resume":
+		a.pauseHandler(w, r, false)
+	case len(segments) == 3 && segments[0] == "analyses" && segments[2] == "kill":
+		a.killHandler(w, r, segments[1])
+	case len(segments) == 3 && segments[0] == "analyses" && segments[2] == "preview-notification":
+		a.previewNotificationHandler(w, r, segments[1])
+	case len(segments) == 3 && segments[0] == "analyses" && segments[2] == "exempt":
+		a.exemptHandler(w, r, segments[1], true)
+	case len(segments) == 3 && segments[0] == "analyses" && segments[2] == "unexempt":
+		a.exemptHandler(w, r, segments[1], false)
+	case len(segments) == 3 && segments[0] == "analyses" && segments[2] == "extend":
+		a.extendHandler(w, r, segments[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// debugJobsHandler returns the job lists computed during the most recent
+// iterations of the job killer loop. Handles GET /debug/jobs.
+func (a *API) debugJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, loopState.Snapshot())
+}
+
+// debugJobByExternalIDHandler returns the job with the given external ID as
+// timelord sees it, which helps when all that's known about an analysis is
+// the invocation ID from app-exposer's logs. Handles
+// GET /debug/analyses/by-external-id/{externalID}.
+func (a *API) debugJobByExternalIDHandler(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(strings.TrimPrefix(r.URL.Path, "/debug/analyses/by-external-id/"))
+	if len(segments) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	externalID := segments[0]
+	job, err := lookupByExternalID(r.Context(), a.db, externalID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "analysis not found")
+		return
+	}
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error looking up analysis by external ID %s", externalID))
+		writeError(w, http.StatusInternalServerError, "error looking up analysis")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+// debugConfigHandler returns the configuration that timelord is running with,
+// with secrets redacted. Handles GET /debug/config.
+func (a *API) debugConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.config)
+}
+
+// healthzHandler reports that timelord is up, along with whether this replica
+// is the leader. Followers are healthy too, they're just waiting to take over.
+// A replica is always the leader if leader election is disabled. The state of
+// the connection to the AMQP broker is included too, which stays idle on
+// followers since only the leader consumes status updates. Responds
+// with a 503 if the leader's job killer loop has gone longer than staleAfter
+// without finishing an iteration. Handles GET /healthz.
+func (a *API) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	leader := a.elector == nil || a.elector.IsLeader()
+
+	// Followers don't run the job killer, so they'd otherwise report the
+	// pause as it was when they started or last handled a pause request.
+	if err := killPause.Refresh(r.Context(), a.vicedb); err != nil {
+		log.Error(err)
+	}
+
+	body := map[string]interface{}{
+		"status":          "ok",
+		"leader_election": a.elector != nil,
+		"leader":          leader,
+		"kills_paused":    killPause.Paused(),
+	}
+	if a.elector != nil {
+		body["id"] = a.elector.ID
+	}
+	if a.consumer != nil {
+		body["amqp"] = a.consumer.State()
+	}
+
+	body["last_iteration"] = nil
+	if last := lastIterationTime(); !last.IsZero() {
+		body["last_iteration"] = last.Format(time.RFC3339)
+	}
+
+	// Followers don't run the job killer loop, so it can't be stale for them.
+	if leader && loopStale(CurrentClock.Now(), a.staleAfter) {
+		body["status"] = "stale"
+		writeJSON(w, http.StatusServiceUnavailable, body)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, body)
+}
+
+// readyzHandler reports whether timelord is ready, which it isn't until the
+// startup self-check of the critical database queries has passed. Responds
+// with a 503 until then. Handles GET /readyz.
+func (a *API) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	if !selfCheckPassed.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "not ready"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ready"})
+}
+
+// defaultAuditWindow is how far back the audit log is read when no since
+// query parameter is given.
+const defaultAuditWindow = 24 * time.Hour
+
+// maxAuditEntries is the most audit log entries returned by a single request.
+const maxAuditEntries = 1000
+
+// auditHandler returns the audit log entries for the jobs killed at or after
+// the time in the since query parameter, which is in RFC 3339 format and
+// defaults to a day ago. At most maxAuditEntries are returned, oldest first,
+// so the killed_at time of the last one can be used as the next since.
+// Handles GET /admin/audit.
+func (a *API) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	since := CurrentClock.Now().Add(-defaultAuditWindow)
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, "since must be an RFC 3339 timestamp")
+			return
+		}
+	}
+
+	entries, err := a.vicedb.AuditEntries(r.Context(), since, maxAuditEntries)
+	if err != nil {
+		log.Error(errors.Wrap(err, "error reading the audit log"))
+		writeError(w, http.StatusInternalServerError, "error reading the audit log")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"since":   since,
+		"entries": entries,
+	})
+}
+
+// pauseHandler pauses killing jobs if pause is true and resumes it otherwise.
+// The pause is stored in the database, so any replica can handle the request
+// and the leader picks it up in its next iteration. Handles POST /admin/pause
+// and POST /admin/resume.
+func (a *API) pauseHandler(w http.ResponseWriter, r *http.Request, pause bool) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	pauseLog := log.WithFields(log.Fields{
+		"context":    "kill pause",
+		"remoteAddr": r.RemoteAddr,
+		"userAgent":  r.UserAgent(),
+	})
+
+	set := killPause.Resume
+	if pause {
+		set = killPause.Pause
+	}
+
+	changed, err := set(r.Context(), a.vicedb)
+	if err != nil {
+		pauseLog.Error(err)
+		writeError(w, http.StatusInternalServerError, "error setting the kill pause")
+		return
+	}
+
+	switch {
+	case changed && pause:
+		pauseLog.Warn("killing jobs has been paused")
+	case changed:
+		pauseLog.Warn("killing jobs has been resumed")
+	default:
+		pauseLog.Infof("killing jobs is already in the requested state, paused: %t", pause)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"paused": killPause.Paused(),
+	})
+}
+
+// upcomingKillsHandler lists the jobs that will be killed within the number
+// of minutes in the minutes query parameter, which defaults to the warning
+// interval. Handles GET /admin/upcoming-kills.
+func (a *API) upcomingKillsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	minutes := a.warningInterval
+	if m := r.URL.Query().Get("minutes"); m != "" {
+		parsed, err := strconv.ParseInt(m, 10, 64)
+		if err != nil || parsed <= 0 {
+			writeError(w, http.StatusBadRequest, "minutes must be a positive integer")
+			return
+		}
+		minutes = parsed
+	}
+
+	jobs, err := JobKillWarnings(r.Context(), a.db, minutes)
+	if err != nil {
+		log.Error(errors.Wrap(err, "error listing upcoming kills"))
+		writeError(w, http.StatusInternalServerError, "error listing upcoming kills")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"minutes": minutes,
+		"jobs":    summarizeJobs(jobs),
+	})
+}
+
+// userRunningCountsHandler returns the number of running interactive jobs for
+// each user that has at least one. Handles GET /admin/user-running-counts.
+func (a *API) userRunningCountsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	counts, err := CountRunningJobsByUser(r.Context(), a.db)
+	if err != nil {
+		log.Error(errors.Wrap(err, "error counting running jobs by user"))
+		writeError(w, http.StatusInternalServerError, "error counting running jobs by user")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, counts)
+}
+
+// killHandler kills an analysis right away, regardless of its planned end
+// date. Handles POST /admin/analyses/{id}/kill.
+func (a *API) killHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	ctx := r.Context()
+	killLog := log.WithFields(log.Fields{
+		"context":    "admin kill",
+		"ID":         id,
+		"remoteAddr": r.RemoteAddr,
+		"userAgent":  r.UserAgent(),
+	})
+
+	job := a.loadJob(ctx, w, id)
+	if job == nil {
+		return
+	}
+	killLog = killLog.WithFields(log.Fields{"externalID": job.ExternalID, "user": job.User})
+
+	if job.Status != "Running" {
+		writeError(w, http.StatusConflict, fmt.Sprintf("analysis is %s, not Running", job.Status))
+		return
+	}
+
+	killLog.Info("admin kill requested")
+
+	// The job killer loop, or another instance, could be killing the same
+	// analysis, so it's only killed while holding its lock.
+	var (
+		notified bool
+		killErr  error
+	)
+	locked, err := withJobLock(ctx, a.db, job.ID, func(ctx context.Context) {
+		notified, killErr = a.adminKill(ctx, job, killLog)
+	})
+	if err != nil {
+		killLog.Error(errors.Wrapf(err, "error locking analysis %s", id))
+		writeError(w, http.StatusInternalServerError, "error locking analysis")
+		return
+	}
+	if !locked {
+		writeError(w, http.StatusConflict, "analysis is being handled by another instance")
+		return
+	}
+	if killErr != nil {
+		killLog.Error(errors.Wrapf(killErr, "error terminating analysis '%s'", id))
+		writeError(w, http.StatusBadGateway, "error terminating analysis")
+		return
+	}
+
+	killLog.Info("analysis terminated by admin request")
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":       job.ID,
+		"killed":   true,
+		"notified": notified,
+	})
+}
+
+// adminKill kills the analysis for killHandler and notifies its user,
+// recording the kill. It must be called while holding the analysis's lock.
+// Returns whether the user was notified.
+func (a *API) adminKill(ctx context.Context, job *Job, killLog *log.Entry) (bool, error) {
+	if err := a.jobKiller.KillJob(ctx, a.db, job); err != nil {
+		return false, err
+	}
+
+	// The request is recorded so that the analysis is made to exit if it
+	// doesn't save and exit in time.
+	recordErr := a.vicedb.EnsureNotifRecord(ctx, job)
+	if recordErr != nil {
+		killLog.Error(recordErr)
+	} else if err := a.vicedb.SetKillRequestedAt(ctx, job, CurrentClock.Now()); err != nil {
+		killLog.Error(err)
+	}
+
+	notified := true
+	if err := SendKillNotification(ctx, job, "", KillReasonAdmin); err != nil {
+		killLog.Error(errors.Wrapf(err, "error sending notification that %s has been terminated", job.ID))
+		notified = false
+	}
+
+	notifOutcome := auditNotifSent
+	if !notified {
+		notifOutcome = auditNotifFailed
+	}
+	recordKill(ctx, a.vicedb, job, auditReasonAdmin, auditKilled, notifOutcome)
+
+	if recordErr == nil {
+		if err := a.vicedb.SetKillWarningSent(ctx, job, true); err != nil {
+			killLog.Error(err)
+		}
+	}
+
+	return notified, nil
+}
+
+// exemptHandler exempts a running analysis from being killed for passing its
+// time limit, or lifts the exemption, recording the admin named in the
+// required requested_by query parameter in the audit log. Lifting the
+// exemption gives the analysis the planned end date it would have had without
+// it. Handles POST /admin/analyses/{id}/exempt and
+// POST /admin/analyses/{id}/unexempt.
+func (a *API) exemptHandler(w http.ResponseWriter, r *http.Request, id string, exempt bool) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	requestedBy := r.URL.Query().Get("requested_by")
+	if requestedBy == "" {
+		writeError(w, http.StatusBadRequest, "requested_by is required")
+		return
+	}
+
+	ctx := r.Context()
+	exemptLog := log.WithFields(log.Fields{
+		"context":     "admin exemption",
+		"ID":          id,
+		"requestedBy": requestedBy,
+		"remoteAddr":  r.RemoteAddr,
+	})
+
+	job := a.loadJob(ctx, w, id)
+	if job == nil {
+		return
+	}
+	exemptLog = exemptLog.WithFields(log.Fields{"externalID": job.ExternalID, "user": job.User})
+
+	if job.Status != "Running" {
+		writeError(w, http.StatusConflict, fmt.Sprintf("analysis is %s, not Running", job.Status))
+		return
+	}
+	if isExempt(job) == exempt {
+		writeError(w, http.StatusConflict, fmt.Sprintf("analysis exempt is already %t", exempt))
+		return
+	}
+
+	if exempt {
+		if err := ExemptJob(ctx, a.db, a.vicedb, job); err != nil {
+			exemptLog.Error(errors.Wrapf(err, "error exempting analysis %s", id))
+			writeError(w, http.StatusInternalServerError, "error exempting analysis")
+			return
+		}
+		recordExemption(ctx, a.vicedb, job, auditExempted, requestedBy)
+		exemptLog.Warn("analysis exempted from being killed by admin request")
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":     job.ID,
+			"exempt": true,
+		})
+		return
+	}
+
+	if err := UnexemptJob(ctx, a.db, job); err != nil {
+		exemptLog.Error(errors.Wrapf(err, "error lifting the exemption of analysis %s", id))
+		writeError(w, http.StatusInternalServerError, "error lifting exemption")
+		return
+	}
+
+	// The audit log and the response both get the new planned end date.
+	if job = a.loadJob(ctx, w, id); job == nil {
+		return
+	}
+	recordExemption(ctx, a.vicedb, job, auditUnexempted, requestedBy)
+	exemptLog.Warnf("exemption lifted by admin request, planned end date is now %s", job.PlannedEndDate)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":               job.ID,
+		"exempt":           false,
+		"planned_end_date": job.PlannedEndDate,
+	})
+}
+
+// extendHandler pushes the planned end date of a running analysis back by the
+// duration query parameter, recording the admin named in the requested_by
+// query parameter in the audit log. The user is warned again before the new
+// planned end date. Handles POST /admin/analyses/{id}/extend.
+func (a *API) extendHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	requestedBy := r.URL.Query().Get("requested_by")
+	if requestedBy == "" {
+		writeError(w, http.StatusBadRequest, "requested_by is required")
+		return
+	}
+
+	d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil || d <= 0 {
+		writeError(w, http.StatusBadRequest, "duration must be a positive duration, such as 2h")
+		return
+	}
+
+	ctx := r.Context()
+	extendLog := log.WithFields(log.Fields{
+		"context":     "admin extension",
+		"ID":          id,
+		"requestedBy": requestedBy,
+		"remoteAddr":  r.RemoteAddr,
+	})
+
+	job := a.loadJob(ctx, w, id)
+	if job == nil {
+		return
+	}
+	extendLog = extendLog.WithFields(log.Fields{"externalID": job.ExternalID, "user": job.User})
+
+	if job.Status != "Running" {
+		writeError(w, http.StatusConflict, fmt.Sprintf("analysis is %s, not Running", job.Status))
+		return
+	}
+	if isExempt(job) {
+		writeError(w, http.StatusConflict, "analysis is exempt from being killed")
+		return
+	}
+
+	endDate, err := ExtendPlannedEndDate(ctx, a.db, a.vicedb, job, d)
+	if err == ErrExtensionLimitReached {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		extendLog.Error(errors.Wrapf(err, "error extending analysis %s", id))
+		writeError(w, http.StatusInternalServerError, "error extending analysis")
+		return
+	}
+	recordExemption(ctx, a.vicedb, job, auditExtended, requestedBy)
+	extendLog.Warnf("planned end date extended by %s to %s by admin request", d, job.PlannedEndDate)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":               job.ID,
+		"planned_end_date": endDate,
+	})
+}
+
+// previewNotificationHandler returns the notification that would be sent to
+// the user about an analysis, without sending it. Handles
+// GET /admin/analyses/{id}/preview-notification?type=warning|kill|periodic.
+// Kill previews can set the reason query parameter to one of the KillReason
+// constants, and default to the analysis passing its time limit.
+func (a *API) previewNotificationHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	var build func(context.Context, *Job) (*Notification, *User, error)
+
+	notifType := r.URL.Query().Get("type")
+	switch notifType {
+	case "warning":
+		build = warningNotif
+	case "periodic":
+		build = func(ctx context.Context, j *Job) (*Notification, *User, error) {
+			return periodicNotif(ctx, j, statusHistoryOpts(ctx, a.db, j)...)
+		}
+	case "kill":
+		reason := r.URL.Query().Get("reason")
+		switch reason {
+		case "", KillReasonTimeLimit, KillReasonAdmin, KillReasonDisabledUser, KillReasonIdle:
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown kill reason %q", reason))
+			return
+		}
+		build = func(ctx context.Context, j *Job) (*Notification, *User, error) {
+			return killNotif(ctx, j, reason)
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "type must be warning, kill, or periodic")
+		return
+	}
+
+	ctx := r.Context()
+
+	job := a.loadJob(ctx, w, id)
+	if job == nil {
+		return
+	}
+	if notifType == "warning" && isExempt(job) {
+		writeError(w, http.StatusConflict, "analysis is exempt from being killed, so it isn't warned")
+		return
+	}
+
+	notif, _, err := build(ctx, job)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error building %s notification preview for analysis %s", notifType, id))
+		writeError(w, http.StatusInternalServerError, "error building notification")
+		return
+	}
+	if notif == nil {
+		writeError(w, http.StatusServiceUnavailable, "notifications aren't configured")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, notif)
+}
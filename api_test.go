@@ -0,0 +1,866 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestAPI returns an API backed by a fake database and a mux with its
+// handlers registered.
+func newTestAPI(t *testing.T) (*http.ServeMux, *fakeDB) {
+	db, f := newFakeDB(t)
+	api := &API{db: db, vicedb: &VICEDatabaser{db: db}, warningInterval: 60}
+	mux := http.NewServeMux()
+	api.RegisterHandlers(mux)
+	return mux, f
+}
+
+func TestSetPeriodicEnabledHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		found  bool
+		status int
+	}{
+		{"disable", http.MethodPost, `{"enabled": false}`, true, http.StatusOK},
+		{"not found", http.MethodPost, `{"enabled": false}`, false, http.StatusNotFound},
+		{"missing enabled", http.MethodPost, `{}`, true, http.StatusBadRequest},
+		{"wrong method", http.MethodGet, "", true, http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		mux, f := newTestAPI(t)
+		if test.found {
+			f.on("where jobs.id = $1", jobByExternalIDColumns, jobByExternalIDRow("Running"))
+		}
+
+		req := httptest.NewRequest(test.method, "/analyses/job-id/notifications/periodic", strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status was %d, not %d", test.name, w.Code, test.status)
+		}
+
+		updated := f.ran("set periodic_enabled") > 0
+		if updated != (test.status == http.StatusOK) {
+			t.Errorf("%s: periodic_enabled updated was %t", test.name, updated)
+		}
+	}
+}
+
+func TestSetPeriodicPeriodHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		period string
+	}{
+		{"valid period", `{"period": 7200}`, http.StatusOK, "7200 seconds"},
+		{"minimum period", `{"period": 1800}`, http.StatusOK, "1800 seconds"},
+		{"below minimum", `{"period": 60}`, http.StatusBadRequest, ""},
+		{"missing period", `{}`, http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		mux, f := newTestAPI(t)
+		f.on("where jobs.id = $1", jobByExternalIDColumns, jobByExternalIDRow("Running"))
+
+		req := httptest.NewRequest(http.MethodPost, "/analyses/job-id/notifications/periodic/period", strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status was %d, not %d", test.name, w.Code, test.status)
+		}
+
+		args := f.argsFor("set periodic_warning_period")
+		if test.period == "" {
+			if args != nil {
+				t.Errorf("%s: periodic_warning_period was updated", test.name)
+			}
+			continue
+		}
+		if len(args) != 2 || args[0] != test.period {
+			t.Errorf("%s: periodic_warning_period args were %v, not [%s job-id]", test.name, args, test.period)
+		}
+	}
+}
+
+func TestUpcomingKillsHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		status  int
+		minutes int64
+	}{
+		{"default window", "", http.StatusOK, 60},
+		{"custom window", "?minutes=120", http.StatusOK, 120},
+		{"invalid window", "?minutes=soon", http.StatusBadRequest, 0},
+	}
+
+	for _, test := range tests {
+		mux, f := newTestAPI(t)
+		f.on("and jobs.planned_end_date <= $3", jobColumns, jobRow(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)))
+		f.on("select job_steps.external_id", []string{"external_id"}, []driver.Value{"external-id"})
+
+		req := httptest.NewRequest(http.MethodGet, "/admin/upcoming-kills"+test.query, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status was %d, not %d", test.name, w.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		var body struct {
+			Minutes int64        `json:"minutes"`
+			Jobs    []JobSummary `json:"jobs"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Minutes != test.minutes {
+			t.Errorf("%s: minutes was %d, not %d", test.name, body.Minutes, test.minutes)
+		}
+		if len(body.Jobs) != 1 {
+			t.Fatalf("%s: number of jobs was %d, not 1", test.name, len(body.Jobs))
+		}
+		expected := JobSummary{
+			ID:             "job-id",
+			ExternalID:     "external-id",
+			User:           "user@example.com",
+			Name:           "job-name",
+			StartDate:      "2024-01-01T10:00:00",
+			PlannedEndDate: "2024-01-02T10:00:00",
+		}
+		if body.Jobs[0] != expected {
+			t.Errorf("%s: job was %+v, not %+v", test.name, body.Jobs[0], expected)
+		}
+	}
+}
+
+func TestKillHandler(t *testing.T) {
+	NotifsInit("")
+	UsersInit("")
+
+	tests := []struct {
+		name     string
+		found    bool
+		status   string
+		lockHeld bool
+		code     int
+		killed   bool
+	}{
+		{"running", true, "Running", false, http.StatusOK, true},
+		{"not found", false, "", false, http.StatusNotFound, false},
+		{"not running", true, "Completed", false, http.StatusConflict, false},
+		{"handled by another instance", true, "Running", true, http.StatusConflict, false},
+	}
+
+	for _, test := range tests {
+		var killed bool
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/vice/external-id/save-and-exit" {
+				killed = true
+			}
+		}))
+
+		db, f := newFakeDB(t)
+		api := &API{
+			db:        db,
+			vicedb:    &VICEDatabaser{db: db},
+			jobKiller: &JobKiller{K8sEnabled: true, AppExposerBase: srv.URL},
+		}
+		mux := http.NewServeMux()
+		api.RegisterHandlers(mux)
+
+		if test.found {
+			f.on("where jobs.id = $1", jobByExternalIDColumns, jobByExternalIDRow(test.status))
+		}
+		f.on("pg_try_advisory_xact_lock", []string{"locked"}, []driver.Value{!test.lockHeld})
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/analyses/job-id/kill", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		srv.Close()
+
+		if w.Code != test.code {
+			t.Errorf("%s: status was %d, not %d", test.name, w.Code, test.code)
+		}
+		if killed != test.killed {
+			t.Errorf("%s: killed was %t, not %t", test.name, killed, test.killed)
+		}
+		marked := f.ran("update notif_statuses set kill_warning_sent") > 0
+		if marked != test.killed {
+			t.Errorf("%s: kill_warning_sent updated was %t, not %t", test.name, marked, test.killed)
+		}
+		requested := f.ran("set kill_requested_at") > 0
+		if requested != test.killed {
+			t.Errorf("%s: kill_requested_at set was %t, not %t", test.name, requested, test.killed)
+		}
+	}
+}
+
+func TestDebugJobByExternalIDHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		found  bool
+		status int
+	}{
+		{"found", http.MethodGet, "/debug/analyses/by-external-id/external-id", true, http.StatusOK},
+		{"not found", http.MethodGet, "/debug/analyses/by-external-id/external-id", false, http.StatusNotFound},
+		{"missing external ID", http.MethodGet, "/debug/analyses/by-external-id/", true, http.StatusNotFound},
+		{"wrong method", http.MethodPost, "/debug/analyses/by-external-id/external-id", true, http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		mux, f := newTestAPI(t)
+		if test.found {
+			f.on("where job_steps.external_id = $1", jobByExternalIDColumns, jobByExternalIDRow("Running"))
+		}
+
+		req := httptest.NewRequest(test.method, test.path, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status was %d, not %d", test.name, w.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		if args := f.argsFor("where job_steps.external_id = $1"); len(args) != 1 || args[0] != "external-id" {
+			t.Errorf("%s: lookup args were %v", test.name, args)
+		}
+
+		var job Job
+		if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if job.ID != "job-id" || job.ExternalID != "external-id" || job.Subdomain != "a1234abcd" {
+			t.Errorf("%s: job was %+v", test.name, job)
+		}
+		if job.StartDate == "" || job.PlannedEndDate == "" {
+			t.Errorf("%s: job dates were missing from %+v", test.name, job)
+		}
+	}
+}
+
+func TestDebugJobsHandler(t *testing.T) {
+	mux, _ := newTestAPI(t)
+
+	orig := loopState
+	defer func() { loopState = orig }()
+	loopState = newLoopState()
+	loopState.Record(killList, []Job{{ID: "job-id", ExternalID: "external-id", User: "user@example.com"}})
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/jobs", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status was %d, not %d", w.Code, http.StatusOK)
+	}
+
+	var body map[string]JobList
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	kills, ok := body[killList]
+	if !ok {
+		t.Fatalf("%s list missing from %+v", killList, body)
+	}
+	if kills.ComputedAt.IsZero() {
+		t.Error("computed_at was not set")
+	}
+	if len(kills.Jobs) != 1 || kills.Jobs[0].ID != "job-id" || kills.Jobs[0].ExternalID != "external-id" {
+		t.Errorf("unexpected jobs %+v", kills.Jobs)
+	}
+}
+
+func TestUserRunningCountsHandler(t *testing.T) {
+	mux, f := newTestAPI(t)
+	f.on("group by users.username", []string{"username", "count"},
+		[]driver.Value{"alice@example.com", int64(2)},
+	)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/user-running-counts", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status was %d, not %d", w.Code, http.StatusOK)
+	}
+
+	var body map[string]int64
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != 1 || body["alice@example.com"] != 2 {
+		t.Errorf("unexpected counts %v", body)
+	}
+}
+
+func TestHealthzHandler(t *testing.T) {
+	db, _ := newFakeDB(t)
+	follower := NewLeaderElector(db, leaderLeaseName, "replica-2", 30*time.Second)
+
+	tests := []struct {
+		name     string
+		elector  *LeaderElector
+		election bool
+		leader   bool
+	}{
+		{"no leader election", nil, false, true},
+		{"follower", follower, true, false},
+	}
+
+	for _, test := range tests {
+		api := &API{db: db, vicedb: &VICEDatabaser{db: db}, elector: test.elector}
+		mux := http.NewServeMux()
+		api.RegisterHandlers(mux)
+
+		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status was %d, not %d", test.name, w.Code, http.StatusOK)
+			continue
+		}
+
+		var body struct {
+			LeaderElection bool `json:"leader_election"`
+			Leader         bool `json:"leader"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.LeaderElection != test.election || body.Leader != test.leader {
+			t.Errorf("%s: unexpected body %+v", test.name, body)
+		}
+	}
+}
+
+func TestHealthzHandlerStale(t *testing.T) {
+	defer ClockInit(realClock{})
+	defer resetIterations()
+
+	last := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	clock := newFakeClock(last)
+	ClockInit(clock)
+	recordLoopStart(last.Add(-time.Minute))
+	recordIteration(last)
+
+	db, _ := newFakeDB(t)
+	api := &API{vicedb: &VICEDatabaser{db: db}, staleAfter: time.Minute}
+	mux := http.NewServeMux()
+	api.RegisterHandlers(mux)
+
+	tests := []struct {
+		now    time.Time
+		status int
+	}{
+		{last.Add(time.Minute), http.StatusOK},
+		{last.Add(time.Minute + time.Second), http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		clock.Set(test.now)
+
+		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status was %d, not %d", test.now, w.Code, test.status)
+		}
+
+		var body struct {
+			LastIteration string `json:"last_iteration"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.LastIteration != last.Format(time.RFC3339) {
+			t.Errorf("%s: last iteration was %s, not %s", test.now, body.LastIteration, last)
+		}
+	}
+}
+
+func TestNotifStatusHandler(t *testing.T) {
+	for _, found := range []bool{true, false} {
+		mux, f := newTestAPI(t)
+		if found {
+			// Only the 60 minute warning has been sent.
+			f.onFunc("left join warning_threshold_statuses", []string{"sent", "failure_count"}, func(args []driver.Value) [][]driver.Value {
+				if args[1] == int64(60) {
+					return [][]driver.Value{{true, int64(1)}}
+				}
+				return [][]driver.Value{{false, int64(0)}}
+			})
+			f.on("hour_warning_failure_count", notifStatusColumns, notifStatusRow(false))
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/analyses/job-id/notif-status", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if !found {
+			if w.Code != http.StatusNotFound {
+				t.Errorf("status was %d for a missing record, not %d", w.Code, http.StatusNotFound)
+			}
+			continue
+		}
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("status was %d, not %d", w.Code, http.StatusOK)
+		}
+
+		var body notifStatusResponse
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.AnalysisID != "job-id" || body.ExternalID != "external-id" {
+			t.Errorf("unexpected IDs in %+v", body)
+		}
+		if body.LastPeriodicWarning != nil {
+			t.Errorf("last periodic warning was %s, not null", body.LastPeriodicWarning)
+		}
+		if body.PeriodicEnabled == nil || *body.PeriodicEnabled {
+			t.Errorf("periodic enabled was %v, not false", body.PeriodicEnabled)
+		}
+		if args := f.argsFor("kill_warning_failure_count"); len(args) != 1 || args[0] != "job-id" {
+			t.Errorf("query args were %v", args)
+		}
+
+		expected := []warningStatusResponse{
+			{ThresholdMinutes: 1440, Sent: false, FailureCount: 0},
+			{ThresholdMinutes: 60, Sent: true, FailureCount: 1},
+		}
+		if !reflect.DeepEqual(body.Warnings, expected) {
+			t.Errorf("warnings were %+v, not %+v", body.Warnings, expected)
+		}
+	}
+}
+
+func TestEnsureSubdomainHandler(t *testing.T) {
+	generated := generateSubdomain("user-id", "external-id")
+
+	tests := []struct {
+		name      string
+		query     string
+		existing  driver.Value
+		subdomain string
+		set       bool
+	}{
+		{"already set", "", "a1234abcd", "a1234abcd", false},
+		{"forced", "?force=true", "a1234abcd", generated, true},
+		{"unset", "", nil, generated, true},
+	}
+
+	for _, test := range tests {
+		mux, f := newTestAPI(t)
+		row := jobByExternalIDRow("Running")
+		row[8] = test.existing
+		f.on("where jobs.id = $1", jobByExternalIDColumns, row)
+		f.on("SELECT user_id", []string{"user_id"}, []driver.Value{"user-id"})
+		f.on("select count(*) from jobs where subdomain", []string{"count"}, []driver.Value{int64(0)})
+
+		req := httptest.NewRequest(http.MethodPost, "/analyses/job-id/subdomain/ensure"+test.query, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status was %d, not %d", test.name, w.Code, http.StatusOK)
+		}
+
+		var body struct {
+			Subdomain string `json:"subdomain"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Subdomain != test.subdomain {
+			t.Errorf("%s: subdomain was %s, not %s", test.name, body.Subdomain, test.subdomain)
+		}
+
+		set := f.ran("update only jobs set subdomain") > 0
+		if set != test.set {
+			t.Errorf("%s: subdomain set was %t, not %t", test.name, set, test.set)
+		}
+	}
+
+	mux, _ := newTestAPI(t)
+	req := httptest.NewRequest(http.MethodPost, "/analyses/job-id/subdomain/ensure?force=maybe", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status for an invalid force parameter was %d, not %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestExemptHandler(t *testing.T) {
+	mux, f := newTestAPI(t)
+	f.on("where jobs.id = $1", jobByExternalIDColumns, jobByExternalIDRow("Running"))
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/analyses/job-id/exempt?requested_by=admin-user", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status was %d, not %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if args := f.argsFor("update only jobs set planned_end_date"); len(args) != 2 || args[0] != formatDBTimestamp(exemptPlannedEndDate) {
+		t.Errorf("planned end date args were %v", args)
+	}
+	if f.ran("delete from warning_threshold_statuses") != 1 {
+		t.Error("warnings weren't reset")
+	}
+	if f.ran("delete from pending_notifications") != 1 {
+		t.Error("queued warnings weren't deleted")
+	}
+	args := f.argsFor("insert into timelord_audit")
+	if len(args) != 10 || args[7] != auditExempted || args[9] != "admin-user" {
+		t.Errorf("audit entry args were %v", args)
+	}
+}
+
+func TestUnexemptHandler(t *testing.T) {
+	exempt := jobByExternalIDRow("Running")
+	exempt[7] = exemptPlannedEndDate
+
+	mux, f := newTestAPI(t)
+	f.on("where jobs.id = $1", jobByExternalIDColumns, exempt)
+	f.on("FROM tools", []string{"time_limit_seconds"}, []driver.Value{int64(7200)})
+	f.on("min(job_status_updates.sent_on)", []string{"min"}, []driver.Value{nil})
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/analyses/job-id/unexempt?requested_by=admin-user", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status was %d, not %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if f.ran("set planned_end_date = NULL") != 1 {
+		t.Error("planned end date wasn't cleared")
+	}
+	if args := f.argsFor("set planned_end_date = $1"); len(args) != 2 || args[0] != "2024-01-01 12:00:00.000000+00" {
+		t.Errorf("planned end date args were %v", args)
+	}
+	args := f.argsFor("insert into timelord_audit")
+	if len(args) != 10 || args[7] != auditUnexempted || args[9] != "admin-user" {
+		t.Errorf("audit entry args were %v", args)
+	}
+}
+
+func TestExemptHandlerConflicts(t *testing.T) {
+	exempt := jobByExternalIDRow("Running")
+	exempt[7] = exemptPlannedEndDate
+
+	tests := []struct {
+		name   string
+		path   string
+		row    []driver.Value
+		status int
+	}{
+		{"no requester", "/admin/analyses/job-id/exempt", jobByExternalIDRow("Running"), http.StatusBadRequest},
+		{"already exempt", "/admin/analyses/job-id/exempt?requested_by=admin-user", exempt, http.StatusConflict},
+		{"not exempt", "/admin/analyses/job-id/unexempt?requested_by=admin-user", jobByExternalIDRow("Running"), http.StatusConflict},
+		{"not running", "/admin/analyses/job-id/exempt?requested_by=admin-user", jobByExternalIDRow("Completed"), http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		mux, f := newTestAPI(t)
+		f.on("where jobs.id = $1", jobByExternalIDColumns, test.row)
+
+		req := httptest.NewRequest(http.MethodPost, test.path, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status was %d, not %d", test.name, w.Code, test.status)
+		}
+		if f.ran("planned_end_date =") > 0 || f.ran("insert into timelord_audit") > 0 {
+			t.Errorf("%s: analysis was changed", test.name)
+		}
+	}
+}
+
+func TestPreviewNotificationHandlerExempt(t *testing.T) {
+	defer ClockInit(realClock{})
+	defer AnalysesInit("")
+	defer NotifsInit("")
+	defer UsersInit("")
+
+	groups := newGroupsServer(t, User{ID: "user", Email: "user@example.edu"}, nil)
+	defer groups.Close()
+	UsersInit(groups.URL)
+	NotifsInit("http://notification-agent")
+	AnalysesInit("https://cyverse.run")
+	ClockInit(newFakeClock(time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)))
+
+	exempt := jobByExternalIDRow("Running")
+	exempt[7] = exemptPlannedEndDate
+
+	mux, f := newTestAPI(t)
+	f.on("where jobs.id = $1", jobByExternalIDColumns, exempt)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/analyses/job-id/preview-notification?type=warning", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("status of the warning was %d, not %d", rec.Code, http.StatusConflict)
+	}
+
+	// The periodic notification doesn't count down to the far-off planned
+	// end date.
+	req = httptest.NewRequest(http.MethodGet, "/admin/analyses/job-id/preview-notification?type=periodic", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status of the periodic notification was %d, not %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	fixture, err := os.ReadFile(filepath.Join("testdata", "preview-notification", "periodic-exempt.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected, actual interface{}
+	if err = json.Unmarshal(fixture, &expected); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(rec.Body.Bytes(), &actual); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("preview didn't match periodic-exempt.json:\n%s", rec.Body.String())
+	}
+}
+
+func TestExtendHandler(t *testing.T) {
+	mux, f := newTestAPI(t)
+	f.on("where jobs.id = $1", jobByExternalIDColumns, jobByExternalIDRow("Running"))
+	onClaimExtension(f, 0)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/analyses/job-id/extend?duration=2h&requested_by=admin-user", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status was %d, not %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if args := f.argsFor("set planned_end_date = $1"); len(args) != 2 || args[0] != "2024-01-01 13:00:00.000000+00" {
+		t.Errorf("planned end date args were %v", args)
+	}
+	if f.ran("set hour_warning_sent = false") != 1 {
+		t.Error("warnings weren't reset")
+	}
+	args := f.argsFor("insert into timelord_audit")
+	if len(args) != 10 || args[7] != auditExtended || args[9] != "admin-user" {
+		t.Errorf("audit entry args were %v", args)
+	}
+}
+
+func TestExtendHandlerErrors(t *testing.T) {
+	exempt := jobByExternalIDRow("Running")
+	exempt[7] = exemptPlannedEndDate
+
+	tests := []struct {
+		name       string
+		path       string
+		row        []driver.Value
+		extensions int64
+		status     int
+	}{
+		{"no requester", "/admin/analyses/job-id/extend?duration=2h", jobByExternalIDRow("Running"), 0, http.StatusBadRequest},
+		{"no duration", "/admin/analyses/job-id/extend?requested_by=admin-user", jobByExternalIDRow("Running"), 0, http.StatusBadRequest},
+		{"negative duration", "/admin/analyses/job-id/extend?duration=-2h&requested_by=admin-user", jobByExternalIDRow("Running"), 0, http.StatusBadRequest},
+		{"not running", "/admin/analyses/job-id/extend?duration=2h&requested_by=admin-user", jobByExternalIDRow("Completed"), 0, http.StatusConflict},
+		{"exempt", "/admin/analyses/job-id/extend?duration=2h&requested_by=admin-user", exempt, 0, http.StatusConflict},
+		{"limit reached", "/admin/analyses/job-id/extend?duration=2h&requested_by=admin-user", jobByExternalIDRow("Running"), int64(MaxExtensions), http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		mux, f := newTestAPI(t)
+		f.on("where jobs.id = $1", jobByExternalIDColumns, test.row)
+		onClaimExtension(f, test.extensions)
+
+		req := httptest.NewRequest(http.MethodPost, test.path, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status was %d, not %d", test.name, w.Code, test.status)
+		}
+		if f.ran("planned_end_date =") > 0 || f.ran("insert into timelord_audit") > 0 {
+			t.Errorf("%s: analysis was changed", test.name)
+		}
+	}
+}
+
+func TestPauseHandler(t *testing.T) {
+	NotifsInit("")
+	UsersInit("")
+	defer killPause.paused.Store(false)
+
+	// The kill_pause table is shared by every replica.
+	var (
+		mu     sync.Mutex
+		stored bool
+	)
+	mux, f := newTestAPI(t)
+	f.onFunc("update kill_pause", []string{"paused"}, func(args []driver.Value) [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		if stored == args[0].(bool) {
+			return nil
+		}
+		stored = args[0].(bool)
+		return [][]driver.Value{{stored}}
+	})
+	f.onFunc("from kill_pause", []string{"paused"}, func([]driver.Value) [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		return [][]driver.Value{{stored}}
+	})
+
+	tests := []struct {
+		path   string
+		paused bool
+	}{
+		{"/admin/pause", true},
+		{"/admin/pause", true},
+		{"/admin/resume", false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, test.path, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status was %d, not %d", test.path, w.Code, http.StatusOK)
+		}
+
+		var body struct {
+			Paused bool `json:"paused"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Paused != test.paused {
+			t.Errorf("%s: paused was %t, not %t", test.path, body.Paused, test.paused)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		var health struct {
+			KillsPaused bool `json:"kills_paused"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
+			t.Fatal(err)
+		}
+		if health.KillsPaused != test.paused {
+			t.Errorf("%s: healthz kills_paused was %t, not %t", test.path, health.KillsPaused, test.paused)
+		}
+
+		killed := 0
+		kill := func(context.Context, *sql.DB, *Job) error {
+			killed++
+			return nil
+		}
+		db, f := newFakeDB(t)
+		f.on("pg_try_advisory_xact_lock", []string{"locked"}, []driver.Value{true})
+		f.on("hour_warning_failure_count", notifStatusColumns, notifStatusRow(nil))
+
+		killExpiredJobs(context.Background(), db, &VICEDatabaser{db: db}, []Job{{ID: "job-id"}}, kill, "", KillMaxAttempts)
+
+		if expected := map[bool]int{true: 0, false: 1}[test.paused]; killed != expected {
+			t.Errorf("%s: %d jobs were killed, not %d", test.path, killed, expected)
+		}
+	}
+}
+
+func TestPreviewNotificationHandler(t *testing.T) {
+	defer ClockInit(realClock{})
+	defer AnalysesInit("")
+	defer NotifsInit("")
+	defer UsersInit("")
+
+	groups := newGroupsServer(t, User{ID: "user", Email: "user@example.edu"}, nil)
+	defer groups.Close()
+	UsersInit(groups.URL)
+	NotifsInit("http://notification-agent")
+	AnalysesInit("https://cyverse.run")
+	ClockInit(newFakeClock(time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)))
+
+	tests := []struct {
+		query   string
+		status  int
+		fixture string
+	}{
+		{"type=warning", http.StatusOK, "warning.json"},
+		{"type=kill", http.StatusOK, "kill.json"},
+		{"type=kill&reason=admin", http.StatusOK, "kill-admin.json"},
+		{"type=periodic", http.StatusOK, "periodic.json"},
+		{"type=kill&reason=bored", http.StatusBadRequest, ""},
+		{"type=gone", http.StatusBadRequest, ""},
+		{"", http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		mux, f := newTestAPI(t)
+		f.on("where jobs.id = $1", jobByExternalIDColumns, jobByExternalIDRow("Running"))
+
+		req := httptest.NewRequest(http.MethodGet, "/admin/analyses/job-id/preview-notification?"+test.query, nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%q: status was %d, not %d: %s", test.query, rec.Code, test.status, rec.Body.String())
+			continue
+		}
+		if test.fixture == "" {
+			continue
+		}
+
+		fixture, err := os.ReadFile(filepath.Join("testdata", "preview-notification", test.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var expected, actual interface{}
+		if err = json.Unmarshal(fixture, &expected); err != nil {
+			t.Fatalf("%s: %s", test.fixture, err)
+		}
+		if err = json.Unmarshal(rec.Body.Bytes(), &actual); err != nil {
+			t.Fatalf("%q: %s", test.query, err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%q: preview didn't match %s:\n%s", test.query, test.fixture, rec.Body.String())
+		}
+	}
+}
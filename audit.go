@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// The reasons recorded in the audit log for why a job was killed.
+const (
+	auditReasonTimeLimit      = "time_limit"
+	auditReasonBatchTimeLimit = "batch_time_limit"
+	auditReasonDisabledUser   = "disabled_user"
+	auditReasonAdmin          = "admin"
+	auditReasonHardStop       = "hard_stop"
+	auditReasonIdle           = "idle"
+)
+
+// The outcomes of kills recorded in the audit log.
+const (
+	auditKilled = "killed"
+	auditGone   = "already_gone"
+)
+
+// The outcomes recorded in the audit log when an admin exempts a job from
+// being killed, stops exempting it or extends its planned end date.
+const (
+	auditExempted   = "exempted"
+	auditUnexempted = "unexempted"
+	auditExtended   = "extended"
+)
+
+// The outcomes of the notifications about kills recorded in the audit log.
+const (
+	auditNotifSent   = "sent"
+	auditNotifFailed = "failed"
+	auditNotifNone   = "none"
+)
+
+// AuditEntry is a row in the append-only audit log of the jobs that timelord
+// has killed or that admins have exempted from being killed. Exemptions and
+// extensions are recorded at KilledAt with an outcome of auditExempted,
+// auditUnexempted or auditExtended.
+type AuditEntry struct {
+	ID                  string     `json:"id"`
+	AnalysisID          string     `json:"analysis_id"`
+	ExternalID          string     `json:"external_id"`
+	User                string     `json:"user"`
+	AppType             string     `json:"app_type"`         // The job's system ID, such as interactive. Empty for older entries.
+	PlannedEndDate      *time.Time `json:"planned_end_date"` // Nil if the job didn't have one.
+	KilledAt            time.Time  `json:"killed_at"`
+	Reason              string     `json:"reason"`
+	KillOutcome         string     `json:"kill_outcome"`
+	NotificationOutcome string     `json:"notification_outcome"`
+	RequestedBy         string     `json:"requested_by"` // The admin who asked for the entry's action. Empty if none did.
+}
+
+// timeLimitReason returns the audit reason for killing the job because it
+// passed its time limit, which depends on whether it's interactive.
+func timeLimitReason(j *Job) string {
+	if j.Type == interactiveSystemID {
+		return auditReasonTimeLimit
+	}
+	return auditReasonBatchTimeLimit
+}
+
+// newAuditEntry returns the audit log entry for a kill of the job at the
+// current time.
+func newAuditEntry(j *Job, reason, killOutcome, notifOutcome string) *AuditEntry {
+	e := &AuditEntry{
+		AnalysisID:          j.ID,
+		ExternalID:          j.ExternalID,
+		User:                j.User,
+		AppType:             j.Type,
+		KilledAt:            CurrentClock.Now(),
+		Reason:              reason,
+		KillOutcome:         killOutcome,
+		NotificationOutcome: notifOutcome,
+	}
+	if plannedEnd, err := parseDBTimestamp(j.PlannedEndDate); err == nil && j.PlannedEndDate != "" {
+		e.PlannedEndDate = &plannedEnd
+	}
+	return e
+}
+
+// recordKill adds an entry for a kill of the job to the audit log. Failing to
+// write the entry is logged rather than returned, since the kill has already
+// happened.
+func recordKill(ctx context.Context, vicedb *VICEDatabaser, j *Job, reason, killOutcome, notifOutcome string) {
+	if err := vicedb.AddAuditEntry(ctx, newAuditEntry(j, reason, killOutcome, notifOutcome)); err != nil {
+		log.Error(errors.Wrapf(err, "error adding audit log entry for analysis %s", j.ID))
+	}
+}
+
+// recordExemption adds an entry for an admin exempting the job from being
+// killed, no longer exempting it or extending its planned end date to the
+// audit log. Failing to write the entry is logged rather than returned, like
+// recordKill.
+func recordExemption(ctx context.Context, vicedb *VICEDatabaser, j *Job, outcome, requestedBy string) {
+	e := newAuditEntry(j, auditReasonAdmin, outcome, auditNotifNone)
+	e.RequestedBy = requestedBy
+	if err := vicedb.AddAuditEntry(ctx, e); err != nil {
+		log.Error(errors.Wrapf(err, "error adding audit log entry for analysis %s", j.ID))
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var auditColumns = []string{
+	"id",
+	"analysis_id",
+	"external_id",
+	"username",
+	"app_type",
+	"planned_end_date",
+	"killed_at",
+	"reason",
+	"kill_outcome",
+	"notification_outcome",
+	"requested_by",
+}
+
+func TestRecordKill(t *testing.T) {
+	defer ClockInit(realClock{})
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	ClockInit(newFakeClock(now))
+
+	plannedEnd := now.Add(-time.Hour)
+	tests := []struct {
+		name       string
+		job        Job
+		plannedEnd interface{}
+	}{
+		{"planned end", Job{ID: "job-id", ExternalID: "external-id", User: "ipcdev", Type: "de", PlannedEndDate: plannedEnd.In(TimestampLocation).Format(TimestampFromDBFormat)}, plannedEnd},
+		{"no planned end", Job{ID: "job-id", ExternalID: "external-id", User: "ipcdev", Type: "de"}, nil},
+	}
+
+	for _, test := range tests {
+		db, f := newFakeDB(t)
+
+		recordKill(context.Background(), &VICEDatabaser{db: db}, &test.job, timeLimitReason(&test.job), auditKilled, auditNotifSent)
+
+		args := f.argsFor("insert into timelord_audit")
+		if len(args) != 10 {
+			t.Fatalf("%s: audit entry was written with %d args, not 10", test.name, len(args))
+		}
+		expected := []interface{}{"job-id", "external-id", "ipcdev", "de", test.plannedEnd, now, auditReasonBatchTimeLimit, auditKilled, auditNotifSent, ""}
+		for i, arg := range args {
+			if actual, ok := arg.(time.Time); ok {
+				if e, ok := expected[i].(time.Time); !ok || !actual.Equal(e) {
+					t.Errorf("%s: arg %d was %v, not %v", test.name, i+1, arg, expected[i])
+				}
+				continue
+			}
+			if arg != expected[i] {
+				t.Errorf("%s: arg %d was %v, not %v", test.name, i+1, arg, expected[i])
+			}
+		}
+	}
+}
+
+func TestAuditEntries(t *testing.T) {
+	db, f := newFakeDB(t)
+
+	since := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	killedAt := since.Add(time.Hour)
+	plannedEnd := since.Add(30 * time.Minute)
+	f.on("from timelord_audit", auditColumns,
+		[]driver.Value{"1", "job-1", "external-1", "ipcdev", "interactive", plannedEnd, killedAt, auditReasonTimeLimit, auditKilled, auditNotifSent, ""},
+		[]driver.Value{"2", "job-2", "external-2", "ipcdev", "de", nil, killedAt, auditReasonAdmin, auditGone, auditNotifNone, ""},
+	)
+
+	entries, err := (&VICEDatabaser{db: db}).AuditEntries(context.Background(), since, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d entries were returned, not 2", len(entries))
+	}
+	if entries[0].PlannedEndDate == nil || !entries[0].PlannedEndDate.Equal(plannedEnd) {
+		t.Errorf("planned end date was %v, not %s", entries[0].PlannedEndDate, plannedEnd)
+	}
+	if entries[1].PlannedEndDate != nil {
+		t.Errorf("missing planned end date was %s", entries[1].PlannedEndDate)
+	}
+	if entries[0].AppType != "interactive" {
+		t.Errorf("app type was %q, not interactive", entries[0].AppType)
+	}
+	if entries[1].Reason != auditReasonAdmin || entries[1].KillOutcome != auditGone {
+		t.Errorf("second entry was %+v", entries[1])
+	}
+
+	args := f.argsFor("from timelord_audit")
+	if len(args) != 2 || !args[0].(time.Time).Equal(since) || args[1] != int64(10) {
+		t.Errorf("audit log was read with %v", args)
+	}
+}
+
+func TestAuditHandler(t *testing.T) {
+	defer ClockInit(realClock{})
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	ClockInit(newFakeClock(now))
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		since  time.Time
+		status int
+	}{
+		{"default", http.MethodGet, "", now.Add(-defaultAuditWindow), http.StatusOK},
+		{"since", http.MethodGet, "?since=2024-02-01T00:00:00Z", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), http.StatusOK},
+		{"bad since", http.MethodGet, "?since=yesterday", time.Time{}, http.StatusBadRequest},
+		{"wrong method", http.MethodPost, "", time.Time{}, http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		mux, f := newTestAPI(t)
+		f.on("from timelord_audit", auditColumns,
+			[]driver.Value{"1", "job-1", "external-1", "ipcdev", "interactive", nil, now, auditReasonDisabledUser, auditKilled, auditNotifFailed, ""},
+		)
+
+		req := httptest.NewRequest(test.method, "/admin/audit"+test.query, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status was %d, not %d", test.name, w.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			if f.ran("from timelord_audit") > 0 {
+				t.Errorf("%s: audit log was read", test.name)
+			}
+			continue
+		}
+
+		args := f.argsFor("from timelord_audit")
+		if len(args) != 2 || !args[0].(time.Time).Equal(test.since) {
+			t.Errorf("%s: audit log was read with %v", test.name, args)
+		}
+
+		var body struct {
+			Entries []AuditEntry `json:"entries"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(body.Entries) != 1 || body.Entries[0].Reason != auditReasonDisabledUser {
+			t.Errorf("%s: entries were %+v", test.name, body.Entries)
+		}
+	}
+}
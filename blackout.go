@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BlackoutWindow is a daily window of time during which no jobs are killed,
+// stored as offsets from midnight. A window whose end comes before its start,
+// such as 22:00-06:00, spans midnight.
+type BlackoutWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// parseTimeOfDay parses a time of day in the HH:MM format into an offset from
+// midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseBlackoutWindow parses a blackout window in the HH:MM-HH:MM format.
+func parseBlackoutWindow(s string) (BlackoutWindow, error) {
+	var w BlackoutWindow
+
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return w, fmt.Errorf("blackout window %q isn't in the HH:MM-HH:MM format", s)
+	}
+
+	start, err := parseTimeOfDay(parts[0])
+	if err != nil {
+		return w, errors.Wrapf(err, "invalid start of blackout window %q", s)
+	}
+	end, err := parseTimeOfDay(parts[1])
+	if err != nil {
+		return w, errors.Wrapf(err, "invalid end of blackout window %q", s)
+	}
+	if start == end {
+		return w, fmt.Errorf("blackout window %q is empty", s)
+	}
+
+	w.Start = start
+	w.End = end
+	return w, nil
+}
+
+// Contains returns whether the time falls within the window, using the time's
+// location to find the time of day. The start of the window is included and
+// the end isn't.
+func (w BlackoutWindow) Contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// BlackoutWindows are the daily windows during which no jobs are killed. Jobs
+// that pass their planned end dates during a window are killed once it ends.
+var BlackoutWindows []BlackoutWindow
+
+// BlackoutSkipsWarnings is whether warnings and periodic notifications are
+// held back during the blackout windows too.
+var BlackoutSkipsWarnings = false
+
+// BlackoutsInit sets the daily windows during which no jobs are killed and
+// whether warnings are held back during them.
+func BlackoutsInit(windows []BlackoutWindow, skipWarnings bool) {
+	BlackoutWindows = windows
+	BlackoutSkipsWarnings = skipWarnings
+}
+
+// inBlackout returns whether the time falls within any of the blackout
+// windows, in the configured timezone.
+func inBlackout(t time.Time) bool {
+	local := t.In(TimestampLocation)
+	for _, w := range BlackoutWindows {
+		if w.Contains(local) {
+			return true
+		}
+	}
+	return false
+}
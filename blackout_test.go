@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBlackoutWindow(t *testing.T) {
+	tests := []struct {
+		window string
+		valid  bool
+	}{
+		{"22:00-06:00", true},
+		{"09:30-10:45", true},
+		{" 09:30 - 10:45 ", true},
+		{"09:30", false},
+		{"09:30-10:45-11:00", false},
+		{"9am-10am", false},
+		{"25:00-06:00", false},
+		{"10:00-10:00", false},
+	}
+
+	for _, test := range tests {
+		_, err := parseBlackoutWindow(test.window)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: error was %v", test.window, err)
+		}
+	}
+}
+
+func TestBlackoutWindowContains(t *testing.T) {
+	day := func(hour, minute int) time.Time {
+		return time.Date(2024, 1, 1, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		window   string
+		t        time.Time
+		expected bool
+	}{
+		{"09:00-17:00", day(12, 0), true},
+		{"09:00-17:00", day(9, 0), true},
+		{"09:00-17:00", day(17, 0), false},
+		{"09:00-17:00", day(8, 59), false},
+		{"09:00-17:00", day(20, 0), false},
+		{"22:00-06:00", day(23, 30), true},
+		{"22:00-06:00", day(0, 0), true},
+		{"22:00-06:00", day(5, 59), true},
+		{"22:00-06:00", day(6, 0), false},
+		{"22:00-06:00", day(12, 0), false},
+		{"22:00-06:00", day(21, 59), false},
+	}
+
+	for _, test := range tests {
+		w, err := parseBlackoutWindow(test.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := w.Contains(test.t); actual != test.expected {
+			t.Errorf("%s contains %s was %t, not %t", test.window, test.t.Format("15:04"), actual, test.expected)
+		}
+	}
+}
+
+func TestInBlackoutTimezone(t *testing.T) {
+	defer TimezoneInit("UTC")
+	defer BlackoutsInit(nil, false)
+
+	w, err := parseBlackoutWindow("22:00-06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	BlackoutsInit([]BlackoutWindow{w}, false)
+
+	if err = TimezoneInit("America/Phoenix"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 04:00 UTC is 21:00 in Phoenix, which is outside of the window.
+	if inBlackout(time.Date(2024, 1, 1, 4, 0, 0, 0, time.UTC)) {
+		t.Error("21:00 in Phoenix was in the blackout window")
+	}
+	// 06:00 UTC is 23:00 in Phoenix, which is inside of the window.
+	if !inBlackout(time.Date(2024, 1, 1, 6, 0, 0, 0, time.UTC)) {
+		t.Error("23:00 in Phoenix wasn't in the blackout window")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time. The time-based logic gets the time from
+// CurrentClock rather than calling time.Now() so that tests can fix it.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the Clock that uses the system time.
+type realClock struct{}
+
+// Now returns the current system time.
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// CurrentClock is where the time-based logic gets the current time from. It's
+// the system clock outside of tests.
+var CurrentClock Clock = realClock{}
+
+// ClockInit sets where the time-based logic gets the current time from.
+func ClockInit(c Clock) {
+	CurrentClock = c
+}
+
+// intervalGate lets work that's too expensive to do in every iteration of the
+// job killer run at most once per interval.
+type intervalGate struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// Due returns whether interval has passed since the last time Due returned
+// true, and if so, counts now as the latest run.
+func (g *intervalGate) Due(now time.Time, interval time.Duration) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.last.IsZero() && now.Sub(g.last) < interval {
+		return false
+	}
+	g.last = now
+	return true
+}
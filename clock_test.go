@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that's stuck at a fixed time until it's moved.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// newFakeClock returns a *fakeClock stuck at now.
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+// Now returns the time the clock is stuck at.
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set moves the clock to now.
+func (c *fakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// Advance moves the clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestIntervalGate(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	g := &intervalGate{}
+
+	tests := []struct {
+		now time.Time
+		due bool
+	}{
+		{start, true},
+		{start.Add(time.Minute), false},
+		{start.Add(5*time.Minute - time.Second), false},
+		{start.Add(5 * time.Minute), true},
+		{start.Add(6 * time.Minute), false},
+	}
+
+	for _, test := range tests {
+		if actual := g.Due(test.now, 5*time.Minute); actual != test.due {
+			t.Errorf("due at %s was %t, not %t", test.now, actual, test.due)
+		}
+	}
+}
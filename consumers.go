@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/messaging/v9"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// UpdatesPrefetch is the number of status update messages that each consumer
+// can have delivered to it before it acks them. Messages are only acked after
+// they've been processed, so this is also how many messages each consumer
+// processes at once. Messages that haven't been acked when timelord stops are
+// redelivered to another consumer.
+var UpdatesPrefetch = 100
+
+// UpdatesConcurrency is the number of consumers that process status update
+// messages at the same time. Each consumer gets its own UpdatesPrefetch
+// messages, so up to UpdatesPrefetch * UpdatesConcurrency messages can be
+// unacked at once. Each consumer processes its messages concurrently, so the
+// updates for an analysis may be processed out of order.
+var UpdatesConcurrency = 1
+
+// ConsumersInit sets the prefetch count and the number of consumers used for
+// status update messages.
+func ConsumersInit(prefetch, concurrency int) {
+	UpdatesPrefetch = prefetch
+	UpdatesConcurrency = concurrency
+}
+
+// consumerAdder is the part of *messaging.Client used to consume status
+// updates.
+type consumerAdder interface {
+	AddConsumer(exchange, exchangeType, queue, key string, handler messaging.MessageHandler, prefetchCount int)
+}
+
+// addUpdateConsumers adds UpdatesConcurrency consumers for the status update
+// messages to the client, all reading from the same queue.
+func addUpdateConsumers(client consumerAdder, exchange, exchangeType string, handler messaging.MessageHandler) {
+	for i := 0; i < UpdatesConcurrency; i++ {
+		client.AddConsumer(
+			exchange,
+			exchangeType,
+			"timelord",
+			messaging.UpdatesKey,
+			handler,
+			UpdatesPrefetch,
+		)
+	}
+}
+
+// The defaults for reconnecting to the AMQP broker.
+const (
+	defaultReconnectBaseBackoff = time.Second
+	defaultReconnectMaxBackoff  = time.Minute
+)
+
+// reconnectBaseBackoff is how long to wait before reconnecting to the broker
+// after the connection is lost. The wait doubles for each reconnection that
+// fails after that, up to reconnectMaxBackoff.
+var reconnectBaseBackoff = defaultReconnectBaseBackoff
+
+// reconnectMaxBackoff is the longest wait between reconnections. A connection
+// that stays up for at least this long resets the wait to reconnectBaseBackoff.
+var reconnectMaxBackoff = defaultReconnectMaxBackoff
+
+// ReconnectInit sets how long to wait between attempts to reconnect to the
+// broker.
+func ReconnectInit(base, max time.Duration) {
+	reconnectBaseBackoff = base
+	reconnectMaxBackoff = max
+}
+
+// The states of the connection to the broker, as reported on /healthz.
+const (
+	amqpIdle       = "idle"
+	amqpConnecting = "connecting"
+	amqpConnected  = "connected"
+)
+
+// consumerSession is a connection to the broker with the update consumers
+// set up on it.
+type consumerSession interface {
+	// Closed receives once the connection or any of its channels is closed.
+	Closed() <-chan *amqp.Error
+	Close() error
+}
+
+// amqpSession is the consumerSession for a real connection to the broker.
+// Each consumer added to it gets its own channel. AddConsumer can't return
+// an error, so the first one is kept in err and the rest of the consumers are
+// skipped.
+type amqpSession struct {
+	ctx    context.Context
+	conn   *amqp.Connection
+	closed chan *amqp.Error
+	err    error
+}
+
+func dialSession(ctx context.Context, uri string) (*amqpSession, error) {
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "error connecting to the AMQP broker")
+	}
+
+	s := &amqpSession{
+		ctx:    ctx,
+		conn:   conn,
+		closed: make(chan *amqp.Error, 1),
+	}
+	s.watch(conn.NotifyClose(make(chan *amqp.Error, 1)))
+	return s, nil
+}
+
+// watch passes on the close notification from the connection or one of its
+// channels. The notification channel is closed without an error when the
+// connection is closed on purpose.
+func (s *amqpSession) watch(notify chan *amqp.Error) {
+	go func() {
+		err := <-notify
+		select {
+		case s.closed <- err:
+		default:
+		}
+	}()
+}
+
+// Closed implements consumerSession.
+func (s *amqpSession) Closed() <-chan *amqp.Error {
+	return s.closed
+}
+
+// Close implements consumerSession.
+func (s *amqpSession) Close() error {
+	return s.conn.Close()
+}
+
+// AddConsumer implements consumerAdder.
+func (s *amqpSession) AddConsumer(exchange, exchangeType, queue, key string, handler messaging.MessageHandler, prefetchCount int) {
+	if s.err != nil {
+		return
+	}
+	s.err = s.addConsumer(exchange, exchangeType, queue, key, handler, prefetchCount)
+}
+
+func (s *amqpSession) addConsumer(exchange, exchangeType, queue, key string, handler messaging.MessageHandler, prefetchCount int) error {
+	ch, err := s.conn.Channel()
+	if err != nil {
+		return errors.Wrap(err, "error opening an AMQP channel")
+	}
+	s.watch(ch.NotifyClose(make(chan *amqp.Error, 1)))
+
+	if err = ch.ExchangeDeclare(exchange, exchangeType, true, false, false, false, nil); err != nil {
+		return errors.Wrapf(err, "error declaring exchange %s", exchange)
+	}
+	if _, err = ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+		return errors.Wrapf(err, "error declaring queue %s", queue)
+	}
+	if err = ch.QueueBind(queue, key, exchange, false, nil); err != nil {
+		return errors.Wrapf(err, "error binding queue %s to %s with key %s", queue, exchange, key)
+	}
+	if err = ch.Qos(prefetchCount, 0, false); err != nil {
+		return errors.Wrapf(err, "error setting the prefetch count for queue %s", queue)
+	}
+
+	deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error consuming from queue %s", queue)
+	}
+
+	// The deliveries channel is closed along with the AMQP channel, and the
+	// broker redelivers whatever wasn't acked.
+	go dispatchDeliveries(s.ctx, deliveries, handler, prefetchCount)
+
+	return nil
+}
+
+// dispatchDeliveries handles each of the deliveries in its own goroutine, like
+// messaging's Listen did, so that one slow update doesn't hold up the rest. At
+// most limit deliveries are handled at once, which matches the prefetch count
+// the broker holds to anyway. Returns once the deliveries channel is closed.
+func dispatchDeliveries(ctx context.Context, deliveries <-chan amqp.Delivery, handler messaging.MessageHandler, limit int) {
+	sem := make(chan struct{}, limit)
+	for d := range deliveries {
+		sem <- struct{}{}
+		go func(d amqp.Delivery) {
+			defer func() { <-sem }()
+			handler(ctx, d)
+		}(d)
+	}
+}
+
+// UpdateConsumer consumes the status update messages, reconnecting to the
+// broker and setting the consumers up again whenever the connection or one of
+// its channels is closed, such as when RabbitMQ restarts.
+type UpdateConsumer struct {
+	URI          string
+	Exchange     string
+	ExchangeType string
+	Handler      messaging.MessageHandler
+
+	// connect sets up the consumers on a new connection. It's replaced in
+	// tests.
+	connect func(ctx context.Context) (consumerSession, error)
+
+	mu    sync.Mutex
+	state string
+}
+
+// NewUpdateConsumer returns an UpdateConsumer that isn't connected yet.
+func NewUpdateConsumer(uri, exchange, exchangeType string, handler messaging.MessageHandler) *UpdateConsumer {
+	c := &UpdateConsumer{
+		URI:          uri,
+		Exchange:     exchange,
+		ExchangeType: exchangeType,
+		Handler:      handler,
+		state:        amqpIdle,
+	}
+	c.connect = c.dial
+	return c
+}
+
+func (c *UpdateConsumer) dial(ctx context.Context) (consumerSession, error) {
+	s, err := dialSession(ctx, c.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	addUpdateConsumers(s, c.Exchange, c.ExchangeType, c.Handler)
+	if s.err != nil {
+		s.Close()
+		return nil, s.err
+	}
+	return s, nil
+}
+
+// State returns whether the consumer is idle, connecting, or connected.
+func (c *UpdateConsumer) State() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *UpdateConsumer) setState(state string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+}
+
+// Run connects to the broker and consumes status updates until ctx is done.
+// Lost connections are reestablished with exponential backoff. Failed attempts
+// to connect are logged and retried the same way, so Run never gives up.
+func (c *UpdateConsumer) Run(ctx context.Context) {
+	defer c.setState(amqpIdle)
+
+	attempt := 0
+	for {
+		c.setState(amqpConnecting)
+
+		session, err := c.connect(ctx)
+		if err == nil {
+			c.setState(amqpConnected)
+			log.Infof("consuming status updates from exchange %s", c.Exchange)
+
+			connectedAt := time.Now()
+			select {
+			case <-ctx.Done():
+				session.Close()
+				return
+			case err := <-session.Closed():
+				session.Close()
+				if err != nil {
+					log.Errorf("lost the connection to the AMQP broker: %s", err)
+				} else {
+					log.Error("lost the connection to the AMQP broker")
+				}
+			}
+
+			// A connection that's closed right after it's set up counts as a
+			// failed attempt, so it doesn't reconnect in a tight loop.
+			if time.Since(connectedAt) >= reconnectMaxBackoff {
+				attempt = 0
+			}
+		} else {
+			log.Error(err)
+		}
+
+		attempt++
+		delay := expBackoff(attempt, reconnectBaseBackoff, reconnectMaxBackoff)
+		log.Infof("reconnecting to the AMQP broker in %s", delay)
+
+		c.setState(amqpConnecting)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/messaging/v9"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+)
+
+// recordingConsumerAdder records the consumers added to it.
+type recordingConsumerAdder struct {
+	queues    []string
+	keys      []string
+	prefetchs []int
+}
+
+func (r *recordingConsumerAdder) AddConsumer(exchange, exchangeType, queue, key string, handler messaging.MessageHandler, prefetchCount int) {
+	r.queues = append(r.queues, queue)
+	r.keys = append(r.keys, key)
+	r.prefetchs = append(r.prefetchs, prefetchCount)
+}
+
+func TestConfigureConsumers(t *testing.T) {
+	defer ConsumersInit(100, 1)
+	defer ReconnectInit(defaultReconnectBaseBackoff, defaultReconnectMaxBackoff)
+
+	tests := []struct {
+		prefetch    int
+		concurrency int
+		baseBackoff time.Duration
+		maxBackoff  time.Duration
+		valid       bool
+	}{
+		{100, 1, time.Second, time.Minute, true},
+		{25, 4, time.Second, time.Second, true},
+		{0, 1, time.Second, time.Minute, false},
+		{100, 0, time.Second, time.Minute, false},
+		{-1, 1, time.Second, time.Minute, false},
+		{100, 1, 0, time.Minute, false},
+		{100, 1, time.Minute, time.Second, false},
+	}
+
+	for _, test := range tests {
+		cfg := viper.New()
+		cfg.Set("amqp.consumers.prefetch", test.prefetch)
+		cfg.Set("amqp.consumers.concurrency", test.concurrency)
+		cfg.Set("amqp.reconnect.base_backoff", test.baseBackoff)
+		cfg.Set("amqp.reconnect.max_backoff", test.maxBackoff)
+
+		err := ConfigureConsumers(cfg)
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: error was %v", test, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+
+		client := &recordingConsumerAdder{}
+		addUpdateConsumers(client, "de", "topic", func(context.Context, amqp.Delivery) {})
+
+		if len(client.prefetchs) != test.concurrency {
+			t.Errorf("%d consumers were added, not %d", len(client.prefetchs), test.concurrency)
+		}
+		for i, prefetch := range client.prefetchs {
+			if prefetch != test.prefetch {
+				t.Errorf("consumer %d had a prefetch of %d, not %d", i, prefetch, test.prefetch)
+			}
+			if client.queues[i] != "timelord" || client.keys[i] != messaging.UpdatesKey {
+				t.Errorf("consumer %d read %s from %s", i, client.keys[i], client.queues[i])
+			}
+		}
+	}
+}
+
+// fakeSession is a consumerSession that's closed by the test.
+type fakeSession struct {
+	closed chan *amqp.Error
+}
+
+func (s *fakeSession) Closed() <-chan *amqp.Error {
+	return s.closed
+}
+
+func (s *fakeSession) Close() error {
+	return nil
+}
+
+func TestUpdateConsumerReconnects(t *testing.T) {
+	ReconnectInit(time.Millisecond, time.Millisecond)
+	defer ReconnectInit(defaultReconnectBaseBackoff, defaultReconnectMaxBackoff)
+
+	var (
+		mu       sync.Mutex
+		attempts int
+	)
+	sessions := make(chan *fakeSession)
+
+	c := NewUpdateConsumer("amqp://broker", "de", "topic", func(context.Context, amqp.Delivery) {})
+	c.connect = func(ctx context.Context) (consumerSession, error) {
+		mu.Lock()
+		attempts++
+		first := attempts == 1
+		mu.Unlock()
+
+		// The broker isn't up yet the first time.
+		if first {
+			return nil, errors.New("connection refused")
+		}
+		s := &fakeSession{closed: make(chan *amqp.Error, 1)}
+		sessions <- s
+		return s, nil
+	}
+
+	if state := c.State(); state != amqpIdle {
+		t.Errorf("state before running was %s", state)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+
+	waitForState := func(expected string) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for c.State() != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("state was %s, not %s", c.State(), expected)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	first := <-sessions
+	waitForState(amqpConnected)
+
+	// Simulate the broker restarting.
+	first.closed <- &amqp.Error{Code: 320, Reason: "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'"}
+
+	<-sessions
+	waitForState(amqpConnected)
+
+	mu.Lock()
+	if attempts != 3 {
+		t.Errorf("connected %d times, not 3", attempts)
+	}
+	mu.Unlock()
+
+	cancel()
+	<-done
+	if state := c.State(); state != amqpIdle {
+		t.Errorf("state after stopping was %s", state)
+	}
+}
+
+func TestDispatchDeliveries(t *testing.T) {
+	const limit = 2
+
+	var (
+		mu          sync.Mutex
+		inFlight    int
+		maxInFlight int
+	)
+	release := make(chan struct{})
+	started := make(chan struct{}, 4)
+
+	handler := func(context.Context, amqp.Delivery) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		started <- struct{}{}
+		<-release
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}
+
+	deliveries := make(chan amqp.Delivery, 4)
+	for i := 0; i < 4; i++ {
+		deliveries <- amqp.Delivery{}
+	}
+	close(deliveries)
+
+	done := make(chan struct{})
+	go func() {
+		dispatchDeliveries(context.Background(), deliveries, handler, limit)
+		close(done)
+	}()
+
+	// A slow delivery doesn't keep the next one from being handled, but no
+	// more than the limit are handled at once.
+	for i := 0; i < limit; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d deliveries were being handled at once", i)
+		}
+	}
+	select {
+	case <-started:
+		t.Fatal("more deliveries than the limit were handled at once")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	<-done
+	for i := limit; i < 4; i++ {
+		<-started
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxInFlight != limit {
+		t.Errorf("at most %d deliveries were handled at once, not %d", maxInFlight, limit)
+	}
+}
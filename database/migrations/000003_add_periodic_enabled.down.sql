@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS notif_statuses
+    DROP COLUMN IF EXISTS periodic_enabled;
\ No newline at end of file
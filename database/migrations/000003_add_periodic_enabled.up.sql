@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS notif_statuses
+    ADD COLUMN IF NOT EXISTS periodic_enabled BOOL;
\ No newline at end of file
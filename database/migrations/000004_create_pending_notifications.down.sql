@@ -0,0 +1 @@
+DROP TABLE IF EXISTS pending_notifications;
\ No newline at end of file
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS pending_notifications (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	analysis_id UUID NOT NULL,
+	notification_type TEXT NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	next_attempt TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+	last_error TEXT,
+	created_date TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+	UNIQUE (analysis_id, notification_type)
+);
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS notif_statuses
+    ADD COLUMN IF NOT EXISTS extension_count INT NOT NULL DEFAULT 0;
\ No newline at end of file
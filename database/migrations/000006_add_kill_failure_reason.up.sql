@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS notif_statuses
+    ADD COLUMN IF NOT EXISTS kill_failure_reason TEXT;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS warning_threshold_statuses;
\ No newline at end of file
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS warning_threshold_statuses (
+	analysis_id UUID NOT NULL REFERENCES notif_statuses(analysis_id) ON DELETE CASCADE,
+	threshold_minutes INT NOT NULL,
+	sent BOOL NOT NULL DEFAULT false,
+	failure_count INT NOT NULL DEFAULT 0,
+	PRIMARY KEY (analysis_id, threshold_minutes)
+);
+
+-- The hour and day warnings that were already tracked in notif_statuses aren't
+-- copied here, since the hour warning was kept for whatever the warning
+-- interval was configured to be. WarningStatus reads them from notif_statuses
+-- until a threshold gets a record of its own.
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS leader_leases;
\ No newline at end of file
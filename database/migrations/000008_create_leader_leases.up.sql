@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS leader_leases (
+	name TEXT PRIMARY KEY,
+	holder TEXT NOT NULL,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
\ No newline at end of file
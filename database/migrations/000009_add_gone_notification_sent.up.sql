@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS notif_statuses
+    ADD COLUMN IF NOT EXISTS gone_notification_sent BOOLEAN NOT NULL DEFAULT FALSE;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS usage_notifications;
\ No newline at end of file
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS usage_notifications (
+	username TEXT PRIMARY KEY,
+	last_notified TIMESTAMP WITH TIME ZONE NOT NULL
+);
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE IF EXISTS notif_statuses
+    DROP COLUMN IF EXISTS hard_stop_requested,
+    DROP COLUMN IF EXISTS kill_requested_at;
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE IF EXISTS notif_statuses
+    ADD COLUMN IF NOT EXISTS kill_requested_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS hard_stop_requested BOOLEAN NOT NULL DEFAULT FALSE;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS timelord_audit;
\ No newline at end of file
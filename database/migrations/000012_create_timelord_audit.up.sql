@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS timelord_audit (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	analysis_id UUID NOT NULL,
+	external_id TEXT NOT NULL,
+	username TEXT NOT NULL,
+	planned_end_date TIMESTAMP WITH TIME ZONE,
+	killed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	reason TEXT NOT NULL,
+	kill_outcome TEXT NOT NULL,
+	notification_outcome TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS timelord_audit_killed_at_index ON timelord_audit (killed_at);
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS timelord_audit
+    DROP COLUMN IF EXISTS app_type;
\ No newline at end of file
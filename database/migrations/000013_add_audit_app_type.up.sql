@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS timelord_audit
+    ADD COLUMN IF NOT EXISTS app_type TEXT NOT NULL DEFAULT '';
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS kill_digests;
\ No newline at end of file
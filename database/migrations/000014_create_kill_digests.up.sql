@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS kill_digests (
+	period_end TIMESTAMP WITH TIME ZONE PRIMARY KEY,
+	sent BOOLEAN NOT NULL
+);
\ No newline at end of file
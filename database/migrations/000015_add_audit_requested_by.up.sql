@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS timelord_audit
+    ADD COLUMN IF NOT EXISTS requested_by TEXT NOT NULL DEFAULT '';
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS kill_pause;
\ No newline at end of file
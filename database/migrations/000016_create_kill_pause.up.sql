@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS kill_pause (
+	id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+	paused BOOLEAN NOT NULL,
+	updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+INSERT INTO kill_pause (id, paused, updated_at) VALUES (TRUE, FALSE, now()) ON CONFLICT DO NOTHING;
\ No newline at end of file
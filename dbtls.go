@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DBTLSConfig contains the TLS settings for the database connection. Empty
+// settings are left out of the connection string, so whatever the URI or
+// lib/pq's defaults say is used instead.
+type DBTLSConfig struct {
+	SSLMode  string // One of the sslmode values that lib/pq accepts.
+	RootCert string // The path to the CA certificate used to verify the server.
+	Cert     string // The path to the client certificate.
+	Key      string // The path to the client certificate's private key.
+}
+
+// dbSSLModes are the sslmode values that lib/pq accepts.
+var dbSSLModes = map[string]bool{
+	"disable":     true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
+}
+
+// Validate checks that the sslmode is one lib/pq accepts and that all of the
+// certificate files exist.
+func (c *DBTLSConfig) Validate() error {
+	if c.SSLMode != "" && !dbSSLModes[c.SSLMode] {
+		return fmt.Errorf("db.tls.sslmode must be disable, require, verify-ca or verify-full, not %q", c.SSLMode)
+	}
+	if (c.Cert == "") != (c.Key == "") {
+		return errors.New("db.tls.cert and db.tls.key must be set together")
+	}
+
+	for _, f := range []struct{ setting, path string }{
+		{"db.tls.root_cert", c.RootCert},
+		{"db.tls.cert", c.Cert},
+		{"db.tls.key", c.Key},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			return errors.Wrapf(err, "error reading %s", f.setting)
+		}
+	}
+
+	return nil
+}
+
+// params returns the connection string parameters for the settings that are
+// set, in a fixed order.
+func (c *DBTLSConfig) params() [][2]string {
+	var params [][2]string
+	for _, p := range [][2]string{
+		{"sslmode", c.SSLMode},
+		{"sslrootcert", c.RootCert},
+		{"sslcert", c.Cert},
+		{"sslkey", c.Key},
+	} {
+		if p[1] != "" {
+			params = append(params, p)
+		}
+	}
+	return params
+}
+
+// quoteDSNValue quotes a value for a keyword/value connection string.
+func quoteDSNValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
+// withDBTLS returns the database connection string with the TLS settings
+// folded into it, replacing any that it already has. Both postgres:// URLs
+// and keyword/value connection strings are supported.
+func withDBTLS(dsn string, c *DBTLSConfig) (string, error) {
+	params := c.params()
+	if len(params) == 0 {
+		return dsn, nil
+	}
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", errors.Wrap(err, "error parsing db.uri")
+		}
+		q := u.Query()
+		for _, p := range params {
+			q.Set(p[0], p[1])
+		}
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+
+	// lib/pq uses the last value given for a keyword, so appending the
+	// settings overrides any that are already in the connection string.
+	fields := []string{strings.TrimSpace(dsn)}
+	for _, p := range params {
+		fields = append(fields, p[0]+"="+quoteDSNValue(p[1]))
+	}
+	return strings.Join(fields, " "), nil
+}
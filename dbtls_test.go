@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithDBTLS(t *testing.T) {
+	tests := []struct {
+		name     string
+		dsn      string
+		config   DBTLSConfig
+		expected string
+	}{
+		{
+			"nothing set",
+			"postgres://de:secret@db:5432/de?sslmode=disable",
+			DBTLSConfig{},
+			"postgres://de:secret@db:5432/de?sslmode=disable",
+		},
+		{
+			"URL",
+			"postgres://de:secret@db:5432/de?sslmode=disable",
+			DBTLSConfig{SSLMode: "verify-full", RootCert: "/etc/ssl/ca.pem", Cert: "/etc/ssl/client.pem", Key: "/etc/ssl/client.key"},
+			"postgres://de:secret@db:5432/de?sslcert=%2Fetc%2Fssl%2Fclient.pem&sslkey=%2Fetc%2Fssl%2Fclient.key&sslmode=verify-full&sslrootcert=%2Fetc%2Fssl%2Fca.pem",
+		},
+		{
+			"postgresql URL",
+			"postgresql://de@db/de",
+			DBTLSConfig{SSLMode: "require"},
+			"postgresql://de@db/de?sslmode=require",
+		},
+		{
+			"keyword/value",
+			"host=db dbname=de sslmode=disable",
+			DBTLSConfig{SSLMode: "verify-ca", RootCert: "/etc/ssl/ca.pem"},
+			"host=db dbname=de sslmode=disable sslmode='verify-ca' sslrootcert='/etc/ssl/ca.pem'",
+		},
+		{
+			"quoted keyword/value",
+			"host=db ",
+			DBTLSConfig{RootCert: `/etc/ssl/it's\ca.pem`},
+			`host=db sslrootcert='/etc/ssl/it\'s\\ca.pem'`,
+		},
+	}
+
+	for _, test := range tests {
+		actual, err := withDBTLS(test.dsn, &test.config)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("%s: connection string was %s, not %s", test.name, actual, test.expected)
+		}
+	}
+}
+
+func TestDBTLSConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.pem")
+	cert := filepath.Join(dir, "client.pem")
+	key := filepath.Join(dir, "client.key")
+	for _, f := range []string{ca, cert, key} {
+		if err := os.WriteFile(f, []byte("pem"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	missing := filepath.Join(dir, "missing.pem")
+
+	tests := []struct {
+		name   string
+		config DBTLSConfig
+		valid  bool
+	}{
+		{"nothing set", DBTLSConfig{}, true},
+		{"everything set", DBTLSConfig{SSLMode: "verify-full", RootCert: ca, Cert: cert, Key: key}, true},
+		{"invalid sslmode", DBTLSConfig{SSLMode: "sometimes"}, false},
+		{"missing root cert", DBTLSConfig{SSLMode: "verify-ca", RootCert: missing}, false},
+		{"missing key file", DBTLSConfig{Cert: cert, Key: missing}, false},
+		{"cert without key", DBTLSConfig{Cert: cert}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.config.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: error was %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// KillDigestEnabled is whether a daily digest of the jobs that were killed is
+// sent to KillDigestAdmin. It's off by default.
+var KillDigestEnabled = false
+
+// KillDigestTime is the time of day the digest is sent, as an offset from
+// midnight. Each digest covers the day leading up to it.
+var KillDigestTime = 8 * time.Hour
+
+// KillDigestAdmin is the user that the digest is sent to.
+var KillDigestAdmin string
+
+// KillDigestAdminEmail is the email address that the digest is emailed to. It
+// isn't emailed if this is empty.
+var KillDigestAdminEmail string
+
+// KillDigestSkipEmpty is whether the digest is skipped for days when nothing
+// was killed.
+var KillDigestSkipEmpty = true
+
+// KillDigestInit sets whether the daily kill digest is sent, when, who it's
+// sent to, and whether it's skipped when nothing was killed.
+func KillDigestInit(enabled bool, at time.Duration, admin, adminEmail string, skipEmpty bool) {
+	KillDigestEnabled = enabled
+	KillDigestTime = at
+	KillDigestAdmin = admin
+	KillDigestAdminEmail = adminEmail
+	KillDigestSkipEmpty = skipEmpty
+}
+
+// KillDigestSubjectFormat is the subject of the daily kill digest.
+const KillDigestSubjectFormat = "%d analyses were killed in the day before %s."
+
+// KillDigestMessageFormat is the message of the daily kill digest. The
+// parameters are the number of analyses killed, the start and end of the
+// period, the counts by app type, and the affected users.
+const KillDigestMessageFormat = `%d analyses were killed between %s and %s.
+
+By app type:
+%s
+
+Affected users:
+%s`
+
+// killDigestTimeFormat is how the start and end of the period are shown in the
+// digest.
+const killDigestTimeFormat = "2006-01-02 15:04 MST"
+
+// KillDigest summarizes the jobs that were killed during a period.
+type KillDigest struct {
+	Start     time.Time      `json:"start"`
+	End       time.Time      `json:"end"`
+	Total     int            `json:"total"`
+	ByAppType map[string]int `json:"by_app_type"`
+	Users     []string       `json:"users"` // Sorted, without duplicates.
+}
+
+// aggregateKills builds the digest of the jobs killed between start and end
+// from their audit log entries. Only the jobs that timelord actually killed
+// are counted, and each one is only counted once, even if it was hard stopped
+// after it was asked to save and exit. Entries from before app types were
+// recorded are counted as "unknown".
+func aggregateKills(entries []AuditEntry, start, end time.Time) *KillDigest {
+	d := &KillDigest{
+		Start:     start,
+		End:       end,
+		ByAppType: map[string]int{},
+		Users:     []string{},
+	}
+
+	analyses := map[string]bool{}
+	users := map[string]bool{}
+
+	for _, e := range entries {
+		if e.KillOutcome != auditKilled || analyses[e.AnalysisID] {
+			continue
+		}
+		analyses[e.AnalysisID] = true
+
+		appType := e.AppType
+		if appType == "" {
+			appType = "unknown"
+		}
+		d.ByAppType[appType]++
+		d.Total++
+
+		if !users[e.User] {
+			users[e.User] = true
+			d.Users = append(d.Users, e.User)
+		}
+	}
+
+	sort.Strings(d.Users)
+	return d
+}
+
+// digestPeriodEnd returns the most recent time at or before now that a digest
+// was due, at offset past midnight in now's location.
+func digestPeriodEnd(now time.Time, offset time.Duration) time.Time {
+	y, m, d := now.Date()
+	end := time.Date(y, m, d, 0, 0, 0, 0, now.Location()).Add(offset)
+	if end.After(now) {
+		end = end.AddDate(0, 0, -1)
+	}
+	return end
+}
+
+// message returns the text of the digest.
+func (d *KillDigest) message() string {
+	var appTypes []string
+	for appType := range d.ByAppType {
+		appTypes = append(appTypes, appType)
+	}
+	sort.Strings(appTypes)
+
+	byAppType := "none"
+	if len(appTypes) > 0 {
+		lines := make([]string, 0, len(appTypes))
+		for _, appType := range appTypes {
+			lines = append(lines, fmt.Sprintf("  %s: %d", appType, d.ByAppType[appType]))
+		}
+		byAppType = strings.Join(lines, "\n")
+	}
+
+	users := "none"
+	if len(d.Users) > 0 {
+		users = "  " + strings.Join(d.Users, "\n  ")
+	}
+
+	return fmt.Sprintf(
+		KillDigestMessageFormat,
+		d.Total,
+		d.Start.Format(killDigestTimeFormat),
+		d.End.Format(killDigestTimeFormat),
+		byAppType,
+		users,
+	)
+}
+
+// SendKillDigest sends the digest to KillDigestAdmin.
+func SendKillDigest(ctx context.Context, d *KillDigest) error {
+	subject := fmt.Sprintf(KillDigestSubjectFormat, d.Total, d.End.Format(killDigestTimeFormat))
+
+	p := NewPayload()
+	p.Action = "kill_digest"
+	p.Email = KillDigestAdminEmail
+	p.User = KillDigestAdmin
+	p.KillDigest = d
+
+	email := KillDigestAdminEmail != ""
+	notif := NewNotification(KillDigestAdmin, subject, d.message(), email, "kill_digest", p)
+
+	if err := Deliver(ctx, notif); err != nil {
+		return errors.Wrap(err, "failed to send notification")
+	}
+
+	return nil
+}
+
+// sendKillDigest sends the digest of the day's kills if one has come due
+// since the last one was handled. Only the most recent day is covered if
+// several were missed. Days without any kills are recorded without sending
+// anything if KillDigestSkipEmpty is set. Failed digests are retried during
+// the next iteration.
+func sendKillDigest(ctx context.Context, vicedb *VICEDatabaser) {
+	if NotifsURI == "" {
+		return
+	}
+
+	end := digestPeriodEnd(CurrentClock.Now(), KillDigestTime)
+
+	last, err := vicedb.LastKillDigest(ctx)
+	if err != nil {
+		log.Error(errors.Wrap(err, "error looking up the last kill digest"))
+		return
+	}
+	if !last.Before(end) {
+		return
+	}
+
+	start := end.AddDate(0, 0, -1)
+	entries, err := vicedb.AuditEntriesBetween(ctx, start, end)
+	if err != nil {
+		log.Error(errors.Wrap(err, "error reading the audit log for the kill digest"))
+		return
+	}
+
+	d := aggregateKills(entries, start, end)
+
+	sent := false
+	if d.Total > 0 || !KillDigestSkipEmpty {
+		if err = SendKillDigest(ctx, d); err != nil {
+			log.Error(errors.Wrap(err, "error sending kill digest"))
+			return
+		}
+		sent = true
+		log.Infof("sent kill digest of %d analyses for the day before %s", d.Total, end)
+	} else {
+		log.Infof("nothing was killed in the day before %s, skipping the kill digest", end)
+	}
+
+	if err = vicedb.AddKillDigest(ctx, end, sent); err != nil {
+		log.Error(errors.Wrap(err, "error recording kill digest"))
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestAggregateKills(t *testing.T) {
+	start := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 1)
+
+	entries := []AuditEntry{
+		{AnalysisID: "job-1", User: "ipcdev", AppType: "interactive", Reason: auditReasonTimeLimit, KillOutcome: auditKilled},
+		{AnalysisID: "job-1", User: "ipcdev", AppType: "interactive", Reason: auditReasonHardStop, KillOutcome: auditKilled},
+		{AnalysisID: "job-2", User: "wregglej", AppType: "de", Reason: auditReasonBatchTimeLimit, KillOutcome: auditKilled},
+		{AnalysisID: "job-3", User: "ipcdev", AppType: "interactive", Reason: auditReasonIdle, KillOutcome: auditKilled},
+		{AnalysisID: "job-4", User: "sarahr", AppType: "interactive", Reason: auditReasonTimeLimit, KillOutcome: auditGone},
+		{AnalysisID: "job-5", User: "aramsey", Reason: auditReasonAdmin, KillOutcome: auditKilled},
+	}
+
+	d := aggregateKills(entries, start, end)
+
+	if d.Total != 4 {
+		t.Errorf("total was %d, not 4", d.Total)
+	}
+	if fmt.Sprint(d.ByAppType) != "map[de:1 interactive:2 unknown:1]" {
+		t.Errorf("counts by app type were %v", d.ByAppType)
+	}
+	if fmt.Sprint(d.Users) != "[aramsey ipcdev wregglej]" {
+		t.Errorf("users were %v", d.Users)
+	}
+	if !d.Start.Equal(start) || !d.End.Equal(end) {
+		t.Errorf("period was %s to %s", d.Start, d.End)
+	}
+
+	msg := d.message()
+	for _, expected := range []string{"4 analyses were killed", "  interactive: 2", "  wregglej"} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("message doesn't contain %q:\n%s", expected, msg)
+		}
+	}
+
+	empty := aggregateKills(nil, start, end)
+	if empty.Total != 0 || len(empty.Users) != 0 || len(empty.ByAppType) != 0 {
+		t.Errorf("empty digest was %+v", empty)
+	}
+}
+
+func TestDigestPeriodEnd(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		now      time.Time
+		expected time.Time
+	}{
+		{day.Add(9 * time.Hour), day.Add(8 * time.Hour)},
+		{day.Add(8 * time.Hour), day.Add(8 * time.Hour)},
+		{day.Add(7 * time.Hour), day.Add(-16 * time.Hour)},
+	}
+
+	for _, test := range tests {
+		if actual := digestPeriodEnd(test.now, 8*time.Hour); !actual.Equal(test.expected) {
+			t.Errorf("at %s: period end was %s, not %s", test.now, actual, test.expected)
+		}
+	}
+}
+
+func TestSendKillDigest(t *testing.T) {
+	defer ClockInit(realClock{})
+	defer SinksInit(&AgentSink{})
+	defer NotifsInit("")
+	defer KillDigestInit(false, 8*time.Hour, "", "", true)
+
+	now := time.Date(2024, 3, 2, 9, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 3, 2, 8, 0, 0, 0, time.UTC)
+	ClockInit(newFakeClock(now))
+	NotifsInit("http://notification-agent")
+
+	killed := []driver.Value{"1", "job-1", "external-1", "ipcdev", "interactive", nil, end.Add(-time.Hour), auditReasonTimeLimit, auditKilled, auditNotifSent, ""}
+
+	tests := []struct {
+		name      string
+		last      driver.Value
+		rows      [][]driver.Value
+		skipEmpty bool
+		sent      bool
+		recorded  bool
+	}{
+		{"kills", nil, [][]driver.Value{killed}, true, true, true},
+		{"empty and skipped", nil, nil, true, false, true},
+		{"empty and sent", nil, nil, false, true, true},
+		{"already handled", end, [][]driver.Value{killed}, true, false, false},
+	}
+
+	for _, test := range tests {
+		KillDigestInit(true, 8*time.Hour, "admin", "admin@example.com", test.skipEmpty)
+		sink := &recordingSink{}
+		SinksInit(sink)
+
+		db, f := newFakeDB(t)
+		f.on("max(period_end)", []string{"max"}, []driver.Value{test.last})
+		f.on("from timelord_audit", auditColumns, test.rows...)
+
+		sendKillDigest(context.Background(), &VICEDatabaser{db: db})
+
+		if sent := len(sink.notifs) > 0; sent != test.sent {
+			t.Errorf("%s: digest sent was %t, not %t", test.name, sent, test.sent)
+		}
+		if recorded := f.ran("insert into kill_digests") > 0; recorded != test.recorded {
+			t.Errorf("%s: digest recorded was %t, not %t", test.name, recorded, test.recorded)
+		}
+		if test.recorded {
+			args := f.argsFor("insert into kill_digests")
+			if len(args) != 2 || !args[0].(time.Time).Equal(end) || args[1] != test.sent {
+				t.Errorf("%s: digest was recorded with %v", test.name, args)
+			}
+		}
+		if !test.sent {
+			continue
+		}
+
+		n := sink.notifs[0]
+		if n.User != "admin" || !n.Email || n.Payload.KillDigest == nil {
+			t.Errorf("%s: notification was %+v", test.name, n)
+			continue
+		}
+		if n.Payload.KillDigest.Total != len(test.rows) {
+			t.Errorf("%s: digest total was %d, not %d", test.name, n.Payload.KillDigest.Total, len(test.rows))
+		}
+		args := f.argsFor("from timelord_audit")
+		if len(args) != 2 || !args[0].(time.Time).Equal(end.AddDate(0, 0, -1)) || !args[1].(time.Time).Equal(end) {
+			t.Errorf("%s: audit log was read with %v", test.name, args)
+		}
+	}
+}
+
+func TestConfigureKillDigest(t *testing.T) {
+	defer KillDigestInit(false, 8*time.Hour, "", "", true)
+
+	tests := []struct {
+		enabled bool
+		at      string
+		admin   string
+		valid   bool
+	}{
+		{true, "06:30", "admin", true},
+		{false, "08:00", "", true},
+		{true, "08:00", "", false},
+		{false, "8am", "", false},
+	}
+
+	for _, test := range tests {
+		cfg := viper.New()
+		cfg.Set("kill_digest.enabled", test.enabled)
+		cfg.Set("kill_digest.time", test.at)
+		cfg.Set("kill_digest.admin_user", test.admin)
+
+		err := ConfigureKillDigest(cfg)
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: error was %v", test, err)
+			continue
+		}
+		if test.valid && test.enabled && KillDigestTime != 6*time.Hour+30*time.Minute {
+			t.Errorf("%+v: digest time was %s", test, KillDigestTime)
+		}
+	}
+}
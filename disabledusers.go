@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DisabledUserKillsEnabled is whether the running interactive jobs of users
+// whose accounts have been disabled are killed regardless of their time
+// limits. It's off by default.
+var DisabledUserKillsEnabled = false
+
+// DisabledUserAdmin is the user that's notified when a disabled user's job is
+// killed, since the disabled user can't do anything about it.
+var DisabledUserAdmin string
+
+// DisabledUserAdminEmail is the email address that the notifications sent to
+// DisabledUserAdmin are emailed to.
+var DisabledUserAdminEmail string
+
+// DisabledUserKillsInit sets whether the jobs of disabled users are killed and
+// who is notified about it.
+func DisabledUserKillsInit(enabled bool, admin, adminEmail string) {
+	DisabledUserKillsEnabled = enabled
+	DisabledUserAdmin = admin
+	DisabledUserAdminEmail = adminEmail
+}
+
+// DisabledUserKillSubjectFormat is the subject of the notification sent to the
+// admin when a disabled user's job is killed.
+const DisabledUserKillSubjectFormat = "Analysis %s of disabled user %s canceled."
+
+// DisabledUserKillMessageFormat is the message sent to the admin when a
+// disabled user's job is killed.
+const DisabledUserKillMessageFormat = `Analysis "%s" (%s) belonging to %s was canceled because the user's account is disabled.
+
+Output files should be available in the %s folder in iRODS.`
+
+// DisabledUsers returns the IDs of the users that iplant-groups no longer
+// knows about, which is what happens to accounts that have been disabled.
+// Users missing from the bulk lookup are only counted as disabled once a
+// lookup of their own comes back as not found, since a partial response or a
+// mismatched ID format would otherwise look the same. Users whose own lookup
+// fails are left out. If none of the users are found by the bulk lookup, an
+// error is returned instead, since it's much more likely that the lookup is
+// broken than that every account is disabled.
+func DisabledUsers(ctx context.Context, ids []string) (map[string]bool, error) {
+	disabled := make(map[string]bool)
+	if len(ids) == 0 {
+		return disabled, nil
+	}
+
+	found, err := lookupUsers(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("none of the %d users were found", len(ids))
+	}
+
+	known := make(map[string]bool, len(found))
+	for _, u := range found {
+		known[u.ID] = true
+	}
+	for _, id := range ids {
+		if known[id] {
+			continue
+		}
+
+		notFound, err := userNotFound(ctx, id)
+		if err != nil {
+			log.Error(errors.Wrapf(err, "error confirming that user %s is disabled, leaving their jobs alone", id))
+			continue
+		}
+		if !notFound {
+			log.Warnf("user %s was missing from the bulk lookup but exists, leaving their jobs alone", id)
+			continue
+		}
+		disabled[id] = true
+	}
+
+	return disabled, nil
+}
+
+// selectDisabledUserJobs returns the jobs that belong to disabled users.
+func selectDisabledUserJobs(jobs []Job, disabled map[string]bool) []Job {
+	selected := []Job{}
+	for _, j := range jobs {
+		if disabled[ParseID(j.User)] {
+			selected = append(selected, j)
+		}
+	}
+	return selected
+}
+
+// DisabledUserJobs returns the running interactive jobs that belong to users
+// whose accounts have been disabled.
+func DisabledUserJobs(ctx context.Context, dedb *sql.DB) ([]Job, error) {
+	jobs, err := RunningInteractiveJobs(ctx, dedb)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing running interactive jobs")
+	}
+
+	seen := make(map[string]bool)
+	var ids []string
+	for _, j := range jobs {
+		id := ParseID(j.User)
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	disabled, err := DisabledUsers(ctx, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "error looking up disabled users")
+	}
+
+	return selectDisabledUserJobs(jobs, disabled), nil
+}
+
+// SendDisabledUserKillNotification tells the admin that a disabled user's job
+// has been killed.
+func SendDisabledUserKillNotification(ctx context.Context, j *Job) error {
+	if NotifsURI == "" || DisabledUserAdmin == "" {
+		log.Infof("notification URI is %s and disabled user admin is %s", NotifsURI, DisabledUserAdmin)
+		return nil
+	}
+
+	sd, err := parseDBTimestamp(j.StartDate)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse %s", j.StartDate)
+	}
+
+	subject := fmt.Sprintf(DisabledUserKillSubjectFormat, j.Name, j.User)
+	msg := fmt.Sprintf(DisabledUserKillMessageFormat, j.Name, j.ID, j.User, displayResultFolder(j.ResultFolder))
+
+	p := NewPayload()
+	p.AnalysisID = j.ID
+	p.AnalysisName = j.Name
+	p.AnalysisDescription = j.Description
+	p.AnalysisStatus = "Canceled"
+	p.StartDate = strconv.FormatInt(sd.UnixMilli(), 10)
+	p.AnalysisResultsFolder = j.ResultFolder
+	if p.AccessURL, err = j.accessURL(); err != nil {
+		return errors.Wrap(err, "failed to determine access URL for job")
+	}
+	p.Email = DisabledUserAdminEmail
+	p.User = DisabledUserAdmin
+
+	email := DisabledUserAdminEmail != ""
+	notif := NewNotification(DisabledUserAdmin, subject, msg, email, "analysis_status_change", p)
+
+	if err = Deliver(ctx, notif); err != nil {
+		return errors.Wrap(err, "failed to send notification")
+	}
+
+	return nil
+}
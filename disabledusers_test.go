@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newLookupServer returns a server for the iplant-groups bulk subject lookup
+// that only knows about the given users. Lookups of single users say that the
+// other users aren't found.
+func newLookupServer(t *testing.T, known ...string) *httptest.Server {
+	return newPartialLookupServer(t, known, known)
+}
+
+// newPartialLookupServer returns a server for the iplant-groups subject
+// lookups whose bulk lookup only returns the users in bulk, while lookups of
+// single users find all of the users in exist.
+func newPartialLookupServer(t *testing.T, bulk, exist []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/subjects/") {
+			id := strings.TrimPrefix(r.URL.Path, "/subjects/")
+			for _, e := range exist {
+				if id == e {
+					json.NewEncoder(w).Encode(User{ID: id})
+					return
+				}
+			}
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Path != "/subjects/lookup" {
+			t.Errorf("unexpected request for %s", r.URL.Path)
+		}
+		known := bulk
+
+		var body struct {
+			SubjectIDs []string `json:"subject_ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+
+		subjects := []User{}
+		for _, id := range body.SubjectIDs {
+			for _, k := range known {
+				if id == k {
+					subjects = append(subjects, User{ID: id})
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string][]User{"subjects": subjects})
+	}))
+}
+
+func TestSelectDisabledUserJobs(t *testing.T) {
+	jobs := []Job{
+		{ID: "job-1", User: "alice@example.com"},
+		{ID: "job-2", User: "bob@example.com"},
+		{ID: "job-3", User: "alice@example.com"},
+	}
+
+	selected := selectDisabledUserJobs(jobs, map[string]bool{"alice": true})
+	if len(selected) != 2 || selected[0].ID != "job-1" || selected[1].ID != "job-3" {
+		t.Errorf("unexpected jobs %+v", selected)
+	}
+
+	if selected = selectDisabledUserJobs(jobs, map[string]bool{}); len(selected) != 0 {
+		t.Errorf("jobs were selected without disabled users: %+v", selected)
+	}
+}
+
+func TestDisabledUsers(t *testing.T) {
+	srv := newLookupServer(t, "bob")
+	defer srv.Close()
+	UsersInit(srv.URL)
+	defer UsersInit("")
+
+	disabled, err := DisabledUsers(context.Background(), []string{"alice", "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disabled) != 1 || !disabled["alice"] {
+		t.Errorf("disabled users were %v, not alice", disabled)
+	}
+}
+
+func TestDisabledUsersPartialResponse(t *testing.T) {
+	// The bulk lookup leaves out alice even though she still exists, and
+	// carol really is gone.
+	srv := newPartialLookupServer(t, []string{"bob"}, []string{"alice", "bob"})
+	defer srv.Close()
+	UsersInit(srv.URL)
+	defer UsersInit("")
+
+	disabled, err := DisabledUsers(context.Background(), []string{"alice", "bob", "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disabled) != 1 || !disabled["carol"] {
+		t.Errorf("disabled users were %v, not carol", disabled)
+	}
+}
+
+func TestDisabledUsersNoneFound(t *testing.T) {
+	srv := newLookupServer(t)
+	defer srv.Close()
+	UsersInit(srv.URL)
+	defer UsersInit("")
+
+	if _, err := DisabledUsers(context.Background(), []string{"alice", "bob"}); err == nil {
+		t.Error("error was nil when no users were found")
+	}
+}
+
+func TestDisabledUserJobs(t *testing.T) {
+	srv := newLookupServer(t, "user")
+	defer srv.Close()
+	UsersInit(srv.URL)
+	defer UsersInit("")
+
+	db, f := newFakeDB(t)
+	enabled := jobRow(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC))
+	disabled := jobRow(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC))
+	disabled[0] = "disabled-job-id"
+	disabled[11] = "gone@example.com"
+	f.on("jobs.status = $1\n   and exists", jobColumns, enabled, disabled)
+	f.on("select job_steps.external_id", []string{"external_id"}, []driver.Value{"external-id"})
+
+	jobs, err := DisabledUserJobs(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != "disabled-job-id" {
+		t.Errorf("unexpected jobs %+v", jobs)
+	}
+	if args := f.argsFor("jobs.status = $1\n   and exists"); len(args) != 1 || args[0] != "Running" {
+		t.Errorf("query args were %v", args)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// exemptPlannedEndDate is the planned end date given to jobs that an admin has
+// exempted from being killed, which keeps them out of jobsToKillQuery and the
+// kill warnings. Clearing the planned end date instead wouldn't last, since
+// EnsurePlannedEndDate sets it again on the job's next status update, as does
+// the sweep for missing planned end dates.
+var exemptPlannedEndDate = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// isExempt returns whether the job has been exempted from being killed. The
+// date read back from the database may be shifted into another timezone, so
+// only the year is compared.
+func isExempt(j *Job) bool {
+	if j.PlannedEndDate == "" {
+		return false
+	}
+	end, err := parseDBTimestamp(j.PlannedEndDate)
+	return err == nil && end.Year() >= exemptPlannedEndDate.Year()
+}
+
+// ExemptJob keeps the job from ever being killed for passing its time limit.
+// The job's warnings are reset and any queued warnings are dropped, so that
+// the user is warned again if the exemption is lifted.
+func ExemptJob(ctx context.Context, dedb *sql.DB, vicedb *VICEDatabaser, job *Job) error {
+	var err error
+
+	if err = setPlannedEndDate(ctx, dedb, job.ID, exemptPlannedEndDate.UnixMilli()); err != nil {
+		return err
+	}
+
+	if err = vicedb.ResetWarnings(ctx, job); err != nil {
+		return errors.Wrapf(err, "error resetting warnings for analysis %s", job.ID)
+	}
+
+	if err = vicedb.DeletePendingWarnings(ctx, job); err != nil {
+		return errors.Wrapf(err, "error deleting queued warnings for analysis %s", job.ID)
+	}
+
+	return nil
+}
+
+const clearPlannedEndDateMutation = `update only jobs set planned_end_date = NULL where id = $1`
+
+// UnexemptJob lifts the job's exemption by computing its planned end date
+// again from its tools' time limits, as if it had never been set. A job whose
+// time limit has already passed is killed during the next iteration of the
+// job killer. If the planned end date can't be computed it's left unset, and
+// the sweep for missing planned end dates tries again later.
+func UnexemptJob(ctx context.Context, dedb *sql.DB, job *Job) error {
+	if _, err := dedb.ExecContext(ctx, clearPlannedEndDateMutation, job.ID); err != nil {
+		return errors.Wrapf(err, "error clearing planned_end_date for job %s", job.ID)
+	}
+
+	job.PlannedEndDate = ""
+	return EnsurePlannedEndDate(ctx, dedb, job)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeResponse is the canned response for statements containing a substring.
+type fakeResponse struct {
+	substr  string
+	columns []string
+	rows    [][]driver.Value
+	fn      func(args []driver.Value) [][]driver.Value
+	err     error
+}
+
+// fakeDB is a minimal database/sql driver for tests. Statements are matched
+// against the registered responses by substring, in the order the responses
+// were registered, and every statement that's run is recorded.
+type fakeDB struct {
+	mu         sync.Mutex
+	responses  []fakeResponse
+	statements []string
+	args       [][]driver.NamedValue
+}
+
+// newFakeDB returns a *sql.DB backed by a new fakeDB.
+func newFakeDB(t *testing.T) (*sql.DB, *fakeDB) {
+	f := &fakeDB{}
+	db := sql.OpenDB(f)
+	t.Cleanup(func() { db.Close() })
+	return db, f
+}
+
+// on registers the rows returned by statements containing substr.
+func (f *fakeDB) on(substr string, columns []string, rows ...[]driver.Value) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, fakeResponse{substr: substr, columns: columns, rows: rows})
+}
+
+// onFunc registers a function that returns the rows for statements containing
+// substr based on the statement's arguments.
+func (f *fakeDB) onFunc(substr string, columns []string, fn func(args []driver.Value) [][]driver.Value) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, fakeResponse{substr: substr, columns: columns, fn: fn})
+}
+
+// onError registers an error returned by statements containing substr.
+func (f *fakeDB) onError(substr string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, fakeResponse{substr: substr, err: err})
+}
+
+// ran returns the number of statements run that contained substr.
+func (f *fakeDB) ran(substr string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, stmt := range f.statements {
+		if strings.Contains(stmt, substr) {
+			count++
+		}
+	}
+	return count
+}
+
+// argsFor returns the arguments of the last statement run that contained substr.
+func (f *fakeDB) argsFor(substr string) []driver.Value {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.statements) - 1; i >= 0; i-- {
+		if strings.Contains(f.statements[i], substr) {
+			var values []driver.Value
+			for _, arg := range f.args[i] {
+				values = append(values, arg.Value)
+			}
+			return values
+		}
+	}
+	return nil
+}
+
+func (f *fakeDB) respond(query string, args []driver.NamedValue) (fakeResponse, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statements = append(f.statements, query)
+	f.args = append(f.args, args)
+	for _, r := range f.responses {
+		if strings.Contains(query, r.substr) {
+			return r, true
+		}
+	}
+	return fakeResponse{}, false
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return &fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return fakeDriver{f} }
+
+type fakeDriver struct{ f *fakeDB }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return &fakeConn{d.f}, nil }
+
+type fakeConn struct{ f *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{c.f, query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	r, ok := c.f.respond(query, args)
+	if !ok {
+		return &fakeRows{}, nil
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.fn != nil {
+		var values []driver.Value
+		for _, arg := range args {
+			values = append(values, arg.Value)
+		}
+		return &fakeRows{columns: r.columns, rows: r.fn(values)}, nil
+	}
+	return &fakeRows{columns: r.columns, rows: r.rows}, nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	r, _ := c.f.respond(query, args)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return driver.RowsAffected(len(r.rows)), nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	f     *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return (&fakeConn{s.f}).ExecContext(context.Background(), s.query, named(args))
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return (&fakeConn{s.f}).QueryContext(context.Background(), s.query, named(args))
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	var n []driver.NamedValue
+	for i, a := range args {
+		n = append(n, driver.NamedValue{Ordinal: i + 1, Value: a})
+	}
+	return n
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	pos     int
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.pos])
+	r.pos++
+	return nil
+}
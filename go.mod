@@ -15,6 +15,8 @@ require (
 	github.com/streadway/amqp v1.0.1-0.20200716223359-e6b33f460591
 	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.31.0
 	go.opentelemetry.io/otel v1.6.3
+	go.opentelemetry.io/otel/sdk v1.6.1
+	go.opentelemetry.io/otel/trace v1.6.3
 )
 
 require (
@@ -36,8 +38,6 @@ require (
 	github.com/uptrace/opentelemetry-go-extra/otelsql v0.1.12 // indirect
 	go.opentelemetry.io/otel/exporters/jaeger v1.6.1 // indirect
 	go.opentelemetry.io/otel/metric v0.29.0 // indirect
-	go.opentelemetry.io/otel/sdk v1.6.1 // indirect
-	go.opentelemetry.io/otel/trace v1.6.3 // indirect
 	golang.org/x/sys v0.1.0 // indirect
 	golang.org/x/text v0.3.8 // indirect
 	gopkg.in/yaml.v2 v2.2.4 // indirect
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// HardStopAfter is how long a VICE analysis can keep running after it was
+// asked to save and exit before it's made to exit without saving. Zero, the
+// default, turns hard stops off.
+var HardStopAfter time.Duration
+
+// HardStopInit sets how long a VICE analysis can keep running after it was
+// asked to save and exit before it's made to exit.
+func HardStopInit(after time.Duration) {
+	HardStopAfter = after
+}
+
+// hardStopDue returns whether an analysis that was asked to save and exit at
+// requestedAt should be made to exit now. Analyses that were never asked to
+// save and exit or have already been hard stopped aren't due.
+func hardStopDue(requestedAt time.Time, hardStopRequested bool, now time.Time, after time.Duration) bool {
+	if after <= 0 || requestedAt.IsZero() || hardStopRequested {
+		return false
+	}
+	return now.Sub(requestedAt) >= after
+}
+
+// hardStopCandidatesQuery selects the running jobs that were asked to save and
+// exit at or before $2 and haven't been made to exit since, whatever they were
+// asked to shut down for. The pages are keyed on $3 and $4.
+const hardStopCandidatesQuery = jobListColumns + `
+  join notif_statuses on jobs.id = notif_statuses.analysis_id
+ where jobs.status = $1
+   and notif_statuses.kill_requested_at is not null
+   and notif_statuses.kill_requested_at <= $2
+   and not notif_statuses.hard_stop_requested
+   and jobs.id > $3
+ order by jobs.id
+ limit $4`
+
+// HardStopCandidates returns the running jobs that were asked to save and exit
+// at least HardStopAfter ago and haven't been made to exit since.
+func HardStopCandidates(ctx context.Context, dedb *sql.DB) ([]Job, error) {
+	return listJobPages(
+		ctx,
+		dedb,
+		hardStopCandidatesQuery,
+		nil,
+		"Running",
+		CurrentClock.Now().Add(-HardStopAfter),
+	)
+}
+
+// hardStopStuckJobs makes the jobs that are still running long after they
+// were asked to save and exit exit without saving, skipping the ones that
+// another timelord instance is handling.
+func hardStopStuckJobs(ctx context.Context, db *sql.DB, vicedb *VICEDatabaser, jobs []Job, stop killFunc) {
+	for _, j := range jobs {
+		j := j
+
+		select {
+		case <-ctx.Done():
+			log.Info("stopping hard stops, the context is done")
+			return
+		default:
+		}
+
+		if killPause.Paused() {
+			log.Info("stopping hard stops, killing has been paused")
+			return
+		}
+
+		locked, err := withJobLock(ctx, db, j.ID, func(ctx context.Context) {
+			hardStopStuckJob(ctx, db, vicedb, stop, &j)
+		})
+		if err != nil {
+			jobLogger(&j).Error(errors.Wrapf(err, "error locking analysis %s", j.ID))
+			continue
+		}
+		if !locked {
+			jobLogger(&j).Infof("analysis %s is being handled by another instance, skipping it", j.ID)
+		}
+	}
+}
+
+// hardStopStuckJob makes the job exit without saving if it's been running for
+// HardStopAfter since it was asked to save and exit. It's only done once per
+// job.
+func hardStopStuckJob(ctx context.Context, db *sql.DB, vicedb *VICEDatabaser, stop killFunc, j *Job) {
+	stopLog := jobLogger(j).WithField("context", "hard stop")
+
+	requestedAt, hardStopRequested, err := vicedb.KillRequest(ctx, j)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		stopLog.Error(err)
+		return
+	}
+
+	if !hardStopDue(requestedAt, hardStopRequested, CurrentClock.Now(), HardStopAfter) {
+		return
+	}
+
+	stopLog.Warnf("analysis is still running %s after it was asked to save and exit, making it exit", HardStopAfter)
+
+	killOutcome := auditKilled
+	if err = stop(ctx, db, j); err != nil {
+		if !errors.Is(err, ErrKillNotFound) {
+			stopLog.Error(errors.Wrap(err, "error hard stopping analysis"))
+			return
+		}
+		killOutcome = auditGone
+	}
+
+	recordKill(ctx, vicedb, j, auditReasonHardStop, killOutcome, auditNotifNone)
+
+	if err = vicedb.SetHardStopRequested(ctx, j, true); err != nil {
+		stopLog.Error(err)
+	}
+}
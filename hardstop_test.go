@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+func TestHardStopDue(t *testing.T) {
+	requestedAt := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name              string
+		requestedAt       time.Time
+		hardStopRequested bool
+		elapsed           time.Duration
+		after             time.Duration
+		due               bool
+	}{
+		{"not long enough", requestedAt, false, 4 * time.Minute, 5 * time.Minute, false},
+		{"long enough", requestedAt, false, 5 * time.Minute, 5 * time.Minute, true},
+		{"well past", requestedAt, false, time.Hour, 5 * time.Minute, true},
+		{"before the request", requestedAt, false, -time.Minute, 5 * time.Minute, false},
+		{"already hard stopped", requestedAt, true, time.Hour, 5 * time.Minute, false},
+		{"never asked to save and exit", time.Time{}, false, time.Hour, 5 * time.Minute, false},
+		{"hard stops turned off", requestedAt, false, time.Hour, 0, false},
+	}
+
+	for _, test := range tests {
+		now := requestedAt.Add(test.elapsed)
+		if due := hardStopDue(test.requestedAt, test.hardStopRequested, now, test.after); due != test.due {
+			t.Errorf("%s: due was %t, not %t", test.name, due, test.due)
+		}
+	}
+}
+
+func TestHardStopStuckJobs(t *testing.T) {
+	defer HardStopInit(0)
+	defer ClockInit(realClock{})
+	HardStopInit(5 * time.Minute)
+
+	requestedAt := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	clock := newFakeClock(requestedAt)
+	ClockInit(clock)
+
+	tests := []struct {
+		name              string
+		elapsed           time.Duration
+		hardStopRequested bool
+		stopped           bool
+	}{
+		{"too soon", 4 * time.Minute, false, false},
+		{"stuck", 5 * time.Minute, false, true},
+		{"already hard stopped", time.Hour, true, false},
+	}
+
+	for _, test := range tests {
+		clock.Set(requestedAt.Add(test.elapsed))
+
+		db, f := newFakeDB(t)
+		f.on("pg_try_advisory_xact_lock", []string{"locked"}, []driver.Value{true})
+		f.on("select kill_requested_at", []string{"kill_requested_at", "hard_stop_requested"}, []driver.Value{requestedAt, test.hardStopRequested})
+
+		var stopped []string
+		stop := func(_ context.Context, _ *sql.DB, j *Job) error {
+			stopped = append(stopped, j.ID)
+			return nil
+		}
+
+		hardStopStuckJobs(context.Background(), db, &VICEDatabaser{db: db}, []Job{{ID: "job-id"}}, stop)
+
+		if (len(stopped) == 1) != test.stopped {
+			t.Errorf("%s: stopped jobs were %v", test.name, stopped)
+		}
+		if recorded := f.ran("set hard_stop_requested") > 0; recorded != test.stopped {
+			t.Errorf("%s: hard stop recorded was %t, not %t", test.name, recorded, test.stopped)
+		}
+	}
+}
+
+func TestHardStopCandidates(t *testing.T) {
+	defer HardStopInit(0)
+	defer ClockInit(realClock{})
+	HardStopInit(5 * time.Minute)
+
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	ClockInit(newFakeClock(now))
+
+	db, f := newFakeDB(t)
+	f.on("notif_statuses.kill_requested_at is not null", jobColumns, jobRow(now.Add(-time.Hour)))
+	f.on("select job_steps.external_id", []string{"external_id"}, []driver.Value{"external-id"})
+
+	jobs, err := HardStopCandidates(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != "job-id" {
+		t.Errorf("unexpected jobs %+v", jobs)
+	}
+
+	args := f.argsFor("notif_statuses.kill_requested_at is not null")
+	if len(args) != 4 || args[0] != "Running" {
+		t.Fatalf("query args were %v", args)
+	}
+	if cutoff, ok := args[1].(time.Time); !ok || !cutoff.Equal(now.Add(-5*time.Minute)) {
+		t.Errorf("requests were cut off at %v, not %s", args[1], now.Add(-5*time.Minute))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// The defaults for the shared HTTP transport. Most of what timelord sends is
+// small requests to a handful of hosts, so it keeps more idle connections to
+// each of them than the standard library's two.
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 20
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultHTTPTimeout         = 30 * time.Second
+)
+
+// httpTransport is the transport shared by all of the requests sent through
+// httpClient.
+var httpTransport = newHTTPTransport(defaultMaxIdleConns, defaultMaxIdleConnsPerHost, defaultIdleConnTimeout)
+
+// newHTTPTransport returns a copy of the default transport with its idle
+// connection pool limits set. Zero values mean no limit, as they do for
+// http.Transport.
+func newHTTPTransport(maxIdleConns, maxIdleConnsPerHost int, idleConnTimeout time.Duration) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = maxIdleConns
+	t.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	t.IdleConnTimeout = idleConnTimeout
+	return t
+}
+
+// HTTPClientInit sets the idle connection pool limits of the shared HTTP
+// client's transport.
+func HTTPClientInit(maxIdleConns, maxIdleConnsPerHost int, idleConnTimeout time.Duration) {
+	httpTransport = newHTTPTransport(maxIdleConns, maxIdleConnsPerHost, idleConnTimeout)
+	httpClient.Transport = otelhttp.NewTransport(httpTransport)
+}
+
+// HTTPTimeoutInit sets how long each request sent through the shared HTTP
+// client can take, including reading the response body. Each retry gets the
+// full timeout. A timeout of zero means there's no limit.
+func HTTPTimeoutInit(timeout time.Duration) {
+	httpClient.Timeout = timeout
+}
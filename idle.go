@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// IdleKillsEnabled is whether running VICE analyses are killed once they've
+// gone IdleKillThreshold without any requests, regardless of their planned end
+// dates. It's off by default. The time limits still apply either way.
+var IdleKillsEnabled = false
+
+// IdleKillThreshold is how long a VICE analysis can go without any requests
+// before it's killed, if IdleKillsEnabled is set.
+var IdleKillThreshold = 2 * time.Hour
+
+// IdleCheckInterval is how often the running VICE analyses are checked for
+// being idle. Each check asks app-exposer about every one of them, so it's
+// done less often than the rest of the job killer's work.
+var IdleCheckInterval = 5 * time.Minute
+
+// idleChecks tracks when the running VICE analyses were last checked for being
+// idle.
+var idleChecks = &intervalGate{}
+
+// IdleKillsInit sets whether idle VICE analyses are killed, how long they can
+// be idle for and how often they're checked.
+func IdleKillsInit(enabled bool, threshold, checkInterval time.Duration) {
+	IdleKillsEnabled = enabled
+	IdleKillThreshold = threshold
+	IdleCheckInterval = checkInterval
+}
+
+// activityFunc returns when a VICE analysis last handled a request, or the
+// zero time if it hasn't handled any.
+type activityFunc func(ctx context.Context, job *Job) (time.Time, error)
+
+// LastActivity asks app-exposer when the VICE analysis last handled a request.
+// The response looks like {"last_activity": "2024-01-01T10:00:00Z"}, with a
+// null or missing last_activity if the analysis hasn't handled any requests.
+func (j *JobKiller) LastActivity(ctx context.Context, job *Job) (time.Time, error) {
+	apiURL, err := url.Parse(j.AppExposerBase)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "error parsing URL %s", j.AppExposerBase)
+	}
+	apiURL.Path = path.Join(apiURL.Path, "vice", job.ExternalID, "activity")
+
+	resp, err := doWithRetry(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, apiURL.String(), nil)
+	})
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "error getting activity for external-id %s", job.ExternalID)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "error reading activity response for external-id %s", job.ExternalID)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return time.Time{}, fmt.Errorf("response status code for GET %s was %d: %s", apiURL.String(), resp.StatusCode, body)
+	}
+
+	var activity struct {
+		LastActivity *time.Time `json:"last_activity"`
+	}
+	if err = json.Unmarshal(body, &activity); err != nil {
+		return time.Time{}, errors.Wrapf(err, "error parsing activity response for external-id %s", job.ExternalID)
+	}
+	if activity.LastActivity == nil {
+		return time.Time{}, nil
+	}
+	return *activity.LastActivity, nil
+}
+
+// IdleJobs returns the jobs that have gone longer than threshold without
+// handling a request as of now. Jobs that haven't handled any requests are
+// idle from their start dates. Jobs that started less than threshold ago can't
+// be idle yet, so their activity isn't looked up. Jobs whose activity can't be
+// looked up are left out rather than risk killing active work, as are jobs
+// that KillFilter doesn't allow.
+func IdleJobs(ctx context.Context, jobs []Job, now time.Time, threshold time.Duration, activity activityFunc) []Job {
+	idle := []Job{}
+
+	for _, j := range jobs {
+		j := j
+
+		if !KillFilter.Allows(&j) {
+			continue
+		}
+
+		start, err := parseDBTimestamp(j.StartDate)
+		if err != nil || j.StartDate == "" {
+			log.Errorf("analysis %s doesn't have a valid start date, not checking whether it's idle", j.ID)
+			continue
+		}
+		if now.Sub(start) <= threshold {
+			continue
+		}
+
+		last, err := activity(ctx, &j)
+		if err != nil {
+			log.Error(errors.Wrapf(err, "error looking up activity for analysis %s", j.ID))
+			continue
+		}
+		if last.IsZero() || last.Before(start) {
+			last = start
+		}
+
+		if now.Sub(last) > threshold {
+			idle = append(idle, j)
+		}
+	}
+
+	return idle
+}
+
+// IdleJobsToKill returns the running interactive jobs that have been idle for
+// longer than IdleKillThreshold.
+func IdleJobsToKill(ctx context.Context, dedb *sql.DB, activity activityFunc) ([]Job, error) {
+	jobs, err := RunningInteractiveJobs(ctx, dedb)
+	if err != nil {
+		return nil, err
+	}
+	return IdleJobs(ctx, jobs, CurrentClock.Now(), IdleKillThreshold, activity), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestIdleJobs(t *testing.T) {
+	defer KillFilterInit(NewJobFilter(nil, nil, nil, nil))
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	threshold := 2 * time.Hour
+	longAgo := now.Add(-24 * time.Hour).Format(TimestampFromDBFormat)
+
+	activity := map[string]time.Time{
+		"active":        now.Add(-time.Hour),
+		"idle":          now.Add(-3 * time.Hour),
+		"boundary":      now.Add(-threshold),
+		"no requests":   {},
+		"before start":  now.Add(-48 * time.Hour),
+		"denied":        now.Add(-3 * time.Hour),
+		"recent start":  {},
+		"lookup failed": {},
+	}
+
+	jobs := []Job{
+		{ID: "active", StartDate: longAgo},
+		{ID: "idle", StartDate: longAgo},
+		{ID: "boundary", StartDate: longAgo},
+		{ID: "no requests", StartDate: longAgo},
+		{ID: "before start", StartDate: now.Add(-time.Hour).Format(TimestampFromDBFormat)},
+		{ID: "recent start", StartDate: now.Add(-time.Hour).Format(TimestampFromDBFormat)},
+		{ID: "denied", StartDate: longAgo, AppID: "denied-app"},
+		{ID: "lookup failed", StartDate: longAgo},
+		{ID: "no start date"},
+	}
+
+	KillFilterInit(NewJobFilter(nil, nil, nil, []string{"denied-app"}))
+
+	var lookedUp []string
+	lookup := func(_ context.Context, j *Job) (time.Time, error) {
+		lookedUp = append(lookedUp, j.ID)
+		if j.ID == "lookup failed" {
+			return time.Time{}, errors.New("app-exposer is down")
+		}
+		return activity[j.ID], nil
+	}
+
+	idle := IdleJobs(context.Background(), jobs, now, threshold, lookup)
+
+	var ids []string
+	for _, j := range idle {
+		ids = append(ids, j.ID)
+	}
+	if len(ids) != 2 || ids[0] != "idle" || ids[1] != "no requests" {
+		t.Errorf("idle jobs were %v, not [idle no requests]", ids)
+	}
+
+	for _, id := range lookedUp {
+		if id == "recent start" || id == "denied" || id == "no start date" {
+			t.Errorf("activity was looked up for %s", id)
+		}
+	}
+}
+
+func TestLastActivity(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		expected time.Time
+		valid    bool
+	}{
+		{"active", http.StatusOK, `{"last_activity": "2024-01-01T10:00:00Z"}`, time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), true},
+		{"no requests", http.StatusOK, `{"last_activity": null}`, time.Time{}, true},
+		{"missing", http.StatusOK, `{}`, time.Time{}, true},
+		{"not found", http.StatusNotFound, `not found`, time.Time{}, false},
+		{"bad body", http.StatusOK, `{"last_activity": "yesterday"}`, time.Time{}, false},
+	}
+
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/vice/external-id/activity" {
+				t.Errorf("%s: unexpected request for %s", test.name, r.URL.Path)
+			}
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+
+		killer := &JobKiller{AppExposerBase: srv.URL}
+		actual, err := killer.LastActivity(context.Background(), &Job{ExternalID: "external-id"})
+		if (err == nil) != test.valid {
+			t.Errorf("%s: error was %v", test.name, err)
+		}
+		if !actual.Equal(test.expected) {
+			t.Errorf("%s: last activity was %s, not %s", test.name, actual, test.expected)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestConfigureIdleKills(t *testing.T) {
+	defer IdleKillsInit(false, 2*time.Hour, 5*time.Minute)
+
+	tests := []struct {
+		enabled       bool
+		threshold     string
+		checkInterval string
+		valid         bool
+	}{
+		{true, "90m", "5m", true},
+		{false, "0s", "0s", true},
+		{true, "0s", "5m", false},
+		{true, "-1h", "5m", false},
+		{true, "90m", "0s", false},
+	}
+
+	for _, test := range tests {
+		cfg := viper.New()
+		cfg.Set("idle_kills.enabled", test.enabled)
+		cfg.Set("idle_kills.threshold", test.threshold)
+		cfg.Set("idle_kills.check_interval", test.checkInterval)
+
+		err := ConfigureIdleKills(cfg)
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: error was %v", test, err)
+			continue
+		}
+		if test.valid && IdleKillsEnabled != test.enabled {
+			t.Errorf("%+v: enabled was %t", test, IdleKillsEnabled)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The default paths of the endpoints that stop analyses, relative to the base
+// URLs of the apps and app-exposer services.
+const (
+	defaultAppsStopPath        = "analyses/{id}/stop"
+	defaultVICESaveAndExitPath = "vice/{externalID}/save-and-exit"
+	defaultVICEExitPath        = "vice/{externalID}/exit"
+)
+
+// AppsStopPath is the path template of the apps endpoint that stops an
+// analysis.
+var AppsStopPath = defaultAppsStopPath
+
+// VICESaveAndExitPath is the path template of the app-exposer endpoint that
+// makes a VICE analysis save its outputs and exit.
+var VICESaveAndExitPath = defaultVICESaveAndExitPath
+
+// VICEExitPath is the path template of the app-exposer endpoint that makes a
+// VICE analysis exit without saving its outputs.
+var VICEExitPath = defaultVICEExitPath
+
+// KillPathsInit sets the path templates of the endpoints that stop analyses.
+func KillPathsInit(appsStop, viceSaveAndExit, viceExit string) {
+	AppsStopPath = appsStop
+	VICESaveAndExitPath = viceSaveAndExit
+	VICEExitPath = viceExit
+}
+
+// killPathPlaceholders are the placeholders that can be used in kill path
+// templates. {id} is the analysis UUID, {externalID} is the invocation ID,
+// and {user} is the short username of the analysis's owner.
+var killPathPlaceholders = map[string]bool{
+	"id":         true,
+	"externalID": true,
+	"user":       true,
+}
+
+var placeholderRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// validateKillPath returns an error if the path template is empty, uses a
+// placeholder that isn't in killPathPlaceholders, or has unbalanced braces.
+func validateKillPath(tmpl string) error {
+	if strings.TrimSpace(tmpl) == "" {
+		return fmt.Errorf("path template must not be empty")
+	}
+
+	for _, m := range placeholderRegexp.FindAllStringSubmatch(tmpl, -1) {
+		if !killPathPlaceholders[m[1]] {
+			return fmt.Errorf("unknown placeholder %s in path template %s", m[0], tmpl)
+		}
+	}
+
+	if rest := placeholderRegexp.ReplaceAllString(tmpl, ""); strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("unbalanced braces in path template %s", tmpl)
+	}
+
+	return nil
+}
+
+// renderKillPath fills in the placeholders of the path template. The username
+// is shortened before it's used. Placeholders without a value are left empty.
+func renderKillPath(tmpl, id, externalID, username string) string {
+	return strings.NewReplacer(
+		"{id}", id,
+		"{externalID}", externalID,
+		"{user}", ParseID(username),
+	).Replace(tmpl)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestRenderKillPath(t *testing.T) {
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{defaultAppsStopPath, "analyses/job-id/stop"},
+		{defaultVICESaveAndExitPath, "vice/external-id/save-and-exit"},
+		{defaultVICEExitPath, "vice/external-id/exit"},
+		{"v2/users/{user}/analyses/{id}/{externalID}", "v2/users/test-user/analyses/job-id/external-id"},
+		{"{id}/{id}", "job-id/job-id"},
+		{"no/placeholders", "no/placeholders"},
+	}
+
+	for _, test := range tests {
+		actual := renderKillPath(test.tmpl, "job-id", "external-id", "test-user@example.com")
+		if actual != test.expected {
+			t.Errorf("%s: path was %s, not %s", test.tmpl, actual, test.expected)
+		}
+	}
+}
+
+func TestValidateKillPath(t *testing.T) {
+	tests := []struct {
+		tmpl  string
+		valid bool
+	}{
+		{defaultAppsStopPath, true},
+		{defaultVICESaveAndExitPath, true},
+		{"users/{user}/analyses/{id}", true},
+		{"no/placeholders", true},
+		{"", false},
+		{"  ", false},
+		{"analyses/{uuid}/stop", false},
+		{"analyses/{}/stop", false},
+		{"analyses/{id/stop", false},
+		{"analyses/id}/stop", false},
+	}
+
+	for _, test := range tests {
+		if err := validateKillPath(test.tmpl); (err == nil) != test.valid {
+			t.Errorf("%q: error was %v", test.tmpl, err)
+		}
+	}
+}
+
+func TestConfigureKillPaths(t *testing.T) {
+	defer KillPathsInit(defaultAppsStopPath, defaultVICESaveAndExitPath, defaultVICEExitPath)
+
+	cfg := viper.New()
+	cfg.Set("kill_paths.apps_stop", "v2/analyses/{id}/stop")
+	cfg.Set("kill_paths.vice_save_and_exit", "v2/vice/{externalID}/save-and-exit")
+	cfg.Set("kill_paths.vice_exit", "v2/vice/{externalID}/exit")
+	if err := ConfigureKillPaths(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := appsStopURL("http://apps", "job-id", "test-user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.String() != "http://apps/v2/analyses/job-id/stop?user=test-user" {
+		t.Errorf("apps stop URL was %s", u)
+	}
+
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	killer := &JobKiller{K8sEnabled: true, AppExposerBase: srv.URL}
+	job := &Job{ID: "job-id", ExternalID: "external-id"}
+	if err = killer.KillJob(context.Background(), nil, job); err != nil {
+		t.Fatal(err)
+	}
+	if err = killer.HardStopJob(context.Background(), nil, job); err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 2 || requested[0] != "/v2/vice/external-id/save-and-exit" || requested[1] != "/v2/vice/external-id/exit" {
+		t.Errorf("requested paths were %v", requested)
+	}
+
+	cfg.Set("kill_paths.vice_exit", "vice/{invocationID}/exit")
+	if err = ConfigureKillPaths(cfg); err == nil {
+		t.Error("no error for an unknown placeholder")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// killRamp limits how many jobs are killed during each iteration of the job
+// killer, so that a backlog of jobs that passed their planned end dates while
+// timelord was down isn't killed in one burst. Iteration k of the ramp kills at
+// most k times step jobs, and once the ramp is over every iteration kills at
+// most as many as its last one did. Only the jobs that a kill is actually
+// tried for count against the limit, so jobs that are still listed after
+// they've been handled don't use it up. Jobs past the limit stay listed and are
+// killed during a later iteration.
+type killRamp struct {
+	mu         sync.Mutex
+	iterations int  // How many iterations the ramp lasts. Zero disables it.
+	step       int  // How much the limit goes up by each iteration.
+	iteration  int  // The current iteration, counting from one.
+	remaining  int  // How many more jobs can be killed during this iteration.
+	finished   bool // Whether the end of the ramp has been logged.
+}
+
+func newKillRamp(iterations, step int) *killRamp {
+	return &killRamp{
+		iterations: iterations,
+		step:       step,
+	}
+}
+
+// startupRamp is the kill ramp used by the job killer loop. It's disabled
+// until KillRampInit is called with a positive number of iterations.
+var startupRamp = newKillRamp(0, 0)
+
+// KillRampInit sets how many iterations the kill ramp lasts for and how much
+// the limit goes up by each iteration.
+func KillRampInit(iterations, step int) {
+	startupRamp = newKillRamp(iterations, step)
+}
+
+// limited returns whether the current iteration has a limit. Must be called
+// with the mutex held.
+func (r *killRamp) limited() bool {
+	return r.iterations > 0 && r.iteration >= 1
+}
+
+// StartIteration resets the limit for the next iteration of the job killer
+// and logs the state of the ramp.
+func (r *killRamp) StartIteration() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.iterations == 0 {
+		return
+	}
+
+	if r.iteration < r.iterations {
+		r.iteration++
+		r.remaining = r.iteration * r.step
+		log.Infof("kill ramp iteration %d of %d, killing at most %d jobs", r.iteration, r.iterations, r.remaining)
+		return
+	}
+
+	r.remaining = r.iterations * r.step
+	if !r.finished {
+		r.finished = true
+		log.Infof("kill ramp finished after %d iterations, killing at most %d jobs per iteration from now on", r.iterations, r.remaining)
+	}
+}
+
+// Allow returns whether another job can be killed during the current
+// iteration and counts it against the limit if it can.
+func (r *killRamp) Allow() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.limited() {
+		return true
+	}
+	if r.remaining == 0 {
+		return false
+	}
+	r.remaining--
+	return true
+}
+
+// Exhausted returns whether no more jobs can be killed during the current
+// iteration.
+func (r *killRamp) Exhausted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.limited() && r.remaining == 0
+}
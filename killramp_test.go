@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestKillRamp(t *testing.T) {
+	ramp := newKillRamp(3, 2)
+
+	// The limit goes up by the step during the ramp and stays at its last
+	// value once the ramp is over.
+	for i, expected := range []int{2, 4, 6, 6, 6} {
+		ramp.StartIteration()
+
+		allowed := 0
+		for j := 0; j < 10; j++ {
+			if ramp.Allow() {
+				allowed++
+			}
+		}
+		if allowed != expected {
+			t.Errorf("iteration %d: %d kills were allowed, not %d", i+1, allowed, expected)
+		}
+		if !ramp.Exhausted() {
+			t.Errorf("iteration %d: the ramp wasn't exhausted", i+1)
+		}
+	}
+}
+
+func TestKillRampDisabled(t *testing.T) {
+	ramp := newKillRamp(0, 0)
+	for i := 0; i < 3; i++ {
+		ramp.StartIteration()
+		for j := 0; j < 10; j++ {
+			if !ramp.Allow() {
+				t.Fatalf("iteration %d: kill %d wasn't allowed", i+1, j+1)
+			}
+		}
+		if ramp.Exhausted() {
+			t.Errorf("iteration %d: the disabled ramp was exhausted", i+1)
+		}
+	}
+}
+
+func TestKillExpiredJobRampSkipsHandledJobs(t *testing.T) {
+	NotifsInit("")
+	UsersInit("")
+	defer KillRampInit(0, 0)
+
+	KillRampInit(1, 1)
+	startupRamp.StartIteration()
+
+	db, f := newFakeDB(t)
+	f.onFunc("hour_warning_failure_count", notifStatusColumns, func(args []driver.Value) [][]driver.Value {
+		row := notifStatusRow(nil)
+		row[0] = args[0]
+		row[6] = args[0] == "handled-id" // kill_warning_sent
+		return [][]driver.Value{row}
+	})
+	vicedb := &VICEDatabaser{db: db}
+
+	var killed []string
+	kill := func(_ context.Context, _ *sql.DB, j *Job) error {
+		killed = append(killed, j.ID)
+		return nil
+	}
+
+	// The job that's already been handled doesn't count against the limit,
+	// so the first job that's left is still killed but the second isn't.
+	for _, id := range []string{"handled-id", "first-id", "second-id"} {
+		j := &Job{ID: id, User: "user@example.com"}
+		killExpiredJob(context.Background(), db, vicedb, kill, j, jobLogger(j), "", KillMaxAttempts)
+	}
+
+	if fmt.Sprint(killed) != "[first-id]" {
+		t.Errorf("killed %v, not [first-id]", killed)
+	}
+}
+
+func TestConfigureKillRamp(t *testing.T) {
+	defer KillRampInit(0, 0)
+
+	tests := []struct {
+		iterations int
+		step       int
+		valid      bool
+	}{
+		{5, 10, true},
+		{0, 0, true},
+		{-1, 10, false},
+		{5, 0, false},
+	}
+
+	for _, test := range tests {
+		cfg := viper.New()
+		cfg.Set("kill_ramp.iterations", test.iterations)
+		cfg.Set("kill_ramp.step", test.step)
+
+		err := ConfigureKillRamp(cfg)
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: error was %v", test, err)
+			continue
+		}
+		if test.valid && (startupRamp.iterations != test.iterations || startupRamp.step != test.step) {
+			t.Errorf("%+v: ramp was %d iterations with a step of %d", test, startupRamp.iterations, startupRamp.step)
+		}
+	}
+}
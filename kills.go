@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// killReason describes why killJobsForReason kills jobs, for the jobs that are
+// killed for something other than passing their time limits.
+type killReason struct {
+	name   string                            // Describes the kills in log messages, such as "idle".
+	audit  string                            // The reason recorded in the audit log.
+	notify func(context.Context, *Job) error // Tells someone that the job was killed.
+}
+
+// idleKill is the reason for killing VICE analyses that have gone too long
+// without handling any requests. Their users are told about it.
+var idleKill = killReason{
+	name:  "idle",
+	audit: auditReasonIdle,
+	notify: func(ctx context.Context, j *Job) error {
+		return SendKillNotification(ctx, j, "", KillReasonIdle)
+	},
+}
+
+// disabledUserKill is the reason for killing the jobs of users whose accounts
+// have been disabled. The admin is told about it rather than the user.
+var disabledUserKill = killReason{
+	name:   "disabled user",
+	audit:  auditReasonDisabledUser,
+	notify: SendDisabledUserKillNotification,
+}
+
+// killJobsForReason kills the jobs that no other timelord instance is handling
+// for the reason. Like killExpiredJobs, it stops before the next job once ctx
+// is done or killing has been paused.
+func killJobsForReason(ctx context.Context, db *sql.DB, vicedb *VICEDatabaser, jobs []Job, kill killFunc, reason killReason) {
+	for _, j := range jobs {
+		j := j
+
+		select {
+		case <-ctx.Done():
+			log.Infof("stopping %s kills, the context is done", reason.name)
+			return
+		default:
+		}
+
+		if killPause.Paused() {
+			log.Infof("stopping %s kills, killing has been paused", reason.name)
+			return
+		}
+
+		locked, err := withJobLock(ctx, db, j.ID, func(ctx context.Context) {
+			killJobForReason(ctx, db, vicedb, kill, &j, reason)
+		})
+		if err != nil {
+			jobLogger(&j).Error(errors.Wrapf(err, "error locking analysis %s", j.ID))
+			continue
+		}
+		if !locked {
+			jobLogger(&j).Infof("analysis %s is being handled by another instance, skipping it", j.ID)
+		}
+	}
+}
+
+// killJobForReason kills a job for the reason and sends the reason's
+// notification. The job's kill_warning_sent flag keeps it from being killed
+// again while the status change is still on its way.
+func killJobForReason(ctx context.Context, db *sql.DB, vicedb *VICEDatabaser, kill killFunc, j *Job, reason killReason) {
+	killLog := jobLogger(j).WithField("context", reason.name+" kill")
+
+	notifStatuses, err := vicedb.EnsureNotifStatuses(ctx, j)
+	if err != nil {
+		killLog.Error(err)
+		return
+	}
+	if notifStatuses.KillWarningSent {
+		return
+	}
+
+	if err = kill(ctx, db, j); err != nil {
+		killLog.Error(errors.Wrap(err, "error terminating analysis"))
+
+		if reasonErr := vicedb.SetKillFailureReason(ctx, j, KillFailureReason(err)); reasonErr != nil {
+			killLog.Error(reasonErr)
+		}
+
+		// Anything other than the analysis already being gone is retried
+		// during the next iteration.
+		if !errors.Is(err, ErrKillNotFound) {
+			return
+		}
+
+		recordKill(ctx, vicedb, j, reason.audit, auditGone, auditNotifNone)
+	} else {
+		killLog.Warnf("killed analysis, reason: %s", reason.name)
+
+		if err = vicedb.SetKillRequestedAt(ctx, j, CurrentClock.Now()); err != nil {
+			killLog.Error(err)
+		}
+
+		notifOutcome := auditNotifSent
+		if err = reason.notify(ctx, j); err != nil {
+			killLog.Error(errors.Wrap(err, "error sending notification"))
+			notifOutcome = auditNotifFailed
+		}
+
+		recordKill(ctx, vicedb, j, reason.audit, auditKilled, notifOutcome)
+	}
+
+	if err = vicedb.SetKillWarningSent(ctx, j, true); err != nil {
+		killLog.Error(err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+func TestKillJobsForReason(t *testing.T) {
+	tests := []struct {
+		name         string
+		killErr      error
+		notifyErr    error
+		killOutcome  string
+		notified     int
+		notifOutcome string
+		flagged      bool
+	}{
+		{"killed", nil, nil, auditKilled, 1, auditNotifSent, true},
+		{"notification failed", nil, errors.New("unavailable"), auditKilled, 1, auditNotifFailed, true},
+		{"already gone", ErrKillNotFound, nil, auditGone, 0, auditNotifNone, true},
+		{"kill failed", ErrKillUpstream, nil, "", 0, "", false},
+	}
+
+	for _, test := range tests {
+		db, f := newFakeDB(t)
+		f.on("pg_try_advisory_xact_lock", []string{"locked"}, []driver.Value{true})
+		f.on("hour_warning_failure_count", notifStatusColumns, notifStatusRow(nil))
+
+		notified := 0
+		reason := killReason{
+			name:  "test",
+			audit: auditReasonIdle,
+			notify: func(context.Context, *Job) error {
+				notified++
+				return test.notifyErr
+			},
+		}
+		kill := func(context.Context, *sql.DB, *Job) error {
+			return test.killErr
+		}
+
+		killJobsForReason(context.Background(), db, &VICEDatabaser{db: db}, []Job{{ID: "job-id"}}, kill, reason)
+
+		if notified != test.notified {
+			t.Errorf("%s: notified %d times, not %d", test.name, notified, test.notified)
+		}
+
+		args := f.argsFor("insert into timelord_audit")
+		if test.killOutcome == "" {
+			if args != nil {
+				t.Errorf("%s: audit entry was added: %v", test.name, args)
+			}
+		} else if len(args) != 10 || args[6] != auditReasonIdle || args[7] != test.killOutcome || args[8] != test.notifOutcome {
+			t.Errorf("%s: audit entry args were %v", test.name, args)
+		}
+
+		if flagged := f.ran("set kill_warning_sent") > 0; flagged != test.flagged {
+			t.Errorf("%s: kill_warning_sent was set: %t", test.name, flagged)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// LeaderElectionEnabled is whether replicas elect a leader to run the job
+// killer loop and consume status updates. It's off by default, which is what
+// a single replica wants.
+var LeaderElectionEnabled = false
+
+// LeaderLeaseDuration is how long the leader holds its lease without renewing
+// it before another replica can take over.
+var LeaderLeaseDuration = 30 * time.Second
+
+// LeaderElectionInit sets whether replicas elect a leader and how long the
+// leader's lease lasts.
+func LeaderElectionInit(enabled bool, lease time.Duration) {
+	LeaderElectionEnabled = enabled
+	LeaderLeaseDuration = lease
+}
+
+// leaderLeaseName is the name of the lease that timelord replicas compete for.
+const leaderLeaseName = "timelord"
+
+// acquireLeaseQuery takes the lease if nobody holds it or the holder's lease
+// has expired, and renews it if we already hold it. The expiration time comes
+// from the database's clock so that the replicas' clocks don't matter. It only
+// returns a row if we hold the lease afterwards.
+const acquireLeaseQuery = `
+insert into leader_leases (name, holder, expires_at)
+values ($1, $2, now() + cast($3 as interval))
+on conflict (name) do update
+   set holder = excluded.holder,
+       expires_at = excluded.expires_at
+ where leader_leases.holder = excluded.holder
+    or leader_leases.expires_at < now()
+returning holder
+`
+
+// LeaderElector competes for the leader lease in the leader_leases table on
+// behalf of a replica and keeps renewing it once the replica has it.
+type LeaderElector struct {
+	db            *sql.DB
+	Name          string        // The name of the lease.
+	ID            string        // Identifies the replica, usually its hostname.
+	LeaseDuration time.Duration // How long the lease lasts without being renewed.
+
+	// OnLost is called when the replica loses the lease after holding it.
+	OnLost func()
+
+	mu        sync.RWMutex
+	leader    bool
+	renewedAt time.Time
+	acquired  chan struct{} // Closed when the replica first gets the lease.
+	once      sync.Once
+}
+
+// NewLeaderElector returns a *LeaderElector for the named lease.
+func NewLeaderElector(db *sql.DB, name, id string, lease time.Duration) *LeaderElector {
+	return &LeaderElector{
+		db:            db,
+		Name:          name,
+		ID:            id,
+		LeaseDuration: lease,
+		acquired:      make(chan struct{}),
+	}
+}
+
+// IsLeader returns whether the replica currently holds the lease.
+func (e *LeaderElector) IsLeader() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.leader
+}
+
+// setLeader records whether the replica holds the lease, calling OnLost if it
+// just lost it.
+func (e *LeaderElector) setLeader(leader bool, now time.Time) {
+	e.mu.Lock()
+	wasLeader := e.leader
+	e.leader = leader
+	if leader {
+		e.renewedAt = now
+	}
+	e.mu.Unlock()
+
+	if leader {
+		e.once.Do(func() { close(e.acquired) })
+	}
+	if wasLeader && !leader && e.OnLost != nil {
+		e.OnLost()
+	}
+}
+
+// TryAcquire tries to take or renew the lease and returns whether the replica
+// holds it afterwards. If the database can't be reached, the replica keeps
+// the lease until it would have expired.
+func (e *LeaderElector) TryAcquire(ctx context.Context) (bool, error) {
+	now := time.Now()
+
+	var holder string
+	err := e.db.QueryRowContext(
+		ctx,
+		acquireLeaseQuery,
+		e.Name,
+		e.ID,
+		fmt.Sprintf("%d milliseconds", e.LeaseDuration.Milliseconds()),
+	).Scan(&holder)
+
+	switch {
+	case err == sql.ErrNoRows:
+		e.setLeader(false, now)
+	case err != nil:
+		e.mu.RLock()
+		expired := now.Sub(e.renewedAt) >= e.LeaseDuration
+		e.mu.RUnlock()
+		if expired {
+			e.setLeader(false, now)
+		}
+		return e.IsLeader(), errors.Wrapf(err, "error acquiring the %s lease", e.Name)
+	default:
+		e.setLeader(holder == e.ID, now)
+	}
+
+	return e.IsLeader(), nil
+}
+
+// WaitForLeadership blocks until the replica first gets the lease or ctx is
+// done.
+func (e *LeaderElector) WaitForLeadership(ctx context.Context) error {
+	select {
+	case <-e.acquired:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run tries to take or renew the lease three times per lease duration until
+// ctx is done.
+func (e *LeaderElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.LeaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		if _, err := e.TryAcquire(ctx); err != nil {
+			log.Error(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestLease returns a fake database holding a single lease, along with a
+// function that sets its holder. The acquire query only returns a row if the
+// replica asking for the lease is the holder, like the real one.
+func newTestLease(t *testing.T) (*sql.DB, *fakeDB, func(string)) {
+	var (
+		mu     sync.Mutex
+		holder string
+	)
+
+	db, f := newFakeDB(t)
+	f.onFunc("insert into leader_leases", []string{"holder"}, func(args []driver.Value) [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		if holder == "" {
+			holder = args[1].(string)
+		}
+		if holder != args[1].(string) {
+			return nil
+		}
+		return [][]driver.Value{{holder}}
+	})
+
+	return db, f, func(h string) {
+		mu.Lock()
+		defer mu.Unlock()
+		holder = h
+	}
+}
+
+func TestLeaderElectorAcquire(t *testing.T) {
+	db, f, _ := newTestLease(t)
+	e := NewLeaderElector(db, leaderLeaseName, "replica-1", 30*time.Second)
+
+	leader, err := e.TryAcquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !leader || !e.IsLeader() {
+		t.Error("the free lease wasn't acquired")
+	}
+	if err = e.WaitForLeadership(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	args := f.argsFor("insert into leader_leases")
+	if len(args) != 3 || args[0] != leaderLeaseName || args[1] != "replica-1" || args[2] != "30000 milliseconds" {
+		t.Errorf("lease args were %v", args)
+	}
+}
+
+func TestLeaderElectorRenew(t *testing.T) {
+	db, f, _ := newTestLease(t)
+	e := NewLeaderElector(db, leaderLeaseName, "replica-1", 30*time.Second)
+
+	lost := false
+	e.OnLost = func() { lost = true }
+
+	for i := 0; i < 3; i++ {
+		if leader, err := e.TryAcquire(context.Background()); err != nil || !leader {
+			t.Fatalf("renewal %d: leader was %t, error was %v", i, leader, err)
+		}
+	}
+	if lost {
+		t.Error("the lease was lost while it was being renewed")
+	}
+	if f.ran("insert into leader_leases") != 3 {
+		t.Errorf("the lease was requested %d times, not 3", f.ran("insert into leader_leases"))
+	}
+}
+
+func TestLeaderElectorTakeover(t *testing.T) {
+	db, _, setHolder := newTestLease(t)
+	setHolder("replica-1")
+
+	e := NewLeaderElector(db, leaderLeaseName, "replica-2", 30*time.Second)
+
+	leader, err := e.TryAcquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leader {
+		t.Error("a lease held by another replica was acquired")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = e.WaitForLeadership(ctx); err == nil {
+		t.Error("the follower didn't keep waiting for leadership")
+	}
+
+	// The other replica's lease expired, so the lease is free again.
+	setHolder("")
+	if leader, err = e.TryAcquire(context.Background()); err != nil || !leader {
+		t.Errorf("the expired lease wasn't taken over: leader was %t, error was %v", leader, err)
+	}
+	if err = e.WaitForLeadership(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLeaderElectorLost(t *testing.T) {
+	db, _, setHolder := newTestLease(t)
+	e := NewLeaderElector(db, leaderLeaseName, "replica-1", 30*time.Second)
+
+	lost := 0
+	e.OnLost = func() { lost++ }
+
+	if leader, _ := e.TryAcquire(context.Background()); !leader {
+		t.Fatal("the free lease wasn't acquired")
+	}
+
+	setHolder("replica-2")
+	if leader, _ := e.TryAcquire(context.Background()); leader {
+		t.Error("the replica is still the leader after another one took over")
+	}
+	if lost != 1 {
+		t.Errorf("OnLost was called %d times, not 1", lost)
+	}
+}
+
+func TestLeaderElectorDatabaseError(t *testing.T) {
+	db, f := newFakeDB(t)
+	f.onError("insert into leader_leases", errors.New("connection refused"))
+
+	e := NewLeaderElector(db, leaderLeaseName, "replica-1", time.Hour)
+	e.setLeader(true, time.Now())
+
+	leader, err := e.TryAcquire(context.Background())
+	if err == nil {
+		t.Error("error was nil")
+	}
+	if !leader {
+		t.Error("the lease was given up before it expired")
+	}
+
+	e.setLeader(true, time.Now().Add(-2*time.Hour))
+	if leader, _ = e.TryAcquire(context.Background()); leader {
+		t.Error("the lease was kept after it expired")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The names of the job lists recorded in the loop state.
+const (
+	periodicList         = "periodic_warnings"
+	killList             = "kills"
+	batchKillList        = "batch_kills"
+	disabledUserKillList = "disabled_user_kills"
+	idleKillList         = "idle_kills"
+)
+
+// warningListName returns the name of the job list recorded for the warning
+// threshold, in minutes.
+func warningListName(thresholdMinutes int64) string {
+	return fmt.Sprintf("warnings_%d", thresholdMinutes)
+}
+
+// JobList is a list of jobs computed by the job killer loop along with when
+// it was computed.
+type JobList struct {
+	ComputedAt time.Time    `json:"computed_at"`
+	Jobs       []JobSummary `json:"jobs"`
+}
+
+// JobSummary describes a job in the lists returned by the admin and debug
+// endpoints.
+type JobSummary struct {
+	ID             string `json:"id"`
+	ExternalID     string `json:"external_id"`
+	User           string `json:"user"`
+	Name           string `json:"name"`
+	StartDate      string `json:"start_date"`
+	PlannedEndDate string `json:"planned_end_date"`
+}
+
+// summarizeJobs returns the summaries of the jobs.
+func summarizeJobs(jobs []Job) []JobSummary {
+	summaries := make([]JobSummary, 0, len(jobs))
+	for _, j := range jobs {
+		summaries = append(summaries, JobSummary{
+			ID:             j.ID,
+			ExternalID:     j.ExternalID,
+			User:           j.User,
+			Name:           j.Name,
+			StartDate:      j.StartDate,
+			PlannedEndDate: j.PlannedEndDate,
+		})
+	}
+	return summaries
+}
+
+// LoopState holds the most recent job lists computed by the job killer loop
+// so they can be inspected over HTTP. It's written by the loop and read by the
+// HTTP handlers, so access to it is guarded by a mutex.
+type LoopState struct {
+	mu    sync.RWMutex
+	lists map[string]JobList
+}
+
+func newLoopState() *LoopState {
+	return &LoopState{lists: make(map[string]JobList)}
+}
+
+// Record replaces the named job list.
+func (s *LoopState) Record(name string, jobs []Job) {
+	list := JobList{
+		ComputedAt: time.Now(),
+		Jobs:       summarizeJobs(jobs),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lists[name] = list
+}
+
+// Snapshot returns a copy of the recorded job lists.
+func (s *LoopState) Snapshot() map[string]JobList {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	lists := make(map[string]JobList, len(s.lists))
+	for name, list := range s.lists {
+		lists[name] = list
+	}
+	return lists
+}
+
+// loopState is the state of the most recent job killer loop iteration.
+var loopState = newLoopState()
+
+// loopStarted and lastIteration are when the job killer loop started and when
+// it last finished an iteration without being cut off, in nanoseconds since
+// the epoch. They're zero until it happens.
+var (
+	loopStarted   atomic.Int64
+	lastIteration atomic.Int64
+)
+
+func init() {
+	expvar.Publish("last_iteration", expvar.Func(func() any {
+		if t := lastIterationTime(); !t.IsZero() {
+			return t.Format(time.RFC3339)
+		}
+		return nil
+	}))
+}
+
+// recordLoopStart records when the job killer loop started.
+func recordLoopStart(t time.Time) {
+	loopStarted.Store(t.UnixNano())
+}
+
+// recordIteration records when the job killer loop last finished an iteration.
+func recordIteration(t time.Time) {
+	lastIteration.Store(t.UnixNano())
+}
+
+// lastIterationTime returns when the job killer loop last finished an
+// iteration, or the zero time if it hasn't finished one yet.
+func lastIterationTime() time.Time {
+	if n := lastIteration.Load(); n != 0 {
+		return time.Unix(0, n).UTC()
+	}
+	return time.Time{}
+}
+
+// loopStale returns whether the job killer loop has gone longer than
+// threshold without finishing an iteration, counting from when it started if
+// it hasn't finished one yet. The loop is never stale before it's started or
+// if threshold is zero or less.
+func loopStale(now time.Time, threshold time.Duration) bool {
+	if threshold <= 0 {
+		return false
+	}
+
+	since := lastIteration.Load()
+	if since == 0 {
+		since = loopStarted.Load()
+	}
+	if since == 0 {
+		return false
+	}
+
+	return now.Sub(time.Unix(0, since)) > threshold
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoopStateConcurrentAccess(t *testing.T) {
+	s := newLoopState()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.Record(killList, []Job{{ID: "job-id"}})
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		for _, list := range s.Snapshot() {
+			_ = len(list.Jobs)
+		}
+	}
+	<-done
+}
+
+// resetIterations forgets when the job killer loop started and last finished
+// an iteration.
+func resetIterations() {
+	loopStarted.Store(0)
+	lastIteration.Store(0)
+}
+
+func TestLoopStale(t *testing.T) {
+	defer resetIterations()
+
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	threshold := 5 * time.Minute
+
+	resetIterations()
+	if loopStale(start.Add(time.Hour), threshold) {
+		t.Error("loop was stale before it started")
+	}
+
+	recordLoopStart(start)
+
+	tests := []struct {
+		name      string
+		last      time.Time
+		now       time.Time
+		threshold time.Duration
+		stale     bool
+	}{
+		{"no iterations yet", time.Time{}, start.Add(threshold), threshold, false},
+		{"first iteration overdue", time.Time{}, start.Add(threshold + time.Second), threshold, true},
+		{"at the threshold", start.Add(time.Minute), start.Add(time.Minute + threshold), threshold, false},
+		{"past the threshold", start.Add(time.Minute), start.Add(time.Minute + threshold + time.Nanosecond), threshold, true},
+		{"check disabled", start.Add(time.Minute), start.Add(time.Hour), 0, false},
+	}
+
+	for _, test := range tests {
+		lastIteration.Store(0)
+		if !test.last.IsZero() {
+			recordIteration(test.last)
+		}
+
+		if stale := loopStale(test.now, test.threshold); stale != test.stale {
+			t.Errorf("%s: stale was %t, not %t", test.name, stale, test.stale)
+		}
+	}
+}
@@ -5,14 +5,19 @@ import (
 	"database/sql"
 	"flag"
 	"fmt"
-	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "expvar"
+	_ "time/tzdata"
 
 	"github.com/cyverse-de/configurate"
 	"github.com/cyverse-de/dbutil"
@@ -22,62 +27,206 @@ import (
 	"github.com/spf13/viper"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 
 	_ "github.com/lib/pq"
-
-	"github.com/cyverse-de/messaging/v9"
 )
 
 const serviceName = "timelord"
 const otelName = "github.com/cyverse-de/timelord"
 
-var httpClient = http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+var httpClient = http.Client{Transport: otelhttp.NewTransport(httpTransport), Timeout: defaultHTTPTimeout}
 
 const defaultConfig = `db:
   uri: "db:5432"
+  timezone: UTC
+  tls:
+    sslmode: ""
+    root_cert: ""
+    cert: ""
+    key: ""
 notification_agent:
   base: http://notification-agent
+email:
+  base: http://iplant-email
 iplant_groups:
   base: http://iplant-groups
   user: grouper-user
+  max_concurrent_requests: 10
+user_info:
+  base: ""
 k8s:
   frontend:
     base: ""
+  subdomain:
+    prefix: a
+    length: 9
+hard_stop:
+  after: 0s
+kill_ramp:
+  iterations: 0
+  step: 10
+job_limits:
+  default_seconds: 259200
+  min_seconds: 0
+  max_seconds: 0
+  max_extensions: 3
+kill_filters:
+  allow_system_ids: []
+  deny_system_ids: []
+  allow_app_ids: []
+  deny_app_ids: []
+kill_blackouts:
+  windows: []
+  skip_warnings: false
+kill_pause:
+  skip_warnings: false
+leader_election:
+  enabled: false
+  lease_duration: 30s
+usage_warnings:
+  enabled: false
+  window: 720h
+  threshold: 500h
+  check_interval: 1h
+idle_kills:
+  enabled: false
+  threshold: 2h
+  check_interval: 5m
+kill_paths:
+  apps_stop: analyses/{id}/stop
+  vice_save_and_exit: vice/{externalID}/save-and-exit
+  vice_exit: vice/{externalID}/exit
+disabled_users:
+  kill_jobs: false
+  admin_user: ""
+  admin_email: ""
+kill_digest:
+  enabled: false
+  time: "08:00"
+  admin_user: ""
+  admin_email: ""
+  skip_empty: true
+batch_limits:
+  enabled: false
+  default_seconds: 604800
+notifications:
+  periodic_default: 4h
+  periodic_min_runtime: 0s
+  warning_thresholds: ""
+  max_attempts:
+    warning: 3
+    kill: 3
+  gone_enabled: false
+  lookup_fallback: false
+  templates_file: ""
+  status_history: 0
+  result_folders:
+    prefix: ""
+    display_prefix: ""
+  cc:
+    users: []
+    groups: []
+http_client:
+  max_idle_conns: 100
+  max_idle_conns_per_host: 20
+  idle_conn_timeout: 90s
+  timeout: 30s
+  max_retries: 2
+  base_backoff: 500ms
+  max_backoff: 5s
+amqp:
+  consumers:
+    prefetch: 100
+    concurrency: 1
+  reconnect:
+    base_backoff: 1s
+    max_backoff: 1m
 `
 
-const warningSentKey = "warningsent"
-const oneDayWarningKey = "onedaywarning"
+func sendNotif(ctx context.Context, j *Job, status, subject, msg string, email bool, email_template string, opts ...PayloadOption) error {
+	notif, _, err := jobNotif(ctx, j, status, subject, msg, email, email_template, opts...)
+	if err != nil {
+		return err
+	}
+	return deliverNotif(ctx, notif)
+}
 
-func sendNotif(ctx context.Context, j *Job, status, subject, msg string, email bool, email_template string) error {
+// deliverNotif delivers a notification built by jobNotif. Does nothing if the
+// notification is nil because notifications aren't configured.
+func deliverNotif(ctx context.Context, notif *Notification) error {
+	if notif == nil {
+		return nil
+	}
+
+	if err := Deliver(ctx, notif); err != nil {
+		return errors.Wrap(err, "failed to send notification")
+	}
+
+	return nil
+}
+
+// deliverNotifWithCopies delivers the notification like deliverNotif does,
+// then sends copies of it to the addresses configured for the user or their
+// groups.
+func deliverNotifWithCopies(ctx context.Context, notif *Notification, user *User) error {
+	if notif == nil {
+		return nil
+	}
+
+	if err := deliverNotif(ctx, notif); err != nil {
+		return err
+	}
+
+	sendCopies(ctx, notif, user)
+
+	return nil
+}
+
+// jobNotif builds the notification about the job for its user, returning the
+// user along with it. Returns a nil notification if notifications aren't
+// configured.
+func jobNotif(ctx context.Context, j *Job, status, subject, msg string, email bool, email_template string, opts ...PayloadOption) (*Notification, *User, error) {
 	var err error
 
 	// Don't send notification if things aren't configured correctly. It's
 	// technically not an error, for now.
-	if NotifsURI == "" || UsersURI == "" {
+	if !notifsConfigured() {
 		log.Infof("notification URI is %s and iplant-groups URI is %s", NotifsURI, UsersURI)
-		return nil
+		return nil, nil, nil
+	}
+
+	u := ParseID(j.User)
+	if u == "" {
+		return nil, nil, fmt.Errorf("analysis %s doesn't have a user to notify", j.ID)
 	}
 
 	// We need to get the user's email address from the iplant-groups service.
-	user := NewUser(ParseID(j.User))
+	// If that fails, the in-app notification can still be sent if that's
+	// enabled, since it only needs the username.
+	user := NewUser(u)
 	if err = user.Get(ctx); err != nil {
-		return errors.Wrap(err, "failed to get user info")
+		if !LookupFallbackEnabled {
+			return nil, nil, errors.Wrap(err, "failed to get user info")
+		}
+		log.Error(errors.Wrapf(err, "failed to get user info for %s, sending the notification for analysis %s without an email", u, j.ID))
+		user = &User{URI: UsersURI, ID: u}
+		email = false
 	}
 
-	u := ParseID(j.User)
-	sd, err := time.ParseInLocation(TimestampFromDBFormat, j.StartDate, time.Local)
+	sd, err := parseDBTimestamp(j.StartDate)
 	if err != nil {
-		return errors.Wrapf(err, "failed to parse %s", j.StartDate)
+		return nil, nil, errors.Wrapf(err, "failed to parse %s", j.StartDate)
 	}
 	sdmillis := sd.UnixNano() / 1000000
 
 	durString, err := getJobDuration(j)
 	if err != nil {
-		return errors.Wrapf(err, "failed to parse job duration from %s", j.StartDate)
+		return nil, nil, errors.Wrapf(err, "failed to parse job duration from %s", j.StartDate)
 	}
 	remainingString, err := getRemainingDuration(j)
 	if err != nil {
-		return errors.Wrapf(err, "failed to parse remaining time duration from %s", j.PlannedEndDate)
+		return nil, nil, errors.Wrapf(err, "failed to parse remaining time duration from %s", j.PlannedEndDate)
 	}
 
 	p := NewPayload()
@@ -91,47 +240,260 @@ func sendNotif(ctx context.Context, j *Job, status, subject, msg string, email b
 	p.EndDuration = remainingString
 	access_url, err := j.accessURL()
 	if err != nil {
-		return errors.Wrapf(err, "failed to determine access URL for job")
+		return nil, nil, errors.Wrapf(err, "failed to determine access URL for job")
 	}
 	if access_url != "" {
 		p.AccessURL = access_url
 	}
+	if email && !emailEnabled(ctx, u) {
+		log.Debugf("%s has turned off email notifications, not emailing them about analysis %s", u, j.ID)
+		email = false
+	}
 	if email {
 		p.Email = user.Email
 	}
 	p.User = u
+	for _, opt := range opts {
+		opt(p)
+	}
 
-	notif := NewNotification(u, subject, msg, email, email_template, p)
+	return NewNotification(u, subject, msg, email, email_template, p), user, nil
+}
 
-	resp, err := notif.Send(ctx)
+// ConfigureNotifications sets up the notification emitters.
+func ConfigureNotifications(cfg *viper.Viper, notifPath string) error {
+	notifBase := cfg.GetString("notification_agent.base")
+	notifURL, err := url.Parse(notifBase)
 	if err != nil {
-		return errors.Wrap(err, "failed to send notification")
+		return errors.Wrapf(err, "failed to parse %s", notifBase)
+	}
+	notifURL = notifURL.JoinPath(notifPath)
+
+	NotifsInit(notifURL.String())
+
+	sinks := []Sink{&AgentSink{}}
+	if webhookURL := cfg.GetString("notification_webhook.url"); webhookURL != "" {
+		if _, err = url.Parse(webhookURL); err != nil {
+			return errors.Wrapf(err, "failed to parse %s", webhookURL)
+		}
+		sinks = append(sinks, &WebhookSink{URL: webhookURL})
+	}
+	SinksInit(sinks...)
+
+	return nil
+}
+
+// ConfigurePeriodicNotifications sets up the default period between periodic
+// notifications and how long jobs must run before they're sent.
+func ConfigurePeriodicNotifications(cfg *viper.Viper) error {
+	periodicDefault := cfg.GetDuration("notifications.periodic_default")
+	if periodicDefault <= 0 {
+		return fmt.Errorf("notifications.periodic_default must be positive, not %s", periodicDefault)
+	}
+	PeriodicWarningDefaultInit(periodicDefault)
+
+	minRuntime := cfg.GetDuration("notifications.periodic_min_runtime")
+	if minRuntime < 0 {
+		return fmt.Errorf("notifications.periodic_min_runtime must not be negative, not %s", minRuntime)
 	}
+	PeriodicMinRuntimeInit(minRuntime)
+	return nil
+}
+
+// parseWarningThresholds parses a comma-separated list of minutes into warning
+// thresholds sorted from the longest to the shortest, with duplicates removed.
+func parseWarningThresholds(list string) ([]int64, error) {
+	var thresholds []int64
+	seen := make(map[int64]bool)
+
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		minutes, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid warning threshold %s", field)
+		}
+		if minutes <= 0 {
+			return nil, fmt.Errorf("warning thresholds must be positive, not %d", minutes)
+		}
+
+		if !seen[minutes] {
+			seen[minutes] = true
+			thresholds = append(thresholds, minutes)
+		}
+	}
+
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] > thresholds[j] })
+
+	return thresholds, nil
+}
+
+// parseWarningInterval parses the --warning-interval flag, which is either a
+// duration such as 90m or 1h30m or, as it was originally, a bare number of
+// minutes. Returns the interval in minutes, which must be positive and whole.
+func parseWarningInterval(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+
+	var d time.Duration
+	if minutes, err := strconv.ParseInt(s, 10, 64); err == nil {
+		d = time.Duration(minutes) * time.Minute
+	} else if d, err = time.ParseDuration(s); err != nil {
+		return 0, fmt.Errorf("warning interval %q isn't a duration or a number of minutes", s)
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("warning interval must be positive, not %s", s)
+	}
+	if d%time.Minute != 0 {
+		return 0, fmt.Errorf("warning interval must be a whole number of minutes, not %s", s)
+	}
+
+	return int64(d / time.Minute), nil
+}
 
-	b, err := io.ReadAll(resp.Body)
+// warningIntervalTooLong returns whether the warning interval in minutes is
+// longer than the default time limit in seconds, in which case jobs with the
+// default limit are already inside the interval when they start.
+func warningIntervalTooLong(minutes, defaultLimitSeconds int64) bool {
+	return minutes*60 > defaultLimitSeconds
+}
+
+// ConfigureWarningThresholds sets up the thresholds at which users are warned
+// about upcoming job kills. If notifications.warning_thresholds isn't set,
+// users are warned a day ahead and warningInterval minutes ahead.
+func ConfigureWarningThresholds(cfg *viper.Viper, warningInterval int64) error {
+	list := cfg.GetString("notifications.warning_thresholds")
+	if list == "" {
+		list = fmt.Sprintf("1440,%d", warningInterval)
+	}
+
+	thresholds, err := parseWarningThresholds(list)
 	if err != nil {
-		return errors.Wrap(err, "failed to read notification response body")
+		return errors.Wrap(err, "error parsing notifications.warning_thresholds")
+	}
+	if len(thresholds) == 0 {
+		return errors.New("notifications.warning_thresholds must contain at least one threshold")
+	}
+
+	WarningThresholdsInit(thresholds)
+	HourWarningThresholdInit(warningInterval)
+	return nil
+}
+
+// ConfigureMaxAttempts sets how many times warning and kill notifications are
+// tried before they're handed off to the pending notification queue.
+func ConfigureMaxAttempts(cfg *viper.Viper) error {
+	warning := cfg.GetInt("notifications.max_attempts.warning")
+	if warning < 1 {
+		return fmt.Errorf("notifications.max_attempts.warning must be at least 1, not %d", warning)
 	}
 
-	log.Infof("notification: (invocation_id: %s, status: %s, body: %s)", j.ID, resp.Status, b)
+	kill := cfg.GetInt("notifications.max_attempts.kill")
+	if kill < 1 {
+		return fmt.Errorf("notifications.max_attempts.kill must be at least 1, not %d", kill)
+	}
 
+	MaxAttemptsInit(warning, kill)
 	return nil
 }
 
-// ConfigureNotifications sets up the notification emitters.
-func ConfigureNotifications(cfg *viper.Viper, notifPath string) error {
-	notifBase := cfg.GetString("notification_agent.base")
-	notifURL, err := url.Parse(notifBase)
+// ConfigureConsumers sets the prefetch count and the number of consumers used
+// for status update messages, along with how long to wait between attempts to
+// reconnect to the broker.
+func ConfigureConsumers(cfg *viper.Viper) error {
+	prefetch := cfg.GetInt("amqp.consumers.prefetch")
+	if prefetch < 1 {
+		return fmt.Errorf("amqp.consumers.prefetch must be at least 1, not %d", prefetch)
+	}
+
+	concurrency := cfg.GetInt("amqp.consumers.concurrency")
+	if concurrency < 1 {
+		return fmt.Errorf("amqp.consumers.concurrency must be at least 1, not %d", concurrency)
+	}
+
+	baseBackoff := cfg.GetDuration("amqp.reconnect.base_backoff")
+	maxBackoff := cfg.GetDuration("amqp.reconnect.max_backoff")
+	if baseBackoff <= 0 {
+		return fmt.Errorf("amqp.reconnect.base_backoff must be positive, not %s", baseBackoff)
+	}
+	if maxBackoff < baseBackoff {
+		return fmt.Errorf("amqp.reconnect.max_backoff must be at least amqp.reconnect.base_backoff (%s), not %s", baseBackoff, maxBackoff)
+	}
+
+	ConsumersInit(prefetch, concurrency)
+	ReconnectInit(baseBackoff, maxBackoff)
+	return nil
+}
+
+// ConfigureGoneNotifications sets up whether users are told when their jobs
+// were already gone by the time timelord tried to kill them.
+func ConfigureGoneNotifications(cfg *viper.Viper) {
+	GoneNotificationsInit(cfg.GetBool("notifications.gone_enabled"))
+}
+
+// ConfigureLookupFallback sets up whether notifications are still sent
+// without an email when the user lookup fails.
+func ConfigureLookupFallback(cfg *viper.Viper) {
+	LookupFallbackInit(cfg.GetBool("notifications.lookup_fallback"))
+}
+
+// ConfigureNotifTemplates loads the templates file that overrides the
+// subjects and messages of the notifications sent to users, if one is set.
+func ConfigureNotifTemplates(cfg *viper.Viper) error {
+	return NotifTemplatesInit(cfg.GetString("notifications.templates_file"))
+}
+
+// ConfigureStatusHistory sets up how many status transitions are included in
+// periodic notifications.
+func ConfigureStatusHistory(cfg *viper.Viper) error {
+	n := cfg.GetInt("notifications.status_history")
+	if n < 0 {
+		return fmt.Errorf("notifications.status_history must not be negative, not %d", n)
+	}
+	StatusHistoryInit(n)
+	return nil
+}
+
+// ConfigureResultFolderDisplay sets up how result folder paths are shown in
+// the messages sent to users.
+func ConfigureResultFolderDisplay(cfg *viper.Viper) {
+	ResultFolderDisplayInit(
+		cfg.GetString("notifications.result_folders.prefix"),
+		cfg.GetString("notifications.result_folders.display_prefix"),
+	)
+}
+
+// ConfigureNotificationCC sets up the addresses that kill and warning
+// notifications are copied to for particular users and groups, and the email
+// service that the copies are sent through.
+func ConfigureNotificationCC(cfg *viper.Viper) error {
+	users, err := parseCCEntries(cfg.GetStringSlice("notifications.cc.users"))
 	if err != nil {
-		return errors.Wrapf(err, "failed to parse %s", notifBase)
+		return errors.Wrap(err, "error parsing notifications.cc.users")
 	}
-	notifURL = notifURL.JoinPath(notifPath)
+	groups, err := parseCCEntries(cfg.GetStringSlice("notifications.cc.groups"))
+	if err != nil {
+		return errors.Wrap(err, "error parsing notifications.cc.groups")
+	}
+	NotifCCInit(users, groups)
+
+	emailBase := cfg.GetString("email.base")
+	if (len(users) > 0 || len(groups) > 0) && emailBase == "" {
+		return errors.New("email.base must be set to copy notifications")
+	}
+	if _, err = url.Parse(emailBase); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", emailBase)
+	}
+	CCEmailerInit(&EmailService{URI: emailBase})
 
-	NotifsInit(notifURL.String())
 	return nil
 }
 
-// ConfigureUserLookups sets up the api for getting user information.
+// ConfigureUserLookups sets up the api for getting user information and how
+// many requests can be made to it at once.
 func ConfigureUserLookups(cfg *viper.Viper) error {
 	groupsBase := cfg.GetString("iplant_groups.base")
 	groupsUser := cfg.GetString("iplant_groups.user")
@@ -143,11 +505,40 @@ func ConfigureUserLookups(cfg *viper.Viper) error {
 	q.Set("user", groupsUser)
 	groupsURL.RawQuery = q.Encode()
 	UsersInit(groupsURL.String())
+
+	maxConcurrent := cfg.GetInt("iplant_groups.max_concurrent_requests")
+	if maxConcurrent < 0 {
+		return fmt.Errorf("iplant_groups.max_concurrent_requests must not be negative, not %d", maxConcurrent)
+	}
+	UserLookupLimitInit(maxConcurrent)
 	return nil
 }
 
-// ConfigureAnalyses sets up the base VICE url
+// ConfigurePreferenceLookups sets up the api for getting user preferences.
+// Preferences aren't looked up if user_info.base isn't set.
+func ConfigurePreferenceLookups(cfg *viper.Viper) error {
+	prefsBase := cfg.GetString("user_info.base")
+	if prefsBase != "" {
+		if _, err := url.Parse(prefsBase); err != nil {
+			return errors.Wrapf(err, "failed to parse %s", prefsBase)
+		}
+	}
+	PrefsInit(prefsBase)
+	return nil
+}
+
+// ConfigureAnalyses sets up the base VICE url and how VICE subdomains are generated.
 func ConfigureAnalyses(cfg *viper.Viper) error {
+	if err := SubdomainInit(cfg.GetString("k8s.subdomain.prefix"), cfg.GetInt("k8s.subdomain.length")); err != nil {
+		return errors.Wrap(err, "invalid k8s.subdomain settings")
+	}
+
+	hardStopAfter := cfg.GetDuration("hard_stop.after")
+	if hardStopAfter < 0 {
+		return fmt.Errorf("hard_stop.after must not be negative, not %s", hardStopAfter)
+	}
+	HardStopInit(hardStopAfter)
+
 	viceBase := cfg.GetString("k8s.frontend.base")
 	if viceBase == "" {
 		AnalysesInit("")
@@ -158,229 +549,900 @@ func ConfigureAnalyses(cfg *viper.Viper) error {
 		return errors.Wrapf(err, "failed to parse %s", viceBase)
 	}
 
-	AnalysesInit(viceURL.String())
+	AnalysesInit(viceURL.String())
+	return nil
+}
+
+// ConfigureTimezone sets the timezone that timestamps from the database are
+// interpreted in.
+func ConfigureTimezone(cfg *viper.Viper) error {
+	tz := cfg.GetString("db.timezone")
+	if tz == "" {
+		tz = "UTC"
+	}
+	return TimezoneInit(tz)
+}
+
+// ConfigureBatchLimits sets up the time limit applied to non-interactive jobs.
+func ConfigureBatchLimits(cfg *viper.Viper) error {
+	enabled := cfg.GetBool("batch_limits.enabled")
+	seconds := cfg.GetInt64("batch_limits.default_seconds")
+	if enabled && seconds <= 0 {
+		return fmt.Errorf("batch_limits.default_seconds must be positive, not %d", seconds)
+	}
+	BatchLimitsInit(enabled, seconds)
+	return nil
+}
+
+// ConfigureBlackouts sets up the daily windows during which no jobs are
+// killed. The windows are in the HH:MM-HH:MM format, in the configured
+// timezone.
+func ConfigureBlackouts(cfg *viper.Viper) error {
+	var windows []BlackoutWindow
+	for _, s := range cfg.GetStringSlice("kill_blackouts.windows") {
+		w, err := parseBlackoutWindow(s)
+		if err != nil {
+			return errors.Wrap(err, "error parsing kill_blackouts.windows")
+		}
+		windows = append(windows, w)
+	}
+	BlackoutsInit(windows, cfg.GetBool("kill_blackouts.skip_warnings"))
+	return nil
+}
+
+// ConfigureKillPause sets up what happens while killing is paused at runtime.
+func ConfigureKillPause(cfg *viper.Viper) {
+	KillPauseInit(cfg.GetBool("kill_pause.skip_warnings"))
+}
+
+// ConfigureLeaderElection sets up the election of a leader among the replicas.
+func ConfigureLeaderElection(cfg *viper.Viper) error {
+	enabled := cfg.GetBool("leader_election.enabled")
+	lease := cfg.GetDuration("leader_election.lease_duration")
+	if enabled && lease <= 0 {
+		return fmt.Errorf("leader_election.lease_duration must be positive, not %s", lease)
+	}
+	LeaderElectionInit(enabled, lease)
+	return nil
+}
+
+// ConfigureDBTLS returns the database connection string with the TLS settings
+// from the config folded into it.
+func ConfigureDBTLS(cfg *viper.Viper, dsn string) (string, error) {
+	tlsConfig := &DBTLSConfig{
+		SSLMode:  cfg.GetString("db.tls.sslmode"),
+		RootCert: cfg.GetString("db.tls.root_cert"),
+		Cert:     cfg.GetString("db.tls.cert"),
+		Key:      cfg.GetString("db.tls.key"),
+	}
+	if err := tlsConfig.Validate(); err != nil {
+		return "", err
+	}
+	return withDBTLS(dsn, tlsConfig)
+}
+
+// ConfigureHTTPClient sets up the idle connection pool of the HTTP client used
+// for requests to other services.
+func ConfigureHTTPClient(cfg *viper.Viper) error {
+	maxIdle := cfg.GetInt("http_client.max_idle_conns")
+	maxIdlePerHost := cfg.GetInt("http_client.max_idle_conns_per_host")
+	idleTimeout := cfg.GetDuration("http_client.idle_conn_timeout")
+	if maxIdle < 0 {
+		return fmt.Errorf("http_client.max_idle_conns must not be negative, not %d", maxIdle)
+	}
+	if maxIdlePerHost < 0 {
+		return fmt.Errorf("http_client.max_idle_conns_per_host must not be negative, not %d", maxIdlePerHost)
+	}
+	if idleTimeout < 0 {
+		return fmt.Errorf("http_client.idle_conn_timeout must not be negative, not %s", idleTimeout)
+	}
+
+	timeout := cfg.GetDuration("http_client.timeout")
+	if timeout < 0 {
+		return fmt.Errorf("http_client.timeout must not be negative, not %s", timeout)
+	}
+
+	retries := cfg.GetInt("http_client.max_retries")
+	baseBackoff := cfg.GetDuration("http_client.base_backoff")
+	maxBackoff := cfg.GetDuration("http_client.max_backoff")
+	if retries < 0 {
+		return fmt.Errorf("http_client.max_retries must not be negative, not %d", retries)
+	}
+	if baseBackoff < 0 {
+		return fmt.Errorf("http_client.base_backoff must not be negative, not %s", baseBackoff)
+	}
+	if maxBackoff < baseBackoff {
+		return fmt.Errorf("http_client.max_backoff must be at least http_client.base_backoff (%s), not %s", baseBackoff, maxBackoff)
+	}
+
+	HTTPClientInit(maxIdle, maxIdlePerHost, idleTimeout)
+	HTTPTimeoutInit(timeout)
+	RetryPolicyInit(retries, baseBackoff, maxBackoff)
+	return nil
+}
+
+// ConfigureUsageWarnings sets up the warnings sent to users who have used a
+// lot of compute time recently.
+func ConfigureUsageWarnings(cfg *viper.Viper) error {
+	enabled := cfg.GetBool("usage_warnings.enabled")
+	window := cfg.GetDuration("usage_warnings.window")
+	threshold := cfg.GetDuration("usage_warnings.threshold")
+	checkInterval := cfg.GetDuration("usage_warnings.check_interval")
+	if enabled && window <= 0 {
+		return fmt.Errorf("usage_warnings.window must be positive, not %s", window)
+	}
+	if enabled && threshold <= 0 {
+		return fmt.Errorf("usage_warnings.threshold must be positive, not %s", threshold)
+	}
+	if enabled && checkInterval <= 0 {
+		return fmt.Errorf("usage_warnings.check_interval must be positive, not %s", checkInterval)
+	}
+	UsageWarningsInit(enabled, window, threshold, checkInterval)
+	return nil
+}
+
+// ConfigureKillFilters sets up the allow and deny lists that limit the jobs
+// that are warned about and killed.
+func ConfigureKillFilters(cfg *viper.Viper) {
+	KillFilterInit(NewJobFilter(
+		cfg.GetStringSlice("kill_filters.allow_system_ids"),
+		cfg.GetStringSlice("kill_filters.deny_system_ids"),
+		cfg.GetStringSlice("kill_filters.allow_app_ids"),
+		cfg.GetStringSlice("kill_filters.deny_app_ids"),
+	))
+}
+
+// ConfigureDisabledUserKills sets up the killing of jobs that belong to users
+// whose accounts have been disabled.
+func ConfigureDisabledUserKills(cfg *viper.Viper) error {
+	enabled := cfg.GetBool("disabled_users.kill_jobs")
+	admin := cfg.GetString("disabled_users.admin_user")
+	if enabled && admin == "" {
+		return errors.New("disabled_users.admin_user must be set when disabled_users.kill_jobs is enabled")
+	}
+	DisabledUserKillsInit(enabled, admin, cfg.GetString("disabled_users.admin_email"))
+	return nil
+}
+
+// ConfigureKillRamp sets up the limit on kills during the first iterations of
+// the job killer after startup.
+func ConfigureKillRamp(cfg *viper.Viper) error {
+	iterations := cfg.GetInt("kill_ramp.iterations")
+	step := cfg.GetInt("kill_ramp.step")
+	if iterations < 0 {
+		return fmt.Errorf("kill_ramp.iterations must not be negative, not %d", iterations)
+	}
+	if iterations > 0 && step <= 0 {
+		return fmt.Errorf("kill_ramp.step must be positive, not %d", step)
+	}
+	KillRampInit(iterations, step)
+	return nil
+}
+
+// ConfigureKillDigest sets up the daily digest of the jobs that were killed.
+func ConfigureKillDigest(cfg *viper.Viper) error {
+	enabled := cfg.GetBool("kill_digest.enabled")
+	admin := cfg.GetString("kill_digest.admin_user")
+	if enabled && admin == "" {
+		return errors.New("kill_digest.admin_user must be set when kill_digest.enabled is set")
+	}
+	at, err := parseTimeOfDay(cfg.GetString("kill_digest.time"))
+	if err != nil {
+		return errors.Wrapf(err, "kill_digest.time must be in the HH:MM format, not %q", cfg.GetString("kill_digest.time"))
+	}
+	KillDigestInit(enabled, at, admin, cfg.GetString("kill_digest.admin_email"), cfg.GetBool("kill_digest.skip_empty"))
+	return nil
+}
+
+// ConfigureIdleKills sets up whether VICE analyses are killed for being idle
+// and how long they can be idle for.
+func ConfigureIdleKills(cfg *viper.Viper) error {
+	enabled := cfg.GetBool("idle_kills.enabled")
+	threshold := cfg.GetDuration("idle_kills.threshold")
+	if enabled && threshold <= 0 {
+		return fmt.Errorf("idle_kills.threshold must be positive, not %s", threshold)
+	}
+	checkInterval := cfg.GetDuration("idle_kills.check_interval")
+	if enabled && checkInterval <= 0 {
+		return fmt.Errorf("idle_kills.check_interval must be positive, not %s", checkInterval)
+	}
+	IdleKillsInit(enabled, threshold, checkInterval)
+	return nil
+}
+
+// ConfigureKillPaths sets up the path templates of the endpoints that stop
+// analyses, making sure that they only use known placeholders.
+func ConfigureKillPaths(cfg *viper.Viper) error {
+	paths := map[string]string{}
+	for _, key := range []string{"apps_stop", "vice_save_and_exit", "vice_exit"} {
+		tmpl := cfg.GetString("kill_paths." + key)
+		if err := validateKillPath(tmpl); err != nil {
+			return errors.Wrapf(err, "invalid kill_paths.%s", key)
+		}
+		paths[key] = tmpl
+	}
+	KillPathsInit(paths["apps_stop"], paths["vice_save_and_exit"], paths["vice_exit"])
+	return nil
+}
+
+// ConfigureTimeLimits sets up the time limits applied to jobs.
+func ConfigureTimeLimits(cfg *viper.Viper) error {
+	defaultSeconds := cfg.GetInt64("job_limits.default_seconds")
+	if defaultSeconds <= 0 {
+		return fmt.Errorf("job_limits.default_seconds must be positive, not %d", defaultSeconds)
+	}
+	minSeconds := cfg.GetInt64("job_limits.min_seconds")
+	if minSeconds < 0 {
+		return fmt.Errorf("job_limits.min_seconds must not be negative, not %d", minSeconds)
+	}
+	maxSeconds := cfg.GetInt64("job_limits.max_seconds")
+	if maxSeconds < 0 {
+		return fmt.Errorf("job_limits.max_seconds must not be negative, not %d", maxSeconds)
+	}
+	if maxSeconds > 0 && minSeconds > maxSeconds {
+		return fmt.Errorf("job_limits.min_seconds must not be more than job_limits.max_seconds (%d), not %d", maxSeconds, minSeconds)
+	}
+	TimeLimitsInit(defaultSeconds, minSeconds, maxSeconds)
+	ExtensionsInit(cfg.GetInt("job_limits.max_extensions"))
+	return nil
+}
+
+// killNotif builds the notification telling the user that their job has been
+// killed for the reason, which is one of the KillReason constants. An empty
+// reason is treated as the job passing its time limit.
+func killNotif(ctx context.Context, j *Job, reason string) (*Notification, *User, error) {
+	if reason == "" {
+		reason = KillReasonTimeLimit
+	}
+	subject, msg, err := killNotificationText(j, reason)
+	if err != nil {
+		return nil, nil, err
+	}
+	return jobNotif(ctx, j, "Canceled", subject, msg, true, "analysis_status_change", WithKillReason(reason))
+}
+
+// SendKillNotification sends a notification to the user telling them that
+// their job has been killed for the reason, which is one of the KillReason
+// constants. An empty reason is treated as the job passing its time limit.
+func SendKillNotification(ctx context.Context, j *Job, killNotifKey, reason string) error {
+	notif, user, err := killNotif(ctx, j, reason)
+	if err != nil {
+		return err
+	}
+	return deliverNotifWithCopies(ctx, notif, user)
+}
+
+// SendGoneNotification sends a notification to the user telling them that
+// their job had already stopped when timelord tried to kill it.
+func SendGoneNotification(ctx context.Context, j *Job) error {
+	endtime, err := parseDBTimestamp(j.PlannedEndDate)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse planned end date %s", j.PlannedEndDate)
+	}
+	subject, msg, err := renderNotifText(goneTemplates, jobTemplateData(j).withEndTime(endtime))
+	if err != nil {
+		return err
+	}
+	return sendNotif(ctx, j, j.Status, subject, msg, true, "analysis_gone")
+}
+
+// notifyGone tells the user that their job was already gone when timelord
+// tried to kill it, if that's enabled and they haven't been told already.
+// Returns the outcome of the notification for the audit log.
+func notifyGone(ctx context.Context, vicedb *VICEDatabaser, j *Job, jobLog *log.Entry) string {
+	if !GoneNotificationsEnabled {
+		return auditNotifNone
+	}
+
+	sent, err := vicedb.GoneNotificationSent(ctx, j)
+	if err != nil {
+		jobLog.Error(err)
+		return auditNotifFailed
+	}
+	if sent {
+		return auditNotifNone
+	}
+
+	if err = SendGoneNotification(ctx, j); err != nil {
+		jobLog.Error(errors.Wrapf(err, "error sending notification that %s was already gone", j.ID))
+		return auditNotifFailed
+	}
+
+	if err = vicedb.SetGoneNotificationSent(ctx, j, true); err != nil {
+		jobLog.Error(err)
+	}
+	return auditNotifSent
+}
+
+// warningNotif builds the notification telling the user that their job will
+// be killed in the near future.
+func warningNotif(ctx context.Context, j *Job) (*Notification, *User, error) {
+	endtime, err := parseDBTimestamp(j.PlannedEndDate)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to parse planned end date %s", j.PlannedEndDate)
+	}
+	subject, msg, err := renderNotifText(warningTemplates, jobTemplateData(j).withEndTime(endtime))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return jobNotif(ctx, j, j.Status, subject, msg, true, "analysis_status_change")
+}
+
+// SendWarningNotification sends a notification to the user telling them that
+// their job will be killed in the near future.
+func SendWarningNotification(ctx context.Context, j *Job) error {
+	notif, user, err := warningNotif(ctx, j)
+	if err != nil {
+		return err
+	}
+	return deliverNotifWithCopies(ctx, notif, user)
+}
+
+// periodicNotif builds the periodic notification telling the user how long
+// their job has been running and how long it has left.
+func periodicNotif(ctx context.Context, j *Job, opts ...PayloadOption) (*Notification, *User, error) {
+	durString, err := getJobDuration(j)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remainingString, err := getRemainingDuration(j)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data := jobTemplateData(j)
+	data.Duration = durString
+	data.Remaining = remainingString
+	data.Now = CurrentClock.Now().Format("2006-01-02 15:04") // Mostly static with a timestamp to distinguish
+	subject, msg, err := renderNotifText(periodicTemplates, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The progress of an exempt job towards its far-off planned end date
+	// would always be zero, so it's left out.
+	if isExempt(j) {
+		return jobNotif(ctx, j, j.Status, subject, msg, j.NotifyPeriodic, "analysis_periodic_notification", opts...)
+	}
+
+	start, err := parseDBTimestamp(j.StartDate)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to parse start date %s", j.StartDate)
+	}
+	plannedEnd, err := parseDBTimestamp(j.PlannedEndDate)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to parse planned end date %s", j.PlannedEndDate)
+	}
+
+	opts = append([]PayloadOption{WithProgress(start, plannedEnd, CurrentClock.Now())}, opts...)
+	return jobNotif(ctx, j, j.Status, subject, msg, j.NotifyPeriodic, "analysis_periodic_notification", opts...)
+}
+
+// statusHistoryOpts returns the PayloadOptions that add the job's recent
+// status transitions to its periodic notification, if StatusHistoryLength is
+// positive. The history is left out if it can't be looked up, since it's only
+// there for context.
+func statusHistoryOpts(ctx context.Context, db *sql.DB, j *Job) []PayloadOption {
+	if StatusHistoryLength <= 0 {
+		return nil
+	}
+
+	updates, err := getStatusHistory(ctx, db, j.ID)
+	if err != nil {
+		jobLogger(j).Error(errors.Wrap(err, "error looking up status history, leaving it out of the notification"))
+		return nil
+	}
+	return []PayloadOption{WithStatusHistory(recentTransitions(updates, StatusHistoryLength))}
+}
+
+// SendPeriodicNotification sends the periodic notification for the job.
+func SendPeriodicNotification(ctx context.Context, j *Job, opts ...PayloadOption) error {
+	notif, _, err := periodicNotif(ctx, j, opts...)
+	if err != nil {
+		return err
+	}
+	return deliverNotif(ctx, notif)
+}
+
+// prefetchUsers looks up the users for all of the jobs in one request so that
+// the notifications sent for the jobs don't each need a lookup of their own.
+func prefetchUsers(ctx context.Context, jobs []Job) {
+	if !notifsConfigured() || len(jobs) == 0 {
+		return
+	}
+
+	ids := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		ids = append(ids, ParseID(j.User))
+	}
+
+	if _, err := LookupUsers(ctx, ids); err != nil {
+		log.Error(errors.Wrap(err, "error looking up users"))
+	}
+}
+
+// jobLogger returns a log entry with the fields that identify the job, so that
+// the lines logged about it during an iteration of the job killer can be
+// picked out.
+func jobLogger(j *Job) *log.Entry {
+	return log.WithFields(log.Fields{
+		"externalID": j.ExternalID,
+		"ID":         j.ID,
+		"user":       j.User,
+	})
+}
+
+// sendWarning warns the users whose jobs will be killed within thresholdMinutes
+// minutes, unless they've already been warned for that threshold. A warning is
+// queued for retries once it has failed maxAttempts times. Jobs in warned were
+// already warned for a tighter threshold during this iteration, so the warning
+// for this one is only marked as sent. The jobs warned here are added to it.
+func sendWarning(ctx context.Context, db *sql.DB, vicedb *VICEDatabaser, thresholdMinutes int64, maxAttempts int, warned map[string]bool) {
+	jobs, err := JobKillWarnings(ctx, db, thresholdMinutes)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	loopState.Record(warningListName(thresholdMinutes), jobs)
+
+	prefetchUsers(ctx, jobs)
+
+	for i := range jobs {
+		j := &jobs[i]
+
+		jobLog := jobLogger(j).WithFields(log.Fields{
+			"context":          "warning",
+			"thresholdMinutes": thresholdMinutes,
+		})
+
+		if warned[j.ID] {
+			if err = skipWarning(ctx, vicedb, j, thresholdMinutes); err != nil {
+				jobLog.Error(err)
+			}
+			continue
+		}
+		warned[j.ID] = true
+
+		jobCtx, span := startJobSpan(ctx, "send warning", j)
+		if err = warnJob(jobCtx, vicedb, j, jobLog, thresholdMinutes, maxAttempts); err != nil {
+			jobLog.Error(err)
+			recordSpanError(jobCtx, err)
+		}
+		span.End()
+	}
+}
+
+// skipWarning marks the warning for the threshold as sent without sending it,
+// since the user has been warned for a tighter threshold instead.
+func skipWarning(ctx context.Context, vicedb *VICEDatabaser, j *Job, thresholdMinutes int64) error {
+	wasSent, _, err := vicedb.WarningStatus(ctx, j, thresholdMinutes)
+	if err != nil || wasSent {
+		return err
+	}
+	return vicedb.SetWarningSent(ctx, j, thresholdMinutes, true)
+}
+
+// warnJob warns the user that the job will be killed within thresholdMinutes
+// minutes, unless they've already been warned for that threshold.
+func warnJob(ctx context.Context, vicedb *VICEDatabaser, j *Job, jobLog *log.Entry, thresholdMinutes int64, maxAttempts int) error {
+	var (
+		err          error
+		wasSent      bool
+		failureCount int
+	)
+
+	if err = vicedb.EnsureNotifRecord(ctx, j); err != nil {
+		return errors.Wrapf(err, "error adding notification statuses for analysis %s", j.ID)
+	}
+
+	wasSent, failureCount, err = vicedb.WarningStatus(ctx, j, thresholdMinutes)
+	if err != nil {
+		return err
+	}
+
+	jobLog.Warnf("external ID %s has been warned of possible termination within %d minutes: %v", j.ExternalID, thresholdMinutes, wasSent)
+
+	if wasSent {
+		return nil
+	}
+
+	sendErr := SendWarningNotification(ctx, j)
+	if sendErr != nil {
+		sendErr = errors.Wrapf(sendErr, "error sending warning notification for analysis %s", j.ExternalID)
+		jobLog.Error(sendErr)
+		recordSpanError(ctx, sendErr)
+
+		failureCount = failureCount + 1
+
+		if err = vicedb.SetWarningFailureCount(ctx, j, thresholdMinutes, failureCount); err != nil {
+			jobLog.Error(err)
+		}
+
+		if failureCount >= maxAttempts {
+			if err = vicedb.AddPendingNotification(ctx, j, warningNotificationType(thresholdMinutes)); err != nil {
+				jobLog.Error(errors.Wrapf(err, "error queueing warning notification for analysis %s", j.ExternalID))
+			}
+		}
+	}
+
+	if sendErr == nil || failureCount >= maxAttempts {
+		if err = vicedb.SetWarningSent(ctx, j, thresholdMinutes, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendWarnings sends the warnings and periodic notifications that are due.
+// None of the scans for them are run if notifications aren't configured,
+// since nothing could be sent anyway.
+func sendWarnings(ctx context.Context, db *sql.DB, vicedb *VICEDatabaser) {
+	if !notifsConfigured() {
+		return
+	}
+
+	// The thresholds are gone through from the tightest to the loosest, so
+	// that a job inside several of them is only warned for the tightest one.
+	warned := make(map[string]bool)
+	for i := len(WarningThresholds) - 1; i >= 0; i-- {
+		sendWarning(ctx, db, vicedb, WarningThresholds[i], WarningMaxAttempts, warned)
+	}
+
+	// periodic warnings
+	sendPeriodic(ctx, db, vicedb)
+}
+
+func sendPeriodic(ctx context.Context, db *sql.DB, vicedb *VICEDatabaser) {
+	// fetch jobs which periodic updates might apply to
+	jobs, err := JobPeriodicWarnings(ctx, db)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	loopState.Record(periodicList, jobs)
+
+	prefetchUsers(ctx, jobs)
+
+	for i := range jobs {
+		j := &jobs[i]
+
+		jobLog := jobLogger(j).WithFields(log.Fields{"context": "periodic notification"})
+
+		jobCtx, span := startJobSpan(ctx, "send periodic notification", j)
+		if err = sendJobPeriodic(jobCtx, db, vicedb, j, jobLog); err != nil {
+			jobLog.Error(err)
+			recordSpanError(jobCtx, err)
+		}
+		span.End()
+	}
+}
+
+// sendJobPeriodic sends the periodic notification for the job if one is due
+// and the user hasn't turned them off.
+func sendJobPeriodic(ctx context.Context, db *sql.DB, vicedb *VICEDatabaser, j *Job, jobLog *log.Entry) error {
+	var (
+		err                 error
+		notifStatuses       *NotifStatuses
+		now                 time.Time
+		comparisonTimestamp time.Time
+		periodDuration      time.Duration
+	)
+
+	if err = EnsurePlannedEndDate(ctx, db, j); err != nil {
+		jobLog.Error(errors.Wrapf(err, "Error ensuring a planned end date for job %s", j.ID))
+	}
+
+	// fetch preferences and update in the DB if needed
+	notifStatuses, err = vicedb.EnsureNotifStatuses(ctx, j)
+	if err != nil {
+		return err
+	}
+
+	if notifStatuses.PeriodicEnabled.Valid && !notifStatuses.PeriodicEnabled.Bool {
+		jobLog.Debugf("periodic notifications are turned off for %s, skipping", j.ID)
+		return nil
+	}
+
+	periodDuration = PeriodicWarningDefault
+	if notifStatuses.PeriodicWarningPeriod > 0 {
+		periodDuration = notifStatuses.PeriodicWarningPeriod
+	}
+
+	sd, err := parseDBTimestamp(j.StartDate)
+	if err != nil {
+		return errors.Wrapf(err, "Error parsing start date %s", j.StartDate)
+	}
+
+	now = CurrentClock.Now()
+
+	if now.Sub(sd) < PeriodicMinRuntime {
+		jobLog.Debugf("job %s hasn't been running for %s yet, skipping periodic notification", j.ID, PeriodicMinRuntime)
+		return nil
+	}
+
+	comparisonTimestamp = sd
+	if notifStatuses.LastPeriodicWarning.After(sd) {
+		comparisonTimestamp = notifStatuses.LastPeriodicWarning
+	}
+
+	jobLog.Infof("Comparing last-warning timestamp %s with period %s s", comparisonTimestamp, periodDuration)
+
+	// timeframe is met if: more recent of (last warning, job start date) + periodic warning period is before now
+	if comparisonTimestamp.Add(periodDuration).Before(now) {
+		// if so,
+		if err = SendPeriodicNotification(ctx, j, statusHistoryOpts(ctx, db, j)...); err != nil {
+			return errors.Wrap(err, "Error sending periodic notification")
+		}
+		// update timestamp:
+		if err = vicedb.UpdateLastPeriodicWarning(ctx, j, now); err != nil {
+			return errors.Wrap(err, "Error updating periodic notification timestamp")
+		}
+	}
+
 	return nil
 }
 
-// SendKillNotification sends a notification to the user telling them that
-// their job has been killed.
-func SendKillNotification(ctx context.Context, j *Job, killNotifKey string) error {
-	subject := fmt.Sprintf(KillSubjectFormat, j.Name)
-	endtime, err := time.ParseInLocation(TimestampFromDBFormat, j.PlannedEndDate, time.Local)
-	if err != nil {
-		return errors.Wrapf(err, "failed to parse planned end date %s", j.PlannedEndDate)
+// loopInterval is how long the job killer sleeps between iterations.
+const loopInterval = 10 * time.Second
+
+// defaultIterationTimeout is how long a job killer iteration may run before
+// it's cut off. It's a multiple of loopInterval so that a stuck upstream only
+// delays the next scan by a bounded amount.
+const defaultIterationTimeout = 6 * loopInterval
+
+// runWithDeadline calls fn with a context that's done once timeout has passed
+// and returns whether fn was still running when it did. fn is only cut off if
+// the work it does honors the context. A timeout of zero or less means there's
+// no deadline.
+func runWithDeadline(ctx context.Context, timeout time.Duration, fn func(context.Context)) bool {
+	if timeout <= 0 {
+		fn(ctx)
+		return false
 	}
-	msg := fmt.Sprintf(
-		KillMessageFormat,
-		j.Name,
-		j.ID,
-		endtime.Format("Mon Jan 2 15:04:05 -0700 MST 2006"),
-		endtime.UTC().Format(time.UnixDate),
-		j.ResultFolder,
-	)
-	err = sendNotif(ctx, j, "Canceled", subject, msg, true, "analysis_status_change")
-	return err
-}
 
-// SendWarningNotification sends a notification to the user telling them that
-// their job will be killed in the near future.
-func SendWarningNotification(ctx context.Context, j *Job) error {
-	endtime, err := time.ParseInLocation(TimestampFromDBFormat, j.PlannedEndDate, time.Local)
-	if err != nil {
-		return errors.Wrapf(err, "failed to parse planned end date %s", j.PlannedEndDate)
-	}
-	endtimeMST := endtime.Format("Mon Jan 2 15:04:05 -0700 MST 2006")
-	endtimeUTC := endtime.UTC().Format(time.UnixDate)
-	subject := fmt.Sprintf(WarningSubjectFormat, j.Name, endtimeMST, endtimeUTC)
-
-	msg := fmt.Sprintf(
-		WarningMessageFormat,
-		j.Name,
-		j.ID,
-		endtimeMST,
-		endtimeUTC,
-		j.ResultFolder,
-	)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	return sendNotif(ctx, j, j.Status, subject, msg, true, "analysis_status_change")
+	fn(ctx)
+	return errors.Is(ctx.Err(), context.DeadlineExceeded)
 }
 
-func SendPeriodicNotification(ctx context.Context, j *Job) error {
-	durString, err := getJobDuration(j)
-	if err != nil {
-		return err
+// jitteredInterval returns base randomly adjusted by up to percent percent in
+// either direction. r should return a value in [0.0, 1.0), like rand.Float64.
+// A percent of zero or less returns base unchanged.
+func jitteredInterval(base time.Duration, percent float64, r func() float64) time.Duration {
+	if percent <= 0 {
+		return base
+	}
+	if percent > 100 {
+		percent = 100
 	}
+	spread := float64(base) * percent / 100
+	return base + time.Duration((r()*2-1)*spread)
+}
 
-	remainingString, err := getRemainingDuration(j)
+const jobLockQuery = `select pg_try_advisory_xact_lock(hashtext($1))`
+
+// withJobLock calls fn while holding a transaction-level advisory lock on the
+// job ID, so that only one timelord instance handles the job at a time. The
+// lock is released when the transaction ends after fn returns. Returns false
+// without calling fn if another instance holds the lock.
+func withJobLock(ctx context.Context, db *sql.DB, id string, fn func(context.Context)) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return false, err
 	}
+	defer tx.Rollback()
 
-	subject := fmt.Sprintf(PeriodicSubjectFormat, time.Now().Format("2006-01-02 15:04")) // Mostly static with a timestamp to distinguish
+	var locked bool
+	if err = tx.QueryRowContext(ctx, jobLockQuery, id).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
 
-	msg := fmt.Sprintf(
-		PeriodicMessageFormat,
-		j.Name,
-		durString,
-		remainingString,
-	)
+	fn(ctx)
 
-	return sendNotif(ctx, j, j.Status, subject, msg, j.NotifyPeriodic, "analysis_periodic_notification")
+	return true, tx.Commit()
 }
 
-func ensureNotifRecord(ctx context.Context, vicedb *VICEDatabaser, job Job) error {
-	analysisRecordExists := vicedb.AnalysisRecordExists(ctx, job.ID)
+// killExpiredJobs calls killExpiredJob for each of the jobs that no other
+// timelord instance is handling. It stops before the next job once ctx is
+// done, so that no new kills are started during shutdown, or once killing has
+// been paused.
+func killExpiredJobs(ctx context.Context, db *sql.DB, vicedb *VICEDatabaser, jobs []Job, kill killFunc, killNotifKey string, maxAttempts int) {
+	prefetchUsers(ctx, jobs)
+
+	for _, j := range jobs {
+		j := j
+
+		select {
+		case <-ctx.Done():
+			log.Info("stopping kills, the context is done")
+			return
+		default:
+		}
+
+		if killPause.Paused() {
+			log.Info("stopping kills, killing has been paused")
+			return
+		}
+
+		if startupRamp.Exhausted() {
+			log.Info("stopping kills, the kill ramp's limit for this iteration has been reached")
+			return
+		}
+
+		jobLog := jobLogger(&j).WithFields(log.Fields{"context": "kill"})
 
-	if !analysisRecordExists {
-		notifId, err := vicedb.AddNotifRecord(ctx, &job)
+		jobCtx, span := startJobSpan(ctx, "kill job", &j)
+		locked, err := withJobLock(jobCtx, db, j.ID, func(ctx context.Context) {
+			killExpiredJob(ctx, db, vicedb, kill, &j, jobLog, killNotifKey, maxAttempts)
+		})
 		if err != nil {
-			return err
+			err = errors.Wrapf(err, "error locking analysis %s", j.ID)
+			jobLog.Error(err)
+			recordSpanError(jobCtx, err)
+		} else if !locked {
+			jobLog.Infof("analysis %s is being handled by another instance, skipping it", j.ID)
 		}
-		log.Debugf("notif_statuses ID inserted: %s", notifId)
+		span.End()
 	}
-
-	return nil
 }
 
-const maxAttempts = 3
+// killFunc kills a job. It's either JobKiller.KillJob or JobKiller.KillBatchJob.
+type killFunc func(context.Context, *sql.DB, *Job) error
+
+// killExpiredJob kills a job that has passed its planned end date and notifies
+// the user, tracking failures in the job's notification statuses.
+func killExpiredJob(ctx context.Context, db *sql.DB, vicedb *VICEDatabaser, kill killFunc, j *Job, jobLog *log.Entry, killNotifKey string, maxAttempts int) {
+	var (
+		err           error
+		notifStatuses *NotifStatuses
+	)
 
-func sendWarning(ctx context.Context, db *sql.DB, vicedb *VICEDatabaser, warningInterval int64, warningKey string) {
-	jobs, err := JobKillWarnings(ctx, db, warningInterval)
+	notifStatuses, err = vicedb.EnsureNotifStatuses(ctx, j)
 	if err != nil {
-		log.Error(err)
-	} else {
-		for _, j := range jobs {
-			var (
-				wasSent            bool
-				notifStatuses      *NotifStatuses
-				failureCount       int
-				updateWarningSent  func(context.Context, *Job, bool) error
-				updateFailureCount func(context.Context, *Job, int) error
-			)
-
-			if err = ensureNotifRecord(ctx, vicedb, j); err != nil {
-				log.Error(err)
-				continue
-			}
+		jobLog.Error(err)
+		return
+	}
 
-			notifStatuses, err = vicedb.NotifStatuses(ctx, &j)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
+	if notifStatuses.KillWarningSent {
+		return
+	}
 
-			switch warningKey {
-			case warningSentKey: // one hour warning
-				wasSent = notifStatuses.HourWarningSent
-				failureCount = notifStatuses.HourWarningFailureCount
-				updateWarningSent = vicedb.SetHourWarningSent
-				updateFailureCount = vicedb.SetHourWarningFailureCount
-			case oneDayWarningKey: // one day warning
-				wasSent = notifStatuses.DayWarningSent
-				failureCount = notifStatuses.DayWarningFailureCount
-				updateWarningSent = vicedb.SetDayWarningSent
-				updateFailureCount = vicedb.SetDayWarningFailureCount
-			default:
-				err = fmt.Errorf("unknown warning key: %s", warningKey)
-			}
+	if !startupRamp.Allow() {
+		jobLog.Info("the kill ramp's limit for this iteration has been reached, leaving the analysis for a later iteration")
+		return
+	}
 
-			if err != nil {
-				log.Error(err)
-				continue
+	var notifFailed bool
+
+	err = kill(ctx, db, j)
+	if err != nil {
+		jobLog.Error(errors.Wrapf(err, "error terminating analysis '%s'", j.ID))
+		recordSpanError(ctx, err)
+
+		if reasonErr := vicedb.SetKillFailureReason(ctx, j, KillFailureReason(err)); reasonErr != nil {
+			jobLog.Error(reasonErr)
+		}
+
+		// The analysis is already gone, so there's nothing left to kill.
+		if errors.Is(err, ErrKillNotFound) {
+			recordKill(ctx, vicedb, j, timeLimitReason(j), auditGone, notifyGone(ctx, vicedb, j, jobLog))
+			if err = vicedb.SetKillWarningSent(ctx, j, true); err != nil {
+				jobLog.Error(err)
 			}
+			return
+		}
+	} else {
+		if reqErr := vicedb.SetKillRequestedAt(ctx, j, CurrentClock.Now()); reqErr != nil {
+			jobLog.Error(reqErr)
+		}
 
-			log.Warnf("external ID %s has been warned of possible termination: %v", j.ExternalID, wasSent)
+		notifOutcome := auditNotifSent
+		err = SendKillNotification(ctx, j, killNotifKey, KillReasonTimeLimit)
+		if err != nil {
+			jobLog.Error(errors.Wrapf(err, "error sending notification that %s has been terminated", j.ID))
+			recordSpanError(ctx, err)
+			notifFailed = true
+			notifOutcome = auditNotifFailed
+		}
 
-			if !wasSent {
-				if err = SendWarningNotification(ctx, &j); err != nil {
-					log.Error(errors.Wrapf(err, "error sending warning notification for analysis %s", j.ExternalID))
+		recordKill(ctx, vicedb, j, timeLimitReason(j), auditKilled, notifOutcome)
+	}
 
-					failureCount = failureCount + 1
+	failed := err != nil
+	if failed {
+		notifStatuses.KillWarningFailureCount = notifStatuses.KillWarningFailureCount + 1
 
-					if err = updateFailureCount(ctx, &j, failureCount); err != nil {
-						log.Error(err)
-					}
-				}
+		if err = vicedb.SetKillWarningFailureCount(ctx, j, notifStatuses.KillWarningFailureCount); err != nil {
+			jobLog.Error(err)
+			return
+		}
 
-				if err == nil || failureCount >= maxAttempts {
-					if err = updateWarningSent(ctx, &j, true); err != nil {
-						log.Error(err)
-						continue
-					}
-				}
+		if notifFailed && notifStatuses.KillWarningFailureCount >= maxAttempts {
+			if err = vicedb.AddPendingNotification(ctx, j, killNotificationType(KillReasonTimeLimit)); err != nil {
+				jobLog.Error(errors.Wrapf(err, "error queueing kill notification for analysis %s", j.ID))
 			}
 		}
 	}
-}
 
-func sendPeriodic(ctx context.Context, db *sql.DB, vicedb *VICEDatabaser) {
-	// fetch jobs which periodic updates might apply to
-	jobs, err := JobPeriodicWarnings(ctx, db)
+	if !failed || notifStatuses.KillWarningFailureCount >= maxAttempts {
+		if err = vicedb.SetKillWarningSent(ctx, j, true); err != nil {
+			jobLog.Error(err)
+		}
+	}
+}
 
-	// loop over them and check if they have notif_statuses info
-	if err != nil {
-		log.Error(err)
-	} else {
-		for _, j := range jobs {
-			var (
-				notifStatuses       *NotifStatuses
-				now                 time.Time
-				comparisonTimestamp time.Time
-				periodDuration      time.Duration
-			)
-
-			if err = EnsurePlannedEndDate(ctx, db, &j); err != nil {
-				log.Error(errors.Wrapf(err, "Error ensuring a planned end date for job %s", j.ID))
-			}
+// redacted replaces the values of secret settings in the effective config.
+const redacted = "[REDACTED]"
 
-			// fetch preferences and update in the DB if needed
-			if err = ensureNotifRecord(ctx, vicedb, j); err != nil {
-				log.Error(err)
-				continue
-			}
+// secretConfigKeys are the config settings that are always redacted. They're
+// connection strings that can contain credentials.
+var secretConfigKeys = map[string]bool{
+	"db.uri":   true,
+	"amqp.uri": true,
+}
 
-			notifStatuses, err = vicedb.NotifStatuses(ctx, &j)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
+// secretKeyPattern matches the names of other settings that look like secrets.
+var secretKeyPattern = regexp.MustCompile(`(?i)(password|secret|token|credential)`)
 
-			periodDuration = 14400 * time.Second
-			if notifStatuses.PeriodicWarningPeriod > 0 {
-				periodDuration = notifStatuses.PeriodicWarningPeriod
+// redactConfigValue returns the value with secrets removed. URLs with
+// passwords in them keep everything but the password.
+func redactConfigValue(key string, value interface{}) interface{} {
+	if secretConfigKeys[key] || secretKeyPattern.MatchString(key) {
+		return redacted
+	}
+	if str, ok := value.(string); ok {
+		if u, err := url.Parse(str); err == nil && u.User != nil {
+			if _, hasPassword := u.User.Password(); hasPassword {
+				u.User = url.UserPassword(u.User.Username(), "xxxxx")
+				return u.String()
 			}
+		}
+	}
+	return value
+}
 
-			sd, err := time.ParseInLocation(TimestampFromDBFormat, j.StartDate, time.Local)
-			if err != nil {
-				log.Error(errors.Wrapf(err, "Error parsing start date %s", j.StartDate))
-				continue
-			}
-			comparisonTimestamp = sd
-			if notifStatuses.LastPeriodicWarning.After(sd) {
-				comparisonTimestamp = notifStatuses.LastPeriodicWarning
-			}
+// effectiveConfig returns the settings that timelord is running with, with
+// secrets redacted. The config file settings, including defaults, are keyed by
+// their dotted names, and the command-line flags by their flag names, so flag
+// overrides are included.
+func effectiveConfig(cfg *viper.Viper, flags *flag.FlagSet) map[string]interface{} {
+	settings := make(map[string]interface{})
+	for _, key := range cfg.AllKeys() {
+		settings[key] = redactConfigValue(key, cfg.Get(key))
+	}
 
-			log.Infof("Comparing last-warning timestamp %s with period %s s", comparisonTimestamp, periodDuration)
+	flagValues := make(map[string]interface{})
+	flags.VisitAll(func(f *flag.Flag) {
+		flagValues[f.Name] = redactConfigValue(f.Name, f.Value.String())
+	})
 
-			now = time.Now()
+	return map[string]interface{}{
+		"config": settings,
+		"flags":  flagValues,
+	}
+}
 
-			// timeframe is met if: more recent of (last warning, job start date) + periodic warning period is before now
-			if comparisonTimestamp.Add(periodDuration).Before(now) {
-				// if so,
-				err = SendPeriodicNotification(ctx, &j)
-				if err != nil {
-					log.Error(errors.Wrap(err, "Error sending periodic notification"))
-					continue
-				}
-				// update timestamp:
-				err = vicedb.UpdateLastPeriodicWarning(ctx, &j, now)
-				if err != nil {
-					log.Error(errors.Wrap(err, "Error updating periodic notification timestamp"))
-					continue
-				}
-			}
-		}
+// configureLogging sets the log output format, which may be "text" or "json".
+func configureLogging(format string) error {
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %s, must be text or json", format)
 	}
+	return nil
 }
 
 func main() {
@@ -390,16 +1452,38 @@ func main() {
 		err error
 		cfg *viper.Viper
 
-		notifPath       = "/notification"
-		configPath      = flag.String("config", "/etc/iplant/de/jobservices.yml", "The path to the YAML config file.")
-		expvarPort      = flag.String("port", "60000", "The path to listen for expvar requests on.")
-		appExposerBase  = flag.String("app-exposer", "http://app-exposer", "The base URL for the app-exposer service.")
-		killNotifKey    = flag.String("kill-notif-key", "killnotifsent", "The key for the annotation detailing whether the notification about job termination was sent.")
-		warningInterval = flag.Int64("warning-interval", 60, "The number of minutes in advance to warn users about job kills.")
-		warningSentKey  = flag.String("warning-sent-key", warningSentKey, "The key for the annotation detailing whether the job termination warning was sent.")
+		notifPath        = "/notification"
+		configPath       = flag.String("config", "/etc/iplant/de/jobservices.yml", "The path to the YAML config file.")
+		expvarPort       = flag.String("port", "60000", "The path to listen for expvar requests on.")
+		appExposerBase   = flag.String("app-exposer", "http://app-exposer", "The base URL for the app-exposer service.")
+		killNotifKey     = flag.String("kill-notif-key", "killnotifsent", "The key for the annotation detailing whether the notification about job termination was sent.")
+		warningFlag      = flag.String("warning-interval", "60", "How far in advance to warn users about job kills, if notifications.warning_thresholds isn't set. Either a duration such as 90m or a number of minutes.")
+		userCacheTTL     = flag.Duration("user-cache-ttl", 5*time.Minute, "How long to cache user lookups from iplant-groups. Set to 0 to disable caching.")
+		killGracePeriod  = flag.Duration("kill-grace-period", 0, "How long past a job's planned end date to wait before killing it.")
+		retryInterval    = flag.Duration("notif-retry-interval", time.Minute, "How often to retry notifications that failed to send.")
+		retryMaxAge      = flag.Duration("notif-retry-max-age", 24*time.Hour, "How long to keep retrying a notification before giving up on it.")
+		endDateSweep     = flag.Duration("end-date-sweep-interval", 5*time.Minute, "How often to set planned end dates for running jobs that are missing them. Set to 0 to disable the sweep.")
+		loopJitter       = flag.Float64("loop-jitter", 0, "The percentage to randomly vary the sleep between job killer iterations by, to keep replicas from querying the database in lockstep.")
+		logFormat        = flag.String("log-format", "text", "The format of the log output, either text or json.")
+		backfill         = flag.Bool("backfill-end-dates", false, "Set the planned end dates of all running interactive jobs that don't have one, then exit.")
+		notifSweep       = flag.Duration("notif-status-sweep-interval", time.Hour, "How often to delete the notification statuses of analyses that were deleted or finished long ago. Set to 0 to disable the sweep.")
+		notifMaxAge      = flag.Duration("notif-status-max-age", 7*24*time.Hour, "How long after an analysis finishes its notification statuses are kept.")
+		iterationTimeout = flag.Duration("iteration-timeout", defaultIterationTimeout, "How long a job killer iteration may run before it's cut off and the next one starts. Set to 0 to disable the deadline.")
+		staleAfter       = flag.Duration("stale-loop-threshold", 0, "How long the job killer loop may go without finishing an iteration before /healthz reports it as stale. Set to 0 to disable the check.")
 	)
+	// Kept so that existing deployments that pass it still start up.
+	flag.String("warning-sent-key", "warningsent", "Deprecated and ignored. Warnings are tracked per threshold in the database.")
 	flag.Parse()
 
+	if err = configureLogging(*logFormat); err != nil {
+		log.Fatal(err)
+	}
+
+	warningInterval, err := parseWarningInterval(*warningFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// make sure the configuration object has sane defaults.
 	if cfg, err = configurate.InitDefaults(*configPath, defaultConfig); err != nil {
 		log.Fatal(err)
@@ -410,11 +1494,40 @@ func main() {
 	shutdown := otelutils.TracerProviderFromEnv(tracerCtx, serviceName, func(e error) { log.Fatal(e) })
 	defer shutdown()
 
+	if err = ConfigureHTTPClient(cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("done configuring the HTTP client, keeping up to %d idle connections per host and retrying requests up to %d times", httpTransport.MaxIdleConnsPerHost, maxRetries)
+
 	log.Info("configuring notification support...")
 	// configure the notification emitters
 	if err = ConfigureNotifications(cfg, notifPath); err != nil {
 		log.Fatal(err)
 	}
+	if err = ConfigurePeriodicNotifications(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = ConfigureWarningThresholds(cfg, warningInterval); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("warning thresholds in minutes: %v", WarningThresholds)
+
+	if err = ConfigureMaxAttempts(cfg); err != nil {
+		log.Fatal(err)
+	}
+	ConfigureGoneNotifications(cfg)
+	ConfigureLookupFallback(cfg)
+	if err = ConfigureNotifTemplates(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if err = ConfigureStatusHistory(cfg); err != nil {
+		log.Fatal(err)
+	}
+	ConfigureResultFolderDisplay(cfg)
+	if err = ConfigureNotificationCC(cfg); err != nil {
+		log.Fatal(err)
+	}
 	log.Info("done configuring notification support")
 
 	log.Info("configuring user lookups...")
@@ -422,7 +1535,17 @@ func main() {
 	if err = ConfigureUserLookups(cfg); err != nil {
 		log.Fatal(err)
 	}
-	log.Info("done configuring user lookups")
+	UserCacheInit(*userCacheTTL)
+	log.Infof("done configuring user lookups, at most %d concurrent requests (0 means no limit)", cap(usersSemaphore))
+
+	if err = ConfigurePreferenceLookups(cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("done configuring preference lookups, enabled: %t", PrefsURI != "")
+
+	if !notifsConfigured() {
+		log.Warn("notifications aren't configured, skipping warnings and periodic notifications")
+	}
 
 	log.Info("configuring VICE URL...")
 	if err = ConfigureAnalyses(cfg); err != nil {
@@ -430,12 +1553,80 @@ func main() {
 	}
 	log.Info("done configuring VICE URL")
 
+	log.Info("configuring timezone...")
+	if err = ConfigureTimezone(cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("done configuring timezone, using %s", TimestampLocation)
+
+	log.Info("configuring time limits...")
+	if err = ConfigureTimeLimits(cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("done configuring time limits, default is %d seconds, minimum is %d seconds, maximum is %d seconds", DefaultTimeLimitSeconds, MinTimeLimitSeconds, MaxTimeLimitSeconds)
+	if warningIntervalTooLong(warningInterval, DefaultTimeLimitSeconds) {
+		log.Warnf("the warning interval of %d minutes is longer than the default time limit of %d seconds", warningInterval, DefaultTimeLimitSeconds)
+	}
+
+	if err = ConfigureBatchLimits(cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("done configuring batch time limits, enabled: %t, limit is %d seconds", BatchLimitsEnabled, BatchTimeLimitSeconds)
+
+	if err = ConfigureBlackouts(cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("done configuring kill blackouts, %d windows", len(BlackoutWindows))
+
+	ConfigureKillPause(cfg)
+
+	if err = ConfigureLeaderElection(cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("done configuring leader election, enabled: %t", LeaderElectionEnabled)
+
+	ConfigureKillFilters(cfg)
+	log.Infof("kill filters: %+v", *KillFilter)
+
+	if err = ConfigureDisabledUserKills(cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("done configuring disabled user kills, enabled: %t", DisabledUserKillsEnabled)
+
+	if err = ConfigureKillRamp(cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("done configuring the kill ramp, lasting %d iterations", startupRamp.iterations)
+
+	if err = ConfigureKillDigest(cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("done configuring the kill digest, enabled: %t, sent daily at %s past midnight", KillDigestEnabled, KillDigestTime)
+
+	if err = ConfigureIdleKills(cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("done configuring idle kills, enabled: %t, threshold is %s", IdleKillsEnabled, IdleKillThreshold)
+
+	if err = ConfigureUsageWarnings(cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("done configuring usage warnings, enabled: %t, threshold is %s over %s, checked every %s", UsageWarningsEnabled, UsageThreshold, UsageWindow, UsageCheckInterval)
+
 	var k8sEnabled bool
 	if cfg.InConfig("vice.k8s-enabled") {
 		k8sEnabled = cfg.GetBool("vice.k8s-enabled")
 	} else {
 		k8sEnabled = true
 	}
+	if IdleKillsEnabled && !k8sEnabled {
+		log.Warn("idle kills need activity data from app-exposer, so they're skipped while vice.k8s-enabled is false")
+	}
+
+	if err = ConfigureKillPaths(cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("done configuring kill paths, apps: %s, app-exposer: %s and %s", AppsStopPath, VICESaveAndExitPath, VICEExitPath)
 
 	appsBase := cfg.GetString("apps.base")
 
@@ -462,6 +1653,9 @@ func main() {
 	if dbURI == "" {
 		log.Fatal("db.uri must be set in the config file")
 	}
+	if dbURI, err = ConfigureDBTLS(cfg, dbURI); err != nil {
+		log.Fatal(err)
+	}
 
 	connector, err := dbutil.NewDefaultConnector("1m")
 	if err != nil {
@@ -477,24 +1671,27 @@ func main() {
 		db: db,
 	}
 
+	if *backfill {
+		summary, err := SweepMissingEndDates(context.Background(), db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof(
+			"backfilled planned end dates for %d running interactive jobs: %d ensured, %d failed",
+			summary.Missing, summary.Ensured, summary.Failed,
+		)
+		return
+	}
+
 	log.Info("configuring messaging support...")
-	amqpclient, err := messaging.NewClient(amqpURI, false)
-	if err != nil {
+	if err = ConfigureConsumers(cfg); err != nil {
 		log.Fatal(err)
 	}
-	defer amqpclient.Close()
 
-	go amqpclient.Listen()
+	// The consumer doesn't connect until this replica is the leader.
+	consumer := NewUpdateConsumer(amqpURI, exchange, exchangeType, CreateMessageHandler(db, vicedb))
 
-	amqpclient.AddConsumer(
-		exchange,
-		exchangeType,
-		"timelord",
-		messaging.UpdatesKey,
-		CreateMessageHandler(db),
-		100,
-	)
-	log.Info("done configuring messaging support")
+	log.Infof("done configuring messaging support, %d consumers with a prefetch of %d", UpdatesConcurrency, UpdatesPrefetch)
 
 	jobKiller := &JobKiller{
 		K8sEnabled:     k8sEnabled,
@@ -502,89 +1699,215 @@ func main() {
 		AppExposerBase: *appExposerBase,
 	}
 
+	var elector *LeaderElector
+	if LeaderElectionEnabled {
+		id, err := os.Hostname()
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "error getting the hostname for leader election"))
+		}
+		elector = NewLeaderElector(db, leaderLeaseName, fmt.Sprintf("%s-%d", id, os.Getpid()), LeaderLeaseDuration)
+
+		// Status updates might still be in flight, so exit and let another
+		// replica take over cleanly instead of trying to stop them.
+		elector.OnLost = func() {
+			log.Fatal("lost the leader lease, exiting")
+		}
+	}
+
+	api := &API{
+		db:              db,
+		vicedb:          vicedb,
+		warningInterval: warningInterval,
+		jobKiller:       jobKiller,
+		config:          effectiveConfig(cfg, flag.CommandLine),
+		elector:         elector,
+		staleAfter:      *staleAfter,
+		consumer:        consumer,
+	}
+	api.RegisterHandlers(http.DefaultServeMux)
+
+	listenAddr := fmt.Sprintf(":%s", *expvarPort)
+	log.Infof("listening for expvar requests on %s", listenAddr)
+	sock, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		if err := http.Serve(sock, nil); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	log.Info("running the startup self-check...")
+	if err = StartupSelfCheck(context.Background(), db); err != nil {
+		log.Fatal(err)
+	}
+	log.Info("done running the startup self-check")
+
+	// Only the leader consumes status updates and runs the job killer, so
+	// followers wait here until they take over.
+	if elector != nil {
+		go elector.Run(context.Background())
+
+		log.Infof("waiting to become the leader as %s...", elector.ID)
+		if err = elector.WaitForLeadership(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+		log.Info("became the leader")
+	}
+
+	go consumer.Run(context.Background())
+
+	if *endDateSweep > 0 {
+		go func() {
+			ticker := time.NewTicker(*endDateSweep)
+			defer ticker.Stop()
+
+			for ; ; <-ticker.C {
+				ctx, span := otel.Tracer(otelName).Start(context.Background(), "planned end date sweep")
+				if _, err := SweepMissingEndDates(ctx, db); err != nil {
+					log.Error(err)
+				}
+				span.End()
+			}
+		}()
+	}
+
+	if *notifSweep > 0 {
+		go func() {
+			ticker := time.NewTicker(*notifSweep)
+			defer ticker.Stop()
+
+			for ; ; <-ticker.C {
+				ctx, span := otel.Tracer(otelName).Start(context.Background(), "orphaned notification status sweep")
+				if _, err := SweepOrphanedNotifStatuses(ctx, vicedb, *notifMaxAge); err != nil {
+					log.Error(err)
+				}
+				span.End()
+			}
+		}()
+	}
+
+	if UsageWarningsEnabled {
+		go func() {
+			ticker := time.NewTicker(UsageCheckInterval)
+			defer ticker.Stop()
+
+			for ; ; <-ticker.C {
+				ctx, span := otel.Tracer(otelName).Start(context.Background(), "usage warnings")
+				sendUsageWarnings(ctx, db, vicedb)
+				span.End()
+			}
+		}()
+	}
+
+	retrier := NewNotifRetrier(db, vicedb, *retryMaxAge, *retryInterval)
+	go retrier.Run(context.Background(), *retryInterval)
+
 	go func() {
-		var jl []Job
+		// iterate runs a single pass of the job killer. Everything it does
+		// honors ctx, so it returns early once the iteration's deadline passes.
+		iterate := func(ctx context.Context) {
+			// The pause may have been set through another replica.
+			if err := killPause.Refresh(ctx, vicedb); err != nil {
+				log.Error(err)
+			}
 
-		for {
-			ctx, span := otel.Tracer(otelName).Start(context.Background(), "job killer iteration")
+			blackout := inBlackout(CurrentClock.Now())
+			paused := killPause.Paused()
+
+			if (!blackout || !BlackoutSkipsWarnings) && (!paused || !PauseSkipsWarnings) {
+				sendWarnings(ctx, db, vicedb)
+			}
+
+			// The digest covers what's already happened, so it's sent
+			// during blackouts and pauses too.
+			if KillDigestEnabled {
+				sendKillDigest(ctx, vicedb)
+			}
 
-			// 1 hour warning
-			sendWarning(ctx, db, vicedb, *warningInterval, *warningSentKey)
+			// Jobs that pass their planned end dates during a blackout are
+			// picked up once it's over.
+			if blackout {
+				log.Info("in a kill blackout window, not killing any jobs")
+				return
+			}
 
-			// 1 day warning
-			sendWarning(ctx, db, vicedb, 1440, oneDayWarningKey)
+			if paused {
+				log.Info("killing is paused, not killing any jobs")
+				return
+			}
 
-			// periodic warnings
-			sendPeriodic(ctx, db, vicedb)
+			startupRamp.StartIteration()
 
-			jl, err = JobsToKill(ctx, db)
+			jl, err := JobsToKill(ctx, db, *killGracePeriod)
 			if err != nil {
 				log.Error(errors.Wrap(err, "error getting list of jobs to kill"))
-				span.End()
-				continue
+				return
 			}
 
-			for _, j := range jl {
-				if err = ensureNotifRecord(ctx, vicedb, j); err != nil {
-					log.Error(err)
-					span.End()
-					continue
+			loopState.Record(killList, jl)
+			killExpiredJobs(ctx, db, vicedb, jl, jobKiller.KillJob, *killNotifKey, KillMaxAttempts)
+
+			if BatchLimitsEnabled {
+				jl, err = BatchJobsToKill(ctx, db, *killGracePeriod)
+				if err != nil {
+					log.Error(errors.Wrap(err, "error getting list of batch jobs to kill"))
+				} else {
+					loopState.Record(batchKillList, jl)
+					killExpiredJobs(ctx, db, vicedb, jl, jobKiller.KillBatchJob, *killNotifKey, KillMaxAttempts)
 				}
+			}
 
-				var notifStatuses *NotifStatuses
+			if IdleKillsEnabled && jobKiller.K8sEnabled && idleChecks.Due(CurrentClock.Now(), IdleCheckInterval) {
+				jl, err = IdleJobsToKill(ctx, db, jobKiller.LastActivity)
+				if err != nil {
+					log.Error(errors.Wrap(err, "error getting list of idle jobs to kill"))
+				} else {
+					loopState.Record(idleKillList, jl)
+					killJobsForReason(ctx, db, vicedb, jl, jobKiller.KillJob, idleKill)
+				}
+			}
 
-				notifStatuses, err = vicedb.NotifStatuses(ctx, &j)
+			if DisabledUserKillsEnabled {
+				jl, err = DisabledUserJobs(ctx, db)
 				if err != nil {
-					log.Error(err)
-					span.End()
-					continue
+					log.Error(errors.Wrap(err, "error getting list of disabled users' jobs to kill"))
+				} else {
+					loopState.Record(disabledUserKillList, jl)
+					killJobsForReason(ctx, db, vicedb, jl, jobKiller.KillJob, disabledUserKill)
 				}
+			}
 
-				if !notifStatuses.KillWarningSent {
-					err = jobKiller.KillJob(ctx, db, &j)
-					if err != nil {
-						log.Error(errors.Wrapf(err, "error terminating analysis '%s'", j.ID))
-					} else {
-
-						err = SendKillNotification(ctx, &j, *killNotifKey)
-						if err != nil {
-							log.Error(errors.Wrapf(err, "error sending notification that %s has been terminated", j.ID))
-						}
-					}
-
-					if err != nil {
-						notifStatuses.KillWarningFailureCount = notifStatuses.KillWarningFailureCount + 1
-
-						if err = vicedb.SetKillWarningFailureCount(ctx, &j, notifStatuses.KillWarningFailureCount); err != nil {
-							log.Error(err)
-							span.End()
-							continue
-						}
-					}
-
-					if err == nil || notifStatuses.KillWarningFailureCount >= maxAttempts {
-						if err = vicedb.SetKillWarningSent(ctx, &j, true); err != nil {
-							log.Error(err)
-							span.End()
-							continue
-						}
-					}
+			// Jobs that are still running after being asked to save and exit,
+			// for whatever reason, haven't shut down yet.
+			if jobKiller.K8sEnabled && HardStopAfter > 0 {
+				jl, err = HardStopCandidates(ctx, db)
+				if err != nil {
+					log.Error(errors.Wrap(err, "error getting list of jobs to hard stop"))
+				} else {
+					hardStopStuckJobs(ctx, db, vicedb, jl, jobKiller.HardStopJob)
 				}
 			}
+		}
+
+		recordLoopStart(CurrentClock.Now())
+
+		for {
+			ctx, span := otel.Tracer(otelName).Start(WithUserMemo(context.Background()), "job killer iteration")
+
+			timedOut := runWithDeadline(ctx, *iterationTimeout, iterate)
+			span.SetAttributes(attribute.Bool("timed_out", timedOut))
+			if timedOut {
+				log.Warnf("job killer iteration was cut off after %s", *iterationTimeout)
+			} else {
+				recordIteration(CurrentClock.Now())
+			}
 
 			span.End()
-			time.Sleep(time.Second * 10)
+			time.Sleep(jitteredInterval(loopInterval, *loopJitter, rand.Float64))
 		}
 	}()
 
-	listenAddr := fmt.Sprintf(":%s", *expvarPort)
-	log.Infof("listening for expvar requests on %s", listenAddr)
-	sock, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = http.Serve(sock, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
+	select {}
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// NotifCCUsers maps user IDs to the addresses that are copied on the kill and
+// warning notifications sent for their jobs.
+var NotifCCUsers = map[string][]string{}
+
+// NotifCCGroups maps iplant-groups group names to the addresses that are
+// copied on the kill and warning notifications sent for their members' jobs,
+// such as a PI who wants to hear about their students' analyses.
+var NotifCCGroups = map[string][]string{}
+
+// NotifCCInit sets the addresses that notifications are copied to.
+func NotifCCInit(users, groups map[string][]string) {
+	NotifCCUsers = users
+	NotifCCGroups = groups
+}
+
+// parseCCEntry parses a notification cc entry in the name=address,address
+// format, where name is a user ID or a group name.
+func parseCCEntry(s string) (string, []string, error) {
+	name, list, found := strings.Cut(s, "=")
+	name = strings.TrimSpace(name)
+	if !found || name == "" {
+		return "", nil, fmt.Errorf("notification cc entry %q isn't in the name=address,address format", s)
+	}
+
+	var addresses []string
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if _, err := mail.ParseAddress(field); err != nil {
+			return "", nil, errors.Wrapf(err, "invalid address %q in notification cc entry for %s", field, name)
+		}
+		addresses = append(addresses, field)
+	}
+	if len(addresses) == 0 {
+		return "", nil, fmt.Errorf("notification cc entry for %s doesn't have any addresses", name)
+	}
+
+	return name, addresses, nil
+}
+
+// parseCCEntries parses a list of notification cc entries into a map from
+// names to addresses. Entries for the same name are combined.
+func parseCCEntries(entries []string) (map[string][]string, error) {
+	cc := make(map[string][]string)
+	for _, s := range entries {
+		name, addresses, err := parseCCEntry(s)
+		if err != nil {
+			return nil, err
+		}
+		cc[name] = append(cc[name], addresses...)
+	}
+	return cc, nil
+}
+
+// userGroups returns the names of the iplant-groups groups that the user is
+// a member of.
+func userGroups(ctx context.Context, id string) ([]string, error) {
+	u, err := url.Parse(UsersURI)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse user lookup URL")
+	}
+
+	u.Path = fmt.Sprintf("/subjects/%s/groups", id)
+
+	resp, b, err := doUserLookup(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to GET groups from %s", u.String())
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("failed group lookup for %s (status: %s, msg %s)", id, resp.Status, b)
+	}
+
+	var lookup struct {
+		Groups []struct {
+			Name string `json:"name"`
+		} `json:"groups"`
+	}
+	if err = json.Unmarshal(b, &lookup); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal group lookup response")
+	}
+
+	names := make([]string, 0, len(lookup.Groups))
+	for _, g := range lookup.Groups {
+		names = append(names, g.Name)
+	}
+	return names, nil
+}
+
+// ccRecipients returns the addresses that notifications about the user's jobs
+// are copied to, without duplicates or the user's own address. Groups are
+// only looked up if there are group entries. If the lookup fails, the
+// addresses configured for the user are still returned along with the error.
+func ccRecipients(ctx context.Context, id, primary string) ([]string, error) {
+	var (
+		recipients []string
+		lookupErr  error
+	)
+
+	seen := map[string]bool{strings.ToLower(primary): true}
+	add := func(addresses []string) {
+		for _, a := range addresses {
+			if key := strings.ToLower(a); !seen[key] {
+				seen[key] = true
+				recipients = append(recipients, a)
+			}
+		}
+	}
+
+	add(NotifCCUsers[id])
+
+	if len(NotifCCGroups) > 0 {
+		groups, err := userGroups(ctx, id)
+		if err != nil {
+			lookupErr = errors.Wrapf(err, "error looking up groups for %s", id)
+		}
+		for _, g := range groups {
+			add(NotifCCGroups[g])
+		}
+	}
+
+	return recipients, lookupErr
+}
+
+// Emailer sends the copies of notifications to their cc addresses.
+type Emailer interface {
+	Email(ctx context.Context, to string, n *Notification) error
+}
+
+// EmailMessage is the request that EmailService POSTs to the DE email service.
+// The notification's email template is rendered with its payload.
+type EmailMessage struct {
+	To       string   `json:"to"`
+	Subject  string   `json:"subject"`
+	Template string   `json:"template"`
+	Values   *Payload `json:"values"`
+}
+
+// EmailService sends emails through the DE email service at URI. Unlike
+// notification-agent, it doesn't add a notification to anyone's list in the
+// DE or pass the message on to the other sinks.
+type EmailService struct {
+	URI string
+}
+
+// Email POSTs the notification to the email service, addressed to to.
+func (s *EmailService) Email(ctx context.Context, to string, n *Notification) error {
+	msg, err := json.Marshal(&EmailMessage{
+		To:       to,
+		Subject:  n.Subject,
+		Template: n.EmailTemplate,
+		Values:   n.Payload,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal email to %s", to)
+	}
+
+	resp, err := doWithRetry(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URI, bytes.NewBuffer(msg))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("content-type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to post email")
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read email service response body")
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("email service returned status %s: %s", resp.Status, b)
+	}
+
+	return nil
+}
+
+// CCEmailer sends the copies of notifications.
+var CCEmailer Emailer = &EmailService{}
+
+// CCEmailerInit sets what sends the copies of notifications.
+func CCEmailerInit(e Emailer) {
+	CCEmailer = e
+}
+
+// sendCopies emails a copy of the notification to each of the addresses that
+// notifications for the user are copied on. The copies are only emailed, so
+// that the user doesn't get another notification in the DE and the other
+// sinks don't hear about the notification more than once. Failures are logged
+// rather than returned, since they shouldn't affect the notification the user
+// already got.
+func sendCopies(ctx context.Context, n *Notification, u *User) {
+	if len(NotifCCUsers) == 0 && len(NotifCCGroups) == 0 {
+		return
+	}
+
+	recipients, err := ccRecipients(ctx, u.ID, u.Email)
+	if err != nil {
+		log.Error(err)
+	}
+
+	for _, address := range recipients {
+		payload := *n.Payload
+		payload.Email = address
+
+		cc := *n
+		cc.Payload = &payload
+
+		if err = CCEmailer.Email(ctx, address, &cc); err != nil {
+			log.Error(errors.Wrapf(err, "failed to copy notification for analysis %s to %s", n.Payload.AnalysisID, address))
+		}
+	}
+}
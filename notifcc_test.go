@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseCCEntry(t *testing.T) {
+	tests := []struct {
+		entry     string
+		name      string
+		addresses []string
+		valid     bool
+	}{
+		{"student=pi@example.edu", "student", []string{"pi@example.edu"}, true},
+		{" lab:bio101 = pi@example.edu, ta@example.edu ", "lab:bio101", []string{"pi@example.edu", "ta@example.edu"}, true},
+		{"student=pi@example.edu,", "student", []string{"pi@example.edu"}, true},
+		{"pi@example.edu", "", nil, false},
+		{"=pi@example.edu", "", nil, false},
+		{"student=", "", nil, false},
+		{"student=not an address", "", nil, false},
+	}
+
+	for _, test := range tests {
+		name, addresses, err := parseCCEntry(test.entry)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: error was %v", test.entry, err)
+			continue
+		}
+		if name != test.name || fmt.Sprint(addresses) != fmt.Sprint(test.addresses) {
+			t.Errorf("%q: parsed as %s and %v, not %s and %v", test.entry, name, addresses, test.name, test.addresses)
+		}
+	}
+
+	cc, err := parseCCEntries([]string{"student=pi@example.edu", "student=ta@example.edu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(cc["student"]) != "[pi@example.edu ta@example.edu]" {
+		t.Errorf("combined entries were %v", cc["student"])
+	}
+}
+
+// newGroupsServer returns an iplant-groups server that knows about a single
+// user and the groups they belong to. If groups is nil, group lookups fail.
+func newGroupsServer(t *testing.T, user User, groups []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/subjects/" + user.ID:
+			json.NewEncoder(w).Encode(user)
+		case "/subjects/" + user.ID + "/groups":
+			if groups == nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			var body struct {
+				Groups []map[string]string `json:"groups"`
+			}
+			for _, g := range groups {
+				body.Groups = append(body.Groups, map[string]string{"name": g})
+			}
+			json.NewEncoder(w).Encode(body)
+		default:
+			t.Errorf("unexpected request for %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestCCRecipients(t *testing.T) {
+	defer NotifCCInit(map[string][]string{}, map[string][]string{})
+	defer UsersInit("")
+
+	tests := []struct {
+		name     string
+		users    map[string][]string
+		groups   map[string][]string
+		member   []string
+		expected []string
+		err      bool
+	}{
+		{"none", map[string][]string{}, map[string][]string{}, []string{"lab"}, nil, false},
+		{"user", map[string][]string{"student": {"pi@example.edu"}}, map[string][]string{}, nil, []string{"pi@example.edu"}, false},
+		{"group", map[string][]string{}, map[string][]string{"lab": {"pi@example.edu"}, "other": {"other@example.edu"}}, []string{"lab"}, []string{"pi@example.edu"}, false},
+		{
+			"deduped",
+			map[string][]string{"student": {"pi@example.edu", "student@example.edu"}},
+			map[string][]string{"lab": {"PI@example.edu", "ta@example.edu"}, "course": {"ta@example.edu"}},
+			[]string{"lab", "course"},
+			[]string{"pi@example.edu", "ta@example.edu"},
+			false,
+		},
+		{"group lookup fails", map[string][]string{"student": {"pi@example.edu"}}, map[string][]string{"lab": {"ta@example.edu"}}, nil, []string{"pi@example.edu"}, true},
+	}
+
+	for _, test := range tests {
+		srv := newGroupsServer(t, User{ID: "student"}, test.member)
+		UsersInit(srv.URL)
+		NotifCCInit(test.users, test.groups)
+
+		recipients, err := ccRecipients(context.Background(), "student", "student@example.edu")
+		if (err != nil) != test.err {
+			t.Errorf("%s: error was %v", test.name, err)
+		}
+		if fmt.Sprint(recipients) != fmt.Sprint(test.expected) {
+			t.Errorf("%s: recipients were %v, not %v", test.name, recipients, test.expected)
+		}
+
+		srv.Close()
+	}
+}
+
+// recordingEmailer records the addresses it's asked to email and fails the
+// ones in fail.
+type recordingEmailer struct {
+	mu     sync.Mutex
+	fail   map[string]bool
+	emails []string
+}
+
+func (e *recordingEmailer) Email(_ context.Context, to string, n *Notification) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.emails = append(e.emails, to)
+	if n.Payload.Email != to {
+		return fmt.Errorf("copy to %s was addressed to %s", to, n.Payload.Email)
+	}
+	if e.fail[to] {
+		return errors.New("copy failed")
+	}
+	return nil
+}
+
+func TestSendKillNotificationCopies(t *testing.T) {
+	defer NotifCCInit(map[string][]string{}, map[string][]string{})
+	defer CCEmailerInit(&EmailService{})
+	defer SinksInit(&AgentSink{})
+	defer NotifsInit("")
+	defer UsersInit("")
+
+	start := time.Now().Add(-48 * time.Hour).In(TimestampLocation)
+	j := &Job{
+		ID:             "job-id",
+		Name:           "job-name",
+		User:           "student@example.com",
+		StartDate:      start.Format(TimestampFromDBFormat),
+		PlannedEndDate: start.Add(24 * time.Hour).Format(TimestampFromDBFormat),
+	}
+
+	tests := []struct {
+		name   string
+		member []string
+		fail   map[string]bool
+	}{
+		{"copies sent", []string{"lab"}, nil},
+		{"group lookup fails", nil, nil},
+		{"copies fail", []string{"lab"}, map[string]bool{"ta@example.edu": true, "pi@example.edu": true}},
+	}
+
+	for _, test := range tests {
+		srv := newGroupsServer(t, User{ID: "student", Email: "student@example.edu"}, test.member)
+		UsersInit(srv.URL)
+		NotifsInit("http://notification-agent")
+		sink := &recordingSink{}
+		SinksInit(sink)
+		emailer := &recordingEmailer{fail: test.fail}
+		CCEmailerInit(emailer)
+		NotifCCInit(
+			map[string][]string{"student": {"ta@example.edu"}},
+			map[string][]string{"lab": {"pi@example.edu", "ta@example.edu"}},
+		)
+
+		if err := SendKillNotification(context.Background(), j, "", KillReasonTimeLimit); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+
+		// The copies are only emailed, so the sinks just get the student's
+		// notification.
+		if len(sink.notifs) != 1 {
+			t.Errorf("%s: %d notifications were delivered, not 1", test.name, len(sink.notifs))
+		} else if n := sink.notifs[0]; n.User != "student" || !n.Email || n.Payload.Email != "student@example.edu" {
+			t.Errorf("%s: notification was for %s at %s with email %t", test.name, n.User, n.Payload.Email, n.Email)
+		}
+
+		expected := "ta@example.edu,pi@example.edu"
+		if test.member == nil {
+			expected = "ta@example.edu"
+		}
+		if actual := strings.Join(emailer.emails, ","); actual != expected {
+			t.Errorf("%s: copies were emailed to %s, not %s", test.name, actual, expected)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestEmailService(t *testing.T) {
+	var msg EmailMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	n := &Notification{
+		Subject:       "subject",
+		EmailTemplate: "analysis_status_change",
+		Payload:       &Payload{AnalysisID: "job-id", Email: "pi@example.edu"},
+	}
+	if err := (&EmailService{URI: srv.URL}).Email(context.Background(), "pi@example.edu", n); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.To != "pi@example.edu" || msg.Subject != "subject" || msg.Template != "analysis_status_change" {
+		t.Errorf("email was %+v", msg)
+	}
+	if msg.Values == nil || msg.Values.AnalysisID != "job-id" {
+		t.Errorf("email values were %+v", msg.Values)
+	}
+}
@@ -4,9 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 )
 
 // NotifsURI the default URI for notification requests.
@@ -17,35 +23,241 @@ func NotifsInit(newuri string) {
 	NotifsURI = newuri
 }
 
-// KillMessageFormat contains the parameterized message that gets sent to users when
-// their job expires.
-const KillMessageFormat = `Analysis "%s" (%s) had a configured end date of "%s" (%s), which has passed.
+// notifsConfigured returns whether notifications can be sent at all, which
+// needs both the notification-agent and iplant-groups URIs.
+func notifsConfigured() bool {
+	return NotifsURI != "" && UsersURI != ""
+}
+
+// PeriodicWarningDefault is how often periodic notifications are sent for jobs
+// that don't have their own period set.
+var PeriodicWarningDefault = 4 * time.Hour
+
+// PeriodicWarningDefaultInit sets how often periodic notifications are sent for
+// jobs that don't have their own period set.
+func PeriodicWarningDefaultInit(d time.Duration) {
+	PeriodicWarningDefault = d
+}
+
+// PeriodicMinRuntime is how long a job has to have been running before any
+// periodic notifications are sent for it.
+var PeriodicMinRuntime time.Duration
+
+// PeriodicMinRuntimeInit sets how long a job has to have been running before
+// any periodic notifications are sent for it.
+func PeriodicMinRuntimeInit(d time.Duration) {
+	PeriodicMinRuntime = d
+}
+
+// WarningThresholds are the numbers of minutes before a job's planned end date
+// at which its user is warned that it will be killed, in descending order.
+var WarningThresholds = []int64{1440, 60}
 
-Output files should be available in the %s folder in iRODS.`
+// WarningThresholdsInit sets the numbers of minutes before a job's planned end
+// date at which its user is warned that it will be killed.
+func WarningThresholdsInit(thresholds []int64) {
+	WarningThresholds = thresholds
+}
+
+// HourWarningThreshold is the threshold, in minutes, that the hour_warning_sent
+// and hour_warning_failure_count columns in notif_statuses were kept for before
+// the warning thresholds could be configured, which was the warning interval.
+// The day_warning_sent and day_warning_failure_count columns were always kept
+// for 1440 minutes.
+var HourWarningThreshold int64 = 60
+
+// HourWarningThresholdInit sets the threshold, in minutes, that the hour
+// warning columns in notif_statuses were kept for.
+func HourWarningThresholdInit(minutes int64) {
+	HourWarningThreshold = minutes
+}
 
-// KillSubjectFormat is the parameterized email subject that is used for the email
-// that is sent to users when their job expires.
-const KillSubjectFormat = "Analysis %s canceled due to time limit restrictions."
+// WarningMaxAttempts is how many times sending a warning notification is tried
+// before it's handed off to the pending notification queue.
+var WarningMaxAttempts = 3
 
-// WarningMessageFormat is the parameterized message that gets send to users
-// when their job is going to expire in the near future.
-const WarningMessageFormat = `Analysis "%s" (%s) is set to expire on "%s" (%s).
+// KillMaxAttempts is how many times sending a kill notification is tried before
+// it's handed off to the pending notification queue.
+var KillMaxAttempts = 3
 
-Please finish any work that is in progress. Output files will be transferred to the %s folder in iRODS when the application shuts down.`
+// MaxAttemptsInit sets how many times warning and kill notifications are tried
+// before they're handed off to the pending notification queue.
+func MaxAttemptsInit(warning, kill int) {
+	WarningMaxAttempts = warning
+	KillMaxAttempts = kill
+}
+
+// GoneNotificationsEnabled is whether users are told when their analyses were
+// already gone by the time timelord tried to kill them. It's off by default.
+var GoneNotificationsEnabled = false
+
+// GoneNotificationsInit sets whether users are told when their analyses were
+// already gone by the time timelord tried to kill them.
+func GoneNotificationsInit(enabled bool) {
+	GoneNotificationsEnabled = enabled
+}
 
-// WarningSubjectFormat is the parameterized subject for the email that is sent
-// to users when their job is going to terminate in the near future.
-const WarningSubjectFormat = "Analysis %s will terminate on %s (%s)."
+// LookupFallbackEnabled is whether notifications are still sent, without an
+// email, when the user can't be looked up in iplant-groups. It's off by
+// default.
+var LookupFallbackEnabled = false
+
+// LookupFallbackInit sets whether notifications are still sent when the user
+// can't be looked up.
+func LookupFallbackInit(enabled bool) {
+	LookupFallbackEnabled = enabled
+}
+
+// StatusHistoryLength is how many of the job's most recent status transitions
+// are included in periodic notifications. None are included while it's zero,
+// which is the default.
+var StatusHistoryLength = 0
+
+// StatusHistoryInit sets how many status transitions are included in
+// periodic notifications.
+func StatusHistoryInit(n int) {
+	StatusHistoryLength = n
+}
+
+// ResultFolderPrefix is the start of the result folder paths that's replaced
+// with ResultFolderDisplayPrefix in the messages sent to users, so that they
+// see the paths the way the deployment presents them. No paths are changed if
+// it's empty.
+var ResultFolderPrefix string
+
+// ResultFolderDisplayPrefix replaces ResultFolderPrefix at the start of the
+// result folder paths in the messages sent to users.
+var ResultFolderDisplayPrefix string
+
+// ResultFolderDisplayInit sets the result folder path prefix that's replaced
+// in the messages sent to users and what it's replaced with.
+func ResultFolderDisplayInit(prefix, displayPrefix string) {
+	ResultFolderPrefix = prefix
+	ResultFolderDisplayPrefix = displayPrefix
+}
+
+// displayResultFolder returns the result folder path as it's shown to users.
+// The prefix is only replaced if it ends at a path separator, so that a prefix
+// of /iplant/home doesn't change /iplant/homework.
+func displayResultFolder(folder string) string {
+	if ResultFolderPrefix == "" || !strings.HasPrefix(folder, ResultFolderPrefix) {
+		return folder
+	}
+
+	rest := strings.TrimPrefix(folder, ResultFolderPrefix)
+	if rest != "" && !strings.HasSuffix(ResultFolderPrefix, "/") && !strings.HasPrefix(rest, "/") {
+		return folder
+	}
+
+	return ResultFolderDisplayPrefix + rest
+}
 
-// PeriodicMessageFormat is the parameterized message that gets sent to users
-// when it's time to send a regular reminder the job is still running
-// parameters: analysis name, current duration, duration until planned end date
-const PeriodicMessageFormat = `Analysis "%s" has been running for %s and will stop in %s.`
+// KillMessageFormat is the default template of the message that gets sent to
+// users when their job expires.
+const KillMessageFormat = `Analysis "{{.JobName}}" ({{.ID}}) had a configured end date of "{{.EndTimeLocal}}" ({{.EndTimeUTC}}), which has passed.
 
-// PeriodicSubjectFormat is the subject for the email that is sent
-// to users as a regular reminder of a running job
-// one parameter should be a timestamp, to distinguish messages so they're not grouped by gmail et al
-const PeriodicSubjectFormat = `CyVerse: Your analysis is still running (%s)`
+Output files should be available in the {{.ResultFolder}} folder in iRODS.`
+
+// KillSubjectFormat is the default template of the email subject that is used
+// for the email that is sent to users when their job expires.
+const KillSubjectFormat = "Analysis {{.JobName}} canceled due to time limit restrictions."
+
+// AdminKillMessageFormat is the default template of the message that gets
+// sent to users when an administrator kills their job.
+const AdminKillMessageFormat = `Analysis "{{.JobName}}" ({{.ID}}) was canceled by an administrator.
+
+Output files should be available in the {{.ResultFolder}} folder in iRODS.`
+
+// AdminKillSubjectFormat is the default template of the subject for the email
+// that is sent to users when an administrator kills their job.
+const AdminKillSubjectFormat = "Analysis {{.JobName}} canceled by an administrator."
+
+// DisabledUserMessageFormat is the default template of the message that gets
+// sent to users when their job is killed because their account is disabled.
+const DisabledUserMessageFormat = `Analysis "{{.JobName}}" ({{.ID}}) was canceled because your account is disabled.
+
+Output files should be available in the {{.ResultFolder}} folder in iRODS.`
+
+// DisabledUserSubjectFormat is the default template of the subject for the
+// email that is sent to users when their job is killed because their account
+// is disabled.
+const DisabledUserSubjectFormat = "Analysis {{.JobName}} canceled because the account is disabled."
+
+// IdleKillMessageFormat is the default template of the message that gets sent
+// to users when their VICE analysis is killed because it hasn't been used in a
+// while.
+const IdleKillMessageFormat = `Analysis "{{.JobName}}" ({{.ID}}) was canceled because it hadn't been used in a while.
+
+Output files should be available in the {{.ResultFolder}} folder in iRODS.`
+
+// IdleKillSubjectFormat is the default template of the subject for the email
+// that is sent to users when their VICE analysis is killed for being idle.
+const IdleKillSubjectFormat = "Analysis {{.JobName}} canceled due to inactivity."
+
+// The reasons a job can be killed for, which pick the wording of the kill
+// notification.
+const (
+	KillReasonTimeLimit    = "time_limit"
+	KillReasonAdmin        = "admin"
+	KillReasonDisabledUser = "disabled_user"
+	KillReasonIdle         = "idle"
+)
+
+// killNotificationText returns the subject and message of the notification
+// telling the user that their job was killed for the reason. Unknown reasons,
+// including an empty one, get the time limit wording.
+func killNotificationText(j *Job, reason string) (string, string, error) {
+	data := jobTemplateData(j)
+
+	switch reason {
+	case KillReasonAdmin:
+		return renderNotifText(adminKillTemplates, data)
+	case KillReasonDisabledUser:
+		return renderNotifText(disabledUserKillTemplates, data)
+	case KillReasonIdle:
+		return renderNotifText(idleKillTemplates, data)
+	}
+
+	endtime, err := parseDBTimestamp(j.PlannedEndDate)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to parse planned end date %s", j.PlannedEndDate)
+	}
+	return renderNotifText(killTemplates, data.withEndTime(endtime))
+}
+
+// WarningMessageFormat is the default template of the message that gets sent
+// to users when their job is going to expire in the near future.
+const WarningMessageFormat = `Analysis "{{.JobName}}" ({{.ID}}) is set to expire on "{{.EndTimeLocal}}" ({{.EndTimeUTC}}).
+
+Please finish any work that is in progress. Output files will be transferred to the {{.ResultFolder}} folder in iRODS when the application shuts down.`
+
+// WarningSubjectFormat is the default template of the subject for the email
+// that is sent to users when their job is going to terminate in the near
+// future.
+const WarningSubjectFormat = "Analysis {{.JobName}} will terminate on {{.EndTimeLocal}} ({{.EndTimeUTC}})."
+
+// GoneMessageFormat is the default template of the message that gets sent to
+// users when their job had already stopped by the time its planned end date
+// passed.
+const GoneMessageFormat = `Analysis "{{.JobName}}" ({{.ID}}) had a configured end date of "{{.EndTimeLocal}}" ({{.EndTimeUTC}}), but it had already stopped running.
+
+Output files should be available in the {{.ResultFolder}} folder in iRODS.`
+
+// GoneSubjectFormat is the default template of the subject for the email that
+// is sent to users when their job had already stopped by the time its planned
+// end date passed.
+const GoneSubjectFormat = "Analysis {{.JobName}} has already stopped."
+
+// PeriodicMessageFormat is the default template of the message that gets sent
+// to users when it's time to send a regular reminder the job is still running.
+// Analyses that are exempt from being killed don't get told when they'll stop.
+const PeriodicMessageFormat = `Analysis "{{.JobName}}" has been running for {{.Duration}}{{if .Remaining}} and will stop in {{.Remaining}}{{end}}.`
+
+// PeriodicSubjectFormat is the default template of the subject for the email
+// that is sent to users as a regular reminder of a running job. It includes
+// the current time to distinguish messages so they're not grouped by gmail et
+// al.
+const PeriodicSubjectFormat = `CyVerse: Your analysis is still running ({{.Now}})`
 
 // Notification is a message intended as a notification to some upstream service
 // or the DE UI.
@@ -74,6 +286,60 @@ type Payload struct {
 	Email                 string `json:"email_address"`
 	Action                string `json:"action"`
 	User                  string `json:"user"`
+	KillReason            string `json:"kill_reason,omitempty"` // Only set for kill notifications.
+
+	// Numeric progress fields, only set for periodic notifications so that
+	// the UI can show progress without parsing the duration strings.
+	StartMillis      int64    `json:"startmillis,omitempty"`      // Milliseconds since the epoch.
+	PlannedEndMillis int64    `json:"plannedendmillis,omitempty"` // Milliseconds since the epoch.
+	FractionElapsed  *float64 `json:"fractionelapsed,omitempty"`  // Between 0 and 1.
+
+	// The job's most recent status transitions, oldest first. Only set for
+	// periodic notifications when StatusHistoryLength is positive.
+	StatusHistory []StatusUpdate `json:"status_history,omitempty"`
+
+	// The summary of a day's kills. Only set for the kill digest.
+	KillDigest *KillDigest `json:"kill_digest,omitempty"`
+}
+
+// PayloadOption sets optional fields on a Payload.
+type PayloadOption func(*Payload)
+
+// WithProgress returns a PayloadOption that sets the progress fields from the
+// job's start date and planned end date as of now.
+func WithProgress(start, plannedEnd, now time.Time) PayloadOption {
+	return func(p *Payload) {
+		p.StartMillis = start.UnixMilli()
+		p.PlannedEndMillis = plannedEnd.UnixMilli()
+
+		total := plannedEnd.Sub(start)
+		fraction := 1.0
+		if total > 0 {
+			fraction = float64(now.Sub(start)) / float64(total)
+		}
+		if fraction < 0 {
+			fraction = 0
+		}
+		if fraction > 1 {
+			fraction = 1
+		}
+		p.FractionElapsed = &fraction
+	}
+}
+
+// WithStatusHistory returns a PayloadOption that sets the job's recent status
+// transitions.
+func WithStatusHistory(updates []StatusUpdate) PayloadOption {
+	return func(p *Payload) {
+		p.StatusHistory = updates
+	}
+}
+
+// WithKillReason returns a PayloadOption that sets why the job was killed.
+func WithKillReason(reason string) PayloadOption {
+	return func(p *Payload) {
+		p.KillReason = reason
+	}
 }
 
 // NewPayload returns a newly constructed *Payload with the Action set to "job_status_change"
@@ -104,16 +370,161 @@ func (n *Notification) Send(ctx context.Context) (*http.Response, error) {
 		return nil, errors.Wrapf(err, "failed to marshal message for user %s with subject '%s'", n.User, n.Subject)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URI, bytes.NewBuffer(msg))
+	resp, err := doWithRetry(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URI, bytes.NewBuffer(msg))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("content-type", "application/json")
+		return req, nil
+	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to post notification")
 	}
-	req.Header.Set("content-type", "application/json")
 
-	resp, err := httpClient.Do(req)
+	return resp, nil
+}
+
+// Sink is a destination that notifications are delivered to.
+type Sink interface {
+	Deliver(ctx context.Context, n *Notification) error
+}
+
+// notifAgentResponses counts the responses from the notification-agent by
+// status class, such as 2xx or 5xx. It's published through expvar.
+var notifAgentResponses = expvar.NewMap("notification_agent_responses")
+
+// statusClass returns the class of the HTTP status code, such as 2xx or 5xx.
+func statusClass(code int) string {
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+// AgentSink delivers notifications to the DE notification-agent at the URI
+// set in the notification.
+type AgentSink struct{}
+
+// Deliver POSTs the notification to the notification-agent. Returns an error
+// if the notification-agent responds with a non-2xx status.
+func (s *AgentSink) Deliver(ctx context.Context, n *Notification) error {
+	resp, err := n.Send(ctx)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to post notification")
+		return err
 	}
+	defer resp.Body.Close()
 
-	return resp, nil
+	notifAgentResponses.Add(statusClass(resp.StatusCode), 1)
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read notification response body")
+	}
+
+	var analysisID string
+	if n.Payload != nil {
+		analysisID = n.Payload.AnalysisID
+	}
+	log.Infof("notification: (invocation_id: %s, status: %s, body: %s)", analysisID, resp.Status, b)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notification-agent returned status %s: %s", resp.Status, b)
+	}
+
+	return nil
+}
+
+// WebhookMessage is the compact message that WebhookSink POSTs. The Text field
+// makes it usable with Slack incoming webhooks as-is.
+type WebhookMessage struct {
+	Text         string `json:"text"`
+	User         string `json:"user"`
+	Subject      string `json:"subject"`
+	Message      string `json:"message"`
+	AnalysisID   string `json:"analysis_id,omitempty"`
+	AnalysisName string `json:"analysis_name,omitempty"`
+	Status       string `json:"status,omitempty"`
+	AccessURL    string `json:"access_url,omitempty"`
+}
+
+// WebhookSink delivers notifications to an arbitrary webhook, such as a Slack
+// channel.
+type WebhookSink struct {
+	URL string
+}
+
+// Deliver POSTs a compact JSON version of the notification to the webhook.
+func (s *WebhookSink) Deliver(ctx context.Context, n *Notification) error {
+	wm := &WebhookMessage{
+		Text:    fmt.Sprintf("[%s] %s\n%s", n.User, n.Subject, n.Message),
+		User:    n.User,
+		Subject: n.Subject,
+		Message: n.Message,
+	}
+	if n.Payload != nil {
+		wm.AnalysisID = n.Payload.AnalysisID
+		wm.AnalysisName = n.Payload.AnalysisName
+		wm.Status = n.Payload.AnalysisStatus
+		wm.AccessURL = n.Payload.AccessURL
+	}
+
+	msg, err := json.Marshal(wm)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal webhook message for user %s", n.User)
+	}
+
+	resp, err := doWithRetry(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewBuffer(msg))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("content-type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to post webhook message")
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read webhook response body")
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %s: %s", resp.Status, b)
+	}
+
+	return nil
+}
+
+// NotifSinks are the sinks that notifications are delivered to. The first one
+// is the primary sink, which is normally the notification-agent.
+var NotifSinks = []Sink{&AgentSink{}}
+
+// SinksInit sets the sinks that notifications are delivered to, starting with
+// the primary one.
+func SinksInit(sinks ...Sink) {
+	NotifSinks = sinks
+}
+
+// Deliver sends the notification to the primary sink, then to each of the
+// secondary ones. An error is returned if the primary sink fails, so that the
+// caller can retry, and the secondary sinks aren't given the notification
+// until it succeeds. Failures in the secondary sinks are only logged, so that
+// they don't cause the notification to be sent to the user again.
+func Deliver(ctx context.Context, n *Notification) error {
+	if len(NotifSinks) == 0 {
+		return nil
+	}
+
+	if err := NotifSinks[0].Deliver(ctx, n); err != nil {
+		return errors.Wrapf(err, "failed to deliver notification to %T", NotifSinks[0])
+	}
+
+	for _, sink := range NotifSinks[1:] {
+		if err := sink.Deliver(ctx, n); err != nil {
+			log.Error(errors.Wrapf(err, "failed to deliver notification to %T", sink))
+		}
+	}
+
+	return nil
 }
@@ -3,10 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"expvar"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNotifsInit(t *testing.T) {
@@ -77,3 +80,319 @@ func TestSend(t *testing.T) {
 		t.Errorf("status code was %d, not 200", resp.StatusCode)
 	}
 }
+
+func TestDeliverWebhook(t *testing.T) {
+	defer fastRetries()()
+	defer SinksInit(&AgentSink{})
+
+	var received *WebhookMessage
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = &WebhookMessage{}
+		if err := json.NewDecoder(r.Body).Decode(received); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer webhook.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	// A failing secondary sink doesn't fail the delivery.
+	SinksInit(&WebhookSink{URL: webhook.URL}, &WebhookSink{URL: failing.URL})
+
+	p := NewPayload()
+	p.AnalysisID = "analysis-id"
+	p.AnalysisName = "analysis-name"
+	n := NewNotification("test-user", "test-subject", "test-message", true, "analysis_status_change", p)
+
+	if err := Deliver(context.Background(), n); err != nil {
+		t.Error(err)
+	}
+
+	if received == nil {
+		t.Fatal("webhook didn't receive the notification")
+	}
+	if received.User != "test-user" {
+		t.Errorf("user was %s, not test-user", received.User)
+	}
+	if received.Subject != "test-subject" {
+		t.Errorf("subject was %s, not test-subject", received.Subject)
+	}
+	if received.AnalysisID != "analysis-id" {
+		t.Errorf("analysis ID was %s, not analysis-id", received.AnalysisID)
+	}
+	if received.Text == "" {
+		t.Error("text was empty")
+	}
+}
+
+func TestDeliverPrimarySinkFails(t *testing.T) {
+	defer fastRetries()()
+	defer SinksInit(&AgentSink{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	secondary := &recordingSink{}
+	SinksInit(&WebhookSink{URL: srv.URL}, secondary)
+
+	n := NewNotification("test-user", "test-subject", "", false, "", nil)
+	if err := Deliver(context.Background(), n); err == nil {
+		t.Error("error was nil")
+	}
+	if len(secondary.notifs) != 0 {
+		t.Errorf("secondary sink got %d notifications before the primary one succeeded", len(secondary.notifs))
+	}
+}
+
+func TestWithProgress(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(4 * time.Hour)
+
+	tests := []struct {
+		now      time.Time
+		expected float64
+	}{
+		{start.Add(-time.Hour), 0},
+		{start, 0},
+		{start.Add(time.Hour), 0.25},
+		{end, 1},
+		{end.Add(time.Hour), 1},
+	}
+
+	for _, test := range tests {
+		p := NewPayload()
+		WithProgress(start, end, test.now)(p)
+
+		if p.StartMillis != start.UnixMilli() {
+			t.Errorf("start was %d, not %d", p.StartMillis, start.UnixMilli())
+		}
+		if p.PlannedEndMillis != end.UnixMilli() {
+			t.Errorf("planned end was %d, not %d", p.PlannedEndMillis, end.UnixMilli())
+		}
+		if p.FractionElapsed == nil || *p.FractionElapsed != test.expected {
+			t.Errorf("fraction elapsed at %s was %v, not %v", test.now, p.FractionElapsed, test.expected)
+		}
+	}
+}
+
+func TestPayloadWithoutProgress(t *testing.T) {
+	b, err := json.Marshal(NewPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]interface{}
+	if err = json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"startmillis", "plannedendmillis", "fractionelapsed"} {
+		if _, ok := fields[field]; ok {
+			t.Errorf("%s was included without progress", field)
+		}
+	}
+}
+
+func TestSendWarningNotificationAgentError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/subjects/user" {
+			json.NewEncoder(w).Encode(User{ID: "user", Email: "user@example.com"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	NotifsInit(srv.URL + "/notification")
+	UsersInit(srv.URL)
+	defer NotifsInit("")
+	defer UsersInit("")
+
+	before := int64(0)
+	if v, ok := notifAgentResponses.Get("5xx").(*expvar.Int); ok {
+		before = v.Value()
+	}
+
+	start := time.Now().Add(-time.Hour)
+	j := &Job{
+		ID:             "job-id",
+		Name:           "job-name",
+		User:           "user@example.com",
+		StartDate:      start.In(TimestampLocation).Format(TimestampFromDBFormat),
+		PlannedEndDate: start.Add(2 * time.Hour).In(TimestampLocation).Format(TimestampFromDBFormat),
+	}
+
+	if err := SendWarningNotification(context.Background(), j); err == nil {
+		t.Error("error was nil when the notification-agent returned a 500")
+	}
+
+	v, ok := notifAgentResponses.Get("5xx").(*expvar.Int)
+	if !ok || v.Value() != before+1 {
+		t.Errorf("5xx responses were %v, not %d", notifAgentResponses.Get("5xx"), before+1)
+	}
+}
+
+func TestDisplayResultFolder(t *testing.T) {
+	defer ResultFolderDisplayInit("", "")
+
+	folder := "/iplant/home/user/analyses/job-name"
+
+	ResultFolderDisplayInit("", "")
+	if actual := displayResultFolder(folder); actual != folder {
+		t.Errorf("folder without a mapping was %s, not %s", actual, folder)
+	}
+
+	tests := []struct {
+		prefix   string
+		display  string
+		folder   string
+		expected string
+	}{
+		{"/iplant/home", "/home", folder, "/home/user/analyses/job-name"},
+		{"/iplant/home/", "", folder, "user/analyses/job-name"},
+		{"/iplant/home", "/home", "/iplant/homework/job-name", "/iplant/homework/job-name"},
+		{"/iplant/home", "/home", "/iplant/home", "/home"},
+		{"/other/zone", "/home", folder, folder},
+	}
+
+	for _, test := range tests {
+		ResultFolderDisplayInit(test.prefix, test.display)
+		if actual := displayResultFolder(test.folder); actual != test.expected {
+			t.Errorf("%s with %s mapped to %q was %s, not %s", test.folder, test.prefix, test.display, actual, test.expected)
+		}
+	}
+}
+
+func TestKillNotificationText(t *testing.T) {
+	plannedEnd := time.Date(2024, 3, 1, 9, 0, 0, 0, TimestampLocation)
+	j := &Job{
+		ID:             "job-id",
+		Name:           "job-name",
+		ResultFolder:   "/iplant/home/user/analyses/job-name",
+		PlannedEndDate: plannedEnd.Format(TimestampFromDBFormat),
+	}
+
+	tests := []struct {
+		reason  string
+		subject string
+		message string
+	}{
+		{KillReasonTimeLimit, "Analysis job-name canceled due to time limit restrictions.", "had a configured end date of"},
+		{"", "Analysis job-name canceled due to time limit restrictions.", "had a configured end date of"},
+		{KillReasonAdmin, "Analysis job-name canceled by an administrator.", "was canceled by an administrator"},
+		{KillReasonDisabledUser, "Analysis job-name canceled because the account is disabled.", "your account is disabled"},
+	}
+
+	for _, test := range tests {
+		subject, msg, err := killNotificationText(j, test.reason)
+		if err != nil {
+			t.Errorf("%q: %s", test.reason, err)
+			continue
+		}
+		if subject != test.subject {
+			t.Errorf("%q: subject was %q, not %q", test.reason, subject, test.subject)
+		}
+		if !strings.Contains(msg, test.message) || !strings.Contains(msg, `Analysis "job-name" (job-id)`) || !strings.Contains(msg, j.ResultFolder) {
+			t.Errorf("%q: message was %q", test.reason, msg)
+		}
+	}
+
+	// Only the time limit wording needs the planned end date.
+	noEnd := &Job{ID: "job-id", Name: "job-name"}
+	if _, _, err := killNotificationText(noEnd, KillReasonAdmin); err != nil {
+		t.Errorf("admin kill without a planned end date: %s", err)
+	}
+	if _, _, err := killNotificationText(noEnd, KillReasonTimeLimit); err == nil {
+		t.Error("time limit kill without a planned end date didn't fail")
+	}
+}
+
+func TestSendKillNotificationReason(t *testing.T) {
+	users := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(User{ID: "user", Email: "user@example.com"})
+	}))
+	defer users.Close()
+
+	sink := &recordingSink{}
+	SinksInit(sink)
+	NotifsInit("http://notification-agent")
+	UsersInit(users.URL)
+	defer SinksInit(&AgentSink{})
+	defer NotifsInit("")
+	defer UsersInit("")
+
+	j := &Job{
+		ID:             "job-id",
+		Name:           "job-name",
+		User:           "user@example.com",
+		StartDate:      time.Now().Add(-time.Hour).In(TimestampLocation).Format(TimestampFromDBFormat),
+		PlannedEndDate: time.Now().Add(time.Hour).In(TimestampLocation).Format(TimestampFromDBFormat),
+	}
+
+	if err := SendKillNotification(context.Background(), j, "", KillReasonAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.notifs) != 1 {
+		t.Fatalf("%d notifications were sent, not 1", len(sink.notifs))
+	}
+	n := sink.notifs[0]
+	if n.Payload.KillReason != KillReasonAdmin {
+		t.Errorf("kill reason was %q, not %q", n.Payload.KillReason, KillReasonAdmin)
+	}
+	if n.Payload.AnalysisStatus != "Canceled" {
+		t.Errorf("analysis status was %q, not Canceled", n.Payload.AnalysisStatus)
+	}
+	if n.Subject != "Analysis job-name canceled by an administrator." {
+		t.Errorf("subject was %q", n.Subject)
+	}
+}
+
+func TestSendKillNotificationResultFolder(t *testing.T) {
+	users := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(User{ID: "user", Email: "user@example.com"})
+	}))
+	defer users.Close()
+
+	sink := &recordingSink{}
+	SinksInit(sink)
+	NotifsInit("http://notification-agent")
+	UsersInit(users.URL)
+	ResultFolderDisplayInit("/iplant/home", "/home")
+	defer SinksInit(&AgentSink{})
+	defer NotifsInit("")
+	defer UsersInit("")
+	defer ResultFolderDisplayInit("", "")
+
+	start := time.Now().Add(-48 * time.Hour)
+	j := &Job{
+		ID:             "job-id",
+		Name:           "job-name",
+		User:           "user@example.com",
+		ResultFolder:   "/iplant/home/user/analyses/job-name",
+		StartDate:      start.In(TimestampLocation).Format(TimestampFromDBFormat),
+		PlannedEndDate: start.Add(24 * time.Hour).In(TimestampLocation).Format(TimestampFromDBFormat),
+	}
+
+	if err := SendKillNotification(context.Background(), j, "", KillReasonTimeLimit); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.notifs) != 1 {
+		t.Fatalf("%d notifications were sent, not 1", len(sink.notifs))
+	}
+	n := sink.notifs[0]
+	if !strings.Contains(n.Message, "the /home/user/analyses/job-name folder") {
+		t.Errorf("message didn't contain the display path: %s", n.Message)
+	}
+	if n.Payload.AnalysisResultsFolder != j.ResultFolder {
+		t.Errorf("payload result folder was %s, not %s", n.Payload.AnalysisResultsFolder, j.ResultFolder)
+	}
+	if j.ResultFolder != "/iplant/home/user/analyses/job-name" {
+		t.Errorf("the job's result folder was changed to %s", j.ResultFolder)
+	}
+}
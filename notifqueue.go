@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// killNotificationPrefix starts the type of queued kill notifications.
+// Notifications queued before the reason was stored with them are just "kill",
+// and get the time limit wording.
+const killNotificationPrefix = "kill"
+
+// warningNotificationPrefix starts the type of queued warning notifications.
+const warningNotificationPrefix = "warning_"
+
+// warningNotificationType returns the type of queued warning notifications for
+// the threshold, in minutes.
+func warningNotificationType(thresholdMinutes int64) string {
+	return fmt.Sprintf("%s%d", warningNotificationPrefix, thresholdMinutes)
+}
+
+// killNotificationType returns the type of queued kill notifications for jobs
+// killed for the reason, which is one of the KillReason constants.
+func killNotificationType(reason string) string {
+	return killNotificationPrefix + "_" + reason
+}
+
+// killNotificationReason returns the reason stored in the type of a queued
+// kill notification, and whether it's the type of a kill notification at all.
+// The reason is empty for notifications that were queued without one.
+func killNotificationReason(notificationType string) (string, bool) {
+	if notificationType == killNotificationPrefix {
+		return "", true
+	}
+	reason, ok := strings.CutPrefix(notificationType, killNotificationPrefix+"_")
+	if !ok {
+		return "", false
+	}
+	return reason, true
+}
+
+// NotifRetrier retries the notifications in the pending_notifications table
+// until they're sent or they get too old. Failed retries are backed off
+// exponentially, starting at Backoff and capped at MaxBackoff.
+type NotifRetrier struct {
+	db         *sql.DB
+	vicedb     *VICEDatabaser
+	MaxAge     time.Duration
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// send delivers a notification of the given type for the job. Tests
+	// replace it; it defaults to sendQueuedNotification.
+	send func(context.Context, *Job, string) error
+}
+
+// NewNotifRetrier returns a *NotifRetrier that sends queued notifications
+// through the configured sinks.
+func NewNotifRetrier(db *sql.DB, vicedb *VICEDatabaser, maxAge, backoff time.Duration) *NotifRetrier {
+	return &NotifRetrier{
+		db:         db,
+		vicedb:     vicedb,
+		MaxAge:     maxAge,
+		Backoff:    backoff,
+		MaxBackoff: time.Hour,
+		send:       sendQueuedNotification,
+	}
+}
+
+// sendQueuedNotification sends a notification of the given type for the job.
+// Kill notifications are worded for the reason stored in their type.
+func sendQueuedNotification(ctx context.Context, job *Job, notificationType string) error {
+	if strings.HasPrefix(notificationType, warningNotificationPrefix) {
+		return SendWarningNotification(ctx, job)
+	}
+	if reason, ok := killNotificationReason(notificationType); ok {
+		return SendKillNotification(ctx, job, "", reason)
+	}
+	return fmt.Errorf("unknown notification type: %s", notificationType)
+}
+
+// warningApplies returns whether a queued warning for the job still needs to
+// be sent, which is only the case while the job is running and due to be
+// killed at a planned end date that hasn't passed yet. A job that has finished,
+// been exempted or already passed its planned end date gets the kill
+// notification, if any, instead.
+func warningApplies(job *Job, now time.Time) bool {
+	if job.Status != "Running" || job.PlannedEndDate == "" || isExempt(job) {
+		return false
+	}
+	end, err := parseDBTimestamp(job.PlannedEndDate)
+	return err == nil && end.After(now)
+}
+
+// backoff returns how long to wait before the next retry of a notification
+// that has failed the given number of retries.
+func (r *NotifRetrier) backoff(attempts int) time.Duration {
+	d := r.Backoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= r.MaxBackoff {
+			return r.MaxBackoff
+		}
+	}
+	return d
+}
+
+// RetryPending makes a single pass over the notifications that are due to be
+// retried. Sent notifications are removed from the queue, as are notifications
+// for analyses that no longer exist, warnings that no longer apply and
+// notifications older than MaxAge.
+func (r *NotifRetrier) RetryPending(ctx context.Context) error {
+	pending, err := r.vicedb.DuePendingNotifications(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error listing pending notifications")
+	}
+
+	now := CurrentClock.Now()
+
+	for _, p := range pending {
+		retryLog := log.WithFields(log.Fields{
+			"context":          "notification retry",
+			"ID":               p.AnalysisID,
+			"notificationType": p.NotificationType,
+			"attempts":         p.Attempts,
+		})
+
+		if r.MaxAge > 0 && now.Sub(p.CreatedDate) > r.MaxAge {
+			retryLog.Warn("giving up on notification")
+			if err = r.vicedb.DeletePendingNotification(ctx, p.ID); err != nil {
+				retryLog.Error(err)
+			}
+			continue
+		}
+
+		job, err := lookupByID(ctx, r.db, p.AnalysisID)
+		if err == sql.ErrNoRows {
+			retryLog.Warn("analysis not found, dropping notification")
+			if err = r.vicedb.DeletePendingNotification(ctx, p.ID); err != nil {
+				retryLog.Error(err)
+			}
+			continue
+		}
+		if err != nil {
+			retryLog.Error(errors.Wrapf(err, "error looking up analysis %s", p.AnalysisID))
+			continue
+		}
+
+		if strings.HasPrefix(p.NotificationType, warningNotificationPrefix) && !warningApplies(job, now) {
+			retryLog.Info("warning no longer applies, dropping notification")
+			if err = r.vicedb.DeletePendingNotification(ctx, p.ID); err != nil {
+				retryLog.Error(err)
+			}
+			continue
+		}
+
+		if sendErr := r.send(ctx, job, p.NotificationType); sendErr != nil {
+			attempts := p.Attempts + 1
+			retryLog.Error(errors.Wrap(sendErr, "error retrying notification"))
+			if err = r.vicedb.ReschedulePendingNotification(ctx, p.ID, attempts, now.Add(r.backoff(attempts)), sendErr.Error()); err != nil {
+				retryLog.Error(err)
+			}
+			continue
+		}
+
+		retryLog.Info("sent queued notification")
+		if err = r.vicedb.DeletePendingNotification(ctx, p.ID); err != nil {
+			retryLog.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// Run retries the pending notifications every interval until ctx is done.
+func (r *NotifRetrier) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.RetryPending(ctx); err != nil {
+			log.Error(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+)
+
+var pendingNotificationColumns = []string{"id", "analysis_id", "notification_type", "attempts", "created_date"}
+
+// runningJobRow returns a row for a running job that's due to be killed an
+// hour from now.
+func runningJobRow() []driver.Value {
+	row := jobByExternalIDRow("Running")
+	row[7] = time.Now().Add(time.Hour)
+	return row
+}
+
+// newTestRetrier returns a NotifRetrier backed by a fake database with a
+// single due warning created at the given time for a running job, along with
+// a pointer to the number of sends attempted.
+func newTestRetrier(t *testing.T, created time.Time, sendErr error) (*NotifRetrier, *fakeDB, *int) {
+	return newTestRetrierForJob(t, created, sendErr, runningJobRow())
+}
+
+// newTestRetrierForJob is like newTestRetrier, but the warning is for the job
+// in the given row.
+func newTestRetrierForJob(t *testing.T, created time.Time, sendErr error, jobRow []driver.Value) (*NotifRetrier, *fakeDB, *int) {
+	db, f := newFakeDB(t)
+	f.on("from pending_notifications", pendingNotificationColumns,
+		[]driver.Value{"pending-id", "job-id", warningNotificationType(60), int64(1), created},
+	)
+	f.on("where jobs.id = $1", jobByExternalIDColumns, jobRow)
+
+	sends := 0
+	r := NewNotifRetrier(db, &VICEDatabaser{db: db}, 24*time.Hour, time.Minute)
+	r.send = func(_ context.Context, job *Job, notificationType string) error {
+		sends++
+		if job.ID != "job-id" || notificationType != warningNotificationType(60) {
+			t.Errorf("unexpected send of %s for %s", notificationType, job.ID)
+		}
+		return sendErr
+	}
+	return r, f, &sends
+}
+
+func TestRetryPendingSuccess(t *testing.T) {
+	r, f, sends := newTestRetrier(t, time.Now(), nil)
+
+	if err := r.RetryPending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if *sends != 1 {
+		t.Errorf("sends was %d, not 1", *sends)
+	}
+	if f.ran("delete from pending_notifications") != 1 {
+		t.Error("sent notification was not removed from the queue")
+	}
+	if f.ran("update pending_notifications") != 0 {
+		t.Error("sent notification was rescheduled")
+	}
+}
+
+func TestRetryPendingFailure(t *testing.T) {
+	r, f, sends := newTestRetrier(t, time.Now(), errors.New("notification agent unavailable"))
+
+	before := time.Now()
+	if err := r.RetryPending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if *sends != 1 {
+		t.Errorf("sends was %d, not 1", *sends)
+	}
+	if f.ran("delete from pending_notifications") != 0 {
+		t.Error("failed notification was removed from the queue")
+	}
+
+	args := f.argsFor("update pending_notifications")
+	if args == nil {
+		t.Fatal("failed notification was not rescheduled")
+	}
+	if args[0] != int64(2) {
+		t.Errorf("attempts was %v, not 2", args[0])
+	}
+	next := args[1].(time.Time)
+	if next.Before(before.Add(2*time.Minute)) || next.After(time.Now().Add(2*time.Minute)) {
+		t.Errorf("next attempt %s was not about two minutes away", next)
+	}
+	if args[2] != "notification agent unavailable" {
+		t.Errorf("last error was %v", args[2])
+	}
+}
+
+func TestRetryPendingTooOld(t *testing.T) {
+	r, f, sends := newTestRetrier(t, time.Now().Add(-25*time.Hour), nil)
+
+	if err := r.RetryPending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if *sends != 0 {
+		t.Errorf("sends was %d, not 0", *sends)
+	}
+	if f.ran("delete from pending_notifications") != 1 {
+		t.Error("expired notification was not removed from the queue")
+	}
+}
+
+func TestRetryPendingWarningNoLongerApplies(t *testing.T) {
+	completed := runningJobRow()
+	completed[3] = "Completed"
+
+	expired := runningJobRow()
+	expired[7] = time.Now().Add(-time.Minute)
+
+	exempt := runningJobRow()
+	exempt[7] = exemptPlannedEndDate
+
+	tests := []struct {
+		name string
+		row  []driver.Value
+	}{
+		{"completed", completed},
+		{"past planned end date", expired},
+		{"exempt", exempt},
+	}
+
+	for _, test := range tests {
+		r, f, sends := newTestRetrierForJob(t, time.Now(), nil, test.row)
+
+		if err := r.RetryPending(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if *sends != 0 {
+			t.Errorf("%s: sends was %d, not 0", test.name, *sends)
+		}
+		if f.ran("delete from pending_notifications") != 1 {
+			t.Errorf("%s: warning was not removed from the queue", test.name)
+		}
+	}
+}
+
+func TestNotifRetrierBackoff(t *testing.T) {
+	r := &NotifRetrier{Backoff: time.Minute, MaxBackoff: 10 * time.Minute}
+
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{4, 8 * time.Minute},
+		{5, 10 * time.Minute},
+		{20, 10 * time.Minute},
+	}
+
+	for _, test := range tests {
+		if actual := r.backoff(test.attempts); actual != test.expected {
+			t.Errorf("backoff(%d) was %s, not %s", test.attempts, actual, test.expected)
+		}
+	}
+}
+
+func TestKillNotificationReason(t *testing.T) {
+	tests := []struct {
+		notificationType string
+		reason           string
+		ok               bool
+	}{
+		{killNotificationType(KillReasonIdle), KillReasonIdle, true},
+		{killNotificationType(KillReasonDisabledUser), KillReasonDisabledUser, true},
+		{killNotificationType(KillReasonTimeLimit), KillReasonTimeLimit, true},
+		{"kill", "", true},
+		{warningNotificationType(60), "", false},
+		{"killer", "", false},
+	}
+
+	for _, test := range tests {
+		reason, ok := killNotificationReason(test.notificationType)
+		if reason != test.reason || ok != test.ok {
+			t.Errorf("%s: reason was %q, %t, not %q, %t", test.notificationType, reason, ok, test.reason, test.ok)
+		}
+	}
+}
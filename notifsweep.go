@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// SweepOrphanedNotifStatuses deletes the notif_statuses rows for analyses
+// that have been deleted or that finished more than maxAge ago. The message
+// handler normally removes them when an analysis finishes, but rows are left
+// behind when a status update is missed. Returns the number of rows deleted.
+func SweepOrphanedNotifStatuses(ctx context.Context, vicedb *VICEDatabaser, maxAge time.Duration) (int, error) {
+	ids, err := vicedb.OrphanedNotifStatuses(ctx, CurrentClock.Now().Add(-maxAge))
+	if err != nil {
+		return 0, errors.Wrap(err, "error listing orphaned notification statuses")
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		if err = vicedb.DeleteNotifRecord(ctx, &Job{ID: id}); err != nil {
+			log.Error(errors.Wrapf(err, "error deleting the orphaned notification statuses for analysis %s", id))
+			continue
+		}
+		deleted++
+	}
+
+	log.Infof("deleted %d of %d orphaned notification statuses", deleted, len(ids))
+
+	return deleted, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOrphanedNotifStatuses(t *testing.T) {
+	db, f := newFakeDB(t)
+	f.on("left join jobs on jobs.id = notif_statuses.analysis_id", []string{"analysis_id"},
+		[]driver.Value{"deleted-job"},
+		[]driver.Value{"old-job"},
+	)
+
+	olderThan := time.Date(2024, 3, 1, 9, 0, 0, 0, TimestampLocation)
+	ids, err := (&VICEDatabaser{db: db}).OrphanedNotifStatuses(context.Background(), olderThan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != "deleted-job" || ids[1] != "old-job" {
+		t.Errorf("orphaned analysis IDs were %v", ids)
+	}
+
+	args := f.argsFor("left join jobs on jobs.id = notif_statuses.analysis_id")
+	if len(args) != 1 || args[0] != formatDBTimestamp(olderThan) {
+		t.Errorf("query args were %v, not [%s]", args, formatDBTimestamp(olderThan))
+	}
+}
+
+func TestSweepOrphanedNotifStatuses(t *testing.T) {
+	defer ClockInit(realClock{})
+	now := time.Date(2024, 3, 8, 9, 0, 0, 0, TimestampLocation)
+	ClockInit(newFakeClock(now))
+
+	db, f := newFakeDB(t)
+	f.on("left join jobs on jobs.id = notif_statuses.analysis_id", []string{"analysis_id"},
+		[]driver.Value{"deleted-job"},
+		[]driver.Value{"old-job"},
+	)
+
+	deleted, err := SweepOrphanedNotifStatuses(context.Background(), &VICEDatabaser{db: db}, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("%d notification statuses were deleted, not 2", deleted)
+	}
+	if n := f.ran("delete from notif_statuses"); n != 2 {
+		t.Errorf("notification statuses were deleted %d times, not 2", n)
+	}
+
+	cutoff := formatDBTimestamp(now.Add(-7 * 24 * time.Hour))
+	if args := f.argsFor("left join jobs on jobs.id = notif_statuses.analysis_id"); len(args) != 1 || args[0] != cutoff {
+		t.Errorf("query args were %v, not [%s]", args, cutoff)
+	}
+}
+
+func TestSweepOrphanedNotifStatusesError(t *testing.T) {
+	db, f := newFakeDB(t)
+	f.onError("left join jobs on jobs.id = notif_statuses.analysis_id", errors.New("connection refused"))
+
+	if _, err := SweepOrphanedNotifStatuses(context.Background(), &VICEDatabaser{db: db}, time.Hour); err == nil {
+		t.Error("no error was returned")
+	}
+	if f.ran("delete from notif_statuses") != 0 {
+		t.Error("notification statuses were deleted")
+	}
+}
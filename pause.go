@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// KillPause lets an operator stop the job killer from killing anything at
+// runtime, such as during an incident. The pause is stored in the kill_pause
+// table, so it reaches the leader whichever replica it's set on and lasts
+// through restarts and failovers. Paused returns the state that was last
+// loaded or set, which the job killer refreshes at the start of each
+// iteration.
+type KillPause struct {
+	paused atomic.Bool
+}
+
+// Pause stops jobs from being killed. Returns false if they already were.
+func (p *KillPause) Pause(ctx context.Context, vicedb *VICEDatabaser) (bool, error) {
+	return p.set(ctx, vicedb, true)
+}
+
+// Resume lets jobs be killed again. Returns false if they already could be.
+func (p *KillPause) Resume(ctx context.Context, vicedb *VICEDatabaser) (bool, error) {
+	return p.set(ctx, vicedb, false)
+}
+
+func (p *KillPause) set(ctx context.Context, vicedb *VICEDatabaser, paused bool) (bool, error) {
+	changed, err := vicedb.SetKillPaused(ctx, paused)
+	if err != nil {
+		return false, errors.Wrap(err, "error setting the kill pause")
+	}
+	p.paused.Store(paused)
+	return changed, nil
+}
+
+// Refresh loads whether killing jobs is paused from the database. The state
+// that was loaded last is kept if it can't be loaded.
+func (p *KillPause) Refresh(ctx context.Context, vicedb *VICEDatabaser) error {
+	paused, err := vicedb.KillPaused(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error loading the kill pause")
+	}
+	p.paused.Store(paused)
+	return nil
+}
+
+// Paused returns whether killing jobs is paused.
+func (p *KillPause) Paused() bool {
+	return p.paused.Load()
+}
+
+// killPause is checked by the job killer before it kills anything.
+var killPause = &KillPause{}
+
+// PauseSkipsWarnings is whether warnings and periodic notifications are held
+// back while killing is paused too. They're sent by default, since the jobs
+// will still be killed once killing resumes.
+var PauseSkipsWarnings = false
+
+// KillPauseInit sets whether warnings are held back while killing is paused.
+func KillPauseInit(skipWarnings bool) {
+	PauseSkipsWarnings = skipWarnings
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+func TestKillPauseRefresh(t *testing.T) {
+	tests := []struct {
+		name     string
+		rows     [][]driver.Value
+		err      error
+		previous bool
+		expected bool
+	}{
+		{"paused through another replica", [][]driver.Value{{true}}, nil, false, true},
+		{"resumed through another replica", [][]driver.Value{{false}}, nil, true, false},
+		{"never set", nil, nil, true, false},
+		{"database unavailable", nil, errors.New("connection refused"), true, true},
+	}
+
+	for _, test := range tests {
+		db, f := newFakeDB(t)
+		if test.err != nil {
+			f.onError("from kill_pause", test.err)
+		} else {
+			f.on("from kill_pause", []string{"paused"}, test.rows...)
+		}
+
+		p := &KillPause{}
+		p.paused.Store(test.previous)
+
+		err := p.Refresh(context.Background(), &VICEDatabaser{db: db})
+		if (err != nil) != (test.err != nil) {
+			t.Errorf("%s: err was %v", test.name, err)
+		}
+		if p.Paused() != test.expected {
+			t.Errorf("%s: paused was %t, not %t", test.name, p.Paused(), test.expected)
+		}
+	}
+}
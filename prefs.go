@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// PrefsURI is the base URI of the user-info service that user preferences are
+// looked up from. Preferences aren't looked up if it's empty.
+var PrefsURI string
+
+// PrefsInit initializes the base URI used for requests to the user-info
+// service.
+func PrefsInit(u string) {
+	PrefsURI = u
+}
+
+// EmailPrefKey is the user preference that turns email notifications about
+// the user's analyses on or off.
+const EmailPrefKey = "enableAnalysisEmailNotification"
+
+// userPrefs returns the preferences the user has saved in the user-info
+// service.
+func userPrefs(ctx context.Context, id string) (map[string]interface{}, error) {
+	u, err := url.Parse(PrefsURI)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse preferences lookup URL")
+	}
+
+	u = u.JoinPath("preferences", id)
+
+	resp, err := doWithRetry(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to GET preferences from %s", u.String())
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response body for preferences lookup request")
+	}
+
+	// Users that have never saved any preferences don't have any to return.
+	if resp.StatusCode == http.StatusNotFound {
+		return map[string]interface{}{}, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("failed preferences lookup for %s (status: %s, msg %s)", id, resp.Status, b)
+	}
+
+	var lookup struct {
+		Preferences map[string]interface{} `json:"preferences"`
+	}
+	if err = json.Unmarshal(b, &lookup); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal preferences lookup response")
+	}
+
+	return lookup.Preferences, nil
+}
+
+// emailEnabled returns whether notifications about the user's analyses should
+// be emailed to them. Emails are sent unless the user has turned them off, so
+// it returns true if preference lookups aren't configured, the preference
+// isn't set, or the lookup fails.
+func emailEnabled(ctx context.Context, id string) bool {
+	if PrefsURI == "" {
+		return true
+	}
+
+	prefs, err := userPrefs(ctx, id)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error looking up preferences for %s, emailing them anyway", id))
+		return true
+	}
+
+	enabled, ok := prefs[EmailPrefKey].(bool)
+	if !ok {
+		return true
+	}
+	return enabled
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newPrefsServer returns a user-info server that responds to preference
+// lookups for the student user with the given status and body.
+func newPrefsServer(t *testing.T, status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/preferences/student" {
+			t.Errorf("unexpected request for %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func TestEmailEnabled(t *testing.T) {
+	defer PrefsInit("")
+
+	if !emailEnabled(context.Background(), "student") {
+		t.Error("email was disabled without preference lookups configured")
+	}
+
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		expected bool
+	}{
+		{"enabled", http.StatusOK, `{"preferences": {"enableAnalysisEmailNotification": true}}`, true},
+		{"disabled", http.StatusOK, `{"preferences": {"enableAnalysisEmailNotification": false}}`, false},
+		{"unset", http.StatusOK, `{"preferences": {"rememberLastPath": true}}`, true},
+		{"not a bool", http.StatusOK, `{"preferences": {"enableAnalysisEmailNotification": "false"}}`, true},
+		{"no preferences", http.StatusNotFound, ``, true},
+		{"lookup fails", http.StatusInternalServerError, `oops`, true},
+	}
+
+	for _, test := range tests {
+		srv := newPrefsServer(t, test.status, test.body)
+		PrefsInit(srv.URL)
+
+		if actual := emailEnabled(context.Background(), "student"); actual != test.expected {
+			t.Errorf("%s: email enabled was %t, not %t", test.name, actual, test.expected)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestJobNotifEmailPreference(t *testing.T) {
+	defer PrefsInit("")
+	defer NotifsInit("")
+	defer UsersInit("")
+
+	groups := newGroupsServer(t, User{ID: "student", Email: "student@example.edu"}, nil)
+	defer groups.Close()
+	UsersInit(groups.URL)
+	NotifsInit("http://notification-agent")
+
+	start := time.Now().Add(-48 * time.Hour).In(TimestampLocation)
+	j := &Job{
+		ID:             "job-id",
+		Name:           "job-name",
+		User:           "student@example.com",
+		StartDate:      start.Format(TimestampFromDBFormat),
+		PlannedEndDate: start.Add(24 * time.Hour).Format(TimestampFromDBFormat),
+	}
+
+	tests := []struct {
+		name          string
+		enabled       string
+		email         bool
+		expectedEmail bool
+		expectedAddr  string
+	}{
+		{"email enabled", "true", true, true, "student@example.edu"},
+		{"email disabled", "false", true, false, ""},
+		{"email not requested", "true", false, false, ""},
+	}
+
+	for _, test := range tests {
+		srv := newPrefsServer(t, http.StatusOK, `{"preferences": {"enableAnalysisEmailNotification": `+test.enabled+`}}`)
+		PrefsInit(srv.URL)
+
+		notif, _, err := jobNotif(context.Background(), j, "Running", "subject", "message", test.email, "analysis_status_change")
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if notif.Email != test.expectedEmail {
+			t.Errorf("%s: email was %t, not %t", test.name, notif.Email, test.expectedEmail)
+		}
+		if notif.Payload.Email != test.expectedAddr {
+			t.Errorf("%s: payload email was %q, not %q", test.name, notif.Payload.Email, test.expectedAddr)
+		}
+		if notif.Payload.User != "student" {
+			t.Errorf("%s: payload user was %s, not student", test.name, notif.Payload.User)
+		}
+
+		srv.Close()
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The defaults for retrying requests to upstreams.
+const (
+	defaultMaxRetries  = 2
+	defaultBaseBackoff = 500 * time.Millisecond
+	defaultMaxBackoff  = 5 * time.Second
+)
+
+// maxRetries is the most times a request is sent again after a transient
+// failure, so a request is sent at most maxRetries + 1 times.
+var maxRetries = defaultMaxRetries
+
+// baseBackoff is how long to wait before the first retry of a request. The
+// wait doubles for each retry after that, up to maxBackoff.
+var baseBackoff = defaultBaseBackoff
+
+// maxBackoff is the longest wait between retries, unless the upstream asks for
+// a longer one with a Retry-After header.
+var maxBackoff = defaultMaxBackoff
+
+// RetryPolicyInit sets how requests to upstreams are retried.
+func RetryPolicyInit(retries int, base, max time.Duration) {
+	maxRetries = retries
+	baseBackoff = base
+	maxBackoff = max
+}
+
+// maxRetryAfter is the longest we'll wait for an upstream that asks us to come
+// back later. Anything longer is left to the next job killer iteration or the
+// notification retry queue.
+var maxRetryAfter = 30 * time.Second
+
+// parseRetryAfter returns how long a Retry-After header value asks us to wait
+// from now. The value is either a number of seconds or an HTTP date. Returns
+// false if the value is missing or can't be parsed. Dates in the past mean
+// there's no need to wait.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// transientStatus returns whether a response with the status code might
+// succeed if the request is sent again.
+func transientStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// idempotentMethod returns whether sending a request with the method more than
+// once has the same effect as sending it once.
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// retrySafe returns whether the request can be sent again after it failed
+// with resp, or err if there wasn't a response. Requests that aren't
+// idempotent, like the POSTs that send notifications and stop jobs, may have
+// been acted on already if they timed out or a gateway gave up waiting on
+// them, so they're only sent again if they never got to the upstream or it
+// turned them away without acting on them.
+func retrySafe(method string, resp *http.Response, err error) bool {
+	if idempotentMethod(method) {
+		return true
+	}
+	if err != nil {
+		var opErr *net.OpError
+		return errors.As(err, &opErr) && opErr.Op == "dial"
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// backoff returns how long to wait before sending a request again after the
+// attempt, counting from one, failed.
+func backoff(attempt int) time.Duration {
+	return expBackoff(attempt, baseBackoff, maxBackoff)
+}
+
+// expBackoff returns base for the first attempt, doubling for each attempt
+// after that up to max.
+func expBackoff(attempt int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// retryDelay returns how long to wait before sending a request again after the
+// attempt got resp, or err if there wasn't a response. Returns false if the
+// request shouldn't be sent again, either because the failure isn't transient
+// or because waiting would take longer than maxRetryAfter or run past ctx's
+// deadline. Waits as long as the upstream asks in a Retry-After header, and
+// backs off exponentially otherwise.
+func retryDelay(ctx context.Context, resp *http.Response, err error, attempt int, now time.Time) (time.Duration, bool) {
+	delay := backoff(attempt)
+
+	if err != nil {
+		// Requests that were given up on aren't worth sending again.
+		if ctx.Err() != nil {
+			return 0, false
+		}
+	} else {
+		if !transientStatus(resp.StatusCode) {
+			return 0, false
+		}
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now); ok {
+			if retryAfter > maxRetryAfter {
+				return 0, false
+			}
+			delay = retryAfter
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && now.Add(delay).After(deadline) {
+		return 0, false
+	}
+
+	return delay, true
+}
+
+// doWithRetry sends the request built by newReq, sending it again up to
+// maxRetries times if it fails with an error or a response that might not
+// happen next time, such as a 503. Every outbound request goes through it so
+// that the retry policy is the same everywhere. Requests that aren't
+// idempotent are only sent again when retrySafe says so. newReq is called for
+// each attempt so that request bodies can be sent again. The last response or
+// error is returned once the retries run out.
+func doWithRetry(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := httpClient.Do(req)
+		if attempt > maxRetries || !retrySafe(req.Method, resp, err) {
+			return resp, err
+		}
+		delay, ok := retryDelay(ctx, resp, err, attempt, time.Now())
+		if !ok {
+			return resp, err
+		}
+
+		// The response is being thrown away, so drain it to let the
+		// connection be reused.
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
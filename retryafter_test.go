@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"seconds", "120", 2 * time.Minute, true},
+		{"zero seconds", "0", 0, true},
+		{"padded seconds", " 5 ", 5 * time.Second, true},
+		{"negative seconds", "-5", 0, false},
+		{"HTTP date", now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{"RFC 850 date", now.Add(time.Hour).Format(time.RFC850), time.Hour, true},
+		{"past HTTP date", now.Add(-time.Hour).Format(http.TimeFormat), 0, true},
+		{"missing", "", 0, false},
+		{"garbage", "soon", 0, false},
+	}
+
+	for _, test := range tests {
+		actual, ok := parseRetryAfter(test.value, now)
+		if ok != test.ok {
+			t.Errorf("%s: ok was %t, not %t", test.name, ok, test.ok)
+		}
+		if actual != test.expected {
+			t.Errorf("%s: delay was %s, not %s", test.name, actual, test.expected)
+		}
+	}
+}
+
+// newRetryAfterServer returns a server that responds to the first failures
+// requests with the status and Retry-After header, then succeeds. The bodies
+// of the requests it receives are recorded.
+func newRetryAfterServer(failures, status int, retryAfter func() string) (*httptest.Server, func() []string) {
+	var (
+		mu     sync.Mutex
+		bodies []string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		n := len(bodies)
+		mu.Unlock()
+
+		if n <= failures {
+			w.Header().Set("Retry-After", retryAfter())
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), bodies...)
+	}
+}
+
+// fastRetries makes retries back off for milliseconds rather than seconds
+// until the returned function is called.
+func fastRetries() func() {
+	RetryPolicyInit(defaultMaxRetries, time.Millisecond, 10*time.Millisecond)
+	return func() { RetryPolicyInit(defaultMaxRetries, defaultBaseBackoff, defaultMaxBackoff) }
+}
+
+func TestBackoff(t *testing.T) {
+	defer RetryPolicyInit(defaultMaxRetries, defaultBaseBackoff, defaultMaxBackoff)
+	RetryPolicyInit(5, 100*time.Millisecond, time.Second)
+
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, e := range expected {
+		if actual := backoff(i + 1); actual != e {
+			t.Errorf("backoff after attempt %d was %s, not %s", i+1, actual, e)
+		}
+	}
+}
+
+func TestDoWithRetry(t *testing.T) {
+	defer fastRetries()()
+
+	tests := []struct {
+		name       string
+		method     string
+		failures   int
+		status     int
+		retryAfter func() string
+		requests   int
+		final      int
+	}{
+		{"seconds", http.MethodPost, 1, http.StatusServiceUnavailable, func() string { return "0" }, 2, http.StatusOK},
+		{"HTTP date", http.MethodPost, 1, http.StatusTooManyRequests, func() string { return time.Now().Add(-time.Second).UTC().Format(http.TimeFormat) }, 2, http.StatusOK},
+		{"too many attempts", http.MethodPost, 5, http.StatusServiceUnavailable, func() string { return "0" }, defaultMaxRetries + 1, http.StatusServiceUnavailable},
+		{"longer than the cap", http.MethodPost, 1, http.StatusServiceUnavailable, func() string { return "3600" }, 1, http.StatusServiceUnavailable},
+		{"internal server error", http.MethodPost, 1, http.StatusInternalServerError, func() string { return "0" }, 1, http.StatusInternalServerError},
+		{"not found", http.MethodPost, 1, http.StatusNotFound, func() string { return "" }, 1, http.StatusNotFound},
+		{"no header", http.MethodPost, 1, http.StatusServiceUnavailable, func() string { return "" }, 2, http.StatusOK},
+
+		// A POST that a gateway gave up on may still have been acted on.
+		{"bad gateway POST", http.MethodPost, 1, http.StatusBadGateway, func() string { return "" }, 1, http.StatusBadGateway},
+		{"gateway timeout POST", http.MethodPost, 1, http.StatusGatewayTimeout, func() string { return "" }, 1, http.StatusGatewayTimeout},
+		{"bad gateway GET", http.MethodGet, 1, http.StatusBadGateway, func() string { return "" }, 2, http.StatusOK},
+		{"gateway timeout GET", http.MethodGet, 1, http.StatusGatewayTimeout, func() string { return "" }, 2, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		srv, bodies := newRetryAfterServer(test.failures, test.status, test.retryAfter)
+
+		resp, err := doWithRetry(context.Background(), func() (*http.Request, error) {
+			return http.NewRequest(test.method, srv.URL, strings.NewReader("body"))
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.final {
+			t.Errorf("%s: status was %d, not %d", test.name, resp.StatusCode, test.final)
+		}
+		received := bodies()
+		if len(received) != test.requests {
+			t.Errorf("%s: %d requests were sent, not %d", test.name, len(received), test.requests)
+		}
+		for i, b := range received {
+			if b != "body" {
+				t.Errorf("%s: body of request %d was %q", test.name, i+1, b)
+			}
+		}
+
+		srv.Close()
+	}
+}
+
+func TestDoWithRetryConnectionError(t *testing.T) {
+	defer fastRetries()()
+
+	// Nothing is listening once the server is closed, so every attempt fails
+	// to connect. The request was never sent, so even a POST is sent again.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	var attempts int
+	_, err := doWithRetry(context.Background(), func() (*http.Request, error) {
+		attempts++
+		return http.NewRequest(http.MethodPost, srv.URL, nil)
+	})
+	if err == nil {
+		t.Fatal("no error was returned")
+	}
+	if attempts != defaultMaxRetries+1 {
+		t.Errorf("the request was sent %d times, not %d", attempts, defaultMaxRetries+1)
+	}
+}
+
+func TestDoWithRetryDroppedConnection(t *testing.T) {
+	defer fastRetries()()
+
+	// The connection is dropped after the request was read, so the upstream
+	// may have acted on it.
+	var mu sync.Mutex
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		panic(http.ErrAbortHandler)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		method   string
+		requests int
+	}{
+		{http.MethodPost, 1},
+		{http.MethodGet, defaultMaxRetries + 1},
+	}
+
+	for _, test := range tests {
+		mu.Lock()
+		requests = 0
+		mu.Unlock()
+
+		_, err := doWithRetry(context.Background(), func() (*http.Request, error) {
+			return http.NewRequest(test.method, srv.URL, nil)
+		})
+		if err == nil {
+			t.Errorf("%s: no error was returned", test.method)
+		}
+
+		mu.Lock()
+		if requests != test.requests {
+			t.Errorf("%s: the request was sent %d times, not %d", test.method, requests, test.requests)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestDoWithRetryAfterDeadline(t *testing.T) {
+	srv, bodies := newRetryAfterServer(1, http.StatusServiceUnavailable, func() string { return "5" })
+	defer srv.Close()
+
+	// Waiting five seconds would run past the deadline, so the 503 is
+	// returned right away.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := doWithRetry(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, srv.URL, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status was %d, not %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if len(bodies()) != 1 {
+		t.Errorf("%d requests were sent, not 1", len(bodies()))
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("waited %s for a delay past the deadline", elapsed)
+	}
+}
+
+func TestKillK8sJobRetryAfter(t *testing.T) {
+	srv, bodies := newRetryAfterServer(1, http.StatusServiceUnavailable, func() string { return "0" })
+	defer srv.Close()
+
+	jk := &JobKiller{K8sEnabled: true, AppExposerBase: srv.URL}
+	if err := jk.KillJob(context.Background(), nil, &Job{ID: "job-id", ExternalID: "external-id"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies()) != 2 {
+		t.Errorf("%d save-and-exit requests were sent, not 2", len(bodies()))
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// selfCheckTimeout is how long the startup self-check can take before it's
+// treated as a failure.
+const selfCheckTimeout = 30 * time.Second
+
+// selfCheckQuery is a critical query along with arguments that make it
+// cheap to run.
+type selfCheckQuery struct {
+	name  string
+	query string
+	args  []interface{}
+}
+
+// selfCheckQueries returns the queries that the job killer can't work without.
+// They're run with arguments that don't return any rows, either an ID that no
+// analysis has or a page size of zero, so running them only checks them
+// against the schema and the database user's permissions.
+func selfCheckQueries(now time.Time) []selfCheckQuery {
+	return []selfCheckQuery{
+		{"jobsToKillQuery", jobsToKillQuery, []interface{}{"Running", formatDBTimestamp(now), firstJobID, 0}},
+		{"notifStatusQuery", notifStatusQuery, []interface{}{firstJobID}},
+		{"getTimeLimitQuery", getTimeLimitQuery, []interface{}{firstJobID}},
+	}
+}
+
+// selfCheckPassed is whether the startup self-check has succeeded. /readyz
+// reports that timelord isn't ready until it has.
+var selfCheckPassed atomic.Bool
+
+// StartupSelfCheck runs each of the critical queries once, returning an error
+// naming the first one that fails. Being able to connect to the database
+// doesn't mean that the queries will work, and the job killer loop would
+// otherwise just log their errors forever.
+func StartupSelfCheck(ctx context.Context, db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+
+	for _, q := range selfCheckQueries(CurrentClock.Now()) {
+		if err := runSelfCheckQuery(ctx, db, q); err != nil {
+			return errors.Wrapf(err, "startup self-check of %s failed, check the database schema and permissions", q.name)
+		}
+	}
+
+	selfCheckPassed.Store(true)
+	return nil
+}
+
+// runSelfCheckQuery runs the query and reads through any rows it returns.
+func runSelfCheckQuery(ctx context.Context, db *sql.DB, q selfCheckQuery) error {
+	rows, err := db.QueryContext(ctx, q.query, q.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+	}
+	return rows.Err()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStartupSelfCheck(t *testing.T) {
+	defer selfCheckPassed.Store(false)
+
+	tests := []struct {
+		name    string
+		failing string
+		query   string
+	}{
+		{"jobs", "jobs.planned_end_date <= $2", "jobsToKillQuery"},
+		{"notif statuses", "from notif_statuses", "notifStatusQuery"},
+		{"time limits", "FROM tools", "getTimeLimitQuery"},
+	}
+
+	for _, test := range tests {
+		selfCheckPassed.Store(false)
+
+		db, f := newFakeDB(t)
+		f.onError(test.failing, errors.New(`pq: column "planned_end_date" does not exist`))
+
+		err := StartupSelfCheck(context.Background(), db)
+		if err == nil {
+			t.Errorf("%s: no error was returned", test.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.query) || !strings.Contains(err.Error(), `column "planned_end_date" does not exist`) {
+			t.Errorf("%s: error was %q", test.name, err)
+		}
+		if selfCheckPassed.Load() {
+			t.Errorf("%s: self-check was marked as passed", test.name)
+		}
+	}
+
+	db, f := newFakeDB(t)
+	if err := StartupSelfCheck(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	if !selfCheckPassed.Load() {
+		t.Error("self-check wasn't marked as passed")
+	}
+	for _, substr := range []string{"jobs.planned_end_date <= $2", "from notif_statuses", "FROM tools"} {
+		if f.ran(substr) != 1 {
+			t.Errorf("query containing %q ran %d times, not once", substr, f.ran(substr))
+		}
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	defer selfCheckPassed.Store(false)
+
+	for _, passed := range []bool{false, true} {
+		selfCheckPassed.Store(passed)
+
+		mux, _ := newTestAPI(t)
+		req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		expected := http.StatusServiceUnavailable
+		if passed {
+			expected = http.StatusOK
+		}
+		if w.Code != expected {
+			t.Errorf("passed %t: status was %d, not %d", passed, w.Code, expected)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NotifTemplateData is what the subject and message templates of the
+// notifications sent to users are rendered with. Fields that don't apply to a
+// notification are left empty.
+type NotifTemplateData struct {
+	JobName      string // The name of the analysis.
+	ID           string // The UUID of the analysis.
+	EndTimeLocal string // The planned end date in timelord's timezone.
+	EndTimeUTC   string // The planned end date in UTC.
+	ResultFolder string // The output folder, as users see it.
+	Duration     string // How long the analysis has been running, in H:MM.
+	Remaining    string // How long until the analysis is stopped, in H:MM. Empty if it's exempt.
+	Now          string // The current time, used to keep subjects unique.
+}
+
+// jobTemplateData returns the template data for the job's notifications with
+// the fields that every job has filled in.
+func jobTemplateData(j *Job) *NotifTemplateData {
+	return &NotifTemplateData{
+		JobName:      j.Name,
+		ID:           j.ID,
+		ResultFolder: displayResultFolder(j.ResultFolder),
+	}
+}
+
+// withEndTime sets the end time fields of the template data from the job's
+// planned end date.
+func (d *NotifTemplateData) withEndTime(endtime time.Time) *NotifTemplateData {
+	d.EndTimeLocal = endtime.Format("Mon Jan 2 15:04:05 -0700 MST 2006")
+	d.EndTimeUTC = endtime.UTC().Format(time.UnixDate)
+	return d
+}
+
+// notifTemplates names the subject and message templates of a notification.
+// A templates file overrides them with {{define "<name>"}} blocks.
+type notifTemplates struct {
+	subject string
+	message string
+}
+
+// The templates for each of the notifications sent to users about their jobs.
+var (
+	killTemplates             = notifTemplates{"kill_subject", "kill_message"}
+	adminKillTemplates        = notifTemplates{"admin_kill_subject", "admin_kill_message"}
+	disabledUserKillTemplates = notifTemplates{"disabled_user_kill_subject", "disabled_user_kill_message"}
+	idleKillTemplates         = notifTemplates{"idle_kill_subject", "idle_kill_message"}
+	warningTemplates          = notifTemplates{"warning_subject", "warning_message"}
+	goneTemplates             = notifTemplates{"gone_subject", "gone_message"}
+	periodicTemplates         = notifTemplates{"periodic_subject", "periodic_message"}
+)
+
+// defaultNotifTemplates are the built-in templates, keyed by name.
+var defaultNotifTemplates = map[string]string{
+	killTemplates.subject:             KillSubjectFormat,
+	killTemplates.message:             KillMessageFormat,
+	adminKillTemplates.subject:        AdminKillSubjectFormat,
+	adminKillTemplates.message:        AdminKillMessageFormat,
+	disabledUserKillTemplates.subject: DisabledUserSubjectFormat,
+	disabledUserKillTemplates.message: DisabledUserMessageFormat,
+	idleKillTemplates.subject:         IdleKillSubjectFormat,
+	idleKillTemplates.message:         IdleKillMessageFormat,
+	warningTemplates.subject:          WarningSubjectFormat,
+	warningTemplates.message:          WarningMessageFormat,
+	goneTemplates.subject:             GoneSubjectFormat,
+	goneTemplates.message:             GoneMessageFormat,
+	periodicTemplates.subject:         PeriodicSubjectFormat,
+	periodicTemplates.message:         PeriodicMessageFormat,
+}
+
+// parseNotifTemplates parses the built-in templates, then the overrides in
+// src if it isn't empty. Every template is rendered once with sample data so
+// that references to fields that don't exist are caught up front, rather than
+// when a notification is sent.
+func parseNotifTemplates(src string) (*template.Template, error) {
+	tmpl := template.New("notifications")
+
+	for name, text := range defaultNotifTemplates {
+		if _, err := tmpl.New(name).Parse(text); err != nil {
+			return nil, errors.Wrapf(err, "error parsing built-in template %s", name)
+		}
+	}
+
+	if src != "" {
+		if _, err := tmpl.Parse(src); err != nil {
+			return nil, errors.Wrap(err, "error parsing notification templates")
+		}
+	}
+
+	// A misspelled name would otherwise be ignored without any sign of it.
+	for _, t := range tmpl.Templates() {
+		if _, ok := defaultNotifTemplates[t.Name()]; !ok && t.Name() != tmpl.Name() {
+			return nil, fmt.Errorf("unknown notification template %s", t.Name())
+		}
+	}
+
+	sample := &NotifTemplateData{
+		JobName:      "analysis",
+		ID:           firstJobID,
+		EndTimeLocal: "end",
+		EndTimeUTC:   "end",
+		ResultFolder: "/iplant/home/user/analyses/analysis",
+		Duration:     "1:00",
+		Remaining:    "1:00",
+		Now:          "now",
+	}
+	for name := range defaultNotifTemplates {
+		if err := tmpl.ExecuteTemplate(io.Discard, name, sample); err != nil {
+			return nil, errors.Wrapf(err, "error rendering notification template %s", name)
+		}
+	}
+
+	return tmpl, nil
+}
+
+// notifTemplateSet holds the parsed subject and message templates. It starts
+// out with just the built-in ones.
+var notifTemplateSet = template.Must(parseNotifTemplates(""))
+
+// NotifTemplatesInit reads the templates file at path, whose {{define}}
+// blocks override the built-in templates with the same names. Only the
+// built-in templates are used if path is empty. Nothing changes if the file
+// can't be read or its templates don't parse or render.
+func NotifTemplatesInit(path string) error {
+	var src []byte
+	if path != "" {
+		var err error
+		if src, err = os.ReadFile(path); err != nil {
+			return errors.Wrapf(err, "error reading notification templates file %s", path)
+		}
+	}
+
+	tmpl, err := parseNotifTemplates(string(src))
+	if err != nil {
+		return errors.Wrapf(err, "invalid notification templates file %s", path)
+	}
+
+	notifTemplateSet = tmpl
+	return nil
+}
+
+// renderNotifText renders the subject and message templates with the data.
+func renderNotifText(t notifTemplates, data *NotifTemplateData) (string, string, error) {
+	var subject, msg strings.Builder
+
+	if err := notifTemplateSet.ExecuteTemplate(&subject, t.subject, data); err != nil {
+		return "", "", errors.Wrapf(err, "error rendering template %s", t.subject)
+	}
+	if err := notifTemplateSet.ExecuteTemplate(&msg, t.message, data); err != nil {
+		return "", "", errors.Wrapf(err, "error rendering template %s", t.message)
+	}
+
+	return subject.String(), msg.String(), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifTemplatesFromFile(t *testing.T) {
+	defer NotifTemplatesInit("")
+
+	if err := NotifTemplatesInit("testdata/notif-templates/custom.tmpl"); err != nil {
+		t.Fatal(err)
+	}
+
+	endtime := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	data := jobTemplateData(&Job{ID: "job-id", Name: "job-name", ResultFolder: "/iplant/home/user/analyses/job-name"}).withEndTime(endtime)
+	data.Duration = "4:00"
+	data.Remaining = "20:00"
+	data.Now = "2024-03-01 05:00"
+
+	tests := []struct {
+		templates notifTemplates
+		subject   string
+		message   string
+	}{
+		{
+			killTemplates,
+			"[timelord] job-name hit its time limit",
+			"job-name (job-id) was stopped at Fri Mar 1 09:00:00 +0000 UTC 2024 / Fri Mar  1 09:00:00 UTC 2024. See /iplant/home/user/analyses/job-name.",
+		},
+		{
+			adminKillTemplates,
+			"[timelord] job-name was stopped by an admin",
+			"An admin stopped job-name (job-id). See /iplant/home/user/analyses/job-name.",
+		},
+		{
+			disabledUserKillTemplates,
+			"[timelord] job-name belongs to a disabled account",
+			"job-name (job-id) belongs to a disabled account. See /iplant/home/user/analyses/job-name.",
+		},
+		{
+			idleKillTemplates,
+			"[timelord] job-name was idle",
+			"job-name (job-id) was idle. See /iplant/home/user/analyses/job-name.",
+		},
+		{
+			warningTemplates,
+			"[timelord] job-name stops at Fri Mar  1 09:00:00 UTC 2024",
+			"job-name (job-id) stops at Fri Mar 1 09:00:00 +0000 UTC 2024. Outputs go to /iplant/home/user/analyses/job-name.",
+		},
+		{
+			goneTemplates,
+			"[timelord] job-name already stopped",
+			"job-name (job-id) stopped before Fri Mar 1 09:00:00 +0000 UTC 2024. See /iplant/home/user/analyses/job-name.",
+		},
+		{
+			periodicTemplates,
+			"[timelord] job-name is still running (2024-03-01 05:00)",
+			"job-name has run for 4:00 with 20:00 to go.",
+		},
+	}
+
+	for _, test := range tests {
+		subject, msg, err := renderNotifText(test.templates, data)
+		if err != nil {
+			t.Errorf("%s: %s", test.templates.subject, err)
+			continue
+		}
+		if subject != test.subject {
+			t.Errorf("%s was %q, not %q", test.templates.subject, subject, test.subject)
+		}
+		if msg != test.message {
+			t.Errorf("%s was %q, not %q", test.templates.message, msg, test.message)
+		}
+	}
+}
+
+func TestNotifTemplatesFallback(t *testing.T) {
+	defer NotifTemplatesInit("")
+
+	if err := NotifTemplatesInit("testdata/notif-templates/partial.tmpl"); err != nil {
+		t.Fatal(err)
+	}
+
+	endtime := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	data := jobTemplateData(&Job{ID: "job-id", Name: "job-name", ResultFolder: "/iplant/home/user/analyses/job-name"}).withEndTime(endtime)
+
+	// The file only overrides the warning subject, so the message is still
+	// the built-in one.
+	subject, msg, err := renderNotifText(warningTemplates, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Heads up: job-name stops soon" {
+		t.Errorf("subject was %q", subject)
+	}
+	if !strings.HasPrefix(msg, `Analysis "job-name" (job-id) is set to expire on "Fri Mar 1 09:00:00 +0000 UTC 2024"`) {
+		t.Errorf("message was %q", msg)
+	}
+}
+
+func TestNotifTemplatesInitErrors(t *testing.T) {
+	defer NotifTemplatesInit("")
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"testdata/notif-templates/unparseable.tmpl", "error parsing notification templates"},
+		{"testdata/notif-templates/unknown-field.tmpl", "error rendering notification template warning_subject"},
+		{"testdata/notif-templates/unknown-template.tmpl", "unknown notification template warning_subjcet"},
+		{"testdata/notif-templates/missing.tmpl", "error reading notification templates file"},
+	}
+
+	for _, test := range tests {
+		err := NotifTemplatesInit(test.path)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: error was %v", test.path, err)
+		}
+
+		// The built-in templates are still in use after a failure.
+		subject, _, err := renderNotifText(warningTemplates, &NotifTemplateData{JobName: "job-name", EndTimeLocal: "local", EndTimeUTC: "utc"})
+		if err != nil || subject != "Analysis job-name will terminate on local (utc)." {
+			t.Errorf("%s: subject was %q, error was %v", test.path, subject, err)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startJobSpan starts a span for the work done on a single job as a child of
+// the span in ctx, so that traces show how long each job took.
+func startJobSpan(ctx context.Context, name string, j *Job) (context.Context, trace.Span) {
+	return otel.Tracer(otelName).Start(ctx, name, trace.WithAttributes(
+		attribute.String("analysis.id", j.ID),
+		attribute.String("analysis.external_id", j.ExternalID),
+	))
+}
+
+// recordSpanError records the error on the span in ctx and marks it as failed.
+func recordSpanError(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans sends the spans started during the test to the returned
+// recorder.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	orig := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(orig)
+		_ = tp.Shutdown(context.Background())
+	})
+
+	return recorder
+}
+
+// spanAttribute returns the value of the span's attribute with the key.
+func spanAttribute(s sdktrace.ReadOnlySpan, key string) string {
+	for _, kv := range s.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value.AsString()
+		}
+	}
+	return ""
+}
+
+// jobSpans returns the ended spans with the name, checking that each of them
+// is a child of parent.
+func jobSpans(t *testing.T, recorder *tracetest.SpanRecorder, name string, parent sdktrace.ReadOnlySpan) map[string]sdktrace.ReadOnlySpan {
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range recorder.Ended() {
+		if s.Name() != name {
+			continue
+		}
+		if s.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("%s span for %s isn't a child of the %s span", name, spanAttribute(s, "analysis.id"), parent.Name())
+		}
+		spans[spanAttribute(s, "analysis.id")] = s
+	}
+	return spans
+}
+
+// endedSpan returns the ended span with the name.
+func endedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, s := range recorder.Ended() {
+		if s.Name() == name {
+			return s
+		}
+	}
+	t.Fatalf("no %s span was ended", name)
+	return nil
+}
+
+func TestKillExpiredJobsSpans(t *testing.T) {
+	NotifsInit("")
+	UsersInit("")
+	recorder := recordSpans(t)
+
+	db, f := newFakeDB(t)
+	f.on("pg_try_advisory_xact_lock", []string{"locked"}, []driver.Value{true})
+	f.on("hour_warning_failure_count", notifStatusColumns, notifStatusRow(nil))
+
+	plannedEnd := time.Now().Add(-time.Hour).In(TimestampLocation).Format(TimestampFromDBFormat)
+	jobs := []Job{
+		{ID: "job-1", ExternalID: "external-1", PlannedEndDate: plannedEnd},
+		{ID: "job-2", ExternalID: "external-2", PlannedEndDate: plannedEnd},
+	}
+	kill := func(_ context.Context, _ *sql.DB, j *Job) error {
+		if j.ID == "job-2" {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	ctx, iteration := otel.Tracer(otelName).Start(context.Background(), "iteration")
+	killExpiredJobs(ctx, db, &VICEDatabaser{db: db}, jobs, kill, "", KillMaxAttempts)
+	iteration.End()
+
+	spans := jobSpans(t, recorder, "kill job", endedSpan(t, recorder, "iteration"))
+	if len(spans) != len(jobs) {
+		t.Fatalf("%d kill job spans were ended, not %d", len(spans), len(jobs))
+	}
+	for _, j := range jobs {
+		s, ok := spans[j.ID]
+		if !ok {
+			t.Errorf("no span was ended for %s", j.ID)
+			continue
+		}
+		if actual := spanAttribute(s, "analysis.external_id"); actual != j.ExternalID {
+			t.Errorf("external ID attribute for %s was %q, not %q", j.ID, actual, j.ExternalID)
+		}
+	}
+	if len(spans["job-1"].Events()) != 0 {
+		t.Errorf("errors were recorded for the job that was killed: %v", spans["job-1"].Events())
+	}
+	if len(spans["job-2"].Events()) == 0 {
+		t.Error("the kill failure wasn't recorded")
+	}
+}
+
+func TestSendWarningSpans(t *testing.T) {
+	NotifsInit("")
+	UsersInit("")
+	recorder := recordSpans(t)
+
+	db, f := newFakeDB(t)
+	other := jobRow(time.Now().In(TimestampLocation))
+	other[0] = "other-job-id"
+	f.on("and jobs.planned_end_date > $2", jobColumns,
+		jobRow(time.Now().In(TimestampLocation)),
+		other,
+	)
+	f.on("select job_steps.external_id", []string{"external_id"}, []driver.Value{"external-id"})
+
+	ctx, iteration := otel.Tracer(otelName).Start(context.Background(), "iteration")
+	sendWarning(ctx, db, &VICEDatabaser{db: db}, 60, WarningMaxAttempts, make(map[string]bool))
+	iteration.End()
+
+	var count int
+	for _, s := range recorder.Ended() {
+		if s.Name() == "send warning" {
+			count++
+		}
+	}
+	jobSpans(t, recorder, "send warning", endedSpan(t, recorder, "iteration"))
+	if count != 2 {
+		t.Errorf("%d send warning spans were ended, not 2", count)
+	}
+}
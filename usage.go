@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// UsageWarningsEnabled is whether users whose jobs have run for longer than
+// UsageThreshold in total over the last UsageWindow are warned about it. It's
+// off by default.
+var UsageWarningsEnabled = false
+
+// UsageWindow is the period that a user's compute usage is summed over. Users
+// are warned at most once per window.
+var UsageWindow = 30 * 24 * time.Hour
+
+// UsageThreshold is how much compute time a user can use within UsageWindow
+// before they're warned.
+var UsageThreshold = 500 * time.Hour
+
+// UsageCheckInterval is how often compute usage is summed to find the users
+// to warn. The window is long enough that checking every iteration of the job
+// killer wouldn't warn anyone noticeably sooner.
+var UsageCheckInterval = time.Hour
+
+// UsageWarningsInit sets whether users are warned about their compute usage,
+// the window it's summed over, the threshold they're warned at, and how often
+// it's checked.
+func UsageWarningsInit(enabled bool, window, threshold, checkInterval time.Duration) {
+	UsageWarningsEnabled = enabled
+	UsageWindow = window
+	UsageThreshold = threshold
+	UsageCheckInterval = checkInterval
+}
+
+// UsageSubjectFormat is the subject of the notification sent to users who
+// have crossed the usage threshold.
+const UsageSubjectFormat = "You have used %s of compute time in the last %s."
+
+// UsageMessageFormat is the message sent to users who have crossed the usage
+// threshold.
+const UsageMessageFormat = `Your analyses have run for a total of %s in the last %s, which is more than the %s we expect most users to need.
+
+Please cancel any analyses you're no longer using.`
+
+// usageByUserQuery sums how long each user's jobs have run between $1 and $2,
+// counting only the part of each job that falls within that period. Jobs
+// that are still running count up to $2. Only users whose total is at least
+// $4 seconds are returned. Finished jobs are only read if they ended after $1
+// and running jobs are found by their status, so that neither half of the
+// query has to scan the whole jobs table.
+const usageByUserQuery = `
+select windowed.username,
+       cast(extract(epoch from sum(windowed.ran)) as bigint) as seconds
+  from (
+        select users.username,
+               least(jobs.end_date, $2) - greatest(jobs.start_date, $1) as ran
+          from jobs
+          join users on jobs.user_id = users.id
+         where jobs.end_date > $1
+           and jobs.start_date < $2
+        union all
+        select users.username,
+               $2 - greatest(jobs.start_date, $1) as ran
+          from jobs
+          join users on jobs.user_id = users.id
+         where jobs.status = $3
+           and jobs.end_date is null
+           and jobs.start_date < $2
+       ) as windowed
+ group by windowed.username
+having extract(epoch from sum(windowed.ran)) >= $4`
+
+// UsageByUser returns how long each user's jobs have run between since and
+// until, keyed by username. Only users who have used at least threshold are
+// included.
+func UsageByUser(ctx context.Context, dedb *sql.DB, since, until time.Time, threshold time.Duration) (map[string]time.Duration, error) {
+	rows, err := dedb.QueryContext(
+		ctx,
+		usageByUserQuery,
+		formatDBTimestamp(since),
+		formatDBTimestamp(until),
+		"Running",
+		int64(threshold.Seconds()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make(map[string]time.Duration)
+
+	for rows.Next() {
+		var (
+			username string
+			seconds  int64
+		)
+		if err = rows.Scan(&username, &seconds); err != nil {
+			return nil, err
+		}
+		usage[username] = time.Duration(seconds) * time.Second
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// usageWarningDue returns whether a user last warned at last should be warned
+// again at now. A zero last means the user has never been warned.
+func usageWarningDue(last, now time.Time, window time.Duration) bool {
+	return last.IsZero() || !now.Before(last.Add(window))
+}
+
+// SendUsageNotification tells the user that their jobs have run for usage in
+// total over the last UsageWindow.
+func SendUsageNotification(ctx context.Context, username string, usage time.Duration) error {
+	if NotifsURI == "" || UsersURI == "" {
+		log.Infof("notification URI is %s and iplant-groups URI is %s", NotifsURI, UsersURI)
+		return nil
+	}
+
+	u := ParseID(username)
+	if u == "" {
+		return fmt.Errorf("usage for %q doesn't have a user to notify", username)
+	}
+
+	user := NewUser(u)
+	if err := user.Get(ctx); err != nil {
+		return errors.Wrap(err, "failed to get user info")
+	}
+
+	used := usage.Round(time.Hour).String()
+	window := UsageWindow.String()
+	subject := fmt.Sprintf(UsageSubjectFormat, used, window)
+	msg := fmt.Sprintf(UsageMessageFormat, used, window, UsageThreshold.String())
+
+	p := NewPayload()
+	p.Action = "compute_usage_warning"
+	p.Email = user.Email
+	p.User = u
+
+	notif := NewNotification(u, subject, msg, true, "compute_usage_warning", p)
+
+	if err := Deliver(ctx, notif); err != nil {
+		return errors.Wrap(err, "failed to send notification")
+	}
+
+	return nil
+}
+
+// sendUsageWarnings warns the users who have crossed UsageThreshold within
+// the last UsageWindow, unless they've already been warned within it. Nothing
+// is done if notifications aren't configured.
+func sendUsageWarnings(ctx context.Context, db *sql.DB, vicedb *VICEDatabaser) {
+	if !notifsConfigured() {
+		return
+	}
+
+	now := CurrentClock.Now()
+
+	usage, err := UsageByUser(ctx, db, now.Add(-UsageWindow), now, UsageThreshold)
+	if err != nil {
+		log.Error(errors.Wrap(err, "error summing compute usage by user"))
+		return
+	}
+
+	for username, used := range usage {
+		usageLog := log.WithFields(log.Fields{
+			"context": "usage warning",
+			"user":    username,
+			"usage":   used.String(),
+		})
+
+		last, err := vicedb.LastUsageNotification(ctx, username)
+		if err != nil {
+			usageLog.Error(err)
+			continue
+		}
+		if !usageWarningDue(last, now, UsageWindow) {
+			continue
+		}
+
+		if err = SendUsageNotification(ctx, username, used); err != nil {
+			usageLog.Error(errors.Wrap(err, "error sending usage warning"))
+			continue
+		}
+
+		if err = vicedb.SetLastUsageNotification(ctx, username, now); err != nil {
+			usageLog.Error(err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var usageColumns = []string{"username", "seconds"}
+
+func TestUsageByUser(t *testing.T) {
+	db, f := newFakeDB(t)
+	f.on("as seconds", usageColumns,
+		[]driver.Value{"alice@example.com", int64(600 * 3600)},
+		[]driver.Value{"bob@example.com", int64(550*3600 + 1800)},
+	)
+
+	until := time.Date(2024, 3, 31, 9, 0, 0, 0, TimestampLocation)
+	since := until.Add(-30 * 24 * time.Hour)
+
+	usage, err := UsageByUser(context.Background(), db, since, until, 500*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]time.Duration{
+		"alice@example.com": 600 * time.Hour,
+		"bob@example.com":   550*time.Hour + 30*time.Minute,
+	}
+	if len(usage) != len(expected) {
+		t.Errorf("usage was %v, not %v", usage, expected)
+	}
+	for user, used := range expected {
+		if usage[user] != used {
+			t.Errorf("usage for %s was %s, not %s", user, usage[user], used)
+		}
+	}
+
+	args := f.argsFor("as seconds")
+	if len(args) != 4 {
+		t.Fatalf("number of query args was %d, not 4", len(args))
+	}
+	if args[0] != formatDBTimestamp(since) || args[1] != formatDBTimestamp(until) {
+		t.Errorf("usage was summed from %v to %v, not %s to %s", args[0], args[1], since, until)
+	}
+	if args[2] != "Running" || args[3] != int64(500*3600) {
+		t.Errorf("query args were %v", args)
+	}
+}
+
+func TestUsageWarningDue(t *testing.T) {
+	now := time.Date(2024, 3, 31, 9, 0, 0, 0, time.UTC)
+	window := 30 * 24 * time.Hour
+
+	tests := []struct {
+		name string
+		last time.Time
+		due  bool
+	}{
+		{"never warned", time.Time{}, true},
+		{"warned within the window", now.Add(-24 * time.Hour), false},
+		{"warned a window ago", now.Add(-window), true},
+		{"warned before the window", now.Add(-window - time.Hour), true},
+	}
+
+	for _, test := range tests {
+		if due := usageWarningDue(test.last, now, window); due != test.due {
+			t.Errorf("%s: due was %t, not %t", test.name, due, test.due)
+		}
+	}
+}
+
+func TestSendUsageWarningsOncePerWindow(t *testing.T) {
+	users := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(User{ID: "user", Email: "user@example.com"})
+	}))
+	defer users.Close()
+
+	sink := &recordingSink{}
+	SinksInit(sink)
+	NotifsInit("http://notification-agent")
+	UsersInit(users.URL)
+	defer SinksInit(&AgentSink{})
+	defer NotifsInit("")
+	defer UsersInit("")
+	defer UsageWarningsInit(false, 30*24*time.Hour, 500*time.Hour, time.Hour)
+	defer ClockInit(realClock{})
+
+	UsageWarningsInit(true, 30*24*time.Hour, 500*time.Hour, time.Hour)
+
+	db, f := newFakeDB(t)
+	f.on("as seconds", usageColumns,
+		[]driver.Value{"alice@example.com", int64(600 * 3600)},
+		[]driver.Value{"bob@example.com", int64(550 * 3600)},
+	)
+
+	// The last notification times come from the upserts that have been run,
+	// like they would from the real table.
+	f.onFunc("from usage_notifications", []string{"last_notified"}, func(args []driver.Value) [][]driver.Value {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		var rows [][]driver.Value
+		for i, stmt := range f.statements {
+			if strings.Contains(stmt, "insert into usage_notifications") && f.args[i][0].Value == args[0] {
+				rows = [][]driver.Value{{f.args[i][1].Value}}
+			}
+		}
+		return rows
+	})
+	vicedb := &VICEDatabaser{db: db}
+
+	start := time.Date(2024, 3, 31, 9, 0, 0, 0, TimestampLocation)
+	clock := newFakeClock(start)
+	ClockInit(clock)
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		sent    int
+	}{
+		{"first crossing", 0, 2},
+		{"within the window", 24 * time.Hour, 0},
+		{"next window", 30 * 24 * time.Hour, 2},
+	}
+
+	for _, test := range tests {
+		clock.Advance(test.advance)
+		before := len(sink.notifs)
+
+		sendUsageWarnings(context.Background(), db, vicedb)
+
+		if sent := len(sink.notifs) - before; sent != test.sent {
+			t.Errorf("%s: %d usage warnings were sent, not %d", test.name, sent, test.sent)
+		}
+	}
+
+	if upserts := f.ran("insert into usage_notifications"); upserts != 4 {
+		t.Errorf("the last notification time was recorded %d times, not 4", upserts)
+	}
+	if args := f.argsFor("insert into usage_notifications"); len(args) != 2 || !args[1].(time.Time).Equal(clock.Now()) {
+		t.Errorf("upsert args were %v, not the clock's time", args)
+	}
+	for _, n := range sink.notifs {
+		if n.EmailTemplate != "compute_usage_warning" || n.Payload.Email != "user@example.com" {
+			t.Errorf("unexpected notification %+v", n)
+		}
+	}
+}
+
+func TestSendUsageWarningsUnconfigured(t *testing.T) {
+	NotifsInit("")
+	UsersInit("")
+
+	db, f := newFakeDB(t)
+	sendUsageWarnings(context.Background(), db, &VICEDatabaser{db: db})
+
+	if f.ran("as seconds") != 0 {
+		t.Error("usage was summed without notifications configured")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -8,8 +9,11 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 )
 
 // UsersURI the default URI for user lookup requests
@@ -20,6 +24,168 @@ func UsersInit(u string) {
 	UsersURI = u
 }
 
+// usersSemaphore limits how many requests are made to the iplant-groups
+// service at once. It's shared by everything that looks up users, including
+// the warning, periodic, and kill paths. There's no limit while it's nil.
+var usersSemaphore chan struct{}
+
+// UserLookupLimitInit sets the maximum number of concurrent requests to the
+// iplant-groups service. A limit of zero or less removes the limit.
+func UserLookupLimitInit(max int) {
+	if max <= 0 {
+		usersSemaphore = nil
+		return
+	}
+	usersSemaphore = make(chan struct{}, max)
+}
+
+// acquireUserLookup waits until a request can be made to the iplant-groups
+// service without going over the limit, or until ctx is done. The returned
+// function must be called once the request is finished.
+func acquireUserLookup(ctx context.Context) (func(), error) {
+	sem := usersSemaphore
+	if sem == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "gave up waiting to make a request to iplant-groups")
+	}
+}
+
+// doUserLookup sends the request built by newReq to the iplant-groups service
+// once it's within the concurrency limit, and reads the response body.
+func doUserLookup(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, []byte, error) {
+	release, err := acquireUserLookup(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	resp, err := doWithRetry(ctx, newReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read response body")
+	}
+
+	return resp, b, nil
+}
+
+// userCacheEntry is a cached user lookup along with the time it expires.
+type userCacheEntry struct {
+	user    User
+	expires time.Time
+}
+
+// userCache is an in-memory cache of user lookups keyed by user ID. It's
+// shared between the warning, periodic, and kill paths, so access to it is
+// guarded by a mutex.
+type userCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]userCacheEntry
+}
+
+func newUserCache(ttl time.Duration) *userCache {
+	return &userCache{
+		ttl:     ttl,
+		entries: make(map[string]userCacheEntry),
+	}
+}
+
+// get returns the cached user for the ID if there is one that hasn't expired.
+func (c *userCache) get(id string) (User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[id]
+	if !ok {
+		return User{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, id)
+		return User{}, false
+	}
+	return entry.user, true
+}
+
+// set caches the user under the given ID. Does nothing if caching is disabled.
+func (c *userCache) set(id string, u User) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[id] = userCacheEntry{
+		user:    u,
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+// usersCache is the cache used by User.Get. Caching is disabled until
+// UserCacheInit is called with a positive TTL.
+var usersCache = newUserCache(0)
+
+// UserCacheInit sets how long user lookups are cached for. A TTL of zero or
+// less disables caching.
+func UserCacheInit(ttl time.Duration) {
+	usersCache = newUserCache(ttl)
+}
+
+// userMemo holds the users looked up during a single iteration of the main
+// loop so that each user is only looked up once per iteration.
+type userMemo struct {
+	mu    sync.Mutex
+	users map[string]User
+}
+
+type userMemoKey struct{}
+
+// WithUserMemo returns a context that remembers the users looked up with it.
+// It's meant to be used for a single iteration of the main loop.
+func WithUserMemo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, userMemoKey{}, &userMemo{users: make(map[string]User)})
+}
+
+func userMemoFromContext(ctx context.Context) *userMemo {
+	memo, _ := ctx.Value(userMemoKey{}).(*userMemo)
+	return memo
+}
+
+// knownUser returns the user with the given ID if it has already been looked
+// up during this iteration or is in the cache.
+func knownUser(ctx context.Context, id string) (User, bool) {
+	if memo := userMemoFromContext(ctx); memo != nil {
+		memo.mu.Lock()
+		u, ok := memo.users[id]
+		memo.mu.Unlock()
+		if ok {
+			return u, true
+		}
+	}
+	return usersCache.get(id)
+}
+
+// rememberUser stores the user in the iteration's memo and the cache.
+func rememberUser(ctx context.Context, id string, u User) {
+	if memo := userMemoFromContext(ctx); memo != nil {
+		memo.mu.Lock()
+		memo.users[id] = u
+		memo.mu.Unlock()
+	}
+	usersCache.set(id, u)
+}
+
 // User contains information about a user that was returned by various services
 // in the backend. For now, it all comes from the iplant-groups service.
 type User struct {
@@ -42,8 +208,16 @@ func NewUser(id string) *User {
 }
 
 // Get populates the *User with information. Blocks and makes calls to at least
-// the iplant-groups service.
+// the iplant-groups service unless the user was looked up recently.
 func (u *User) Get(ctx context.Context) error {
+	id := u.ID
+	if cached, ok := knownUser(ctx, id); ok {
+		uri := u.URI
+		*u = cached
+		u.URI = uri
+		return nil
+	}
+
 	url, err := url.Parse(u.URI)
 	if err != nil {
 		return errors.Wrap(err, "failed to parse user lookup URL")
@@ -51,39 +225,160 @@ func (u *User) Get(ctx context.Context) error {
 
 	url.Path = fmt.Sprintf("/subjects/%s", u.ID)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
+	resp, b, err := doUserLookup(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
+	})
 	if err != nil {
 		return errors.Wrapf(err, "failed to GET user information from %s", url.String())
 	}
 
-	resp, err := httpClient.Do(req)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed user lookup for %s (status: %s, msg %s)", u.ID, resp.Status, b)
+	}
+
+	if err = json.Unmarshal(b, u); err != nil {
+		return errors.Wrap(err, "failed to unmarshal user lookup response")
+	}
+
+	rememberUser(ctx, id, *u)
+
+	return nil
+}
+
+// userNotFound returns whether iplant-groups says that there's no user with
+// the ID. Only a 404 counts, so anything else that goes wrong with the lookup
+// is returned as an error rather than taken to mean the user is gone.
+func userNotFound(ctx context.Context, id string) (bool, error) {
+	url, err := url.Parse(UsersURI)
 	if err != nil {
-		return errors.Wrapf(err, "failed to GET user information from %s", url.String())
+		return false, errors.Wrap(err, "failed to parse user lookup URL")
 	}
 
-	b, err := io.ReadAll(resp.Body)
+	url.Path = fmt.Sprintf("/subjects/%s", id)
+
+	resp, b, err := doUserLookup(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
+	})
 	if err != nil {
-		return errors.Wrap(err, "failed to read response body for user lookup request")
+		return false, errors.Wrapf(err, "failed to GET user information from %s", url.String())
 	}
 
-	if resp.StatusCode < 200 || resp.StatusCode > 200 {
-		return errors.Wrapf(err, "failed user lookup (status: %s, msg %s)", resp.Status, b)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return true, nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return false, fmt.Errorf("failed user lookup for %s (status: %s, msg %s)", id, resp.Status, b)
 	}
+	return false, nil
+}
 
-	if err = json.Unmarshal(b, u); err != nil {
-		return errors.Wrap(err, "failed to unmarshal user lookup response")
+// lookupUsers fetches the users with the given IDs from the iplant-groups
+// bulk subject lookup endpoint.
+func lookupUsers(ctx context.Context, ids []string) ([]User, error) {
+	url, err := url.Parse(UsersURI)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse user lookup URL")
 	}
 
-	return nil
+	url.Path = "/subjects/lookup"
+
+	body, err := json.Marshal(map[string][]string{"subject_ids": ids})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal bulk user lookup request")
+	}
+
+	resp, b, err := doUserLookup(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url.String(), bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("content-type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to POST user lookups to %s", url.String())
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("failed bulk user lookup (status: %s, msg %s)", resp.Status, b)
+	}
+
+	var lookup struct {
+		Subjects []User `json:"subjects"`
+	}
+	if err = json.Unmarshal(b, &lookup); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal bulk user lookup response")
+	}
+
+	return lookup.Subjects, nil
+}
+
+// LookupUsers looks up all of the users with the given IDs that haven't been
+// looked up already, in a single request if possible. The results are
+// remembered for the iteration if ctx came from WithUserMemo, so later calls
+// to User.Get for those users don't make requests of their own. Falls back to
+// looking up the users one at a time if the bulk lookup fails.
+func LookupUsers(ctx context.Context, ids []string) (map[string]*User, error) {
+	users := make(map[string]*User)
+
+	var missing []string
+	for _, id := range ids {
+		if _, ok := users[id]; ok {
+			continue
+		}
+		if u, ok := knownUser(ctx, id); ok {
+			u.URI = UsersURI
+			users[id] = &u
+			continue
+		}
+		users[id] = nil
+		missing = append(missing, id)
+	}
+
+	if len(missing) == 0 {
+		return users, nil
+	}
+
+	found, err := lookupUsers(ctx, missing)
+	if err == nil {
+		for i := range found {
+			u := found[i]
+			u.URI = UsersURI
+			rememberUser(ctx, u.ID, u)
+			users[u.ID] = &u
+		}
+		for _, id := range missing {
+			if users[id] == nil {
+				delete(users, id)
+			}
+		}
+		return users, nil
+	}
+
+	log.Error(errors.Wrap(err, "bulk user lookup failed, looking users up individually"))
+
+	var lookupErr error
+	for _, id := range missing {
+		u := NewUser(id)
+		if err = u.Get(ctx); err != nil {
+			lookupErr = err
+			delete(users, id)
+			continue
+		}
+		users[id] = u
+	}
+
+	return users, lookupErr
 }
 
 // ParseID returns a user's ID from their username. Right now it's basically
-// anything to the left of the last @ in their username.
+// anything to the left of the last @ in their username, so a trailing @ is
+// dropped. If there's nothing to the left of the last @, as in "@example.com"
+// or "@", the username is returned as-is rather than an empty ID.
 func ParseID(username string) string {
-	hasAt := strings.Contains(username, "@")
-	if !hasAt {
+	i := strings.LastIndex(username, "@")
+	if i <= 0 {
 		return username
 	}
-	parts := strings.Split(username, "@")
-	return strings.Join(parts[:len(parts)-1], "@")
+	return username[:i]
 }
@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestUsersInit(t *testing.T) {
@@ -103,6 +106,10 @@ func TestParseID(t *testing.T) {
 		"test-user@example.com":     "test-user",
 		"test@user@example.com":     "test@user",
 		"test@user@one@example.com": "test@user@one",
+		"test-user@":                "test-user",
+		"@example.com":              "@example.com",
+		"@":                         "@",
+		"":                          "",
 	}
 	for k, expected := range tests {
 		actual := ParseID(k)
@@ -111,3 +118,192 @@ func TestParseID(t *testing.T) {
 		}
 	}
 }
+
+func TestGetNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("subject not found"))
+	}))
+	defer srv.Close()
+
+	u := NewUser("missing-id")
+	u.URI = srv.URL
+	err := u.Get(context.Background())
+	if err == nil {
+		t.Fatal("error was nil")
+	}
+
+	for _, expected := range []string{"missing-id", "404", "subject not found"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error '%s' did not contain '%s'", err, expected)
+		}
+	}
+}
+
+func TestGetCached(t *testing.T) {
+	UserCacheInit(time.Minute)
+	defer UserCacheInit(0)
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		msg, err := json.Marshal(&User{ID: "cached-id", Email: "cached-id@example.com"})
+		if err != nil {
+			t.Error(err)
+		}
+		w.Write(msg)
+	}))
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		u := NewUser("cached-id")
+		u.URI = srv.URL
+		if err := u.Get(context.Background()); err != nil {
+			t.Error(err)
+		}
+		if u.Email != "cached-id@example.com" {
+			t.Errorf("email was %s, not cached-id@example.com", u.Email)
+		}
+		if u.URI != srv.URL {
+			t.Errorf("URI was %s, not %s", u.URI, srv.URL)
+		}
+	}
+
+	if requests != 1 {
+		t.Errorf("number of requests was %d, not 1", requests)
+	}
+}
+
+func TestLookupUsers(t *testing.T) {
+	var bulkRequests, singleRequests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/subjects/lookup" {
+			atomic.AddInt32(&bulkRequests, 1)
+			var body struct {
+				SubjectIDs []string `json:"subject_ids"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+			var subjects []User
+			for _, id := range body.SubjectIDs {
+				subjects = append(subjects, User{ID: id, Email: id + "@example.com"})
+			}
+			json.NewEncoder(w).Encode(map[string][]User{"subjects": subjects})
+			return
+		}
+		atomic.AddInt32(&singleRequests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	UsersInit(srv.URL)
+
+	ctx := WithUserMemo(context.Background())
+	users, err := LookupUsers(ctx, []string{"one", "two", "one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Errorf("number of users was %d, not 2", len(users))
+	}
+	if users["two"] == nil || users["two"].Email != "two@example.com" {
+		t.Errorf("user two was %v", users["two"])
+	}
+
+	u := NewUser("one")
+	if err = u.Get(ctx); err != nil {
+		t.Error(err)
+	}
+	if u.Email != "one@example.com" {
+		t.Errorf("email was %s, not one@example.com", u.Email)
+	}
+
+	if bulkRequests != 1 {
+		t.Errorf("number of bulk requests was %d, not 1", bulkRequests)
+	}
+	if singleRequests != 0 {
+		t.Errorf("number of single requests was %d, not 0", singleRequests)
+	}
+}
+
+func TestLookupUsersFallback(t *testing.T) {
+	var singleRequests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/subjects/lookup" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&singleRequests, 1)
+		id := strings.TrimPrefix(r.URL.Path, "/subjects/")
+		json.NewEncoder(w).Encode(User{ID: id, Email: id + "@example.com"})
+	}))
+	defer srv.Close()
+	UsersInit(srv.URL)
+
+	users, err := LookupUsers(WithUserMemo(context.Background()), []string{"one", "two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Errorf("number of users was %d, not 2", len(users))
+	}
+	if singleRequests != 2 {
+		t.Errorf("number of single requests was %d, not 2", singleRequests)
+	}
+}
+
+func TestUserLookupLimit(t *testing.T) {
+	defer UserLookupLimitInit(0)
+	defer UsersInit("")
+
+	const limit = 3
+
+	var inFlight, maxInFlight int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			max := atomic.LoadInt64(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		id := strings.TrimPrefix(r.URL.Path, "/subjects/")
+		json.NewEncoder(w).Encode(User{ID: id, Email: id + "@example.org"})
+	}))
+	defer srv.Close()
+
+	UsersInit(srv.URL)
+	UserLookupLimitInit(limit)
+
+	errs := make(chan error, 12)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			errs <- NewUser(fmt.Sprintf("user%d", i)).Get(context.Background())
+		}(i)
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if max := atomic.LoadInt64(&maxInFlight); max > limit {
+		t.Errorf("%d requests were in flight at once, more than the limit of %d", max, limit)
+	}
+
+	// Lookups that can't get under the limit give up when their context is done.
+	UserLookupLimitInit(1)
+	release, err := acquireUserLookup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = NewUser("waiting").Get(ctx); err == nil {
+		t.Error("error was nil for a lookup that couldn't get under the limit")
+	}
+}
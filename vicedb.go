@@ -27,10 +27,12 @@ type NotifStatuses struct {
 	KillWarningFailureCount int
 	LastPeriodicWarning     time.Time
 	PeriodicWarningPeriod   time.Duration
+	PeriodicEnabled         sql.NullBool // Not set unless the user has turned periodic notifications on or off.
 }
 
-const notifStatusQuery = `
-	select analysis_id,
+// notifStatusFields are the notif_statuses columns scanned into a
+// *NotifStatuses.
+const notifStatusFields = `analysis_id,
 		   external_id,
 		   hour_warning_sent,
 		   hour_warning_failure_count,
@@ -39,7 +41,11 @@ const notifStatusQuery = `
 		   kill_warning_sent,
 		   kill_warning_failure_count,
 		   coalesce(last_periodic_warning, '1970-01-01 00:00:00') as last_periodic_warning,
-		   coalesce(periodic_warning_period, '0 seconds'::interval) as periodic_warning_period
+		   coalesce(periodic_warning_period, '0 seconds'::interval) as periodic_warning_period,
+		   periodic_enabled`
+
+const notifStatusQuery = `
+	select ` + notifStatusFields + `
 	  from notif_statuses
 	 where analysis_id = $1
 `
@@ -53,11 +59,21 @@ func (v *VICEDatabaser) NotifStatuses(ctx context.Context, job *Job) (*NotifStat
 
 	notifStatuses = &NotifStatuses{}
 
-	if err = v.db.QueryRowContext(
+	if err = scanNotifStatuses(v.db.QueryRowContext(
 		ctx,
 		notifStatusQuery,
 		job.ID,
-	).Scan(
+	), notifStatuses); err != nil {
+		return nil, err
+	}
+
+	return notifStatuses, nil
+}
+
+// scanNotifStatuses scans a row containing the notifStatusFields into
+// notifStatuses.
+func scanNotifStatuses(row *sql.Row, notifStatuses *NotifStatuses) error {
+	return row.Scan(
 		&notifStatuses.AnalysisID,
 		&notifStatuses.ExternalID,
 		&notifStatuses.HourWarningSent,
@@ -68,78 +84,79 @@ func (v *VICEDatabaser) NotifStatuses(ctx context.Context, job *Job) (*NotifStat
 		&notifStatuses.KillWarningFailureCount,
 		&notifStatuses.LastPeriodicWarning,
 		(*pqinterval.Duration)(&notifStatuses.PeriodicWarningPeriod),
-	); err != nil {
-		return nil, err
-	}
-
-	return notifStatuses, nil
+		&notifStatuses.PeriodicEnabled,
+	)
 }
 
-const getNotifStatusIDQuery = `
-select id
-  from notif_statuses
- where analysis_id = $1
+const ensureNotifStatusQuery = `
+	insert into notif_statuses (analysis_id, external_id, periodic_warning_period)
+	values ($1, $2, cast($3 as interval))
+	on conflict (analysis_id) do nothing
+	returning ` + notifStatusFields + `
 `
 
-// AnalysisRecordExists checks whether the given analysisID is already in the database or not.
-func (v *VICEDatabaser) AnalysisRecordExists(ctx context.Context, analysisID string) bool {
-	var (
-		err     error
-		row     *sql.Row
-		notifID string
-	)
+// EnsureNotifStatuses returns the notification statuses for the job, adding a
+// record for the job first if there isn't one already. A new record is added
+// and returned in a single query. The existing record is only looked up
+// separately when the insert didn't happen.
+func (v *VICEDatabaser) EnsureNotifStatuses(ctx context.Context, job *Job) (*NotifStatuses, error) {
+	notifStatuses := &NotifStatuses{}
 
-	row = v.db.QueryRowContext(
+	err := scanNotifStatuses(v.db.QueryRowContext(
 		ctx,
-		getNotifStatusIDQuery,
-		analysisID,
-	)
-	if err = row.Scan(&notifID); err != nil {
-		log.Error(err)
-		return false
+		ensureNotifStatusQuery,
+		job.ID,
+		job.ExternalID,
+		notifPeriod(job),
+	), notifStatuses)
+	if err == sql.ErrNoRows {
+		return v.NotifStatuses(ctx, job)
+	}
+	if err != nil {
+		return nil, err
 	}
-	return true
-}
 
-const addNotifRecordQuery = `
-insert into notif_statuses (analysis_id, external_id, periodic_warning_period) values ($1, $2, cast($3 as interval)) returning id
-`
+	log.Debugf("notif_statuses record added for analysis %s", job.ID)
 
-// AddNotifRecord adds a new record to the notif_statuses table for the provided analysis.
-// Returns the ID of the new record.
-func (v *VICEDatabaser) AddNotifRecord(ctx context.Context, job *Job) (string, error) {
-	var (
-		err     error
-		notifID string
-		period  string
-	)
+	return notifStatuses, nil
+}
 
-	if job.PeriodicPeriod > 0 {
-		period = fmt.Sprintf("%d seconds", job.PeriodicPeriod)
-	} else {
-		period = "4 hours"
-	}
+const ensureNotifRecordQuery = `
+insert into notif_statuses (analysis_id, external_id, periodic_warning_period)
+values ($1, $2, cast($3 as interval))
+on conflict (analysis_id) do nothing
+`
 
-	if err = v.db.QueryRowContext(
+// EnsureNotifRecord adds a record to the notif_statuses table for the job if
+// there isn't one already.
+func (v *VICEDatabaser) EnsureNotifRecord(ctx context.Context, job *Job) error {
+	_, err := v.db.ExecContext(
 		ctx,
-		addNotifRecordQuery,
+		ensureNotifRecordQuery,
 		job.ID,
 		job.ExternalID,
-		period,
-	).Scan(&notifID); err != nil {
-		return "", err
+		notifPeriod(job),
+	)
+	return err
+}
+
+// notifPeriod returns the periodic warning period stored in a new
+// notif_statuses record for the job, as an interval string.
+func notifPeriod(job *Job) string {
+	if job.PeriodicPeriod > 0 {
+		return fmt.Sprintf("%d seconds", job.PeriodicPeriod)
 	}
-	return notifID, err
+	return fmt.Sprintf("%d seconds", int64(PeriodicWarningDefault.Seconds()))
 }
 
-const getHourWarningQuery = `
-select hour_warning_sent
+const getKillWarningQuery = `
+select kill_warning_sent
   from notif_statuses
  where analysis_id = $1
 `
 
-// HourWarningSent returns true if the 1-hour warning was already sent for the analysis.
-func (v *VICEDatabaser) HourWarningSent(ctx context.Context, job *Job) (bool, error) {
+// KillWarningSent returns true if the job termination warning was already sent for the analyis.
+func (v *VICEDatabaser) KillWarningSent(ctx context.Context, job *Job) (bool, error) {
 	var (
 		err     error
 		wasSent bool
@@ -147,179 +164,804 @@ func (v *VICEDatabaser) HourWarningSent(ctx context.Context, job *Job) (bool, er
 
 	if err = v.db.QueryRowContext(
 		ctx,
-		getHourWarningQuery,
+		getKillWarningQuery,
 		job.ID,
 	).Scan(&wasSent); err != nil {
 		return false, err
 	}
+
 	return wasSent, nil
 }
 
-const getDayWarningQuery = `
-select day_warning_sent
-  from notif_statuses
- where analysis_id = $1
+const setKillWarningSentQuery = `
+update notif_statuses set kill_warning_sent = $1 where analysis_id = $2
 `
 
-// DayWarningSent returns true if the 1-day warning was already sent for the analysis.
-func (v *VICEDatabaser) DayWarningSent(ctx context.Context, job *Job) (bool, error) {
-	var (
-		err     error
-		wasSent bool
+// SetKillWarningSent sets the kill_warning_sent field to the value of wasSent in the
+// record for the analysis represented by job.
+func (v *VICEDatabaser) SetKillWarningSent(ctx context.Context, job *Job, wasSent bool) error {
+	var err error
+
+	_, err = v.db.ExecContext(
+		ctx,
+		setKillWarningSentQuery,
+		wasSent,
+		job.ID,
 	)
+	return err
+}
 
-	if err = v.db.QueryRowContext(
+const setKillWarningFailureCountQuery = `
+update notif_statuses set kill_warning_failure_count = $1 where analysis_id = $2
+`
+
+// SetKillWarningFailureCount sets the new value for the kill_warning_failure_count field.
+func (v *VICEDatabaser) SetKillWarningFailureCount(ctx context.Context, job *Job, failureCount int) error {
+	var err error
+
+	_, err = v.db.ExecContext(
 		ctx,
-		getDayWarningQuery,
+		setKillWarningFailureCountQuery,
+		failureCount,
 		job.ID,
-	).Scan(&wasSent); err != nil {
-		return false, err
-	}
+	)
+	return err
+}
 
-	return wasSent, nil
+const setKillFailureReasonQuery = `
+update notif_statuses set kill_failure_reason = $1 where analysis_id = $2
+`
+
+// SetKillFailureReason records why the last attempt to kill the analysis
+// represented by job failed.
+func (v *VICEDatabaser) SetKillFailureReason(ctx context.Context, job *Job, reason string) error {
+	var err error
+
+	_, err = v.db.ExecContext(
+		ctx,
+		setKillFailureReasonQuery,
+		reason,
+		job.ID,
+	)
+	return err
 }
 
-const getKillWarningQuery = `
-select kill_warning_sent
-  from notif_statuses
- where analysis_id = $1
+const updateLastPeriodicWarningQuery = `
+update notif_statuses set last_periodic_warning = $1 where analysis_id = $2
 `
 
-// KillWarningSent returns true if the job termination warning was already sent for the analyis.
-func (v *VICEDatabaser) KillWarningSent(ctx context.Context, job *Job) (bool, error) {
-	var (
-		err     error
-		wasSent bool
+// UpdateLastPeriodicWarning updates the timestamp for a job's last periodic warning
+func (v *VICEDatabaser) UpdateLastPeriodicWarning(ctx context.Context, job *Job, ts time.Time) error {
+	var err error
+	_, err = v.db.ExecContext(
+		ctx,
+		updateLastPeriodicWarningQuery,
+		ts,
+		job.ID,
 	)
+	return err
+}
 
-	if err = v.db.QueryRowContext(
+const deleteNotifRecordQuery = `
+delete from notif_statuses where analysis_id = $1
+`
+
+// DeleteNotifRecord removes the notif_statuses record for the analysis
+// represented by job, if there is one.
+func (v *VICEDatabaser) DeleteNotifRecord(ctx context.Context, job *Job) error {
+	var err error
+
+	_, err = v.db.ExecContext(
 		ctx,
-		getKillWarningQuery,
+		deleteNotifRecordQuery,
 		job.ID,
-	).Scan(&wasSent); err != nil {
-		return false, err
+	)
+	return err
+}
+
+// orphanedNotifStatusesQuery selects the notif_statuses rows for analyses
+// that no longer exist or that finished before $1.
+const orphanedNotifStatusesQuery = `
+select notif_statuses.analysis_id
+  from notif_statuses
+  left join jobs on jobs.id = notif_statuses.analysis_id
+ where jobs.id is null
+    or (jobs.status in ('Completed', 'Failed', 'Canceled')
+        and coalesce(jobs.end_date, jobs.start_date) < $1)
+`
+
+// OrphanedNotifStatuses returns the IDs of the analyses with notif_statuses
+// rows that are no longer needed, either because the analysis was deleted or
+// because it finished before olderThan.
+func (v *VICEDatabaser) OrphanedNotifStatuses(ctx context.Context, olderThan time.Time) ([]string, error) {
+	rows, err := v.db.QueryContext(ctx, orphanedNotifStatusesQuery, formatDBTimestamp(olderThan))
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return wasSent, nil
+	var ids []string
+
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
 }
 
-const setDayWarningSentQuery = `
-update notif_statuses set day_warning_sent = $1 where analysis_id = $2
+const setPeriodicEnabledQuery = `
+update notif_statuses set periodic_enabled = $1 where analysis_id = $2
 `
 
-// SetDayWarningSent sets the day_warning_sent field to the value of wasSent in the
-// record for the analysis represented by job.
-func (v *VICEDatabaser) SetDayWarningSent(ctx context.Context, job *Job, wasSent bool) error {
+// SetPeriodicEnabled turns the periodic notifications for the analysis
+// represented by job on or off.
+func (v *VICEDatabaser) SetPeriodicEnabled(ctx context.Context, job *Job, enabled bool) error {
 	var err error
 
 	_, err = v.db.ExecContext(
 		ctx,
-		setDayWarningSentQuery,
-		wasSent,
+		setPeriodicEnabledQuery,
+		enabled,
 		job.ID,
 	)
 	return err
 }
 
-const setDayWarningFailureCountQuery = `
-update notif_statuses set day_warning_failure_count = $1 where analysis_id = $2
+const setPeriodicWarningPeriodQuery = `
+update notif_statuses set periodic_warning_period = cast($1 as interval) where analysis_id = $2
 `
 
-// SetDayWarningFailureCount sets the new value for the kill_warning_failure_count field.
-func (v *VICEDatabaser) SetDayWarningFailureCount(ctx context.Context, job *Job, failureCount int) error {
+// SetPeriodicWarningPeriod sets how often periodic notifications are sent for
+// the analysis represented by job.
+func (v *VICEDatabaser) SetPeriodicWarningPeriod(ctx context.Context, job *Job, d time.Duration) error {
 	var err error
 
 	_, err = v.db.ExecContext(
 		ctx,
-		setDayWarningFailureCountQuery,
-		failureCount,
+		setPeriodicWarningPeriodQuery,
+		fmt.Sprintf("%d seconds", int64(d.Seconds())),
 		job.ID,
 	)
 	return err
 }
 
-const setHourWarningSentQuery = `
-update notif_statuses set hour_warning_sent = $1 where analysis_id = $2
+const warningStatusQuery = `
+select coalesce(w.sent, case $2::int
+                          when 1440 then n.day_warning_sent
+                          when $3::int then n.hour_warning_sent
+                          else false
+                        end),
+       coalesce(w.failure_count, case $2::int
+                                   when 1440 then n.day_warning_failure_count
+                                   when $3::int then n.hour_warning_failure_count
+                                   else 0
+                                 end)
+  from notif_statuses n
+  left join warning_threshold_statuses w
+    on w.analysis_id = n.analysis_id
+   and w.threshold_minutes = $2
+ where n.analysis_id = $1
 `
 
-// SetHourWarningSent sets the hour_warning_sent field to the value of wasSent in the
-// record for the analysis represented by job.
-func (v *VICEDatabaser) SetHourWarningSent(ctx context.Context, job *Job, wasSent bool) error {
+// WarningStatus returns whether the warning for the threshold, in minutes
+// before the planned end date, has been sent for the analysis represented by
+// job, along with the number of times sending it has failed. Until the
+// threshold has a record of its own, the status is read from the hour or day
+// warning columns in notif_statuses that it used to be kept in, if any.
+func (v *VICEDatabaser) WarningStatus(ctx context.Context, job *Job, thresholdMinutes int64) (bool, int, error) {
+	var (
+		sent         bool
+		failureCount int
+	)
+
+	err := v.db.QueryRowContext(ctx, warningStatusQuery, job.ID, thresholdMinutes, HourWarningThreshold).Scan(&sent, &failureCount)
+	if err == sql.ErrNoRows {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+
+	return sent, failureCount, nil
+}
+
+const setWarningSentQuery = `
+insert into warning_threshold_statuses (analysis_id, threshold_minutes, sent)
+values ($1, $2, $3)
+on conflict (analysis_id, threshold_minutes) do update set sent = excluded.sent
+`
+
+// SetWarningSent sets whether the warning for the threshold was sent for the
+// analysis represented by job.
+func (v *VICEDatabaser) SetWarningSent(ctx context.Context, job *Job, thresholdMinutes int64, wasSent bool) error {
 	var err error
 
 	_, err = v.db.ExecContext(
 		ctx,
-		setHourWarningSentQuery,
-		wasSent,
+		setWarningSentQuery,
 		job.ID,
+		thresholdMinutes,
+		wasSent,
 	)
 	return err
 }
 
-const setHourWarningFailureCountQuery = `
-update notif_statuses set hour_warning_failure_count = $1 where analysis_id = $2
+const setWarningFailureCountQuery = `
+insert into warning_threshold_statuses (analysis_id, threshold_minutes, failure_count)
+values ($1, $2, $3)
+on conflict (analysis_id, threshold_minutes) do update set failure_count = excluded.failure_count
 `
 
-// SetHourWarningFailureCount sets the new value for the kill_warning_failure_count field.
-func (v *VICEDatabaser) SetHourWarningFailureCount(ctx context.Context, job *Job, failureCount int) error {
+// SetWarningFailureCount sets the number of times sending the warning for the
+// threshold has failed for the analysis represented by job.
+func (v *VICEDatabaser) SetWarningFailureCount(ctx context.Context, job *Job, thresholdMinutes int64, failureCount int) error {
 	var err error
 
 	_, err = v.db.ExecContext(
 		ctx,
-		setHourWarningFailureCountQuery,
+		setWarningFailureCountQuery,
+		job.ID,
+		thresholdMinutes,
 		failureCount,
+	)
+	return err
+}
+
+const resetWarningsQuery = `
+update notif_statuses
+   set hour_warning_sent = false,
+       hour_warning_failure_count = 0,
+       day_warning_sent = false,
+       day_warning_failure_count = 0,
+       kill_warning_sent = false,
+       kill_warning_failure_count = 0
+ where analysis_id = $1
+`
+
+const resetWarningThresholdsQuery = `
+delete from warning_threshold_statuses where analysis_id = $1
+`
+
+// ResetWarnings clears the warning and kill flags and their failure counts in
+// the record for the analysis represented by job, so that the user is warned
+// again before its new planned end date.
+func (v *VICEDatabaser) ResetWarnings(ctx context.Context, job *Job) error {
+	var err error
+
+	if _, err = v.db.ExecContext(
+		ctx,
+		resetWarningsQuery,
+		job.ID,
+	); err != nil {
+		return err
+	}
+
+	_, err = v.db.ExecContext(
+		ctx,
+		resetWarningThresholdsQuery,
 		job.ID,
 	)
 	return err
 }
 
-const setKillWarningSentQuery = `
-update notif_statuses set kill_warning_sent = $1 where analysis_id = $2
+const claimExtensionQuery = `
+update notif_statuses
+   set extension_count = extension_count + 1
+ where analysis_id = $1
+   and extension_count < $2
+returning extension_count
 `
 
-// SetKillWarningSent sets the kill_warning_sent field to the value of wasSent in the
-// record for the analysis represented by job.
-func (v *VICEDatabaser) SetKillWarningSent(ctx context.Context, job *Job, wasSent bool) error {
+// ClaimExtension counts an extension of the planned end date of the analysis
+// represented by job, unless it has already been extended max times. The
+// check and the increment are a single statement, so concurrent extensions
+// can't go over the limit. Returns false if the limit has been reached.
+func (v *VICEDatabaser) ClaimExtension(ctx context.Context, job *Job, max int) (bool, error) {
+	err := v.db.QueryRowContext(ctx, claimExtensionQuery, job.ID, max).Scan(new(int))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+const releaseExtensionQuery = `
+update notif_statuses
+   set extension_count = extension_count - 1
+ where analysis_id = $1
+   and extension_count > 0
+`
+
+// ReleaseExtension gives back an extension claimed with ClaimExtension for an
+// extension that didn't happen.
+func (v *VICEDatabaser) ReleaseExtension(ctx context.Context, job *Job) error {
+	_, err := v.db.ExecContext(ctx, releaseExtensionQuery, job.ID)
+	return err
+}
+
+const goneNotificationSentQuery = `
+select gone_notification_sent from notif_statuses where analysis_id = $1
+`
+
+// GoneNotificationSent returns whether the user has been told that the
+// analysis represented by job was already gone when timelord tried to kill it.
+func (v *VICEDatabaser) GoneNotificationSent(ctx context.Context, job *Job) (bool, error) {
+	var sent bool
+
+	if err := v.db.QueryRowContext(ctx, goneNotificationSentQuery, job.ID).Scan(&sent); err != nil {
+		return false, err
+	}
+
+	return sent, nil
+}
+
+const setGoneNotificationSentQuery = `
+update notif_statuses set gone_notification_sent = $1 where analysis_id = $2
+`
+
+// SetGoneNotificationSent sets the new value for the gone_notification_sent
+// field.
+func (v *VICEDatabaser) SetGoneNotificationSent(ctx context.Context, job *Job, sent bool) error {
 	var err error
 
 	_, err = v.db.ExecContext(
 		ctx,
-		setKillWarningSentQuery,
-		wasSent,
+		setGoneNotificationSentQuery,
+		sent,
 		job.ID,
 	)
 	return err
 }
 
-const setKillWarningFailureCountQuery = `
-update notif_statuses set kill_warning_failure_count = $1 where analysis_id = $2
+// PendingNotification is a notification that failed to send and is waiting
+// to be retried.
+type PendingNotification struct {
+	ID               string
+	AnalysisID       string
+	NotificationType string
+	Attempts         int
+	CreatedDate      time.Time
+}
+
+const addPendingNotificationQuery = `
+insert into pending_notifications (analysis_id, notification_type)
+values ($1, $2)
+on conflict (analysis_id, notification_type) do nothing
 `
 
-// SetKillWarningFailureCount sets the new value for the kill_warning_failure_count field.
-func (v *VICEDatabaser) SetKillWarningFailureCount(ctx context.Context, job *Job, failureCount int) error {
+// AddPendingNotification queues a notification of the given type for the
+// analysis represented by job so that it's retried later. Does nothing if the
+// notification is already queued.
+func (v *VICEDatabaser) AddPendingNotification(ctx context.Context, job *Job, notificationType string) error {
 	var err error
 
 	_, err = v.db.ExecContext(
 		ctx,
-		setKillWarningFailureCountQuery,
-		failureCount,
+		addPendingNotificationQuery,
 		job.ID,
+		notificationType,
 	)
 	return err
 }
 
-const updateLastPeriodicWarningQuery = `
-update notif_statuses set last_periodic_warning = $1 where analysis_id = $2
+const deletePendingWarningsQuery = `
+delete from pending_notifications
+ where analysis_id = $1
+   and notification_type like '` + warningNotificationPrefix + `%'
 `
 
-// UpdateLastPeriodicWarning updates the timestamp for a job's last periodic warning
-func (v *VICEDatabaser) UpdateLastPeriodicWarning(ctx context.Context, job *Job, ts time.Time) error {
+// DeletePendingWarnings removes the queued warnings for the analysis
+// represented by job, so that they aren't retried.
+func (v *VICEDatabaser) DeletePendingWarnings(ctx context.Context, job *Job) error {
 	var err error
+
 	_, err = v.db.ExecContext(
 		ctx,
-		updateLastPeriodicWarningQuery,
+		deletePendingWarningsQuery,
+		job.ID,
+	)
+	return err
+}
+
+const duePendingNotificationsQuery = `
+select id,
+       analysis_id,
+       notification_type,
+       attempts,
+       created_date
+  from pending_notifications
+ where next_attempt <= now()
+ order by next_attempt
+`
+
+// DuePendingNotifications returns the queued notifications that are due to be retried.
+func (v *VICEDatabaser) DuePendingNotifications(ctx context.Context) ([]PendingNotification, error) {
+	var (
+		err     error
+		rows    *sql.Rows
+		pending []PendingNotification
+	)
+
+	if rows, err = v.db.QueryContext(ctx, duePendingNotificationsQuery); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p PendingNotification
+		if err = rows.Scan(
+			&p.ID,
+			&p.AnalysisID,
+			&p.NotificationType,
+			&p.Attempts,
+			&p.CreatedDate,
+		); err != nil {
+			return nil, err
+		}
+		pending = append(pending, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return pending, nil
+}
+
+const deletePendingNotificationQuery = `
+delete from pending_notifications where id = $1
+`
+
+// DeletePendingNotification removes a notification from the retry queue.
+func (v *VICEDatabaser) DeletePendingNotification(ctx context.Context, id string) error {
+	var err error
+
+	_, err = v.db.ExecContext(
+		ctx,
+		deletePendingNotificationQuery,
+		id,
+	)
+	return err
+}
+
+const reschedulePendingNotificationQuery = `
+update pending_notifications
+   set attempts = $1,
+       next_attempt = $2,
+       last_error = $3
+ where id = $4
+`
+
+// ReschedulePendingNotification records a failed retry of a queued
+// notification and sets when it should next be tried.
+func (v *VICEDatabaser) ReschedulePendingNotification(ctx context.Context, id string, attempts int, nextAttempt time.Time, lastError string) error {
+	var err error
+
+	_, err = v.db.ExecContext(
+		ctx,
+		reschedulePendingNotificationQuery,
+		attempts,
+		nextAttempt,
+		lastError,
+		id,
+	)
+	return err
+}
+
+const lastUsageNotificationQuery = `
+select last_notified from usage_notifications where username = $1
+`
+
+// LastUsageNotification returns when the user was last warned about their
+// compute usage. The zero time is returned if they never have been.
+func (v *VICEDatabaser) LastUsageNotification(ctx context.Context, username string) (time.Time, error) {
+	var last time.Time
+
+	err := v.db.QueryRowContext(ctx, lastUsageNotificationQuery, username).Scan(&last)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return last, nil
+}
+
+const setLastUsageNotificationQuery = `
+insert into usage_notifications (username, last_notified)
+values ($1, $2)
+on conflict (username) do update
+   set last_notified = excluded.last_notified
+`
+
+// SetLastUsageNotification records when the user was last warned about their
+// compute usage.
+func (v *VICEDatabaser) SetLastUsageNotification(ctx context.Context, username string, ts time.Time) error {
+	var err error
+
+	_, err = v.db.ExecContext(
+		ctx,
+		setLastUsageNotificationQuery,
+		username,
+		ts,
+	)
+	return err
+}
+
+const setKillRequestedAtQuery = `
+update notif_statuses set kill_requested_at = coalesce(kill_requested_at, $1) where analysis_id = $2
+`
+
+// SetKillRequestedAt records when the analysis represented by job was asked
+// to shut down. Only the first request is kept.
+func (v *VICEDatabaser) SetKillRequestedAt(ctx context.Context, job *Job, ts time.Time) error {
+	var err error
+
+	_, err = v.db.ExecContext(
+		ctx,
+		setKillRequestedAtQuery,
 		ts,
 		job.ID,
 	)
 	return err
 }
+
+const killRequestQuery = `
+select kill_requested_at, hard_stop_requested from notif_statuses where analysis_id = $1
+`
+
+// KillRequest returns when the analysis represented by job was first asked to
+// shut down and whether it's been made to exit without saving since. The zero
+// time is returned if it hasn't been asked to shut down.
+func (v *VICEDatabaser) KillRequest(ctx context.Context, job *Job) (time.Time, bool, error) {
+	var (
+		requestedAt       sql.NullTime
+		hardStopRequested bool
+	)
+
+	if err := v.db.QueryRowContext(ctx, killRequestQuery, job.ID).Scan(&requestedAt, &hardStopRequested); err != nil {
+		return time.Time{}, false, err
+	}
+
+	return requestedAt.Time, hardStopRequested, nil
+}
+
+const setHardStopRequestedQuery = `
+update notif_statuses set hard_stop_requested = $1 where analysis_id = $2
+`
+
+// SetHardStopRequested sets the new value for the hard_stop_requested field.
+func (v *VICEDatabaser) SetHardStopRequested(ctx context.Context, job *Job, requested bool) error {
+	var err error
+
+	_, err = v.db.ExecContext(
+		ctx,
+		setHardStopRequestedQuery,
+		requested,
+		job.ID,
+	)
+	return err
+}
+
+const addAuditEntryQuery = `
+insert into timelord_audit (analysis_id, external_id, username, app_type, planned_end_date, killed_at, reason, kill_outcome, notification_outcome, requested_by)
+values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+`
+
+// AddAuditEntry appends an entry to the audit log.
+func (v *VICEDatabaser) AddAuditEntry(ctx context.Context, e *AuditEntry) error {
+	var plannedEnd sql.NullTime
+	if e.PlannedEndDate != nil {
+		plannedEnd = sql.NullTime{Time: *e.PlannedEndDate, Valid: true}
+	}
+
+	_, err := v.db.ExecContext(
+		ctx,
+		addAuditEntryQuery,
+		e.AnalysisID,
+		e.ExternalID,
+		e.User,
+		e.AppType,
+		plannedEnd,
+		e.KilledAt,
+		e.Reason,
+		e.KillOutcome,
+		e.NotificationOutcome,
+		e.RequestedBy,
+	)
+	return err
+}
+
+const auditEntriesQuery = `
+select id,
+       analysis_id,
+       external_id,
+       username,
+       app_type,
+       planned_end_date,
+       killed_at,
+       reason,
+       kill_outcome,
+       notification_outcome,
+       requested_by
+  from timelord_audit
+ where killed_at >= $1
+ order by killed_at, id
+ limit $2
+`
+
+// AuditEntries returns up to limit entries from the audit log, oldest first,
+// starting with the ones made at since.
+func (v *VICEDatabaser) AuditEntries(ctx context.Context, since time.Time, limit int) ([]AuditEntry, error) {
+	rows, err := v.db.QueryContext(ctx, auditEntriesQuery, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanAuditEntries(rows)
+}
+
+const auditEntriesBetweenQuery = `
+select id,
+       analysis_id,
+       external_id,
+       username,
+       app_type,
+       planned_end_date,
+       killed_at,
+       reason,
+       kill_outcome,
+       notification_outcome,
+       requested_by
+  from timelord_audit
+ where killed_at >= $1
+   and killed_at < $2
+ order by killed_at, id
+`
+
+// AuditEntriesBetween returns all of the entries from the audit log that were
+// made at or after start and before end, oldest first.
+func (v *VICEDatabaser) AuditEntriesBetween(ctx context.Context, start, end time.Time) ([]AuditEntry, error) {
+	rows, err := v.db.QueryContext(ctx, auditEntriesBetweenQuery, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanAuditEntries(rows)
+}
+
+// scanAuditEntries reads the audit log entries returned by one of the audit
+// log queries.
+func scanAuditEntries(rows *sql.Rows) ([]AuditEntry, error) {
+	var err error
+
+	entries := []AuditEntry{}
+
+	for rows.Next() {
+		var (
+			e          AuditEntry
+			plannedEnd sql.NullTime
+		)
+		if err = rows.Scan(
+			&e.ID,
+			&e.AnalysisID,
+			&e.ExternalID,
+			&e.User,
+			&e.AppType,
+			&plannedEnd,
+			&e.KilledAt,
+			&e.Reason,
+			&e.KillOutcome,
+			&e.NotificationOutcome,
+			&e.RequestedBy,
+		); err != nil {
+			return nil, err
+		}
+		if plannedEnd.Valid {
+			e.PlannedEndDate = &plannedEnd.Time
+		}
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+const lastKillDigestQuery = `
+select max(period_end) from kill_digests
+`
+
+// LastKillDigest returns the end of the most recent period that a kill digest
+// was handled for, whether or not it was sent. The zero time is returned if
+// there hasn't been one.
+func (v *VICEDatabaser) LastKillDigest(ctx context.Context) (time.Time, error) {
+	var last sql.NullTime
+
+	if err := v.db.QueryRowContext(ctx, lastKillDigestQuery).Scan(&last); err != nil {
+		return time.Time{}, err
+	}
+	if !last.Valid {
+		return time.Time{}, nil
+	}
+
+	return last.Time, nil
+}
+
+const addKillDigestQuery = `
+insert into kill_digests (period_end, sent)
+values ($1, $2)
+on conflict (period_end) do nothing
+`
+
+// AddKillDigest records that the kill digest for the period ending at
+// periodEnd was handled, and whether it was sent or skipped.
+func (v *VICEDatabaser) AddKillDigest(ctx context.Context, periodEnd time.Time, sent bool) error {
+	var err error
+
+	_, err = v.db.ExecContext(
+		ctx,
+		addKillDigestQuery,
+		periodEnd,
+		sent,
+	)
+	return err
+}
+
+const killPausedQuery = `
+select paused from kill_pause
+`
+
+// KillPaused returns whether killing jobs has been paused. It isn't paused if
+// the pause has never been set.
+func (v *VICEDatabaser) KillPaused(ctx context.Context) (bool, error) {
+	var paused bool
+
+	err := v.db.QueryRowContext(ctx, killPausedQuery).Scan(&paused)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return paused, nil
+}
+
+const setKillPausedQuery = `
+update kill_pause
+   set paused = $1,
+       updated_at = now()
+ where paused <> $1
+returning paused
+`
+
+// SetKillPaused pauses killing jobs or resumes it. Returns false if it was
+// already in that state.
+func (v *VICEDatabaser) SetKillPaused(ctx context.Context, paused bool) (bool, error) {
+	err := v.db.QueryRowContext(ctx, setKillPausedQuery, paused).Scan(new(bool))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEnsureNotifRecord(t *testing.T) {
+	tests := []struct {
+		name           string
+		periodicPeriod int64
+		expected       string
+	}{
+		{"default period", 0, "14400 seconds"},
+		{"custom period", 3600, "3600 seconds"},
+	}
+
+	for _, test := range tests {
+		db, f := newFakeDB(t)
+		vicedb := &VICEDatabaser{db: db}
+
+		job := &Job{ID: "job-id", ExternalID: "external-id", PeriodicPeriod: test.periodicPeriod}
+		if err := vicedb.EnsureNotifRecord(context.Background(), job); err != nil {
+			t.Fatal(err)
+		}
+
+		if f.ran("select id") != 0 {
+			t.Errorf("%s: the record was looked up before it was added", test.name)
+		}
+		args := f.argsFor("insert into notif_statuses")
+		if len(args) != 3 {
+			t.Fatalf("%s: number of args was %d, not 3", test.name, len(args))
+		}
+		if args[0] != "job-id" || args[1] != "external-id" || args[2] != test.expected {
+			t.Errorf("%s: args were %v", test.name, args)
+		}
+	}
+}
+
+func TestEnsureNotifStatusesCreated(t *testing.T) {
+	db, f := newFakeDB(t)
+	f.on("on conflict (analysis_id) do nothing", notifStatusColumns, notifStatusRow(nil))
+	f.on("hour_warning_failure_count", notifStatusColumns, notifStatusRow(true))
+	vicedb := &VICEDatabaser{db: db}
+
+	job := &Job{ID: "job-id", ExternalID: "external-id", PeriodicPeriod: 3600}
+	ns, err := vicedb.EnsureNotifStatuses(context.Background(), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.AnalysisID != "job-id" || ns.ExternalID != "external-id" {
+		t.Errorf("statuses were for %s and %s", ns.AnalysisID, ns.ExternalID)
+	}
+	if ns.PeriodicEnabled.Valid {
+		t.Error("statuses were read from the existing record instead of the inserted one")
+	}
+
+	args := f.argsFor("on conflict (analysis_id) do nothing")
+	if len(args) != 3 || args[0] != "job-id" || args[1] != "external-id" || args[2] != "3600 seconds" {
+		t.Errorf("insert args were %v", args)
+	}
+	if n := f.ran("notif_statuses"); n != 1 {
+		t.Errorf("%d statements were run, not 1", n)
+	}
+}
+
+func TestEnsureNotifStatusesExisting(t *testing.T) {
+	db, f := newFakeDB(t)
+	f.on("on conflict (analysis_id) do nothing", notifStatusColumns)
+	f.on("hour_warning_failure_count", notifStatusColumns, notifStatusRow(true))
+	vicedb := &VICEDatabaser{db: db}
+
+	job := &Job{ID: "job-id", ExternalID: "external-id"}
+	ns, err := vicedb.EnsureNotifStatuses(context.Background(), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ns.PeriodicEnabled.Valid || !ns.PeriodicEnabled.Bool {
+		t.Errorf("periodic enabled was %v, not the existing record's value", ns.PeriodicEnabled)
+	}
+	if n := f.ran("notif_statuses"); n != 2 {
+		t.Errorf("%d statements were run, not 2", n)
+	}
+	if args := f.argsFor("where analysis_id = $1"); len(args) != 1 || args[0] != "job-id" {
+		t.Errorf("lookup args were %v", args)
+	}
+}